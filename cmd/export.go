@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the wireguard config as wg-quick, systemd-networkd or json",
+	Long: `renders the host and its peers as wg-quick, systemd-networkd or json configuration,
+for all networks or a single network. The output contains the private key.
+With --watch the files in the output directory are kept up to date until interrupted.
+
+netclient export --format wg-quick|networkd|json [-n network] [-o dir [--watch]]`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		network, _ := cmd.Flags().GetString("network")
+		output, _ := cmd.Flags().GetString("output")
+		watch, _ := cmd.Flags().GetBool("watch")
+		if err := functions.Export(format, network, output, watch); err != nil {
+			fmt.Println(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().String("format", functions.ExportWgQuick, "output format: wg-quick, networkd or json")
+	exportCmd.Flags().StringP("network", "n", "", "network to export, all networks if not set")
+	exportCmd.Flags().StringP("output", "o", "", "directory to write the files to, stdout if not set")
+	exportCmd.Flags().Bool("watch", false, "keep the files in the output directory up to date")
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// killSwitchCmd represents the killswitch command
+var killSwitchCmd = &cobra.Command{
+	Use:   "killswitch [ on | off | status ]",
+	Short: "killswitch on/off/status",
+	Long: `blocks all traffic not leaving through the netmaker interface, except traffic to
+wireguard peers, the netmaker server, DHCP and optionally the local LAN.
+The kill switch stays active across daemon restarts until it is switched off.
+
+netclient killswitch on [--allow-lan]
+netclient killswitch off
+netclient killswitch status`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"on", "off", "status"},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := cobra.OnlyValidArgs(cmd, args)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if args[0] == "status" {
+			functions.KillSwitchStatus()
+			return
+		}
+		allowLAN, _ := cmd.Flags().GetBool("allow-lan")
+		err = functions.SetKillSwitch(args[0] == "on", allowLAN)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(killSwitchCmd)
+	killSwitchCmd.Flags().Bool("allow-lan", false, "allow traffic to the local LAN while the kill switch is on")
+}
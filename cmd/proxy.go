@@ -9,26 +9,52 @@ import (
 
 // proxyCmd represents the proxy command
 var proxyCmd = &cobra.Command{
-	Use:       "proxy [ on | off ]",
-	Short:     "proxy on/off",
-	Long:      `switches proxy on/off`,
+	Use:   "proxy [ on | off | status | inspect ]",
+	Short: "proxy on/off/status/inspect",
+	Long: `switches proxy on/off or shows its status
+netclient proxy status //display whether the proxy is enabled, the nat type of the host and the latency of the peers
+netclient proxy inspect //dump the peers, routes and host info of the running proxy
+`,
 	Args:      cobra.ExactArgs(1),
-	ValidArgs: []string{"on", "off"},
+	ValidArgs: []string{"on", "off", "status", "inspect"},
 	Run: func(cmd *cobra.Command, args []string) {
 		err := cobra.OnlyValidArgs(cmd, args)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		err = functions.ChangeProxyStatus(args[0] == "on")
+		if args[0] == "status" {
+			err = functions.ProxyStatus()
+		} else {
+			err = functions.ChangeProxyStatus(args[0] == "on")
+		}
 		if err != nil {
 			fmt.Println(err.Error())
 		}
 	},
 }
 
+// proxyInspectCmd represents the proxy inspect command
+var proxyInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "dump the state of the proxy of the daemon",
+	Long: `prints a snapshot of the proxy running in the daemon: the proxied and no proxy peers with their
+local and remote addresses and traffic, the peer hash map, ext clients, relayed routes, host info and nat status
+
+netclient proxy inspect [--format table|json]`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		if err := functions.ProxyInspect(format); err != nil {
+			fmt.Println(err.Error())
+		}
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.AddCommand(proxyInspectCmd)
+	proxyInspectCmd.Flags().String("format", functions.InspectTable, "output format: table or json")
 
 	// Here you will define your flags and configuration settings.
 
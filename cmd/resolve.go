@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// resolveCmd represents the resolve command
+var resolveCmd = &cobra.Command{
+	Use:   "resolve <ip|name|node id|public key>",
+	Short: "map between peer names, node ids, public keys and addresses",
+	Long: `looks up this host and its peers by address, dns name, node id, host id or wireguard public key
+using only the local state, no server is contacted. For example:
+netclient resolve 10.101.0.4
+netclient resolve myhost.mynet
+netclient resolve 2b0QnZ8cGBsUp5RCjxPjRrXzqCN4jdvwYJiDvUs3YAw=`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := functions.Resolve(args[0]); err != nil {
+			fmt.Println(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resolveCmd)
+}
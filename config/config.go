@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -40,6 +41,46 @@ const (
 	DefaultListenPort = 51821
 	// DefaultMTU default MTU for wireguard
 	DefaultMTU = 1420
+	// WgBackendKernel - use the kernel wireguard module
+	WgBackendKernel = "kernel"
+	// WgBackendUserspace - use the embedded wireguard-go implementation
+	WgBackendUserspace = "userspace"
+	// WgBackendAuto - use kernel wireguard if available, embedded wireguard-go otherwise
+	WgBackendAuto = "auto"
+	// IfaceModeShared - a single wireguard interface carries the traffic of all networks
+	IfaceModeShared = "shared"
+	// IfaceModeNetwork - each network gets its own wireguard interface, listen port, peers and routes;
+	// the proxy, lan discovery and ingress/egress gateway firewall rules are only available on the shared
+	// interface, the proxy is disabled when the config is loaded and can't be switched on in this mode.
+	// All interfaces use the host's key, so a peer shared by several networks is on one interface only
+	IfaceModeNetwork = "network"
+	// DNSBackendAuto - use systemd-resolved if it is running, the hosts file otherwise
+	DNSBackendAuto = "auto"
+	// DNSBackendResolved - per link nameservers and routing domains through systemd-resolved
+	DNSBackendResolved = "resolved"
+	// DNSBackendHosts - dns entries written to the hosts file
+	DNSBackendHosts = "hosts"
+	// DNSBackendStub - dns entries answered by the embedded stub resolver, other queries are forwarded upstream
+	DNSBackendStub = "stub"
+	// ProxyAuthCompat - authenticated proxy packets are sent, peers sending unauthenticated packets are accepted and
+	// sent unauthenticated packets in return, only the peers a server marks as legacy once it marks any
+	ProxyAuthCompat = "compat"
+	// ProxyAuthStrict - only authenticated proxy packets are sent, accepted and relayed
+	ProxyAuthStrict = "strict"
+	// ProxyAuthLegacy - unauthenticated proxy packets are sent, for networks relayed by older versions
+	ProxyAuthLegacy = "legacy"
+	// ProxyTransportAuto - proxy packets are sent over udp, falling back to a stream for peers whose handshakes fail
+	ProxyTransportAuto = "auto"
+	// ProxyTransportUDP - proxy packets are only sent over udp
+	ProxyTransportUDP = "udp"
+	// ProxyTransportStream - proxy packets are always sent over a stream, for networks blocking outbound udp
+	ProxyTransportStream = "stream"
+	// ProxyStreamTCP - proxy packets are framed over plain tcp
+	ProxyStreamTCP = "tcp"
+	// ProxyStreamTLS - proxy packets are framed over tls
+	ProxyStreamTLS = "tls"
+	// ProxyStreamWebSocket - proxy packets are framed over a websocket in tls, looks like https to firewalls
+	ProxyStreamWebSocket = "websocket"
 )
 
 var (
@@ -58,12 +99,106 @@ type Config struct {
 	TrafficKeyPublic  []byte                          `json:"traffickeypublic" yaml:"trafficekeypublic"`
 	InternetGateway   net.UDPAddr                     `json:"internetgateway" yaml:"internetgateway"`
 	HostPeers         map[string][]wgtypes.PeerConfig `json:"peers" yaml:"peers"`
+	HostPeerIDs       map[string]models.HostPeerMap   `json:"peerids" yaml:"peerids"`
+	RouteTable        int                             `json:"routetable" yaml:"routetable"`
+	RouteMetric       int                             `json:"routemetric" yaml:"routemetric"`
+	KillSwitch        bool                            `json:"killswitch" yaml:"killswitch"`
+	KillSwitchLAN     bool                            `json:"killswitchlan" yaml:"killswitchlan"`
+	WireGuard         WireGuardCfg                    `json:"wireguard" yaml:"wireguard"`
+	KeyRotation       KeyRotationCfg                  `json:"keyrotation" yaml:"keyrotation"`
+	PresharedKeys     PresharedKeyCfg                 `json:"presharedkeys" yaml:"presharedkeys"`
+	MTUDiscovery      MTUDiscoveryCfg                 `json:"mtudiscovery" yaml:"mtudiscovery"`
+	DNS               DNSCfg                          `json:"dns" yaml:"dns"`
+	LANDiscovery      LANDiscoveryCfg                 `json:"landiscovery" yaml:"landiscovery"`
+	Proxy             ProxyCfg                        `json:"proxy" yaml:"proxy"`
+}
+
+// ProxyCfg - netclient proxy settings
+type ProxyCfg struct {
+	// Auth - authentication of the proxy transport packets: compat, strict or legacy
+	Auth string `json:"auth" yaml:"auth"`
+	// Transport - transport of the proxy packets: auto, udp or stream
+	Transport string `json:"transport" yaml:"transport"`
+	// Stream - kind of stream dialed by the stream transport: tcp, tls or websocket, streams of any kind are accepted
+	Stream string `json:"stream" yaml:"stream"`
+	// StreamPort - tcp port to dial peers on and to listen on in addition to the proxy port, e.g. 443;
+	// the proxy port of the peer is dialed when 0
+	StreamPort int `json:"streamport" yaml:"streamport"`
+	// Turn - turn server relaying the proxy packets of peers that can't be reached otherwise
+	Turn TurnCfg `json:"turn" yaml:"turn"`
+	// StunServers - additional stun servers (host:port) classifying the nat when the stun server of netmaker lacks
+	// RFC 5780 support
+	StunServers []string `json:"stunservers" yaml:"stunservers"`
+	// Workers - sockets listening on the proxy port with SO_REUSEPORT, each served by its own goroutine; linux
+	// only, a single socket is used when 0 or 1
+	Workers int `json:"workers" yaml:"workers"`
+}
+
+// TurnCfg - turn server settings of the proxy
+type TurnCfg struct {
+	// Server - host:port of the turn server, turn is not used when empty
+	Server   string `json:"server" yaml:"server"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	// Advertise - advertise the relayed address to the peers as the endpoint of the proxy instead of the address
+	// found by stun, for hosts behind symmetric nat
+	Advertise bool `json:"advertise" yaml:"advertise"`
+}
+
+// DNSCfg - private dns settings
+type DNSCfg struct {
+	Backend string `json:"backend" yaml:"backend"`
+	// StubAddress - loopback address of the stub resolver when systemd-resolved is not running, defaults to 127.0.0.73
+	StubAddress string `json:"stubaddress" yaml:"stubaddress"`
+}
+
+// LANDiscoveryCfg - direct connections to the peers found on the local networks, must be enabled on both hosts
+// of a peer pair
+type LANDiscoveryCfg struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Port - udp port of the announcements, 0 uses the default
+	Port int `json:"port" yaml:"port"`
+}
+
+// MTUDiscoveryCfg - path mtu probing of the peers through the tunnel
+type MTUDiscoveryCfg struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// AutoApply - lowers the interface mtu to the smallest path mtu of its peers, the configured mtu is the upper bound
+	AutoApply bool `json:"autoapply" yaml:"autoapply"`
+	// Interval - minutes between probe rounds, 0 uses the default
+	Interval int `json:"interval" yaml:"interval"`
+}
+
+// PresharedKeyCfg - per peer preshared keys, must be enabled on both hosts of a peer pair; the keys are exchanged
+// through a server relaying host signals (SIGNAL_HOST host updates), with older servers they are never put into use
+type PresharedKeyCfg struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Interval - days between preshared key rotations, 0 disables rotation
+	Interval int `json:"interval" yaml:"interval"`
+}
+
+// KeyRotationCfg - automatic wireguard key rotation policy and the state of a rotation in progress
+type KeyRotationCfg struct {
+	// Interval - days between automatic key rotations, 0 disables automatic rotation
+	Interval     int       `json:"interval" yaml:"interval"`
+	LastRotation time.Time `json:"lastrotation" yaml:"lastrotation"`
+	// PendingKey - new private key announced to the servers but not yet in use
+	PendingKey wgtypes.Key `json:"pendingkey" yaml:"pendingkey"`
+	// Acked - servers that confirmed the pending key
+	Acked []string `json:"acked" yaml:"acked"`
+}
+
+// WireGuardCfg - wireguard implementation settings
+type WireGuardCfg struct {
+	Backend       string `json:"backend" yaml:"backend"`
+	InterfaceMode string `json:"interfacemode" yaml:"interfacemode"`
 }
 
 func init() {
 	Servers = make(map[string]Server)
 	Nodes = make(map[string]Node)
 	netclient.HostPeers = make(map[string][]wgtypes.PeerConfig)
+	netclient.HostPeerIDs = make(map[string]models.HostPeerMap)
 }
 
 // UpdateNetcllient updates the in memory version of the host configuration
@@ -104,8 +239,17 @@ func UpdateHostPeers(server string, peers []wgtypes.PeerConfig) {
 	netclient.HostPeers = hostPeerMap
 }
 
+// UpdateHostPeerIDs - updates the peer ids (node id, address and network per peer) received from a server
+func UpdateHostPeerIDs(server string, peerIDs models.HostPeerMap) {
+	if netclient.HostPeerIDs == nil {
+		netclient.HostPeerIDs = make(map[string]models.HostPeerMap)
+	}
+	netclient.HostPeerIDs[server] = peerIDs
+}
+
 // DeleteServerHostPeerCfg - deletes the host peers for the server
 func DeleteServerHostPeerCfg(server string) {
+	delete(netclient.HostPeerIDs, server)
 	if netclient.HostPeers == nil {
 		netclient.HostPeers = make(map[string][]wgtypes.PeerConfig)
 		return
@@ -113,6 +257,116 @@ func DeleteServerHostPeerCfg(server string) {
 	delete(netclient.HostPeers, server)
 }
 
+// GetNetworkPeerList - gets the peers of a single network for use on the network's own interface,
+// allowed ips outside of all network ranges (egress ranges, default routes) are kept on the first
+// network, by name, the peer shares with the host
+func GetNetworkPeerList(node *Node) []wgtypes.PeerConfig {
+	peers := []wgtypes.PeerConfig{}
+	for _, peer := range netclient.HostPeers[node.Server] {
+		networks := getPeerNetworks(node.Server, &peer)
+		shared := false
+		for _, network := range networks {
+			if network == node.Network {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			continue
+		}
+		allowedIPs := []net.IPNet{}
+		for _, allowedIP := range peer.AllowedIPs {
+			if node.containsIPNet(allowedIP) ||
+				(networks[0] == node.Network && !isInNetworkRange(node.Server, allowedIP)) {
+				allowedIPs = append(allowedIPs, allowedIP)
+			}
+		}
+		peer.AllowedIPs = allowedIPs
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// GetInterfacePeerList - gets the peers configured on the interface of a network when running an interface
+// per network; all interfaces share the host's key so a peer can only be configured on one of them: a peer
+// sharing several connected networks with the host is only configured on the interface of the first one, by name,
+// with the allowed ips of all of them
+func GetInterfacePeerList(node *Node) []wgtypes.PeerConfig {
+	peers := []wgtypes.PeerConfig{}
+	for _, peer := range netclient.HostPeers[node.Server] {
+		networks := []string{}
+		for _, network := range getPeerNetworks(node.Server, &peer) {
+			if Nodes[network].Connected {
+				networks = append(networks, network)
+			}
+		}
+		if len(networks) == 0 || networks[0] != node.Network {
+			continue
+		}
+		allowedIPs := []net.IPNet{}
+		for _, allowedIP := range peer.AllowedIPs {
+			if !isInNetworkRange(node.Server, allowedIP) {
+				allowedIPs = append(allowedIPs, allowedIP)
+				continue
+			}
+			for _, network := range networks {
+				shared := Nodes[network]
+				if shared.containsIPNet(allowedIP) {
+					allowedIPs = append(allowedIPs, allowedIP)
+					break
+				}
+			}
+		}
+		peer.AllowedIPs = allowedIPs
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// getPeerNetworks - returns the sorted networks a peer shares with the host, based on the peer ids sent by
+// the server or, if not available, on the peer addresses falling in the network ranges
+func getPeerNetworks(server string, peer *wgtypes.PeerConfig) []string {
+	networks := []string{}
+	ids, hasIDs := netclient.HostPeerIDs[server][peer.PublicKey.String()]
+	for _, node := range Nodes {
+		if node.Server != server {
+			continue
+		}
+		if hasIDs {
+			for _, id := range ids {
+				if id.Network == node.Network {
+					networks = append(networks, node.Network)
+					break
+				}
+			}
+			continue
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			if node.containsIPNet(allowedIP) {
+				networks = append(networks, node.Network)
+				break
+			}
+		}
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// isInNetworkRange - checks if a cidr is part of the address range of any of the host's networks on a server
+func isInNetworkRange(server string, cidr net.IPNet) bool {
+	for _, node := range Nodes {
+		if node.Server == server && node.containsIPNet(cidr) {
+			return true
+		}
+	}
+	return false
+}
+
+// PerNetworkIfaces - returns true if each network has its own wireguard interface
+func PerNetworkIfaces() bool {
+	return netclient.WireGuard.InterfaceMode == IfaceModeNetwork
+}
+
 func getUniqueAllowedIPList(currIps, newIps []net.IPNet) []net.IPNet {
 	uniqueIpList := []net.IPNet{}
 	ipMap := make(map[string]struct{})
@@ -462,6 +716,77 @@ func CheckConfig() {
 		logger.Log(0, "setting MTU")
 		netclient.MTU = DefaultMTU
 	}
+	switch netclient.WireGuard.Backend {
+	case WgBackendKernel, WgBackendUserspace, WgBackendAuto:
+	case "":
+		logger.Log(0, "setting wireguard backend")
+		netclient.WireGuard.Backend = WgBackendAuto
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid wireguard backend", netclient.WireGuard.Backend, "- using", WgBackendAuto)
+		netclient.WireGuard.Backend = WgBackendAuto
+		saveRequired = true
+	}
+	switch netclient.WireGuard.InterfaceMode {
+	case IfaceModeShared, IfaceModeNetwork:
+	case "":
+		logger.Log(0, "setting wireguard interface mode")
+		netclient.WireGuard.InterfaceMode = IfaceModeShared
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid wireguard interface mode", netclient.WireGuard.InterfaceMode, "- using", IfaceModeShared)
+		netclient.WireGuard.InterfaceMode = IfaceModeShared
+		saveRequired = true
+	}
+	if netclient.WireGuard.InterfaceMode == IfaceModeNetwork && netclient.ProxyEnabled {
+		logger.Log(0, "proxy is not supported with an interface per network - disabling proxy")
+		netclient.ProxyEnabled = false
+		saveRequired = true
+	}
+	switch netclient.DNS.Backend {
+	case DNSBackendAuto, DNSBackendResolved, DNSBackendHosts, DNSBackendStub:
+	case "":
+		logger.Log(0, "setting dns backend")
+		netclient.DNS.Backend = DNSBackendAuto
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid dns backend", netclient.DNS.Backend, "- using", DNSBackendAuto)
+		netclient.DNS.Backend = DNSBackendAuto
+		saveRequired = true
+	}
+	switch netclient.Proxy.Auth {
+	case ProxyAuthCompat, ProxyAuthStrict, ProxyAuthLegacy:
+	case "":
+		logger.Log(0, "setting proxy authentication")
+		netclient.Proxy.Auth = ProxyAuthCompat
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid proxy authentication", netclient.Proxy.Auth, "- using", ProxyAuthCompat)
+		netclient.Proxy.Auth = ProxyAuthCompat
+		saveRequired = true
+	}
+	switch netclient.Proxy.Transport {
+	case ProxyTransportAuto, ProxyTransportUDP, ProxyTransportStream:
+	case "":
+		logger.Log(0, "setting proxy transport")
+		netclient.Proxy.Transport = ProxyTransportAuto
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid proxy transport", netclient.Proxy.Transport, "- using", ProxyTransportAuto)
+		netclient.Proxy.Transport = ProxyTransportAuto
+		saveRequired = true
+	}
+	switch netclient.Proxy.Stream {
+	case ProxyStreamTCP, ProxyStreamTLS, ProxyStreamWebSocket:
+	case "":
+		logger.Log(0, "setting proxy stream")
+		netclient.Proxy.Stream = ProxyStreamTLS
+		saveRequired = true
+	default:
+		logger.Log(0, "invalid proxy stream", netclient.Proxy.Stream, "- using", ProxyStreamTLS)
+		netclient.Proxy.Stream = ProxyStreamTLS
+		saveRequired = true
+	}
 
 	if len(netclient.TrafficKeyPrivate) == 0 {
 		logger.Log(0, "setting traffic keys")
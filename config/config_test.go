@@ -0,0 +1,105 @@
+package config
+
+import (
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerLists(t *testing.T) {
+	host, nodes := netclient, Nodes
+	defer func() {
+		netclient, Nodes = host, nodes
+	}()
+	cidr := func(s string) net.IPNet {
+		ip, ipnet, _ := net.ParseCIDR(s)
+		ipnet.IP = ip
+		return *ipnet
+	}
+	newNode := func(network, networkRange string, connected bool) Node {
+		node := Node{}
+		node.Network = network
+		node.Server = "server"
+		node.NetworkRange = cidr(networkRange)
+		node.Connected = connected
+		return node
+	}
+	Nodes = NodeMap{
+		"net1": newNode("net1", "10.1.0.0/16", true),
+		"net2": newNode("net2", "10.2.0.0/16", true),
+		"net3": newNode("net3", "10.3.0.0/16", false),
+	}
+	// a only in net1, b shared by net1 and net2 with an egress range, c in net2 and the disconnected net3,
+	// d only in the disconnected net3
+	a, b, c, d := wgtypes.Key{1}, wgtypes.Key{2}, wgtypes.Key{3}, wgtypes.Key{4}
+	netclient = Config{}
+	netclient.HostPeers = map[string][]wgtypes.PeerConfig{
+		"server": {
+			{PublicKey: a, AllowedIPs: []net.IPNet{cidr("10.1.0.2/32")}},
+			{PublicKey: b, AllowedIPs: []net.IPNet{cidr("10.1.0.3/32"), cidr("10.2.0.3/32"), cidr("192.168.0.0/24")}},
+			{PublicKey: c, AllowedIPs: []net.IPNet{cidr("10.2.0.4/32"), cidr("10.3.0.4/32")}},
+			{PublicKey: d, AllowedIPs: []net.IPNet{cidr("10.3.0.5/32")}},
+		},
+	}
+	peerIPs := func(peers []wgtypes.PeerConfig) map[wgtypes.Key][]string {
+		ips := make(map[wgtypes.Key][]string)
+		for _, peer := range peers {
+			ips[peer.PublicKey] = []string{}
+			for _, allowedIP := range peer.AllowedIPs {
+				ips[peer.PublicKey] = append(ips[peer.PublicKey], allowedIP.String())
+			}
+		}
+		return ips
+	}
+	tests := []struct {
+		name         string
+		network      string
+		ifacePeers   map[wgtypes.Key][]string
+		networkPeers map[wgtypes.Key][]string
+	}{
+		{"shared peer on the interface of the first network", "net1",
+			map[wgtypes.Key][]string{
+				a: {"10.1.0.2/32"},
+				b: {"10.1.0.3/32", "10.2.0.3/32", "192.168.0.0/24"},
+			},
+			map[wgtypes.Key][]string{
+				a: {"10.1.0.2/32"},
+				b: {"10.1.0.3/32", "192.168.0.0/24"},
+			}},
+		{"shared peer not on the interface of the second network", "net2",
+			map[wgtypes.Key][]string{
+				c: {"10.2.0.4/32"},
+			},
+			map[wgtypes.Key][]string{
+				b: {"10.2.0.3/32"},
+				c: {"10.2.0.4/32"},
+			}},
+		{"disconnected network", "net3",
+			map[wgtypes.Key][]string{},
+			map[wgtypes.Key][]string{
+				c: {"10.3.0.4/32"},
+				d: {"10.3.0.5/32"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			node := Nodes[tt.network]
+			is.Equal(peerIPs(GetInterfacePeerList(&node)), tt.ifacePeers)
+			is.Equal(peerIPs(GetNetworkPeerList(&node)), tt.networkPeers)
+		})
+	}
+	t.Run("deleted peer", func(t *testing.T) {
+		is := is.New(t)
+		netclient.HostPeers["server"] = netclient.HostPeers["server"][1:]
+		node := Nodes["net1"]
+		is.Equal(peerIPs(GetInterfacePeerList(&node)), map[wgtypes.Key][]string{
+			b: {"10.1.0.3/32", "10.2.0.3/32", "192.168.0.0/24"},
+		})
+		is.Equal(peerIPs(GetNetworkPeerList(&node)), map[wgtypes.Key][]string{
+			b: {"10.1.0.3/32", "192.168.0.0/24"},
+		})
+	})
+}
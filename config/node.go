@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/gravitl/netclient/ncutils"
@@ -27,6 +28,10 @@ const NodeLockfile = "netclient-nodes.lck"
 // Node provides configuration of a node
 type Node struct {
 	models.CommonNode
+	// Interface - wireguard interface of the network when running an interface per network
+	Interface string `json:"interface" yaml:"interface"`
+	// ListenPort - listen port of the network's wireguard interface when running an interface per network
+	ListenPort int `json:"listenport" yaml:"listenport"`
 }
 
 // ReadNodeConfig reads node configuration from disk
@@ -82,6 +87,96 @@ func (node *Node) PrimaryAddress() net.IPNet {
 	return node.Address6
 }
 
+// InterfaceName returns the name of the wireguard interface carrying the node's traffic
+func (node *Node) InterfaceName() string {
+	if PerNetworkIfaces() && node.Interface != "" {
+		return node.Interface
+	}
+	return ncutils.GetInterfaceName()
+}
+
+// containsIPNet returns true if the cidr is part of the node's network ranges
+func (node *Node) containsIPNet(cidr net.IPNet) bool {
+	ones, _ := cidr.Mask.Size()
+	for _, networkRange := range []net.IPNet{node.NetworkRange, node.NetworkRange6} {
+		if networkRange.IP == nil {
+			continue
+		}
+		rangeOnes, _ := networkRange.Mask.Size()
+		if ones >= rangeOnes && networkRange.Contains(cidr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssignNetworkInterfaces assigns an unused interface name and listen port to each node without one,
+// returns true if the node map was changed and needs to be written to disk
+func AssignNetworkInterfaces() bool {
+	lockfile := filepath.Join(os.TempDir(), ConfigLockfile)
+	if err := Lock(lockfile); err != nil {
+		logger.Log(0, "failed to lock config", err.Error())
+		return false
+	}
+	listenPort, proxyListenPort := netclient.ListenPort, netclient.ProxyListenPort
+	Unlock(lockfile)
+	changed := false
+	names := make(map[string]struct{})
+	ports := map[int]struct{}{
+		listenPort:      {},
+		proxyListenPort: {},
+	}
+	networks := []string{}
+	for network, node := range Nodes {
+		networks = append(networks, network)
+		if node.Interface != "" {
+			names[node.Interface] = struct{}{}
+		}
+		if node.ListenPort != 0 {
+			ports[node.ListenPort] = struct{}{}
+		}
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		node := Nodes[network]
+		if node.Interface == "" {
+			for i := 1; ; i++ {
+				name := ncutils.GetNetworkInterfaceName(i)
+				if _, ok := names[name]; !ok {
+					node.Interface = name
+					names[name] = struct{}{}
+					break
+				}
+			}
+			changed = true
+		}
+		if node.ListenPort == 0 {
+			port := listenPort + 1
+			for port <= 65535 {
+				if _, ok := ports[port]; ok {
+					port++
+					continue
+				}
+				free, err := ncutils.GetFreePort(port)
+				if err != nil {
+					logger.Log(0, "failed to find a listen port for network", network, err.Error())
+					break
+				}
+				if _, ok := ports[free]; ok {
+					port = free + 1
+					continue
+				}
+				node.ListenPort = free
+				ports[free] = struct{}{}
+				changed = true
+				break
+			}
+		}
+		Nodes[network] = node
+	}
+	return changed
+}
+
 // WriteNodeConfig writes the node map to disk
 func WriteNodeConfig() error {
 	lockfile := filepath.Join(os.TempDir(), NodeLockfile)
@@ -156,7 +251,7 @@ func ConvertToNetmakerNode(node *Node, server *Server, host *Config) *models.Leg
 	if node.InternetGateway != nil {
 		netmakerNode.InternetGateway = node.InternetGateway.IP.String()
 	}
-	netmakerNode.Interface = ncutils.GetInterfaceName()
+	netmakerNode.Interface = node.InterfaceName()
 	netmakerNode.Interfaces = host.Interfaces
 	netmakerNode.Server = node.Server
 	netmakerNode.TrafficKeys.Mine = host.TrafficKeyPublic
@@ -178,6 +273,10 @@ func ConvertToNetmakerNode(node *Node, server *Server, host *Config) *models.Leg
 		netmakerNode.Address6 = node.Address6.IP.String()
 	}
 	netmakerNode.LocalListenPort = int32(host.ListenPort)
+	if PerNetworkIfaces() && node.ListenPort != 0 {
+		netmakerNode.ListenPort = int32(node.ListenPort)
+		netmakerNode.LocalListenPort = int32(node.ListenPort)
+	}
 	netmakerNode.ProxyListenPort = int32(host.ProxyListenPort)
 	netmakerNode.MTU = int32(host.MTU)
 	netmakerNode.PersistentKeepalive = int32(node.PersistentKeepalive.Seconds())
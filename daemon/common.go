@@ -11,6 +11,11 @@ func Restart() error {
 	return restart()
 }
 
+// Reload - signals a running daemon to re-read the node config and bring the network interfaces in line with it
+func Reload() error {
+	return reload()
+}
+
 // Start - starts system daemon
 func Start() error {
 	return start()
@@ -26,3 +26,19 @@ func restart() error {
 	}
 	return nil
 }
+
+// reload - signals the daemon to reload the node config
+func reload() error {
+	pid, err := ncutils.ReadPID()
+	if err != nil {
+		return fmt.Errorf("failed to find pid %w", err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find running process for pid %d -- %w", pid, err)
+	}
+	if err := p.Signal(syscall.SIGUSR1); err != nil {
+		return fmt.Errorf("SIGUSR1 failed -- %w", err)
+	}
+	return nil
+}
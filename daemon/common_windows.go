@@ -67,6 +67,11 @@ func restart() error {
 	return runWinSWCMD("start")
 }
 
+// reload - windows services can't be signalled, the service is restarted instead
+func reload() error {
+	return restart()
+}
+
 // cleanup - cleans up windows files
 func cleanUp() error {
 	_ = writeServiceConfig() // will auto check if file is present before writing
@@ -30,6 +30,9 @@ func Disconnect(network string) error {
 	if err := PublishNodeUpdate(&node); err != nil {
 		return err
 	}
+	if config.PerNetworkIfaces() {
+		return daemon.Reload()
+	}
 	if err := daemon.Restart(); err != nil {
 		fmt.Println("daemon restart failed", err)
 		if err := daemon.Start(); err != nil {
@@ -61,6 +64,9 @@ func Connect(network string) error {
 	if err := PublishNodeUpdate(&node); err != nil {
 		return err
 	}
+	if config.PerNetworkIfaces() {
+		return daemon.Reload()
+	}
 	if err := daemon.Restart(); err != nil {
 		if err := daemon.Start(); err != nil {
 			return fmt.Errorf("daemon restart failed %w", err)
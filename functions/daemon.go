@@ -16,11 +16,11 @@ import (
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy"
 	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
+	proxyserver "github.com/gravitl/netclient/nmproxy/server"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 	"github.com/gravitl/netmaker/mq"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const (
@@ -45,6 +45,7 @@ func startProxy(wg *sync.WaitGroup) context.CancelFunc {
 		return cancel
 	}
 	server := config.GetServer(servers[0])
+	proxyserver.SetSignaler(publishProxySignal, relaysHostSignals)
 	wg.Add(1)
 	go nmproxy.Start(ctx, wg, ProxyManagerChan, server.StunHost, server.StunPort, config.Netclient().ProxyListenPort)
 	return cancel
@@ -62,10 +63,23 @@ func Daemon() {
 	wg := sync.WaitGroup{}
 	quit := make(chan os.Signal, 1)
 	reset := make(chan os.Signal, 1)
+	reload := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
 	signal.Notify(reset, syscall.SIGHUP)
+	notifyReload(reload)
 	cancel := startGoRoutines(&wg)
 	stopProxy := startProxy(&wg)
+	restart := func() {
+		closeRoutines([]context.CancelFunc{
+			cancel,
+			stopProxy,
+		}, &wg)
+		logger.Log(0, "restarting daemon")
+		cancel = startGoRoutines(&wg)
+		if !proxy_cfg.GetCfg().ProxyStatus {
+			stopProxy = startProxy(&wg)
+		}
+	}
 	for {
 		select {
 		case <-quit:
@@ -78,16 +92,21 @@ func Daemon() {
 			return
 		case <-reset:
 			logger.Log(0, "received reset")
-			closeRoutines([]context.CancelFunc{
-				cancel,
-				stopProxy,
-			}, &wg)
-			logger.Log(0, "restarting daemon")
-			cancel = startGoRoutines(&wg)
-			if !proxy_cfg.GetCfg().ProxyStatus {
-				stopProxy = startProxy(&wg)
+			restart()
+		case <-reload:
+			logger.Log(0, "received reload")
+			if !config.PerNetworkIfaces() {
+				restart()
+				continue
 			}
-
+			if err := config.ReadNodeConfig(); err != nil {
+				logger.Log(0, "error reading node map from disk", err.Error())
+				continue
+			}
+			if err := wireguard.SyncNetworkInterfaces(); err != nil {
+				logger.Log(0, "failed to sync network interfaces", err.Error())
+			}
+			configureDNS()
 		}
 	}
 }
@@ -103,8 +122,7 @@ func closeRoutines(closers []context.CancelFunc, wg *sync.WaitGroup) {
 	}
 	wg.Wait()
 	logger.Log(0, "closing netmaker interface")
-	iface := wireguard.GetInterface()
-	iface.Close()
+	wireguard.CloseInterfaces()
 }
 
 // startGoRoutines starts the daemon goroutines
@@ -120,11 +138,10 @@ func startGoRoutines(wg *sync.WaitGroup) context.CancelFunc {
 		logger.Log(0, "errors reading server map from disk", err.Error())
 	}
 	logger.Log(3, "configuring netmaker wireguard interface")
-
-	nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
-	nc.Create()
-	nc.Configure()
-	wireguard.SetPeers()
+	setupInterfaces()
+	if err := setKillSwitchRules(config.Netclient().KillSwitch); err != nil {
+		logger.Log(0, "failed to apply kill switch", err.Error())
+	}
 	if len(config.Servers) == 0 {
 		ProxyManagerChan <- &models.HostPeerUpdate{
 			ProxyUpdate: models.ProxyManagerPayload{
@@ -141,9 +158,47 @@ func startGoRoutines(wg *sync.WaitGroup) context.CancelFunc {
 	}
 	wg.Add(1)
 	go Checkin(ctx, wg)
+	wg.Add(1)
+	go KeyRotation(ctx, wg)
+	wg.Add(1)
+	go NetworkWatcher(ctx, wg)
+	if config.Netclient().PresharedKeys.Enabled {
+		wg.Add(1)
+		go PresharedKeyRotation(ctx, wg)
+	}
+	if config.Netclient().MTUDiscovery.Enabled {
+		wg.Add(1)
+		go PathMTUDiscovery(ctx, wg)
+	}
+	if config.Netclient().LANDiscovery.Enabled {
+		wg.Add(1)
+		go LANDiscovery(ctx, wg)
+	}
+	if _, ok := getDNSBackend().(*stubBackend); ok {
+		wg.Add(1)
+		go StubResolver(ctx, wg)
+	}
 	return cancel
 }
 
+// setupInterfaces - creates and configures the netmaker interface or, when running an interface
+// per network, the interfaces of all connected networks
+func setupInterfaces() {
+	if config.PerNetworkIfaces() {
+		if err := wireguard.SyncNetworkInterfaces(); err != nil {
+			logger.Log(0, "failed to set up network interfaces", err.Error())
+		}
+		wireguard.SetPeers()
+		configureDNS()
+		return
+	}
+	nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
+	nc.Create()
+	nc.Configure()
+	wireguard.SetPeers()
+	configureDNS()
+}
+
 // sets up Message Queue and subsribes/publishes updates to/from server
 // the client should subscribe to ALL nodes that exist on server locally
 func messageQueue(ctx context.Context, wg *sync.WaitGroup, server *config.Server) {
@@ -276,6 +331,8 @@ func setHostSubscription(client mqtt.Client, server string) {
 		logger.Log(0, "MQ host sub: ", hostID.String(), token.Error().Error())
 		return
 	}
+	// the server relays host signals only if it sends the ping back on host/update
+	go probeHostSignals(server)
 }
 
 // setSubcriptions sets MQ client subscriptions for a specific node config
@@ -372,28 +429,6 @@ func unsubscribeHost(client mqtt.Client, server string) {
 	}
 }
 
-// UpdateKeys -- updates private key and returns new publickey
-func UpdateKeys(node *config.Node, host *config.Config, client mqtt.Client) error {
-	var err error
-	logger.Log(0, "received message to update wireguard keys for network ", node.Network)
-	host.PrivateKey, err = wgtypes.GeneratePrivateKey()
-	if err != nil {
-		logger.Log(0, "network:", node.Network, "error generating privatekey ", err.Error())
-		return err
-	}
-	file := config.GetNetclientPath() + "netmaker.conf"
-	if err := wireguard.UpdatePrivateKey(file, host.PrivateKey.String()); err != nil {
-		logger.Log(0, "network:", node.Network, "error updating wireguard key ", err.Error())
-		return err
-	}
-	host.PublicKey = host.PrivateKey.PublicKey()
-	if err := config.WriteNetclientConfig(); err != nil {
-		logger.Log(0, "error saving netclient config", err.Error())
-	}
-	PublishNodeUpdate(node)
-	return nil
-}
-
 // RemoveServer - removes a server from server conf given a specific node
 func RemoveServer(node *config.Node) {
 	logger.Log(0, "removing server", node.Server, "from mq")
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package functions
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload - relays the signal sent by daemon.Reload
+func notifyReload(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
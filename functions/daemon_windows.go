@@ -0,0 +1,6 @@
+package functions
+
+import "os"
+
+// notifyReload - windows services are restarted instead of reloaded, nothing to relay
+func notifyReload(c chan os.Signal) {}
@@ -1,14 +1,23 @@
 package functions
 
 import (
+	"log"
+	"net"
 	"os"
 	"strings"
 
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
 	"github.com/gravitl/txeh"
 )
 
-const etcHostsComment = "netmaker"
+const (
+	etcHostsComment = "netmaker"
+	// etcHostsPeerComment - comment of the hosts file entries for peer addresses without a dns entry
+	etcHostsPeerComment = etcHostsComment + " peer"
+)
 
 // removeHostDNS -remove dns entries from /etc/hosts using hostctl
 // this function should only be called from the migrate function
@@ -40,7 +49,153 @@ const etcHostsComment = "netmaker"
 // 	return nil
 // }
 
-func deleteAllDNS() error {
+// dnsBackend - applies the private dns of the netmaker networks to the host; update, applyAll and setPeerNames are
+// called with the netclient lock held by dnsUpdate, dnsAll and applyPeerNames, deleteNetwork and deleteAll take
+// it themselves
+type dnsBackend interface {
+	// update - applies a single dns update received from a server
+	update(server string, entry models.DNSUpdate) error
+	// applyAll - applies the full set of dns entries received from a server
+	applyAll(server string, entries []models.DNSUpdate) error
+	// configure - points the netclient interfaces at the nameservers of their networks
+	configure() error
+	// deleteNetwork - removes the dns of a network, the node must already be removed from the config
+	deleteNetwork(network string) error
+	// deleteAll - removes all dns set up by netclient
+	deleteAll() error
+	// setPeerNames - installs the names of the peer addresses, by address, for reverse lookups
+	setPeerNames(names map[string]string) error
+}
+
+// getDNSBackend - returns the configured dns backend, systemd-resolved is used on auto if it is running
+func getDNSBackend() dnsBackend {
+	switch config.Netclient().DNS.Backend {
+	case config.DNSBackendHosts:
+		return &hostsBackend{}
+	case config.DNSBackendStub:
+		if !ncutils.IsWindows() {
+			return &stubBackend{}
+		}
+		logger.Log(1, "the stub resolver is not supported on windows, using hosts file for dns")
+	case config.DNSBackendResolved:
+		if resolvedAvailable() {
+			return &resolvedBackend{}
+		}
+		logger.Log(1, "systemd-resolved is not available, using hosts file for dns")
+	default:
+		if resolvedAvailable() {
+			return &resolvedBackend{}
+		}
+	}
+	return &hostsBackend{}
+}
+
+// configureDNS - configures the dns of the netclient interfaces, must be called whenever they are (re)created
+func configureDNS() {
+	if err := getDNSBackend().configure(); err != nil {
+		logger.Log(0, "failed to configure dns", err.Error())
+	}
+}
+
+// applyPeerNames - installs the names of the peers of the connected networks with dns on under the netclient lock
+func applyPeerNames() {
+	lockfile := os.TempDir() + "/netclient-lock"
+	if err := config.Lock(lockfile); err != nil {
+		logger.Log(0, "could not create lock file", err.Error())
+		return
+	}
+	defer config.Unlock(lockfile)
+	if err := getDNSBackend().setPeerNames(getPeerNames()); err != nil {
+		logger.Log(0, "failed to apply peer names", err.Error())
+	}
+}
+
+// getPeerNames - returns the names of the peer addresses of the connected networks with dns on, by address
+func getPeerNames() map[string]string {
+	names := make(map[string]string)
+	for _, peers := range config.Netclient().HostPeerIDs {
+		for _, ids := range peers {
+			for _, id := range ids {
+				node := config.GetNode(id.Network)
+				if !node.Connected || !node.DNSOn || id.Name == "" {
+					continue
+				}
+				ip := net.ParseIP(id.Address)
+				if ip == nil {
+					if ip, _, _ = net.ParseCIDR(id.Address); ip == nil {
+						continue
+					}
+				}
+				names[ip.String()] = strings.ToLower(id.Name + "." + id.Network)
+			}
+		}
+	}
+	return names
+}
+
+// hostsBackend - writes the dns entries of all networks to the hosts file, each line is tagged with the server and
+// network it belongs to; lines tagged with the bare comment of older versions are treated as belonging to every server
+type hostsBackend struct{}
+
+// hostsBackend.update - applies a dns update to the hosts file, dnsUpdate holds the netclient lock
+func (h *hostsBackend) update(server string, dns models.DNSUpdate) error {
+	if config.Netclient().Debug {
+		log.Println(dns)
+	}
+	hosts, err := txeh.NewHostsDefault()
+	if err != nil {
+		return err
+	}
+	comment := hostsComment(server, dns.Name)
+	switch dns.Action {
+	case models.DNSInsert:
+		addHostEntry(hosts, dns.Address, dns.Name, comment)
+	case models.DNSDeleteByName:
+		hosts.RemoveHost(dns.Name, comment)
+	case models.DNSDeleteByIP:
+		removeHostAddress(hosts, server, dns.Address)
+	case models.DNSReplaceName:
+		ok, ip, _ := hosts.HostAddressLookup(dns.Name, comment)
+		if !ok {
+			logger.Log(2, "failed to find dns address for host", dns.Name)
+			return nil
+		}
+		hosts.RemoveHost(dns.Name, comment)
+		addHostEntry(hosts, ip, dns.NewName, hostsComment(server, dns.NewName))
+	case models.DNSReplaceIP:
+		removeHostAddress(hosts, server, dns.Address)
+		addHostEntry(hosts, dns.NewAddress, dns.Name, comment)
+	}
+	return hosts.Save()
+}
+
+// hostsBackend.applyAll - replaces the hosts file entries of a server with the full set of its entries,
+// dnsAll holds the netclient lock
+func (h *hostsBackend) applyAll(server string, dns []models.DNSUpdate) error {
+	hosts, err := txeh.NewHostsDefault()
+	if err != nil {
+		return err
+	}
+	removeHostLines(hosts, func(lineServer, _ string) bool {
+		return lineServer == server || lineServer == ""
+	})
+	for _, entry := range dns {
+		if entry.Action != models.DNSInsert {
+			logger.Log(0, "invalid dns actions", entry.Action.String())
+			continue
+		}
+		addHostEntry(hosts, entry.Address, entry.Name, hostsComment(server, entry.Name))
+	}
+	return hosts.Save()
+}
+
+// hostsBackend.configure - the hosts file does not depend on the interfaces
+func (h *hostsBackend) configure() error {
+	return nil
+}
+
+// hostsBackend.deleteAll - removes all netclient entries from the hosts file under the netclient lock
+func (h *hostsBackend) deleteAll() error {
 	temp := os.TempDir()
 	lockfile := temp + "/netclient-lock"
 	if err := config.Lock(lockfile); err != nil {
@@ -51,50 +206,173 @@ func deleteAllDNS() error {
 	if err != nil {
 		return err
 	}
-	lines := hosts.GetHostFileLines()
-	addressesToDelete := []string{}
-	for _, line := range *lines {
-		if line.Comment == etcHostsComment {
-			addressesToDelete = append(addressesToDelete, line.Address)
-		}
-	}
-	hosts.RemoveAddresses(addressesToDelete, etcHostsComment)
+	removeHostLines(hosts, func(_, _ string) bool {
+		return true
+	})
 	if err := hosts.Save(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func deleteNetworkDNS(network string) error {
+// hostsBackend.deleteNetwork - removes the entries of a network from the hosts file under the netclient lock
+func (h *hostsBackend) deleteNetwork(network string) error {
 	temp := os.TempDir()
 	lockfile := temp + "/netclient-lock"
 	if err := config.Lock(lockfile); err != nil {
 		return err
 	}
 	defer config.Unlock(lockfile)
+	hosts, err := txeh.NewHostsDefault()
+	if err != nil {
+		return err
+	}
+	removeNetworkHosts(hosts, network)
+	if err := hosts.Save(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeNetworkHosts - removes the entries of a network, names of other networks sharing a prefix are kept
+func removeNetworkHosts(hosts *txeh.Hosts, network string) {
+	network = strings.ToLower(network)
+	removeHostLines(hosts, func(_, lineNetwork string) bool {
+		return lineNetwork == network
+	})
+}
+
+// hostsBackend.setPeerNames - writes the names of the peer addresses not covered by a dns entry to the hosts file,
+// applyPeerNames holds the netclient lock
+func (h *hostsBackend) setPeerNames(names map[string]string) error {
 	hosts, err := txeh.NewHostsDefault()
 	if err != nil {
 		return err
 	}
 	lines := hosts.GetHostFileLines()
-	addressesToRemove := []string{}
+	kept := txeh.HostFileLines{}
+	covered := make(map[string]struct{})
 	for _, line := range *lines {
-		if line.Comment == etcHostsComment {
-			if sliceContains(line.Hostnames, network) {
-				addressesToRemove = append(addressesToRemove, line.Address)
-			}
+		if line.Comment == etcHostsPeerComment {
+			continue
+		}
+		if _, _, ok := parseHostsComment(line.Comment); ok {
+			covered[line.Address] = struct{}{}
 		}
+		kept = append(kept, line)
 	}
-	hosts.RemoveAddresses(addressesToRemove, etcHostsComment)
-	if err := hosts.Save(); err != nil {
-		return err
+	*lines = kept
+	for _, addr := range sortedKeys(names) {
+		if _, ok := covered[addr]; ok {
+			continue
+		}
+		addHostEntry(hosts, addr, names[addr], etcHostsPeerComment)
 	}
-	return nil
+	return hosts.Save()
+}
+
+// hostsComment - returns the comment tagging the hosts file entries of a server and the network of a name,
+// the network is the last label of the name
+func hostsComment(server, name string) string {
+	return etcHostsComment + " " + server + " " + nameNetwork(name)
+}
+
+// parseHostsComment - returns the server and network of a hosts file comment, both are empty for lines written
+// by older versions; ok is false for lines not written by netclient and for the peer name lines, which
+// setPeerNames manages on its own
+func parseHostsComment(comment string) (server, network string, ok bool) {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || fields[0] != etcHostsComment || strings.Join(fields, " ") == etcHostsPeerComment {
+		return "", "", false
+	}
+	if len(fields) == 3 {
+		return fields[1], fields[2], true
+	}
+	return "", "", true
+}
+
+// nameNetwork - returns the network of a dns name
+func nameNetwork(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	return labels[len(labels)-1]
+}
+
+// addHostEntry - adds a name to the line of its address and comment, moving it from another address;
+// unlike txeh.AddHost it never adds the name to a line with a different comment
+func addHostEntry(hosts *txeh.Hosts, address, name, comment string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	name = strings.ToLower(strings.TrimSpace(name))
+	if ok, current, _ := hosts.HostAddressLookup(name, comment); ok {
+		if current == address {
+			return
+		}
+		hosts.RemoveHost(name, comment)
+	}
+	lines := hosts.GetHostFileLines()
+	for i := range *lines {
+		if (*lines)[i].Address == address && (*lines)[i].Comment == comment {
+			(*lines)[i].Hostnames = append((*lines)[i].Hostnames, name)
+			return
+		}
+	}
+	*lines = append(*lines, txeh.HostFileLine{
+		LineType:  txeh.ADDRESS,
+		Address:   address,
+		Hostnames: []string{name},
+		Comment:   comment,
+	})
+}
+
+// removeHostAddress - removes the lines of an address belonging to a server
+func removeHostAddress(hosts *txeh.Hosts, server, address string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	lines := hosts.GetHostFileLines()
+	kept := txeh.HostFileLines{}
+	for _, line := range *lines {
+		lineServer, _, ok := parseHostsComment(line.Comment)
+		if ok && line.Address == address && (lineServer == server || lineServer == "") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	*lines = kept
+}
+
+// removeHostLines - removes the netclient lines of the hosts file matching the server and network of their comment;
+// lines of older versions have an empty server and the network is taken from their names
+func removeHostLines(hosts *txeh.Hosts, match func(server, network string) bool) {
+	lines := hosts.GetHostFileLines()
+	kept := txeh.HostFileLines{}
+	for _, line := range *lines {
+		server, network, ok := parseHostsComment(line.Comment)
+		if !ok {
+			kept = append(kept, line)
+			continue
+		}
+		if network != "" {
+			if match(server, network) {
+				continue
+			}
+			kept = append(kept, line)
+			continue
+		}
+		hostnames := []string{}
+		for _, name := range line.Hostnames {
+			if !match(server, nameNetwork(name)) {
+				hostnames = append(hostnames, name)
+			}
+		}
+		if len(hostnames) > 0 {
+			line.Hostnames = hostnames
+			kept = append(kept, line)
+		}
+	}
+	*lines = kept
 }
 
 func sliceContains(s []string, v string) bool {
 	for _, e := range s {
-		if strings.Contains(e, v) {
+		if e == v {
 			return true
 		}
 	}
@@ -0,0 +1,193 @@
+package functions
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+const (
+	resolvedRunDir = "/run/systemd/resolve"
+	resolvedDBus   = "busctl call org.freedesktop.resolve1 /org/freedesktop/resolve1 org.freedesktop.resolve1.Manager"
+)
+
+// resolvedBackend - sets the nameservers and routing domains of the networks on the netclient interfaces through
+// systemd-resolved so that all names of a network, including wildcards, resolve through the netmaker nameserver;
+// the entries of servers without a nameserver are written to the hosts file
+type resolvedBackend struct {
+	hosts hostsBackend
+}
+
+// resolvedBackend.update - only entries of servers without a nameserver are applied
+func (r *resolvedBackend) update(server string, entry models.DNSUpdate) error {
+	if getNameserver(server) != nil {
+		return nil
+	}
+	return r.hosts.update(server, entry)
+}
+
+// resolvedBackend.applyAll - only entries of servers without a nameserver are applied
+func (r *resolvedBackend) applyAll(server string, entries []models.DNSUpdate) error {
+	if getNameserver(server) != nil {
+		return nil
+	}
+	return r.hosts.applyAll(server, entries)
+}
+
+// resolvedBackend.setPeerNames - systemd-resolved answers reverse queries from the hosts file
+func (r *resolvedBackend) setPeerNames(names map[string]string) error {
+	return r.hosts.setPeerNames(names)
+}
+
+// resolvedBackend.configure - sets the nameservers and routing domains of each netclient interface
+func (r *resolvedBackend) configure() error {
+	var lastErr error
+	for _, name := range wireguard.GetInterfaceNames() {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			logger.Log(1, "interface", name, "not found, skipping dns configuration")
+			continue
+		}
+		nameservers, domains := getLinkDNS(name)
+		if len(nameservers) == 0 {
+			revertLinkDNS(iface)
+			continue
+		}
+		logger.Log(1, "setting nameservers", fmt.Sprint(nameservers), "for domains", strings.Join(domains, " "), "on", name)
+		if err := setLinkDNS(iface, nameservers, domains); err != nil {
+			logger.Log(0, "failed to set dns on", name, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// resolvedBackend.deleteNetwork - re-configures the interfaces without the removed network
+func (r *resolvedBackend) deleteNetwork(network string) error {
+	if err := r.hosts.deleteNetwork(network); err != nil {
+		logger.Log(0, "failed to remove hosts entries of network", network, err.Error())
+	}
+	return r.configure()
+}
+
+// resolvedBackend.deleteAll - reverts the dns settings of the netclient interfaces
+func (r *resolvedBackend) deleteAll() error {
+	for _, name := range wireguard.GetInterfaceNames() {
+		if iface, err := net.InterfaceByName(name); err == nil {
+			revertLinkDNS(iface)
+		}
+	}
+	return r.hosts.deleteAll()
+}
+
+// resolvedAvailable - checks if systemd-resolved is running and can be configured
+func resolvedAvailable() bool {
+	if !ncutils.IsLinux() {
+		return false
+	}
+	if _, err := os.Stat(resolvedRunDir); err != nil {
+		return false
+	}
+	for _, cmd := range []string{"busctl", "resolvectl"} {
+		if _, err := exec.LookPath(cmd); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getNameserver - returns the nameserver of a server, nil if it does not run one
+func getNameserver(server string) net.IP {
+	s := config.GetServer(server)
+	if s == nil {
+		return nil
+	}
+	return net.ParseIP(s.CoreDNSAddr)
+}
+
+// getLinkDNS - returns the nameservers and routing domains of the connected networks with dns on served by an interface
+func getLinkDNS(iface string) ([]net.IP, []string) {
+	nameservers := []net.IP{}
+	domains := []string{}
+	for _, node := range config.GetNodes() {
+		if !node.Connected || !node.DNSOn || node.InterfaceName() != iface {
+			continue
+		}
+		nameserver := getNameserver(node.Server)
+		if nameserver == nil {
+			continue
+		}
+		found := false
+		for _, ns := range nameservers {
+			if ns.Equal(nameserver) {
+				found = true
+			}
+		}
+		if !found {
+			nameservers = append(nameservers, nameserver)
+		}
+		domains = append(domains, node.Network)
+	}
+	return nameservers, domains
+}
+
+// setLinkDNS - sets the nameservers and routing only domains of a link over d-bus, falls back to resolvectl
+func setLinkDNS(iface *net.Interface, nameservers []net.IP, domains []string) error {
+	dns := []string{fmt.Sprint(len(nameservers))}
+	for _, ns := range nameservers {
+		family, addr := 2, ns.To4() // AF_INET
+		if addr == nil {
+			family, addr = 10, ns.To16() // AF_INET6
+		}
+		dns = append(dns, fmt.Sprint(family), fmt.Sprint(len(addr)))
+		for _, b := range addr {
+			dns = append(dns, fmt.Sprint(b))
+		}
+	}
+	routing := []string{fmt.Sprint(len(domains))}
+	for _, domain := range domains {
+		routing = append(routing, domain, "true")
+	}
+	index := fmt.Sprint(iface.Index)
+	_, err := ncutils.RunCmd(resolvedDBus+" SetLinkDNS ia(iay) "+index+" "+strings.Join(dns, " "), false)
+	if err == nil {
+		_, err = ncutils.RunCmd(resolvedDBus+" SetLinkDomains ia(sb) "+index+" "+strings.Join(routing, " "), false)
+	}
+	if err == nil {
+		// the link only answers for its domains
+		_, _ = ncutils.RunCmd(resolvedDBus+" SetLinkDefaultRoute ib "+index+" false", false)
+		return nil
+	}
+	logger.Log(1, "failed to configure systemd-resolved over d-bus, falling back to resolvectl")
+	servers := []string{}
+	for _, ns := range nameservers {
+		servers = append(servers, ns.String())
+	}
+	routingDomains := []string{}
+	for _, domain := range domains {
+		routingDomains = append(routingDomains, "~"+domain)
+	}
+	if _, err := ncutils.RunCmd("resolvectl dns "+iface.Name+" "+strings.Join(servers, " "), true); err != nil {
+		return err
+	}
+	if _, err := ncutils.RunCmd("resolvectl domain "+iface.Name+" "+strings.Join(routingDomains, " "), true); err != nil {
+		return err
+	}
+	_, _ = ncutils.RunCmd("resolvectl default-route "+iface.Name+" false", false)
+	return nil
+}
+
+// revertLinkDNS - removes the dns settings of a link
+func revertLinkDNS(iface *net.Interface) {
+	if _, err := ncutils.RunCmd(resolvedDBus+" RevertLink i "+fmt.Sprint(iface.Index), false); err != nil {
+		_, _ = ncutils.RunCmd("resolvectl revert "+iface.Name, false)
+	}
+}
@@ -0,0 +1,280 @@
+package functions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/resolver"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+const (
+	resolvConf       = "/etc/resolv.conf"
+	macResolverDir   = "/etc/resolver"
+	stubDNSComment   = "# generated by netclient"
+	defaultStubAddr  = "127.0.0.73"
+	macStubAddr      = "127.0.0.1"
+	resolvConfBackup = "resolv.conf.bak"
+)
+
+// stubBackend - answers the dns entries of all networks from the embedded stub resolver; with systemd-resolved the
+// stub listens on the node addresses and is set as the nameserver of the network domains of each interface,
+// otherwise it listens on a loopback address and replaces the system resolvers, forwarding all other names to them
+type stubBackend struct{}
+
+// StubResolver - runs the stub resolver of the daemon, the host dns is restored when the daemon stops
+func StubResolver(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	resolver.Open()
+	configureDNS()
+	applyPeerNames()
+	<-ctx.Done()
+	resolver.Close()
+	if err := restoreStubDNS(); err != nil {
+		logger.Log(0, "failed to restore dns settings", err.Error())
+	}
+}
+
+// stubBackend.update - applies a dns update to the records of the stub resolver
+func (s *stubBackend) update(server string, entry models.DNSUpdate) error {
+	if config.Netclient().Debug {
+		logger.Log(0, "dns update", entry.Action.String(), entry.Name, entry.Address)
+	}
+	resolver.Update(server, entry)
+	return nil
+}
+
+// stubBackend.applyAll - replaces the records of a server in the stub resolver
+func (s *stubBackend) applyAll(server string, entries []models.DNSUpdate) error {
+	resolver.SetRecords(server, entries)
+	return nil
+}
+
+// stubBackend.setPeerNames - sets the names the stub resolver answers reverse queries with for addresses without a record
+func (s *stubBackend) setPeerNames(names map[string]string) error {
+	resolver.SetPeerNames(names)
+	return nil
+}
+
+// stubBackend.configure - sets the search domains and points the host at the stub resolver, the listeners
+// are only managed by the daemon
+func (s *stubBackend) configure() error {
+	domains := getStubDomains("")
+	resolver.SetSearchDomains(domains)
+	if !resolver.IsRunning() {
+		return nil
+	}
+	if resolvedAvailable() {
+		return configureStubLinks()
+	}
+	if err := resolver.Listen([]net.IP{getStubAddress()}); err != nil {
+		return err
+	}
+	if ncutils.IsMac() {
+		return writeMacResolvers(domains)
+	}
+	return writeStubResolvConf(domains)
+}
+
+// stubBackend.deleteNetwork - removes the records of a network immediately and re-configures the host without it
+func (s *stubBackend) deleteNetwork(network string) error {
+	resolver.DeleteNetwork(network)
+	return s.configure()
+}
+
+// stubBackend.deleteAll - removes all records and restores the host dns settings
+func (s *stubBackend) deleteAll() error {
+	resolver.DeleteAll()
+	return restoreStubDNS()
+}
+
+// configureStubLinks - listens on the node address of each netclient interface and sets it as the
+// systemd-resolved nameserver of the network domains of the interface
+func configureStubLinks() error {
+	addrs := []net.IP{}
+	links := make(map[*net.Interface]net.IP)
+	for _, name := range wireguard.GetInterfaceNames() {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			logger.Log(1, "interface", name, "not found, skipping dns configuration")
+			continue
+		}
+		addr := getStubLinkAddr(name)
+		if addr == nil {
+			revertLinkDNS(iface)
+			continue
+		}
+		addrs = append(addrs, addr)
+		links[iface] = addr
+	}
+	// systemd-resolved forwards everything outside the network domains itself
+	resolver.SetUpstreams(nil)
+	lastErr := resolver.Listen(addrs)
+	for iface, addr := range links {
+		domains := getStubDomains(iface.Name)
+		logger.Log(1, "setting stub resolver", addr.String(), "for domains", strings.Join(domains, " "), "on", iface.Name)
+		if err := setLinkDNS(iface, []net.IP{addr}, domains); err != nil {
+			logger.Log(0, "failed to set dns on", iface.Name, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// restoreStubDNS - reverts the host dns settings made for the stub resolver
+func restoreStubDNS() error {
+	if resolvedAvailable() {
+		for _, name := range wireguard.GetInterfaceNames() {
+			if iface, err := net.InterfaceByName(name); err == nil {
+				revertLinkDNS(iface)
+			}
+		}
+		return nil
+	}
+	if ncutils.IsMac() {
+		return writeMacResolvers(nil)
+	}
+	backup := config.GetNetclientPath() + resolvConfBackup
+	original, err := os.ReadFile(backup)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	logger.Log(1, "restoring", resolvConf)
+	if err := os.WriteFile(resolvConf, original, 0644); err != nil {
+		return err
+	}
+	return os.Remove(backup)
+}
+
+// getStubDomains - returns the domains of the connected networks with dns on, limited to an interface if one is given
+func getStubDomains(iface string) []string {
+	domains := []string{}
+	for _, node := range config.GetNodes() {
+		if !node.Connected || !node.DNSOn || (iface != "" && node.InterfaceName() != iface) {
+			continue
+		}
+		domains = append(domains, node.Network)
+	}
+	return domains
+}
+
+// getStubLinkAddr - returns the address the stub resolver listens on for an interface, nil if none of its networks use dns
+func getStubLinkAddr(iface string) net.IP {
+	for _, node := range config.GetNodes() {
+		if !node.Connected || !node.DNSOn || node.InterfaceName() != iface {
+			continue
+		}
+		if addr := node.PrimaryAddress(); addr.IP != nil {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// getStubAddress - returns the loopback address of the stub resolver
+func getStubAddress() net.IP {
+	if addr := net.ParseIP(config.Netclient().DNS.StubAddress); addr != nil {
+		return addr
+	}
+	if ncutils.IsMac() {
+		// only 127.0.0.1 is configured on lo0 by default
+		return net.ParseIP(macStubAddr)
+	}
+	return net.ParseIP(defaultStubAddr)
+}
+
+// writeStubResolvConf - points resolv.conf at the stub resolver, the original is backed up once and its
+// nameservers are used as upstreams
+func writeStubResolvConf(domains []string) error {
+	backup := config.GetNetclientPath() + resolvConfBackup
+	original, err := os.ReadFile(backup)
+	if errors.Is(err, os.ErrNotExist) {
+		if original, err = os.ReadFile(resolvConf); err != nil {
+			return err
+		}
+		if err := os.WriteFile(backup, original, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	stub := getStubAddress()
+	upstreams := []net.IP{}
+	search := append([]string{}, domains...)
+	var other bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.Equal(stub) {
+				upstreams = append(upstreams, ip)
+			}
+			continue
+		}
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			search = append(search, fields[1:]...)
+			continue
+		}
+		other.WriteString(scanner.Text() + "\n")
+	}
+	resolver.SetUpstreams(upstreams)
+	var conf bytes.Buffer
+	conf.WriteString(stubDNSComment + ", the original is saved to " + backup + "\n")
+	conf.WriteString("nameserver " + stub.String() + "\n")
+	if len(search) > 0 {
+		conf.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	conf.Write(other.Bytes())
+	current, err := os.ReadFile(resolvConf)
+	if err == nil && bytes.Equal(current, conf.Bytes()) {
+		return nil
+	}
+	logger.Log(1, "pointing", resolvConf, "at stub resolver", stub.String())
+	return os.WriteFile(resolvConf, conf.Bytes(), 0644)
+}
+
+// writeMacResolvers - writes a resolver file pointing at the stub resolver for each domain and removes the
+// files of other domains written before
+func writeMacResolvers(domains []string) error {
+	files, err := os.ReadDir(macResolverDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(macResolverDir, file.Name())
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.HasPrefix(content, []byte(stubDNSComment)) || sliceContains(domains, file.Name()) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Log(0, "failed to remove resolver file", path, err.Error())
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(macResolverDir, 0755); err != nil {
+		return err
+	}
+	content := stubDNSComment + "\nnameserver " + getStubAddress().String() + "\n"
+	for _, domain := range domains {
+		if err := os.WriteFile(filepath.Join(macResolverDir, domain), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package functions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravitl/txeh"
+	"github.com/matryer/is"
+)
+
+func TestRemoveNetworkHosts(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte(`127.0.0.1 localhost
+10.0.0.1 a.dev # netmaker server dev
+10.1.0.1 a.devops # netmaker server devops
+10.2.0.1 a.dev.example # other
+10.0.0.2 b.dev b.devops # netmaker
+10.0.0.3 c.peer #netmaker peer
+`), 0644)
+	is.NoErr(err)
+	hosts, err := txeh.NewHosts(&txeh.HostsConfig{ReadFilePath: path})
+	is.NoErr(err)
+	removeNetworkHosts(hosts, "DEV")
+	names := make(map[string]string)
+	for _, line := range *hosts.GetHostFileLines() {
+		for _, name := range line.Hostnames {
+			names[name] = line.Address
+		}
+	}
+	t.Run("network removed", func(t *testing.T) {
+		_, ok := names["a.dev"]
+		is.Equal(ok, false)
+		_, ok = names["b.dev"]
+		is.Equal(ok, false)
+	})
+	t.Run("network sharing the prefix kept", func(t *testing.T) {
+		is.Equal(names["a.devops"], "10.1.0.1")
+		is.Equal(names["b.devops"], "10.0.0.2")
+	})
+	t.Run("other entries kept", func(t *testing.T) {
+		is.Equal(names["localhost"], "127.0.0.1")
+		is.Equal(names["a.dev.example"], "10.2.0.1")
+		is.Equal(names["c.peer"], "10.0.0.3")
+	})
+	t.Run("peer names kept when removing an address", func(t *testing.T) {
+		removeHostAddress(hosts, "server", "10.0.0.3")
+		found := false
+		for _, line := range *hosts.GetHostFileLines() {
+			if line.Address == "10.0.0.3" && line.Comment == etcHostsPeerComment {
+				found = true
+			}
+		}
+		is.True(found)
+	})
+}
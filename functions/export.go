@@ -0,0 +1,413 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// ExportWgQuick - wg-quick configuration file
+	ExportWgQuick = "wg-quick"
+	// ExportNetworkd - systemd-networkd .netdev and .network files
+	ExportNetworkd = "networkd"
+	// ExportJSON - json representation of the tunnel(s)
+	ExportJSON = "json"
+	// exportWatchDelay - time to wait for further changes of the configuration before rendering in watch mode
+	exportWatchDelay = time.Millisecond * 500
+)
+
+// exportTunnel - wireguard interface as rendered by the exporters
+type exportTunnel struct {
+	Name       string   `json:"name"`
+	PrivateKey string   `json:"private_key"`
+	ListenPort int      `json:"listen_port"`
+	MTU        int      `json:"mtu"`
+	Addresses  []string `json:"addresses"`
+	// Routes - allowed ips of the peers outside of the tunnel's networks, default routes are left to the gateway
+	Routes      []string     `json:"routes"`
+	RouteTable  int          `json:"route_table,omitempty"`
+	RouteMetric int          `json:"route_metric,omitempty"`
+	Peers       []exportPeer `json:"peers"`
+}
+
+type exportPeer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// Export - renders the host and its peers for one or all networks as wg-quick, systemd-networkd or json,
+// files are written to dir if given, stdout otherwise; watch keeps the files updated until interrupted
+func Export(format, network, dir string, watch bool) error {
+	switch format {
+	case ExportWgQuick, ExportNetworkd, ExportJSON:
+	default:
+		return fmt.Errorf("unsupported format %s, use one of %s, %s, %s", format, ExportWgQuick, ExportNetworkd, ExportJSON)
+	}
+	if watch && dir == "" {
+		return errors.New("watch requires an output directory")
+	}
+	files, err := renderExport(format, network)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		for _, name := range sortedKeys(files) {
+			fmt.Print(string(files[name]))
+		}
+		return nil
+	}
+	if err := writeExport(dir, files); err != nil {
+		return err
+	}
+	if !watch {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(config.GetNetclientPath()); err != nil {
+		return err
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	// a config change is written in several steps, the export is rendered once the files settled
+	settled := time.NewTimer(exportWatchDelay)
+	settled.Stop()
+	defer settled.Stop()
+	for {
+		select {
+		case <-quit:
+			return nil
+		case err := <-watcher.Errors:
+			logger.Log(0, "error watching netclient config", err.Error())
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				settled.Reset(exportWatchDelay)
+			}
+		case <-settled.C:
+			wireguard.ResetPresharedKeys()
+			if _, err := config.ReadNetclientConfig(); err != nil {
+				logger.Log(0, "error reading netclient config", err.Error())
+				continue
+			}
+			if err := config.ReadNodeConfig(); err != nil {
+				logger.Log(0, "error reading node config", err.Error())
+				continue
+			}
+			updated, err := renderExport(format, network)
+			if err != nil {
+				logger.Log(0, "failed to render export", err.Error())
+				continue
+			}
+			if exportChanged(files, updated) {
+				if err := writeExport(dir, updated); err != nil {
+					logger.Log(0, "failed to write export", err.Error())
+					continue
+				}
+				files = updated
+			}
+		}
+	}
+}
+
+// renderExport - returns the rendered files indexed by file name
+func renderExport(format, network string) (map[string][]byte, error) {
+	tunnels, err := getExportTunnels(network)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, tunnel := range tunnels {
+		switch format {
+		case ExportWgQuick:
+			files[tunnel.Name+".conf"] = renderWgQuick(&tunnel)
+		case ExportNetworkd:
+			netdev, network := renderNetworkd(&tunnel)
+			files[tunnel.Name+".netdev"] = netdev
+			files[tunnel.Name+".network"] = network
+		case ExportJSON:
+			data, err := renderJSON(&tunnel)
+			if err != nil {
+				return nil, err
+			}
+			files[tunnel.Name+".json"] = data
+		}
+	}
+	return files, nil
+}
+
+// getExportTunnels - returns the tunnel of the given network, the shared tunnel of all networks or,
+// when running an interface per network, one tunnel per connected network
+func getExportTunnels(network string) ([]exportTunnel, error) {
+	host := config.Netclient()
+	nodes := config.GetNodes()
+	if network != "" {
+		node, ok := nodes[network]
+		if !ok {
+			return nil, errors.New("no such network")
+		}
+		return []exportTunnel{newExportTunnel(host, node.InterfaceName(), getNodeListenPort(host, &node),
+			[]config.Node{node}, wireguard.GetPeerConfigs(&node))}, nil
+	}
+	if config.PerNetworkIfaces() {
+		tunnels := []exportTunnel{}
+		for _, name := range sortedKeys(nodes) {
+			node := nodes[name]
+			if !node.Connected {
+				continue
+			}
+			tunnels = append(tunnels, newExportTunnel(host, node.InterfaceName(), getNodeListenPort(host, &node),
+				[]config.Node{node}, wireguard.GetPeerConfigs(&node)))
+		}
+		return tunnels, nil
+	}
+	connected := []config.Node{}
+	for _, name := range sortedKeys(nodes) {
+		if nodes[name].Connected {
+			connected = append(connected, nodes[name])
+		}
+	}
+	return []exportTunnel{newExportTunnel(host, ncutils.GetInterfaceName(), host.ListenPort,
+		connected, wireguard.GetPeerConfigs(nil))}, nil
+}
+
+func newExportTunnel(host *config.Config, name string, listenPort int, nodes []config.Node, peers []wgtypes.PeerConfig) exportTunnel {
+	tunnel := exportTunnel{
+		Name:        name,
+		PrivateKey:  host.PrivateKey.String(),
+		ListenPort:  listenPort,
+		MTU:         host.MTU,
+		Addresses:   []string{},
+		Routes:      []string{},
+		RouteTable:  host.RouteTable,
+		RouteMetric: host.RouteMetric,
+		Peers:       []exportPeer{},
+	}
+	routes := make(map[string]struct{})
+	for _, node := range nodes {
+		if node.Address.IP != nil {
+			tunnel.Addresses = append(tunnel.Addresses, getExportAddress(node.Address.IP, node.NetworkRange))
+		}
+		if node.Address6.IP != nil {
+			tunnel.Addresses = append(tunnel.Addresses, getExportAddress(node.Address6.IP, node.NetworkRange6))
+		}
+	}
+	for _, peer := range peers {
+		exported := exportPeer{
+			PublicKey:  peer.PublicKey.String(),
+			AllowedIPs: []string{},
+		}
+		if peer.PresharedKey != nil && *peer.PresharedKey != (wgtypes.Key{}) {
+			exported.PresharedKey = peer.PresharedKey.String()
+		}
+		if peer.Endpoint != nil {
+			exported.Endpoint = peer.Endpoint.String()
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			exported.AllowedIPs = append(exported.AllowedIPs, allowedIP.String())
+			if _, ok := routes[allowedIP.String()]; !ok && isExportRoute(nodes, allowedIP) {
+				routes[allowedIP.String()] = struct{}{}
+				tunnel.Routes = append(tunnel.Routes, allowedIP.String())
+			}
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			exported.PersistentKeepalive = int(peer.PersistentKeepaliveInterval.Seconds())
+		}
+		tunnel.Peers = append(tunnel.Peers, exported)
+	}
+	return tunnel
+}
+
+// isExportRoute - checks if an allowed ip needs a route, i.e. it is neither a default route nor part of the
+// networks of the tunnel addresses
+func isExportRoute(nodes []config.Node, allowedIP net.IPNet) bool {
+	if ones, _ := allowedIP.Mask.Size(); ones == 0 {
+		return false
+	}
+	for _, node := range nodes {
+		for _, networkRange := range []net.IPNet{node.NetworkRange, node.NetworkRange6} {
+			if networkRange.IP != nil && networkRange.Contains(allowedIP.IP) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getExportAddress - returns the address with the prefix length of its network, a host route if the range is unknown
+func getExportAddress(ip net.IP, networkRange net.IPNet) string {
+	ones, bits := networkRange.Mask.Size()
+	if bits == 0 {
+		ones = 128
+		if ip.To4() != nil {
+			ones = 32
+		}
+	}
+	return ip.String() + "/" + strconv.Itoa(ones)
+}
+
+func getNodeListenPort(host *config.Config, node *config.Node) int {
+	if config.PerNetworkIfaces() && node.ListenPort != 0 {
+		return node.ListenPort
+	}
+	return host.ListenPort
+}
+
+// renderWgQuick - renders a wg-quick configuration
+func renderWgQuick(tunnel *exportTunnel) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s - generated by netclient\n", tunnel.Name)
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", tunnel.PrivateKey)
+	if len(tunnel.Addresses) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(tunnel.Addresses, ", "))
+	}
+	fmt.Fprintf(&b, "ListenPort = %d\n", tunnel.ListenPort)
+	if tunnel.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", tunnel.MTU)
+	}
+	if tunnel.RouteTable > 0 {
+		fmt.Fprintf(&b, "Table = %d\n", tunnel.RouteTable)
+	}
+	for _, peer := range tunnel.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.Bytes()
+}
+
+// renderNetworkd - renders the systemd-networkd .netdev and .network files
+func renderNetworkd(tunnel *exportTunnel) ([]byte, []byte) {
+	var netdev, network bytes.Buffer
+	fmt.Fprintf(&netdev, "# %s - generated by netclient\n", tunnel.Name)
+	netdev.WriteString("[NetDev]\n")
+	fmt.Fprintf(&netdev, "Name = %s\n", tunnel.Name)
+	netdev.WriteString("Kind = wireguard\n")
+	if tunnel.MTU != 0 {
+		fmt.Fprintf(&netdev, "MTUBytes = %d\n", tunnel.MTU)
+	}
+	netdev.WriteString("\n[WireGuard]\n")
+	fmt.Fprintf(&netdev, "PrivateKey = %s\n", tunnel.PrivateKey)
+	fmt.Fprintf(&netdev, "ListenPort = %d\n", tunnel.ListenPort)
+	for _, peer := range tunnel.Peers {
+		netdev.WriteString("\n[WireGuardPeer]\n")
+		fmt.Fprintf(&netdev, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&netdev, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&netdev, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&netdev, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&netdev, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	fmt.Fprintf(&network, "# %s - generated by netclient\n", tunnel.Name)
+	network.WriteString("[Match]\n")
+	fmt.Fprintf(&network, "Name = %s\n", tunnel.Name)
+	network.WriteString("\n[Network]\n")
+	for _, address := range tunnel.Addresses {
+		fmt.Fprintf(&network, "Address = %s\n", address)
+	}
+	for _, route := range tunnel.Routes {
+		network.WriteString("\n[Route]\n")
+		fmt.Fprintf(&network, "Destination = %s\n", route)
+		if tunnel.RouteTable > 0 {
+			fmt.Fprintf(&network, "Table = %d\n", tunnel.RouteTable)
+		}
+		if tunnel.RouteMetric > 0 {
+			fmt.Fprintf(&network, "Metric = %d\n", tunnel.RouteMetric)
+		}
+	}
+	if tunnel.RouteTable > 0 && len(tunnel.Routes) > 0 {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			network.WriteString("\n[RoutingPolicyRule]\n")
+			fmt.Fprintf(&network, "Table = %d\n", tunnel.RouteTable)
+			fmt.Fprintf(&network, "Priority = %d\n", wireguard.RouteTablePriority)
+			fmt.Fprintf(&network, "Family = %s\n", family)
+		}
+	}
+	return netdev.Bytes(), network.Bytes()
+}
+
+// renderJSON - renders the json representation of a tunnel
+func renderJSON(tunnel *exportTunnel) ([]byte, error) {
+	data, err := json.MarshalIndent(tunnel, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeExport - writes the rendered files, readable by root only as they contain the private key
+func writeExport(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+		logger.Log(1, "exported", filepath.Join(dir, name))
+	}
+	return nil
+}
+
+func exportChanged(current, updated map[string][]byte) bool {
+	if len(current) != len(updated) {
+		return true
+	}
+	for name, data := range updated {
+		if !bytes.Equal(current[name], data) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
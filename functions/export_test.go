@@ -0,0 +1,178 @@
+package functions
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRenderExport(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		ip, ipnet, _ := net.ParseCIDR(s)
+		ipnet.IP = ip
+		return *ipnet
+	}
+	host := &config.Config{}
+	host.PrivateKey = wgtypes.Key{1}
+	host.MTU = 1420
+	host.RouteTable = 100
+	host.RouteMetric = 50
+	node := config.Node{}
+	node.Address = cidr("10.1.0.5/32")
+	node.NetworkRange = cidr("10.1.0.0/16")
+	node.Address6 = cidr("fd00::5/128")
+	node.NetworkRange6 = cidr("fd00::/64")
+	presharedKey := wgtypes.Key{4}
+	keepalive := time.Second * 20
+	peers := []wgtypes.PeerConfig{
+		{
+			PublicKey:                   wgtypes.Key{2},
+			PresharedKey:                &presharedKey,
+			Endpoint:                    &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51821},
+			PersistentKeepaliveInterval: &keepalive,
+			AllowedIPs:                  []net.IPNet{cidr("10.1.0.2/32"), cidr("192.168.1.0/24"), cidr("0.0.0.0/0")},
+		},
+		{
+			PublicKey: wgtypes.Key{3},
+			AllowedIPs: []net.IPNet{cidr("10.1.0.3/32"), cidr("fd00::3/128"), cidr("192.168.1.0/24"),
+				cidr("2001:db8:1::/48")},
+		},
+	}
+	tunnel := newExportTunnel(host, "netmaker", 51821, []config.Node{node}, peers)
+	t.Run("wg-quick", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(string(renderWgQuick(&tunnel)), `# netmaker - generated by netclient
+[Interface]
+PrivateKey = AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+Address = 10.1.0.5/16, fd00::5/64
+ListenPort = 51821
+MTU = 1420
+Table = 100
+
+[Peer]
+PublicKey = AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+PresharedKey = BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 10.1.0.2/32, 192.168.1.0/24, 0.0.0.0/0
+Endpoint = 203.0.113.1:51821
+PersistentKeepalive = 20
+
+[Peer]
+PublicKey = AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 10.1.0.3/32, fd00::3/128, 192.168.1.0/24, 2001:db8:1::/48
+`)
+	})
+	t.Run("networkd", func(t *testing.T) {
+		is := is.New(t)
+		netdev, network := renderNetworkd(&tunnel)
+		is.Equal(string(netdev), `# netmaker - generated by netclient
+[NetDev]
+Name = netmaker
+Kind = wireguard
+MTUBytes = 1420
+
+[WireGuard]
+PrivateKey = AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+ListenPort = 51821
+
+[WireGuardPeer]
+PublicKey = AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+PresharedKey = BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 10.1.0.2/32, 192.168.1.0/24, 0.0.0.0/0
+Endpoint = 203.0.113.1:51821
+PersistentKeepalive = 20
+
+[WireGuardPeer]
+PublicKey = AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 10.1.0.3/32, fd00::3/128, 192.168.1.0/24, 2001:db8:1::/48
+`)
+		is.Equal(string(network), `# netmaker - generated by netclient
+[Match]
+Name = netmaker
+
+[Network]
+Address = 10.1.0.5/16
+Address = fd00::5/64
+
+[Route]
+Destination = 192.168.1.0/24
+Table = 100
+Metric = 50
+
+[Route]
+Destination = 2001:db8:1::/48
+Table = 100
+Metric = 50
+
+[RoutingPolicyRule]
+Table = 100
+Priority = 28000
+Family = ipv4
+
+[RoutingPolicyRule]
+Table = 100
+Priority = 28000
+Family = ipv6
+`)
+	})
+	t.Run("networkd without route table", func(t *testing.T) {
+		is := is.New(t)
+		mainTable := tunnel
+		mainTable.RouteTable = 0
+		_, network := renderNetworkd(&mainTable)
+		is.True(strings.HasSuffix(string(network), `
+[Route]
+Destination = 2001:db8:1::/48
+Metric = 50
+`))
+		is.True(!strings.Contains(string(network), "Table ="))
+	})
+	t.Run("json", func(t *testing.T) {
+		is := is.New(t)
+		data, err := renderJSON(&tunnel)
+		is.NoErr(err)
+		is.Equal(string(data), `{
+  "name": "netmaker",
+  "private_key": "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+  "listen_port": 51821,
+  "mtu": 1420,
+  "addresses": [
+    "10.1.0.5/16",
+    "fd00::5/64"
+  ],
+  "routes": [
+    "192.168.1.0/24",
+    "2001:db8:1::/48"
+  ],
+  "route_table": 100,
+  "route_metric": 50,
+  "peers": [
+    {
+      "public_key": "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+      "preshared_key": "BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+      "endpoint": "203.0.113.1:51821",
+      "allowed_ips": [
+        "10.1.0.2/32",
+        "192.168.1.0/24",
+        "0.0.0.0/0"
+      ],
+      "persistent_keepalive": 20
+    },
+    {
+      "public_key": "AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+      "allowed_ips": [
+        "10.1.0.3/32",
+        "fd00::3/128",
+        "192.168.1.0/24",
+        "2001:db8:1::/48"
+      ]
+    }
+  ]
+}
+`)
+	})
+}
@@ -0,0 +1,226 @@
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	proxyserver "github.com/gravitl/netclient/nmproxy/server"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// hostSignalAction - action of a host update carrying a signal of another host relayed by the server; servers
+// before host signal relaying do not subscribe to host/signal/<HOSTID> and drop the signals, so preshared keys are
+// only exchanged, and proxy signals only sent besides the proxy path, through servers seen relaying them
+const hostSignalAction models.HostMqAction = "SIGNAL_HOST"
+
+// kinds of host signals
+const (
+	// hostSignalPresharedKey - preshared key offer or acknowledgement
+	hostSignalPresharedKey = "psk"
+	// hostSignalProxy - hole punching or path signal of the proxy
+	hostSignalProxy = "proxy"
+	// hostSignalPing - signal a host sends to itself, a server relaying it back relays host signals
+	hostSignalPing = "ping"
+)
+
+// errSignalNotRelayed - the server was not seen relaying host signals
+var errSignalNotRelayed = errors.New("server does not relay host signals")
+
+var signalServers = make(map[string]bool) // servers seen relaying host signals
+var signalServersMutex = sync.RWMutex{}   // used to mutex access to signalServers
+
+// hostSignal - message from one host to another: published by the sender on host/signal/<HOSTID> and relayed by the
+// server to the receiver as a host update; the payload is sealed with the wireguard keys of both hosts
+type hostSignal struct {
+	FromHostID string `json:"from_host_id"`
+	ToHostID   string `json:"to_host_id"`
+	Kind       string `json:"kind"`
+	Payload    []byte `json:"payload"`
+}
+
+// hostSignalUpdate - host update carrying a relayed signal
+type hostSignalUpdate struct {
+	Action models.HostMqAction
+	Signal hostSignal `json:"signal"`
+}
+
+// publishHostSignal - seals the payload for the peer and publishes it to the server to relay it to the peer's host
+func publishHostSignal(server string, peerKey wgtypes.Key, kind string, payload []byte) error {
+	if !relaysHostSignals(server) {
+		return errSignalNotRelayed
+	}
+	hostID := getPeerHostID(server, peerKey)
+	if hostID == "" {
+		return errors.New("no host known for peer " + peerKey.String())
+	}
+	return sendHostSignal(server, hostID, peerKey, kind, payload)
+}
+
+// probeHostSignals - sends a ping signal to the host itself through the server, servers relaying host signals send
+// it back
+func probeHostSignals(server string) {
+	if err := sendHostSignal(server, config.Netclient().ID.String(), config.Netclient().PrivateKey.PublicKey(),
+		hostSignalPing, nil); err != nil {
+		logger.Log(1, "failed to probe host signals of server", server, err.Error())
+	}
+}
+
+// relaysHostSignals - checks if the server was seen relaying host signals
+func relaysHostSignals(server string) bool {
+	signalServersMutex.RLock()
+	defer signalServersMutex.RUnlock()
+	return signalServers[server]
+}
+
+// sendHostSignal - seals the payload for the peer and publishes it to the server to relay it to the host
+func sendHostSignal(server, hostID string, peerKey wgtypes.Key, kind string, payload []byte) error {
+	sealed, err := packet.CreateSignalPacket(payload, config.Netclient().PrivateKey, peerKey)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(hostSignal{
+		FromHostID: config.Netclient().ID.String(),
+		ToHostID:   hostID,
+		Kind:       kind,
+		Payload:    sealed,
+	})
+	if err != nil {
+		return err
+	}
+	return publish(server, fmt.Sprintf("host/signal/%s", config.Netclient().ID.String()), data, 1)
+}
+
+// handleHostSignal - opens a signal relayed by the server, the sealed payload must come from a peer of the server
+// whose host is the one the server names as sender
+func handleHostSignal(server string, data []byte) {
+	var update hostSignalUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		logger.Log(0, "error unmarshalling host signal")
+		return
+	}
+	sig := update.Signal
+	if sig.ToHostID != config.Netclient().ID.String() {
+		return
+	}
+	msg, err := packet.ConsumeSignalMsg(sig.Payload)
+	if err != nil {
+		logger.Log(1, "failed to decode host signal:", err.Error())
+		return
+	}
+	if sig.Kind == hostSignalPing {
+		if sig.FromHostID == sig.ToHostID && msg.Sender == msg.Reciever && msg.Sender == config.Netclient().PrivateKey.PublicKey() {
+			if _, err := packet.OpenSignal(sig.Payload, msg, config.Netclient().PrivateKey); err == nil && !relaysHostSignals(server) {
+				logger.Log(0, "server", server, "relays host signals")
+				signalServersMutex.Lock()
+				signalServers[server] = true
+				signalServersMutex.Unlock()
+			}
+		}
+		return
+	}
+	if msg.Reciever != config.Netclient().PrivateKey.PublicKey() || getPeerHostID(server, msg.Sender) != sig.FromHostID {
+		logger.Log(1, "dropping host signal of unknown peer", msg.Sender.String(), "from host", sig.FromHostID)
+		return
+	}
+	payload, err := packet.OpenSignal(sig.Payload, msg, config.Netclient().PrivateKey)
+	if err != nil {
+		logger.Log(1, "dropping host signal of peer", msg.Sender.String(), err.Error())
+		return
+	}
+	switch sig.Kind {
+	case hostSignalPresharedKey:
+		handlePresharedKeySignal(server, msg.Sender, payload)
+	case hostSignalProxy:
+		proxyserver.NmProxyServer.HandleSignal(msg.Sender, payload)
+	default:
+		logger.Log(1, "unknown host signal", sig.Kind)
+	}
+}
+
+// handlePresharedKeySignal - applies a preshared key message of a peer and answers it
+func handlePresharedKeySignal(server string, peerKey wgtypes.Key, payload []byte) {
+	var msg wireguard.PresharedKeyMsg
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		logger.Log(1, "dropping malformed preshared key message of peer", peerKey.String())
+		return
+	}
+	reply, changed, err := wireguard.HandlePresharedKeyMsg(peerKey, msg)
+	if err != nil {
+		logger.Log(0, "failed to handle preshared key message of peer", peerKey.String(), err.Error())
+		return
+	}
+	if changed {
+		logger.Log(1, "preshared key of peer", peerKey.String(), "changed, updating peers")
+		if err := wireguard.SetPeers(); err != nil {
+			logger.Log(0, "failed to set peers", err.Error())
+		}
+	}
+	if reply == nil {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	if err := publishHostSignal(server, peerKey, hostSignalPresharedKey, data); err != nil {
+		logger.Log(0, "failed to answer preshared key message of peer", peerKey.String(), err.Error())
+	}
+}
+
+// publishProxySignal - relays a signal of the proxy to the peer through the server
+func publishProxySignal(server string, peerKey wgtypes.Key, payload []byte) error {
+	return publishHostSignal(server, peerKey, hostSignalProxy, payload)
+}
+
+// sendPresharedKeyOffers - sends the pending preshared key offers through a server of each peer relaying host
+// signals, offers to peers without one stay pending
+func sendPresharedKeyOffers(offers map[wgtypes.Key]wireguard.PresharedKeyMsg) {
+	for peerKey, offer := range offers {
+		data, err := json.Marshal(offer)
+		if err != nil {
+			continue
+		}
+		for _, server := range getPeerServers(peerKey) {
+			if !relaysHostSignals(server) {
+				logger.Log(1, "preshared key offer to peer", peerKey.String(), "waits for", server, "to relay host signals")
+				continue
+			}
+			if err := publishHostSignal(server, peerKey, hostSignalPresharedKey, data); err != nil {
+				logger.Log(1, "failed to offer preshared key to peer", peerKey.String(), "through", server, err.Error())
+				continue
+			}
+			break
+		}
+	}
+}
+
+// getPeerHostID - returns the id of the host of a peer of a server, empty if unknown
+func getPeerHostID(server string, peerKey wgtypes.Key) string {
+	for _, id := range config.Netclient().HostPeerIDs[server][peerKey.String()] {
+		if id.HostID != "" {
+			return id.HostID
+		}
+	}
+	return ""
+}
+
+// getPeerServers - returns the servers the peer is a peer of the host on
+func getPeerServers(peerKey wgtypes.Key) []string {
+	servers := []string{}
+	for server, peers := range config.Netclient().HostPeers {
+		for _, peer := range peers {
+			if peer.PublicKey == peerKey {
+				servers = append(servers, server)
+				break
+			}
+		}
+	}
+	return servers
+}
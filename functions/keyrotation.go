@@ -0,0 +1,277 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// keyRotationCheckInterval - how often the key rotation policy is evaluated
+	keyRotationCheckInterval = time.Hour
+	// keyRotationAckTimeout - how long to wait for the servers to confirm a new key before rolling back
+	keyRotationAckTimeout = time.Minute * 2
+	// keyRotationStartDelay - gives the mq clients time to connect before a pending rotation is recovered
+	keyRotationStartDelay = time.Minute
+	// pskCheckInterval - how often the preshared keys are checked for expiry and unacknowledged offers are repeated
+	pskCheckInterval = time.Minute
+)
+
+var keyRotationAck = make(chan string, 10)        // names of the servers confirming the pending key
+var keyRotationRequest = make(chan struct{}, 1)   // rotations requested by a server, run by the key rotation routine
+var keyRotationMutex = sync.Mutex{}               // allows a single rotation at a time
+var writeHostConfig = config.WriteNetclientConfig // saves the host config changed during a rotation
+
+// KeyRotation - rotates the host's wireguard key according to the key rotation policy
+// and recovers a rotation interrupted by a crash or restart
+func KeyRotation(ctx context.Context, wg *sync.WaitGroup) {
+	logger.Log(2, "starting key rotation goroutine")
+	defer wg.Done()
+	timer := time.NewTimer(keyRotationStartDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(0, "key rotation routine closed")
+			return
+		case <-keyRotationRequest:
+			if err := RotateKeys(ctx); err != nil {
+				logger.Log(0, "err updating wireguard keys, reusing last key", err.Error())
+			}
+		case <-timer.C:
+			if config.Netclient().KeyRotation.PendingKey != (wgtypes.Key{}) {
+				if err := recoverKeyRotation(); err != nil {
+					logger.Log(0, "failed to recover key rotation", err.Error())
+				}
+			} else if keyRotationDue() {
+				if err := RotateKeys(ctx); err != nil {
+					logger.Log(0, "key rotation failed, reusing last key", err.Error())
+				}
+			}
+			timer.Reset(keyRotationCheckInterval)
+		}
+	}
+}
+
+// RotateKeys - generates a new wireguard key and announces its public key to all servers; the interfaces are only
+// switched to the key and it is only saved as the host key once every server confirmed it, otherwise the
+// announcement is rolled back to the previous key
+func RotateKeys(ctx context.Context) error {
+	if !keyRotationMutex.TryLock() {
+		return errors.New("key rotation already in progress")
+	}
+	defer keyRotationMutex.Unlock()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	// drop confirmations left over from a previous rotation
+	for len(keyRotationAck) > 0 {
+		<-keyRotationAck
+	}
+	if err := lockHostConfig(func(host *config.Config) {
+		host.KeyRotation.PendingKey = key
+		host.KeyRotation.Acked = []string{}
+	}); err != nil {
+		return err
+	}
+	logger.Log(0, "rotating wireguard key, announcing public key", key.PublicKey().String())
+	announcePublicKey(key.PublicKey())
+	return awaitKeyConfirmation(ctx)
+}
+
+// requestKeyRotation - has the key rotation routine rotate the key, so the rotation ends with the daemon
+func requestKeyRotation() {
+	select {
+	case keyRotationRequest <- struct{}{}:
+	default:
+	}
+}
+
+// PresharedKeyRotation - offers new preshared keys to the peers without a key or with an expired one,
+// repeats the offers until the peers acknowledge them and re-applies the peers when their keys change
+func PresharedKeyRotation(ctx context.Context, wg *sync.WaitGroup) {
+	logger.Log(2, "starting preshared key rotation goroutine")
+	defer wg.Done()
+	ticker := time.NewTicker(pskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(0, "preshared key rotation routine closed")
+			return
+		case <-ticker.C:
+			offers, changed, err := wireguard.UpdatePresharedKeys()
+			if err != nil {
+				logger.Log(0, "failed to update preshared keys", err.Error())
+				continue
+			}
+			sendPresharedKeyOffers(offers)
+			if changed {
+				logger.Log(1, "preshared keys changed, updating peers")
+				if err := wireguard.SetPeers(); err != nil {
+					logger.Log(0, "failed to set peers", err.Error())
+				}
+			}
+		}
+	}
+}
+
+// checkKeyRotationAck - records a server update carrying the pending public key as the server's confirmation
+func checkKeyRotationAck(server string, publicKey wgtypes.Key) {
+	pending := config.Netclient().KeyRotation.PendingKey
+	if pending == (wgtypes.Key{}) || publicKey != pending.PublicKey() {
+		return
+	}
+	select {
+	case keyRotationAck <- server:
+	default:
+	}
+}
+
+// == private ==
+
+// keyRotationDue - checks if the key rotation interval has passed, the first check after enabling the policy starts the interval
+func keyRotationDue() bool {
+	rotation := &config.Netclient().KeyRotation
+	if rotation.Interval <= 0 {
+		return false
+	}
+	if rotation.LastRotation.IsZero() {
+		if err := lockHostConfig(func(host *config.Config) {
+			host.KeyRotation.LastRotation = time.Now()
+		}); err != nil {
+			logger.Log(0, "error saving netclient config", err.Error())
+		}
+		return false
+	}
+	return time.Since(rotation.LastRotation) >= time.Hour*24*time.Duration(rotation.Interval)
+}
+
+// recoverKeyRotation - completes an interrupted rotation confirmed by all servers, rolls it back otherwise
+func recoverKeyRotation() error {
+	if !keyRotationMutex.TryLock() {
+		return errors.New("key rotation already in progress")
+	}
+	defer keyRotationMutex.Unlock()
+	if len(getUnconfirmedServers()) == 0 {
+		logger.Log(0, "completing interrupted key rotation")
+		return completeKeyRotation()
+	}
+	logger.Log(0, "rolling back interrupted key rotation")
+	return rollbackKeyRotation()
+}
+
+// awaitKeyConfirmation - waits for all servers to confirm the pending key and keeps it
+func awaitKeyConfirmation(ctx context.Context) error {
+	unconfirmed := getUnconfirmedServers()
+	timeout := time.NewTimer(keyRotationAckTimeout)
+	defer timeout.Stop()
+	for len(unconfirmed) > 0 {
+		select {
+		case <-ctx.Done():
+			// the pending key is persisted and handled on the next start
+			return ctx.Err()
+		case server := <-keyRotationAck:
+			if _, ok := unconfirmed[server]; !ok {
+				continue
+			}
+			logger.Log(1, "server", server, "confirmed new wireguard key")
+			delete(unconfirmed, server)
+			if err := lockHostConfig(func(host *config.Config) {
+				host.KeyRotation.Acked = append(host.KeyRotation.Acked, server)
+			}); err != nil {
+				logger.Log(0, "error saving netclient config", err.Error())
+			}
+		case <-timeout.C:
+			servers := []string{}
+			for server := range unconfirmed {
+				servers = append(servers, server)
+			}
+			if err := rollbackKeyRotation(); err != nil {
+				logger.Log(0, "failed to roll back key rotation", err.Error())
+			}
+			return fmt.Errorf("new key not confirmed by %v", servers)
+		}
+	}
+	return completeKeyRotation()
+}
+
+// completeKeyRotation - makes the confirmed pending key the host key, the interfaces are switched to it
+// unless they already use it
+func completeKeyRotation() error {
+	host := config.Netclient()
+	// persist first so a crash before the device is updated still comes up with the new key
+	if err := lockHostConfig(func(host *config.Config) {
+		host.PrivateKey = host.KeyRotation.PendingKey
+		host.PublicKey = host.PrivateKey.PublicKey()
+		host.KeyRotation.PendingKey = wgtypes.Key{}
+		host.KeyRotation.Acked = nil
+		host.KeyRotation.LastRotation = time.Now()
+	}); err != nil {
+		return err
+	}
+	if err := wireguard.UpdatePrivateKey(config.GetNetclientPath()+"netmaker.conf", host.PrivateKey.String()); err != nil {
+		logger.Log(0, "error updating wireguard key ", err.Error())
+	}
+	logger.Log(0, "switched to new wireguard key", host.PublicKey.String())
+	return wireguard.ApplyPrivateKey(host.PrivateKey)
+}
+
+// rollbackKeyRotation - discards the pending key and re-announces the host key to all servers, the interfaces
+// only switch to a key once it is confirmed
+func rollbackKeyRotation() error {
+	if err := lockHostConfig(func(host *config.Config) {
+		host.PublicKey = host.PrivateKey.PublicKey()
+		host.KeyRotation.PendingKey = wgtypes.Key{}
+		host.KeyRotation.Acked = nil
+	}); err != nil {
+		return err
+	}
+	announcePublicKey(config.Netclient().PublicKey)
+	return nil
+}
+
+// lockHostConfig - changes the host config under the netclient lock and saves it
+func lockHostConfig(update func(host *config.Config)) error {
+	lockfile := filepath.Join(os.TempDir(), "netclient-lock")
+	if err := config.Lock(lockfile); err != nil {
+		return err
+	}
+	defer config.Unlock(lockfile)
+	update(config.Netclient())
+	return writeHostConfig()
+}
+
+// announcePublicKey - publishes the host with the given public key to all servers
+func announcePublicKey(publicKey wgtypes.Key) {
+	host := config.Netclient().Host
+	host.PublicKey = publicKey
+	for _, server := range config.GetServers() {
+		if err := publishHost(server, models.UpdateHost, &host); err != nil {
+			logger.Log(0, "failed to announce public key to server", server, err.Error())
+		}
+	}
+}
+
+// getUnconfirmedServers - returns the servers that did not confirm the pending key yet
+func getUnconfirmedServers() map[string]struct{} {
+	unconfirmed := make(map[string]struct{})
+	for _, server := range config.GetServers() {
+		unconfirmed[server] = struct{}{}
+	}
+	for _, server := range config.Netclient().KeyRotation.Acked {
+		delete(unconfirmed, server)
+	}
+	return unconfirmed
+}
@@ -0,0 +1,76 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestCheckKeyRotationAck(t *testing.T) {
+	is := is.New(t)
+	host := *config.Netclient()
+	defer config.UpdateNetclient(host)
+	pending, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	other, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	acked := func() []string {
+		servers := []string{}
+		for len(keyRotationAck) > 0 {
+			servers = append(servers, <-keyRotationAck)
+		}
+		return servers
+	}
+	t.Run("no rotation", func(t *testing.T) {
+		checkKeyRotationAck("server", pending.PublicKey())
+		is.Equal(acked(), []string{})
+	})
+	config.Netclient().KeyRotation.PendingKey = pending
+	t.Run("other key", func(t *testing.T) {
+		checkKeyRotationAck("server", other.PublicKey())
+		is.Equal(acked(), []string{})
+	})
+	t.Run("pending key", func(t *testing.T) {
+		checkKeyRotationAck("server", pending.PublicKey())
+		checkKeyRotationAck("other", pending.PublicKey())
+		is.Equal(acked(), []string{"server", "other"})
+	})
+	t.Run("full channel", func(t *testing.T) {
+		for i := 0; i < cap(keyRotationAck)+1; i++ {
+			checkKeyRotationAck("server", pending.PublicKey())
+		}
+		is.Equal(len(acked()), cap(keyRotationAck))
+	})
+}
+
+func TestRollbackKeyRotation(t *testing.T) {
+	is := is.New(t)
+	host := *config.Netclient()
+	defer config.UpdateNetclient(host)
+	defer func(write func() error) { writeHostConfig = write }(writeHostConfig)
+	saved := 0
+	writeHostConfig = func() error {
+		saved++
+		return nil
+	}
+	key, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	pending, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	config.Netclient().PrivateKey = key
+	config.Netclient().PublicKey = pending.PublicKey()
+	config.Netclient().KeyRotation.PendingKey = pending
+	config.Netclient().KeyRotation.Acked = []string{"server"}
+	is.NoErr(rollbackKeyRotation())
+	is.Equal(saved, 1)
+	is.Equal(config.Netclient().PrivateKey, key)
+	is.Equal(config.Netclient().PublicKey, key.PublicKey())
+	is.Equal(config.Netclient().KeyRotation.PendingKey, wgtypes.Key{})
+	is.Equal(config.Netclient().KeyRotation.Acked, nil)
+	t.Run("no pending key after the rollback", func(t *testing.T) {
+		checkKeyRotationAck("server", pending.PublicKey())
+		is.Equal(len(keyRotationAck), 0)
+	})
+}
@@ -0,0 +1,85 @@
+package functions
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/nmproxy/router"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// SetKillSwitch - turns the kill switch on/off, the setting is persisted and applied by the restarted daemon;
+// the rules are only changed directly if the daemon can't be restarted
+func SetKillSwitch(status, allowLAN bool) error {
+	logger.Log(1, fmt.Sprint("changing kill switch status to ", status))
+	config.Netclient().KillSwitch = status
+	config.Netclient().KillSwitchLAN = status && allowLAN
+	if err := config.WriteNetclientConfig(); err != nil {
+		return err
+	}
+	if err := daemon.Restart(); err != nil {
+		logger.Log(0, "failed to restart daemon, applying kill switch directly: ", err.Error())
+		if err := setKillSwitchRules(status); err != nil {
+			return err
+		}
+	}
+	if status {
+		fmt.Println("kill switch is switched on")
+	} else {
+		fmt.Println("kill switch is switched off")
+	}
+	return nil
+}
+
+// KillSwitchStatus - prints the configured and the actual state of the kill switch
+func KillSwitchStatus() {
+	host := config.Netclient()
+	fmt.Println("kill switch enabled:", host.KillSwitch)
+	fmt.Println("kill switch active: ", router.IsKillSwitchActive())
+	fmt.Println("local LAN allowed:  ", host.KillSwitchLAN)
+	if host.InternetGateway.IP != nil {
+		fmt.Println("internet gateway:   ", host.InternetGateway.String())
+	} else {
+		fmt.Println("internet gateway:    none, all internet traffic is blocked while the kill switch is active")
+	}
+}
+
+// setKillSwitchRules - installs or removes the kill switch rules according to the status
+func setKillSwitchRules(status bool) error {
+	if status {
+		return applyKillSwitch()
+	}
+	return router.DisableKillSwitch()
+}
+
+// applyKillSwitch - installs the kill switch rules allowing the current peer endpoints and netmaker servers
+func applyKillSwitch() error {
+	cfg := router.KillSwitchCfg{
+		FwMark:       wireguard.GatewayFwMark,
+		Interfaces:   wireguard.GetInterfaceNames(),
+		AllowedAddrs: wireguard.GetGatewayBypassAddrs(),
+	}
+	if config.Netclient().KillSwitchLAN {
+		ifaces, err := getInterfaces()
+		if err != nil {
+			return err
+		}
+		netclientIfaces := make(map[string]struct{})
+		for _, name := range cfg.Interfaces {
+			netclientIfaces[name] = struct{}{}
+		}
+		for _, iface := range *ifaces {
+			if _, ok := netclientIfaces[iface.Name]; ok {
+				continue
+			}
+			cfg.LANRanges = append(cfg.LANRanges, net.IPNet{
+				IP:   iface.Address.IP.Mask(iface.Address.Mask),
+				Mask: iface.Address.Mask,
+			})
+		}
+	}
+	return router.EnableKillSwitch(cfg)
+}
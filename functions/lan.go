@@ -0,0 +1,27 @@
+package functions
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lan"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// LANDiscovery - announces the host on the local networks and connects to the peers found there directly
+func LANDiscovery(ctx context.Context, wg *sync.WaitGroup) {
+	logger.Log(2, "starting lan discovery goroutine")
+	defer wg.Done()
+	err := lan.Discover(ctx, config.Netclient().LANDiscovery.Port, func() {
+		if err := wireguard.SetPeers(); err != nil {
+			logger.Log(0, "failed to set lan endpoints of peers", err.Error())
+		}
+	})
+	if err != nil {
+		logger.Log(0, "lan discovery failed", err.Error())
+		return
+	}
+	logger.Log(0, "lan discovery routine closed")
+}
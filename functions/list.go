@@ -9,6 +9,7 @@ import (
 
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -20,6 +21,7 @@ type output struct {
 	Connected bool      `json:"connected"`
 	Ipv4Addr  string    `json:"ipv4_addr"`
 	Ipv6Addr  string    `json:"ipv6_addr"`
+	PathMTU   int       `json:"path_mtu,omitempty"`
 	Peers     []peerOut `json:"peers,omitempty"`
 }
 
@@ -27,6 +29,7 @@ type peerOut struct {
 	PublicKey  string   `json:"public_key"`
 	Endpoint   string   `json:"endpoint"`
 	AllowedIps []string `json:"allowed_ips"`
+	PathMTU    int      `json:"path_mtu,omitempty"`
 }
 
 // List - list network details for specified networks
@@ -35,6 +38,7 @@ func List(net string, long bool) {
 	listOutput := []output{}
 	found := false
 	nodes := config.GetNodes()
+	pathMTUs := wireguard.GetPathMTUs()
 	for network := range nodes {
 		if network == net || net == "" {
 			found = true
@@ -51,6 +55,12 @@ func List(net string, long bool) {
 			if node.Address6.IP != nil {
 				output.Ipv6Addr = node.Address6.String()
 			}
+			// the smallest path mtu of the network's peers
+			for _, peer := range config.GetNetworkPeerList(&node) {
+				if mtu := pathMTUs[peer.PublicKey.String()].MTU; mtu != 0 && (output.PathMTU == 0 || mtu < output.PathMTU) {
+					output.PathMTU = mtu
+				}
+			}
 			if long {
 				peers, err := GetNodePeers(node)
 				if err != nil {
@@ -65,6 +75,7 @@ func List(net string, long bool) {
 					p := peerOut{
 						PublicKey: peer.PublicKey.String(),
 						Endpoint:  peer.Endpoint.String(),
+						PathMTU:   pathMTUs[peer.PublicKey.String()].MTU,
 					}
 
 					for _, cidr := range peer.AllowedIPs {
@@ -11,10 +11,10 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
-	"github.com/gravitl/txeh"
 )
 
 // MQTimeout - time out for mqtt connections
@@ -44,6 +44,8 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 	newNode := config.Node{}
 	newNode.CommonNode = serverNode.CommonNode
+	newNode.Interface = node.Interface
+	newNode.ListenPort = node.ListenPort
 
 	// see if cache hit, if so skip
 	var currentMessage = read(newNode.Network, lastNodeUpdate)
@@ -70,14 +72,9 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 		logger.Log(0, newNode.ID.String(), "was removed from network", newNode.Network)
 		return
 	case models.NODE_UPDATE_KEY:
-		// == get the current key for node ==
-		oldPrivateKey := config.Netclient().PrivateKey
-		if err := UpdateKeys(&newNode, config.Netclient(), client); err != nil {
-			logger.Log(0, "err updating wireguard keys, reusing last key\n", err.Error())
-			config.Netclient().PrivateKey = oldPrivateKey
-		}
-		config.Netclient().PublicKey = config.Netclient().PrivateKey.PublicKey()
-		ifaceDelta = true
+		logger.Log(0, "received message to update wireguard keys for network ", newNode.Network)
+		// the rotation waits for the servers' confirmation, which arrives through this handler
+		requestKeyRotation()
 	case models.NODE_FORCE_UPDATE:
 		ifaceDelta = true
 	case models.NODE_NOOP:
@@ -89,13 +86,21 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 	if err := config.WriteNodeConfig(); err != nil {
 		logger.Log(0, newNode.Network, "error updating node configuration: ", err.Error())
 	}
-	nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
-	if err := nc.Configure(); err != nil {
-		logger.Log(0, "could not configure netmaker interface", err.Error())
-		return
+	if config.PerNetworkIfaces() {
+		if err := wireguard.SetupNetworkInterface(&newNode); err != nil {
+			logger.Log(0, "could not configure interface for network", newNode.Network, err.Error())
+			return
+		}
+	} else {
+		nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
+		if err := nc.Configure(); err != nil {
+			logger.Log(0, "could not configure netmaker interface", err.Error())
+			return
+		}
 	}
 
 	wireguard.SetPeers()
+	configureDNS()
 	if err := wireguard.UpdateWgInterface(&newNode, config.Netclient()); err != nil {
 
 		logger.Log(0, "error updating wireguard config "+err.Error())
@@ -115,6 +120,14 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 }
 
+// legacyProxyPeers - public keys of the peers a server lists in its peer update as sending unauthenticated proxy
+// messages, servers not sending the list have no legacy peers
+type legacyProxyPeers struct {
+	ProxyUpdate struct {
+		LegacyPeers []string `json:"legacy_peers"`
+	} `json:"proxy_update"`
+}
+
 // HostPeerUpdate - mq handler for host peer update peers/host/<HOSTID>/<SERVERNAME>
 func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 	var peerUpdate models.HostPeerUpdate
@@ -139,6 +152,7 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 		logger.Log(0, "error unmarshalling peer data")
 		return
 	}
+	checkKeyRotationAck(serverName, peerUpdate.Host.PublicKey)
 	if peerUpdate.ServerVersion != config.Version {
 		logger.Log(0, "server/client version mismatch server: ", peerUpdate.ServerVersion, " client: ", config.Version)
 		if versionLessThan(config.Version, peerUpdate.ServerVersion) {
@@ -161,9 +175,19 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 
 	config.UpdateHostPeers(serverName, peerUpdate.Peers)
+	config.UpdateHostPeerIDs(serverName, peerUpdate.HostPeerIDs)
 	config.WriteNetclientConfig()
+	applyPeerNames()
 
 	wireguard.SetPeers()
+	if err := wireguard.UpdateInternetGateways(); err != nil {
+		logger.Log(0, "error updating internet gateway", err.Error())
+	}
+	if config.Netclient().KillSwitch {
+		if err := applyKillSwitch(); err != nil {
+			logger.Log(0, "failed to refresh kill switch", err.Error())
+		}
+	}
 	if config.Netclient().ProxyEnabled {
 		time.Sleep(time.Second * 2) // sleep required to avoid race condition
 		peerUpdate.ProxyUpdate.Action = models.ProxyUpdate
@@ -171,6 +195,10 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 		peerUpdate.ProxyUpdate.Action = models.NoProxy
 	}
 	peerUpdate.ProxyUpdate.Server = serverName
+	var legacy legacyProxyPeers
+	if err := json.Unmarshal([]byte(data), &legacy); err == nil {
+		proxy_cfg.SetLegacyPeers(serverName, legacy.ProxyUpdate.LegacyPeers)
+	}
 	ProxyManagerChan <- &peerUpdate
 }
 
@@ -193,7 +221,12 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 		logger.Log(0, "error unmarshalling host update data")
 		return
 	}
+	if hostUpdate.Action == hostSignalAction {
+		handleHostSignal(serverName, data)
+		return
+	}
 	logger.Log(3, fmt.Sprintf("---> received host update [ action: %v ] for host from %s ", hostUpdate.Action, serverName))
+	checkKeyRotationAck(serverName, hostUpdate.Host.PublicKey)
 	var resetInterface, restartDaemon bool
 	switch hostUpdate.Action {
 	case models.JoinHostToNetwork:
@@ -244,15 +277,19 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 	if resetInterface {
-		nc := wireguard.GetInterface()
-		nc.Close()
-		nc = wireguard.NewNCIface(config.Netclient(), config.GetNodes())
+		wireguard.CloseInterfaces()
+		if config.PerNetworkIfaces() {
+			setupInterfaces()
+			return
+		}
+		nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
 		nc.Create()
 		if err := nc.Configure(); err != nil {
 			logger.Log(0, "could not configure netmaker interface", err.Error())
 			return
 		}
 		wireguard.SetPeers()
+		configureDNS()
 	}
 
 }
@@ -284,6 +321,10 @@ func updateHostConfig(host *models.Host) (resetInterface, restart bool) {
 	if host.MTU != 0 && hostCfg.MTU != host.MTU {
 		resetInterface = true
 	}
+	if host.ProxyEnabled && config.PerNetworkIfaces() {
+		logger.Log(0, "proxy is not supported with an interface per network - ignoring proxy setting of server")
+		host.ProxyEnabled = false
+	}
 	// store password before updating
 	host.HostPass = hostCfg.HostPass
 	hostCfg.Host = *host
@@ -326,58 +367,35 @@ func dnsUpdate(client mqtt.Client, msg mqtt.Message) {
 	if config.Netclient().Debug {
 		log.Println("dnsUpdate received", dns)
 	}
-	var currentMessage = read("dns", lastDNSUpdate)
+	var currentMessage = read(serverName, lastDNSUpdate)
 	if currentMessage == string(data) {
 		logger.Log(3, "cache hit on dns update ... skipping")
 		return
 	}
-	insert("dns", lastDNSUpdate, string(data))
+	insert(serverName, lastDNSUpdate, string(data))
 	logger.Log(3, "received dns update for", dns.Name)
-	applyDNSUpdate(dns)
-}
-
-func applyDNSUpdate(dns models.DNSUpdate) {
-	if config.Netclient().Debug {
-		log.Println(dns)
-	}
-	hosts, err := txeh.NewHostsDefault()
-	if err != nil {
-		logger.Log(0, "failed to read hosts file", err.Error())
-		return
-	}
-	switch dns.Action {
-	case models.DNSInsert:
-		hosts.AddHost(dns.Address, dns.Name, etcHostsComment)
-	case models.DNSDeleteByName:
-		hosts.RemoveHost(dns.Name, etcHostsComment)
-	case models.DNSDeleteByIP:
-		hosts.RemoveAddress(dns.Address, etcHostsComment)
-	case models.DNSReplaceName:
-		ok, ip, _ := hosts.HostAddressLookup(dns.Name, etcHostsComment)
-		if !ok {
-			logger.Log(2, "failed to find dns address for host", dns.Name)
-			return
-		}
-		dns.Address = ip
-		hosts.RemoveHost(dns.Name, etcHostsComment)
-		hosts.AddHost(dns.Address, dns.NewName, etcHostsComment)
-	case models.DNSReplaceIP:
-		hosts.RemoveAddress(dns.Address, etcHostsComment)
-		hosts.AddHost(dns.NewAddress, dns.Name, etcHostsComment)
-	}
-	if err := hosts.Save(); err != nil {
-		logger.Log(0, "error saving hosts file", err.Error())
-		return
+	if err := getDNSBackend().update(serverName, dns); err != nil {
+		logger.Log(0, "failed to apply dns update", err.Error())
 	}
+	// the entries differ from the last full set now, the next one must be applied even if unchanged
+	insert(serverName, lastALLDNSUpdate, "")
 }
 
 // dnsAll- mq handler for host update dnsall/<HOSTID>/server
 func dnsAll(client mqtt.Client, msg mqtt.Message) {
+	if applyAllDNS(msg) {
+		applyPeerNames()
+	}
+}
+
+// applyAllDNS - applies the full set of dns entries of a server under the netclient lock, returns false if the
+// message was not applied
+func applyAllDNS(msg mqtt.Message) bool {
 	temp := os.TempDir()
 	lockfile := temp + "/netclient-lock"
 	if err := config.Lock(lockfile); err != nil {
 		logger.Log(0, "could not create lock file", err.Error())
-		return
+		return false
 	}
 	defer config.Unlock(lockfile)
 	var dns []models.DNSUpdate
@@ -385,11 +403,11 @@ func dnsAll(client mqtt.Client, msg mqtt.Message) {
 	server := config.GetServer(serverName)
 	if server == nil {
 		logger.Log(0, "server ", serverName, " not found in config")
-		return
+		return false
 	}
 	data, err := decryptMsg(serverName, msg.Payload())
 	if err != nil {
-		return
+		return false
 	}
 	if err := json.Unmarshal([]byte(data), &dns); err != nil {
 		logger.Log(0, "error unmarshalling dns update")
@@ -397,35 +415,18 @@ func dnsAll(client mqtt.Client, msg mqtt.Message) {
 	if config.Netclient().Debug {
 		log.Println("all dns", dns)
 	}
-	var currentMessage = read("dnsall", lastALLDNSUpdate)
+	var currentMessage = read(serverName, lastALLDNSUpdate)
 	logger.Log(3, "received initial dns")
 	if currentMessage == string(data) {
 		logger.Log(3, "cache hit on all dns ... skipping")
 		if config.Netclient().Debug {
 			log.Println("dns cache", currentMessage, string(data))
 		}
-		return
+		return false
 	}
-	insert("dnsall", lastALLDNSUpdate, string(data))
-	applyAllDNS(dns)
-}
-
-func applyAllDNS(dns []models.DNSUpdate) {
-	hosts, err := txeh.NewHostsDefault()
-	if err != nil {
-		logger.Log(0, "failed to read hosts file", err.Error())
-		return
-	}
-	for _, entry := range dns {
-		if entry.Action != models.DNSInsert {
-			logger.Log(0, "invalid dns actions", entry.Action.String())
-			continue
-		}
-		hosts.AddHost(entry.Address, entry.Name, etcHostsComment)
-	}
-
-	if err := hosts.Save(); err != nil {
-		logger.Log(0, "error saving hosts file", err.Error())
-		return
+	insert(serverName, lastALLDNSUpdate, string(data))
+	if err := getDNSBackend().applyAll(serverName, dns); err != nil {
+		logger.Log(0, "failed to apply dns entries", err.Error())
 	}
+	return true
 }
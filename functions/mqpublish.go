@@ -16,12 +16,23 @@ import (
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/ncutils"
 	proxyCfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/latency"
+	proxy "github.com/gravitl/netclient/nmproxy/models"
+	proxyserver "github.com/gravitl/netclient/nmproxy/server"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/logic/metrics"
 	"github.com/gravitl/netmaker/models"
 )
 
 var metricsCache = new(sync.Map)
+var advertisedPorts = make(map[string]int) // listen ports of the network interfaces last published, by network
+var advertisedPortsMutex = sync.Mutex{}    // used to mutex access to advertisedPorts
+
+// nodeMetrics - metrics of a node with the state of the proxy to the peers, by node id of the peer
+type nodeMetrics struct {
+	*models.Metrics
+	Proxy map[string]proxy.PeerProxyMetric `json:"proxy,omitempty"`
+}
 
 const (
 	// ACK - acknowledgement signal for MQ
@@ -73,7 +84,7 @@ func checkin() {
 	for network, node := range config.GetNodes() {
 		server := config.GetServer(node.Server)
 		if node.Connected {
-			if !config.Netclient().IsStatic {
+			if !config.Netclient().IsStatic && advertisedRelay() == nil {
 				extIP, err := ncutils.GetPublicIP(server.API)
 				if err != nil {
 					logger.Log(1, "error encountered checking public ip addresses: ", err.Error())
@@ -142,16 +153,20 @@ func PublishGlobalHostUpdate(hostAction models.HostMqAction) error {
 
 // PublishHostUpdate - publishes host updates to server
 func PublishHostUpdate(server string, hostAction models.HostMqAction) error {
-	hostCfg := config.Netclient()
+	return publishHost(server, hostAction, &config.Netclient().Host)
+}
+
+// publishHost - publishes the given host to the server
+func publishHost(server string, hostAction models.HostMqAction, host *models.Host) error {
 	hostUpdate := models.HostUpdate{
 		Action: hostAction,
-		Host:   hostCfg.Host,
+		Host:   *host,
 	}
 	data, err := json.Marshal(hostUpdate)
 	if err != nil {
 		return err
 	}
-	if err = publish(server, fmt.Sprintf("host/serverupdate/%s", hostCfg.ID.String()), data, 1); err != nil {
+	if err = publish(server, fmt.Sprintf("host/serverupdate/%s", host.ID.String()), data, 1); err != nil {
 		return err
 	}
 	return nil
@@ -220,14 +235,15 @@ func publishMetrics(node *config.Node) {
 	}
 	nodeGET := response
 
-	metrics, err := metrics.Collect(ncutils.GetInterfaceName(), node.Server, nodeGET.Node.Network, nodeGET.PeerIDs)
+	metrics, err := metrics.Collect(node.InterfaceName(), node.Server, nodeGET.Node.Network, nodeGET.PeerIDs)
 	if err != nil {
 		logger.Log(0, "failed metric collection for node", config.Netclient().Name, err.Error())
 	}
 	metrics.Network = node.Network
 	metrics.NodeName = config.Netclient().Name
 	metrics.NodeID = node.ID.String()
-	data, err := json.Marshal(metrics)
+	proxyMetrics := collectProxyMetrics(nodeGET.PeerIDs)
+	data, err := json.Marshal(nodeMetrics{Metrics: metrics, Proxy: proxyMetrics})
 	if err != nil {
 		logger.Log(0, "something went wrong when marshalling metrics data for node", config.Netclient().Name, err.Error())
 	}
@@ -251,7 +267,7 @@ func publishMetrics(node *config.Node) {
 					currentMetric.TotalTime += oldMetrics.Connectivity[k].TotalTime
 					metrics.Connectivity[k] = currentMetric
 				}
-				newData, err := json.Marshal(metrics)
+				newData, err := json.Marshal(nodeMetrics{Metrics: metrics, Proxy: proxyMetrics})
 				if err == nil {
 					metricsCache.Store(node.ID, newData)
 				}
@@ -263,6 +279,28 @@ func publishMetrics(node *config.Node) {
 	}
 }
 
+// collectProxyMetrics - active paths of the proxy of the daemon and latency of the peers, by node id of the peer
+func collectProxyMetrics(peerIDs models.PeerMap) map[string]proxy.PeerProxyMetric {
+	var paths map[string]proxy.PeerPath
+	if proxyCfg.GetCfg().IsProxyRunning() {
+		paths = proxyserver.GetActivePaths()
+	}
+	proxyMetrics := make(map[string]proxy.PeerProxyMetric)
+	for peerKey, id := range peerIDs {
+		var metric proxy.PeerProxyMetric
+		if path, found := paths[peerKey]; found {
+			metric.Path = &path
+		}
+		if l, found := latency.Get(peerKey); found {
+			metric.Latency = &l
+		}
+		if metric.Path != nil || metric.Latency != nil {
+			proxyMetrics[id.ID] = metric
+		}
+	}
+	return proxyMetrics
+}
+
 func publish(serverName, dest string, msg []byte, qos byte) error {
 	// setup the keys
 	server := config.GetServer(serverName)
@@ -297,6 +335,14 @@ func publish(serverName, dest string, msg []byte, qos byte) error {
 	return nil
 }
 
+// advertisedRelay - returns the turn relayed address if it is advertised to the peers as the endpoint of the proxy
+func advertisedRelay() *net.UDPAddr {
+	if !config.Netclient().ProxyEnabled || !config.Netclient().Proxy.Turn.Advertise {
+		return nil
+	}
+	return proxyCfg.GetCfg().GetHostInfo().RelayedAddr
+}
+
 // UpdateHostSettings - checks local host settings, if different, mod config and publish
 func UpdateHostSettings() error {
 	var err error
@@ -313,14 +359,27 @@ func UpdateHostSettings() error {
 		if proxypublicport == 0 {
 			proxypublicport = models.NmProxyPort
 		}
+		if relay := advertisedRelay(); relay != nil {
+			proxypublicport = relay.Port
+			if !relay.IP.Equal(config.Netclient().EndpointIP) {
+				logger.Log(1, "advertising turn relay", relay.String(), "as endpoint")
+				config.Netclient().EndpointIP = relay.IP
+				publishMsg = true
+			}
+		}
 	}
-	localPort, err := GetLocalListenPort(ifacename)
-	if err != nil {
-		logger.Log(1, "error encountered checking local listen port: ", ifacename, err.Error())
-	} else if config.Netclient().ListenPort != localPort && localPort != 0 {
-		logger.Log(1, "local port has changed from ", strconv.Itoa(config.Netclient().ListenPort), " to ", strconv.Itoa(localPort))
-		config.Netclient().ListenPort = localPort
-		publishMsg = true
+	// with an interface per network the listen ports are assigned per network and the host port is not bound
+	if !config.PerNetworkIfaces() {
+		localPort, err := GetLocalListenPort(ifacename)
+		if err != nil {
+			logger.Log(1, "error encountered checking local listen port: ", ifacename, err.Error())
+		} else if config.Netclient().ListenPort != localPort && localPort != 0 {
+			logger.Log(1, "local port has changed from ", strconv.Itoa(config.Netclient().ListenPort), " to ", strconv.Itoa(localPort))
+			config.Netclient().ListenPort = localPort
+			publishMsg = true
+		}
+	} else {
+		advertiseNetworkListenPorts()
 	}
 	if config.Netclient().ProxyEnabled {
 
@@ -335,9 +394,9 @@ func UpdateHostSettings() error {
 			publishMsg = true
 		}
 	}
-	if proxyCfg.GetCfg().IsBehindNAT() && !config.Netclient().ProxyEnabled &&
-		!proxyCfg.NatAutoSwitchDone() {
-		logger.Log(0, "Host is behind NAT, enabling proxy...")
+	if proxyCfg.GetCfg().NeedsProxy() && !config.Netclient().ProxyEnabled &&
+		!config.PerNetworkIfaces() && !proxyCfg.NatAutoSwitchDone() {
+		logger.Log(0, "Host is behind", proxyCfg.GetCfg().GetHostInfo().NAT.Type, "NAT, enabling proxy...")
 		proxyCfg.SetNatAutoSwitch()
 		config.Netclient().ProxyEnabled = true
 		publishMsg = true
@@ -355,6 +414,41 @@ func UpdateHostSettings() error {
 	return err
 }
 
+// advertiseNetworkListenPorts - publishes a node update for each network whose interface listen port changed or
+// was not published since the daemon started, the port is sent with the node for the peers of the network
+func advertiseNetworkListenPorts() {
+	advertisedPortsMutex.Lock()
+	defer advertisedPortsMutex.Unlock()
+	changed := false
+	for _, node := range config.GetNodes() {
+		node := node
+		if !node.Connected || node.Interface == "" {
+			continue
+		}
+		if port, err := GetLocalListenPort(node.Interface); err != nil {
+			logger.Log(1, "error encountered checking local listen port: ", node.Interface, err.Error())
+		} else if port != 0 && port != node.ListenPort {
+			logger.Log(1, "listen port of", node.Interface, "has changed from", strconv.Itoa(node.ListenPort), "to", strconv.Itoa(port))
+			node.ListenPort = port
+			config.UpdateNodeMap(node.Network, node)
+			changed = true
+		}
+		if advertisedPorts[node.Network] == node.ListenPort {
+			continue
+		}
+		if err := PublishNodeUpdate(&node); err != nil {
+			logger.Log(0, "could not publish listen port of network", node.Network, err.Error())
+			continue
+		}
+		advertisedPorts[node.Network] = node.ListenPort
+	}
+	if changed {
+		if err := config.WriteNodeConfig(); err != nil {
+			logger.Log(0, "error saving node map", err.Error())
+		}
+	}
+}
+
 // publishes a message to server to update peers on this peer's behalf
 func publishSignal(node *config.Node, signal byte) error {
 	if err := publish(node.Server, fmt.Sprintf("signal/%s", node.ID), []byte{signal}, 1); err != nil {
@@ -0,0 +1,153 @@
+package functions
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/nmproxy"
+	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+// networkChangeDebounce - quiet period after the last change event before the network settings are refreshed
+const networkChangeDebounce = time.Second * 2
+
+// NetworkWatcher - refreshes the endpoint, interfaces and ports as soon as the host's links, addresses or routes change,
+// the checkin ticker remains as a safety net and is the only detection where change events are not supported
+func NetworkWatcher(ctx context.Context, wg *sync.WaitGroup) {
+	logger.Log(2, "starting network watcher goroutine")
+	defer wg.Done()
+	events, err := watchNetworkChanges(ctx)
+	if err != nil {
+		logger.Log(0, "network change events not available, relying on checkin", err.Error())
+		return
+	}
+	debounce := time.NewTimer(networkChangeDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(0, "network watcher routine closed")
+			return
+		case _, ok := <-events:
+			if !ok {
+				logger.Log(0, "network change subscription closed, relying on checkin")
+				return
+			}
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(networkChangeDebounce)
+		case <-debounce.C:
+			logger.Log(1, "network change detected, refreshing host settings")
+			refreshNetworkSettings()
+		}
+	}
+}
+
+// refreshNetworkSettings - updates the local interfaces, default interface and public endpoint of the host,
+// publishes them if changed and checks the listen ports
+func refreshNetworkSettings() {
+	host := config.Netclient()
+	publishMsg := false
+	ip, err := getInterfaces()
+	if err != nil {
+		logger.Log(0, "failed to retrieve local interfaces", err.Error())
+	} else if ip != nil && !reflect.DeepEqual(host.Interfaces, *ip) {
+		host.Interfaces = *ip
+		publishMsg = true
+	}
+	defaultInterface, err := getDefaultInterface()
+	if err != nil {
+		logger.Log(1, "default gateway not found", err.Error())
+	} else if host.DefaultInterface != defaultInterface {
+		logger.Log(1, "default interface has changed from", host.DefaultInterface, "to", defaultInterface)
+		host.DefaultInterface = defaultInterface
+		publishMsg = true
+	}
+	if !host.IsStatic && advertisedRelay() == nil {
+		if endpoint := getPublicEndpoint(); endpoint != nil && !endpoint.Equal(host.EndpointIP) {
+			logger.Log(1, "endpoint has changed from", host.EndpointIP.String(), "to", endpoint.String())
+			host.EndpointIP = endpoint
+			publishMsg = true
+		}
+	}
+	if publishMsg {
+		if err := config.WriteNetclientConfig(); err != nil {
+			logger.Log(0, "error saving netclient config", err.Error())
+		}
+		if err := PublishGlobalHostUpdate(models.UpdateHost); err != nil {
+			logger.Log(0, "could not publish network change", err.Error())
+		}
+	}
+	if host.ProxyEnabled && proxy_cfg.GetCfg().IsProxyRunning() {
+		// the proxy server is bound to the private address found by stun at start, which is ipv6 on ipv6 only hosts
+		defaultRouteAddr := getDefaultRouteAddr
+		privIP := proxy_cfg.GetCfg().GetHostInfo().PrivIp
+		if privIP.To4() == nil {
+			defaultRouteAddr = getDefaultRouteAddr6
+		}
+		if privIP != nil && !privIP.Equal(defaultRouteAddr()) {
+			logger.Log(0, "local address has changed from", privIP.String(), "- re-running stun and rebinding the proxy")
+			rebindProxy()
+		}
+	}
+	_ = UpdateHostSettings()
+}
+
+// rebindProxy - moves the proxy to the new local address using the stun server the proxy was started with
+func rebindProxy() {
+	servers := config.GetServers()
+	if len(servers) == 0 {
+		return
+	}
+	server := config.GetServer(servers[0])
+	if err := nmproxy.Rebind(server.StunHost, server.StunPort); err != nil {
+		logger.Log(0, "failed to rebind proxy", err.Error())
+	}
+}
+
+// getPublicEndpoint - returns the public ip as seen by the first server with a connected node
+func getPublicEndpoint() net.IP {
+	for _, node := range config.GetNodes() {
+		if !node.Connected {
+			continue
+		}
+		extIP, err := ncutils.GetPublicIP(config.GetServer(node.Server).API)
+		if err != nil {
+			logger.Log(1, "error encountered checking public ip addresses: ", err.Error())
+			continue
+		}
+		return net.ParseIP(extIP)
+	}
+	return nil
+}
+
+// isNetclientIface - checks if a link index belongs to one of the netclient wireguard interfaces
+func isNetclientIface(index int) bool {
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return false
+	}
+	return isNetclientIfaceName(iface.Name)
+}
+
+func isNetclientIfaceName(name string) bool {
+	for _, ifaceName := range wireguard.GetInterfaceNames() {
+		if ifaceName == name {
+			return true
+		}
+	}
+	return false
+}
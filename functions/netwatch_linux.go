@@ -0,0 +1,61 @@
+package functions
+
+import (
+	"context"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// watchNetworkChanges - subscribes to netlink link, address and route changes, changes of the netclient
+// interfaces and of routes outside the main table (internet gateway, kill switch) are ignored
+func watchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	links := make(chan netlink.LinkUpdate, 16)
+	addrs := make(chan netlink.AddrUpdate, 16)
+	routes := make(chan netlink.RouteUpdate, 16)
+	if err := netlink.LinkSubscribe(links, ctx.Done()); err != nil {
+		return nil, err
+	}
+	if err := netlink.AddrSubscribe(addrs, ctx.Done()); err != nil {
+		return nil, err
+	}
+	if err := netlink.RouteSubscribe(routes, ctx.Done()); err != nil {
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-links:
+				if !ok {
+					return
+				}
+				if isNetclientIfaceName(update.Attrs().Name) {
+					continue
+				}
+			case update, ok := <-addrs:
+				if !ok {
+					return
+				}
+				if isNetclientIface(update.LinkIndex) {
+					continue
+				}
+			case update, ok := <-routes:
+				if !ok {
+					return
+				}
+				if update.Table != unix.RT_TABLE_MAIN || isNetclientIface(update.LinkIndex) {
+					continue
+				}
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package functions
+
+import (
+	"context"
+	"errors"
+)
+
+// watchNetworkChanges - change events are only supported through netlink
+func watchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,78 @@
+package functions
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/stun"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+)
+
+const (
+	// defaultPMTUInterval - minutes between path mtu probe rounds if not configured
+	defaultPMTUInterval = 30
+	// pmtuStartDelay - gives the interfaces time to come up and complete their handshakes
+	pmtuStartDelay = time.Second * 30
+	// defaultRouteCheckInterval - how often the default interface is checked for changes
+	defaultRouteCheckInterval = time.Minute
+)
+
+// PathMTUDiscovery - probes the path mtu to the peers periodically and whenever the default interface changes
+func PathMTUDiscovery(ctx context.Context, wg *sync.WaitGroup) {
+	logger.Log(2, "starting path mtu discovery goroutine")
+	defer wg.Done()
+	interval := time.Minute * time.Duration(config.Netclient().MTUDiscovery.Interval)
+	if interval <= 0 {
+		interval = time.Minute * defaultPMTUInterval
+	}
+	timer := time.NewTimer(pmtuStartDelay)
+	defer timer.Stop()
+	var lastProbe time.Time
+	defaultAddr := getDefaultRouteAddr()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(0, "path mtu discovery routine closed")
+			return
+		case <-timer.C:
+			reset := false
+			if addr := getDefaultRouteAddr(); !addr.Equal(defaultAddr) {
+				logger.Log(0, "default interface changed, probing path mtu")
+				defaultAddr = addr
+				reset = true
+			}
+			if reset || time.Since(lastProbe) >= interval {
+				if err := wireguard.ProbePathMTU(reset); err != nil {
+					logger.Log(0, "path mtu discovery failed", err.Error())
+				}
+				lastProbe = time.Now()
+			}
+			timer.Reset(defaultRouteCheckInterval)
+		}
+	}
+}
+
+// getDefaultRouteAddr - returns the local address of the default route, nil if there is none;
+// connecting a udp socket selects the route without sending any packet
+func getDefaultRouteAddr() net.IP {
+	conn, err := net.Dial("udp", "1.1.1.1:53")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// getDefaultRouteAddr6 - returns the local address of the ipv6 default route, nil if there is none
+func getDefaultRouteAddr6() net.IP {
+	conn, err := net.Dial("udp6", net.JoinHostPort(stun.GlobalUnicast6, "53"))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -1,10 +1,21 @@
 package functions
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/nmproxy"
+	"github.com/gravitl/netclient/nmproxy/latency"
+	proxy "github.com/gravitl/netclient/nmproxy/models"
+	proxyserver "github.com/gravitl/netclient/nmproxy/server"
+	"github.com/gravitl/netclient/nmproxy/stun"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 )
@@ -12,6 +23,9 @@ import (
 // ChangeProxyStatus - updates proxy status on host and publishes global host update
 func ChangeProxyStatus(status bool) error {
 	logger.Log(1, fmt.Sprint("changing proxy status to ", status))
+	if status && config.PerNetworkIfaces() {
+		return errors.New("proxy is not supported with an interface per network")
+	}
 	servers := config.GetServers()
 	for _, server := range servers {
 		serverCfg := config.GetServer(server)
@@ -40,3 +54,125 @@ func ChangeProxyStatus(status bool) error {
 	}
 	return nil
 }
+
+// proxyStatus - proxy settings of the host and the nat behavior found by the proxy
+type proxyStatus struct {
+	ProxyEnabled bool                         `json:"proxy_enabled"`
+	NAT          proxy.NATInfo                `json:"nat"`
+	Paths        map[string][]proxy.PeerPath  `json:"paths,omitempty"`
+	Latency      map[string]proxy.PeerLatency `json:"latency,omitempty"`
+}
+
+// ProxyStatus - prints whether the proxy is enabled, the nat behavior discovered by the daemon, the paths to the peers
+// and the latency of the peers
+func ProxyStatus() error {
+	nat, err := stun.GetNATInfo()
+	if err != nil {
+		return err
+	}
+	paths, err := proxyserver.GetPeerPaths()
+	if err != nil {
+		return err
+	}
+	latencies, err := latency.GetPeerLatencies()
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(proxyStatus{
+		ProxyEnabled: config.Netclient().ProxyEnabled,
+		NAT:          nat,
+		Paths:        paths,
+		Latency:      latencies,
+	}, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// output formats of ProxyInspect
+const (
+	// InspectTable - tables for reading
+	InspectTable = "table"
+	// InspectJSON - the snapshot as json
+	InspectJSON = "json"
+)
+
+// ProxyInspect - prints a snapshot of the proxy of the daemon: the peers, the peer hashes, ext clients, relayed
+// routes, host info and nat status
+func ProxyInspect(format string) error {
+	if format != InspectTable && format != InspectJSON {
+		return fmt.Errorf("invalid format %q, must be %s or %s", format, InspectTable, InspectJSON)
+	}
+	s, err := nmproxy.Inspect()
+	if err != nil {
+		return err
+	}
+	if format == InspectJSON {
+		out, err := json.MarshalIndent(s, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	return printInspectTable(os.Stdout, s)
+}
+
+// printInspectTable - prints a snapshot of the proxy as tables
+func printInspectTable(out io.Writer, s proxy.Snapshot) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SNAPSHOT\t%s\n", s.Time.Format(time.RFC3339))
+	fmt.Fprintf(w, "RUNNING\t%t\n", s.Running)
+	fmt.Fprintf(w, "PUBLIC\t%s:%d\n", s.HostInfo.PublicIp, s.HostInfo.PubPort)
+	fmt.Fprintf(w, "PRIVATE\t%s:%d\n", s.HostInfo.PrivIp, s.HostInfo.PrivPort)
+	if s.HostInfo.PrivIp6 != nil {
+		fmt.Fprintf(w, "PRIVATE6\t%s\n", s.HostInfo.PrivIp6)
+	}
+	if s.HostInfo.RelayedAddr != nil {
+		fmt.Fprintf(w, "TURN\t%s\n", s.HostInfo.RelayedAddr)
+	}
+	fmt.Fprintf(w, "NAT\t%s (mapping %s, filtering %s), behind nat: %t\n", s.HostInfo.NAT.Type,
+		s.HostInfo.NAT.Mapping, s.HostInfo.NAT.Filtering, s.BehindNAT)
+	w.Flush()
+	printPeerTable(out, "PROXY PEERS", s.Peers)
+	printPeerTable(out, "NO PROXY PEERS", s.NoProxyPeers)
+	printRemotePeerTable(out, "PEER HASHES", s.PeerHashes)
+	printRemotePeerTable(out, "EXT CLIENTS", s.ExtClients)
+	printRemotePeerTable(out, "EXT CLIENTS WAITING", s.ExtClientsWaiting)
+	fmt.Fprintf(out, "\nRELAYED ROUTES\n")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELAYED NODE HASH\tPEER HASH\tPEER\tENDPOINT")
+	for _, r := range s.RelayedRoutes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.RelayedNodeHash, r.PeerHash, r.PeerKey, r.Endpoint)
+	}
+	return w.Flush()
+}
+
+// printPeerTable - prints the proxy connections of peers
+func printPeerTable(out io.Writer, title string, peers []proxy.PeerSnapshot) {
+	fmt.Fprintf(out, "\n%s\n", title)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tLOCAL\tREMOTE\tENDPOINT\tPROXY\tEXT CLIENT\tRELAYED\tSENT\tRECEIVED")
+	for _, p := range peers {
+		relayed := "-"
+		if p.IsRelayed {
+			relayed = p.RelayedEndpoint
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%s\t%d\t%d\n", p.Key, p.LocalAddr, p.RemoteEndpoint, p.PeerEndpoint,
+			p.ProxyStatus, p.IsExtClient, relayed, p.TrafficSent, p.TrafficReceived)
+	}
+	w.Flush()
+}
+
+// printRemotePeerTable - prints the peers the proxy passes received packets to
+func printRemotePeerTable(out io.Writer, title string, peers []proxy.RemotePeerSnapshot) {
+	fmt.Fprintf(out, "\n%s\n", title)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tHASH\tENDPOINT\tLOCAL\tEXT CLIENT")
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", p.Key, p.Hash, p.Endpoint, p.LocalAddr, p.IsExtClient)
+	}
+	w.Flush()
+}
@@ -0,0 +1,63 @@
+package functions
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	proxy "github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+)
+
+func TestPrintInspectTable(t *testing.T) {
+	is := is.New(t)
+	s := proxy.Snapshot{
+		Time:    time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Running: true,
+		HostInfo: proxy.HostInfo{
+			PublicIp: net.IPv4(203, 0, 113, 7),
+			PubPort:  51722,
+			PrivIp:   net.IPv4(192, 168, 1, 20),
+			PrivPort: 51722,
+			NAT:      proxy.NATInfo{Type: proxy.NATFullCone},
+		},
+		Peers: []proxy.PeerSnapshot{{
+			Key:             "peer-key",
+			LocalAddr:       "127.0.0.1:40000",
+			RemoteEndpoint:  "198.51.100.2:51722",
+			PeerEndpoint:    "198.51.100.2:51821",
+			ProxyStatus:     true,
+			IsRelayed:       true,
+			RelayedEndpoint: "198.51.100.9:51722",
+			TrafficSent:     10,
+			TrafficReceived: 20,
+		}},
+		PeerHashes:    []proxy.RemotePeerSnapshot{{Key: "peer-key", Hash: "peer-hash", Endpoint: "198.51.100.2:51821"}},
+		RelayedRoutes: []proxy.RelayedRouteSnapshot{{RelayedNodeHash: "node-hash", PeerHash: "peer-hash", PeerKey: "peer-key"}},
+	}
+	var out bytes.Buffer
+	is.NoErr(printInspectTable(&out, s))
+	lines := strings.Split(out.String(), "\n")
+	is.Equal(strings.Fields(lines[0]), []string{"SNAPSHOT", "2023-01-02T03:04:05Z"})
+	is.Equal(strings.Fields(lines[2]), []string{"PUBLIC", "203.0.113.7:51722"})
+	// tables follow in order: proxy peers, no proxy peers, peer hashes, ext clients, waiting ext clients, routes
+	var titles []string
+	for i, line := range lines {
+		if line == "" && i+1 < len(lines) && lines[i+1] != "" {
+			titles = append(titles, lines[i+1])
+		}
+	}
+	is.Equal(titles, []string{"PROXY PEERS", "NO PROXY PEERS", "PEER HASHES", "EXT CLIENTS", "EXT CLIENTS WAITING",
+		"RELAYED ROUTES"})
+	for i, line := range lines {
+		if line == "PROXY PEERS" {
+			is.Equal(strings.Fields(lines[i+2]), []string{"peer-key", "127.0.0.1:40000", "198.51.100.2:51722",
+				"198.51.100.2:51821", "true", "false", "198.51.100.9:51722", "10", "20"})
+		}
+		if line == "RELAYED ROUTES" {
+			is.Equal(strings.Fields(lines[i+2]), []string{"node-hash", "peer-hash", "peer-key"})
+		}
+	}
+}
@@ -40,6 +40,8 @@ func Pull(network string, iface bool) (*config.Node, error) {
 		return nil, err
 	}
 	newNode := config.ConvertNode(&nodeGet)
+	newNode.Interface = node.Interface
+	newNode.ListenPort = node.ListenPort
 	config.UpdateNodeMap(newNode.Network, *newNode)
 	if err = config.WriteNodeConfig(); err != nil {
 		return nil, err
@@ -47,7 +49,7 @@ func Pull(network string, iface bool) (*config.Node, error) {
 	//update wg config
 	config.UpdateHostPeers(node.Server, nodeGet.HostPeers)
 	internetGateway, err := wireguard.UpdateWgPeers(nodeGet.HostPeers)
-	if internetGateway != nil && err != nil {
+	if internetGateway != nil && err == nil {
 		config.Netclient().InternetGateway = *internetGateway
 	}
 	config.WriteNetclientConfig()
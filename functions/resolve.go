@@ -0,0 +1,169 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/txeh"
+)
+
+// resolveOut - a node of this host or of a peer as known from the local state
+type resolveOut struct {
+	Name      string   `json:"name,omitempty"`
+	Network   string   `json:"network,omitempty"`
+	Server    string   `json:"server"`
+	NodeID    string   `json:"node_id,omitempty"`
+	HostID    string   `json:"host_id,omitempty"`
+	PublicKey string   `json:"public_key"`
+	Addresses []string `json:"addresses"`
+	Self      bool     `json:"self,omitempty"`
+}
+
+// Resolve - maps an address, dns name, node id or wireguard public key to the nodes of this host and its peers,
+// using only the local config and hosts file
+func Resolve(query string) error {
+	query = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(query), "."))
+	if query == "" {
+		return fmt.Errorf("nothing to resolve")
+	}
+	matches := []resolveOut{}
+	for _, entry := range getResolveEntries() {
+		if entry.matches(query) {
+			matches = append(matches, entry)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%s not found in local state", query)
+	}
+	out, err := json.MarshalIndent(matches, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// resolveOut.matches - checks the query against the name, short name, node id, host id, public key and addresses,
+// an address only matches itself and not the other addresses of its range
+func (r *resolveOut) matches(query string) bool {
+	if r.Name != "" && (r.Name == query || strings.SplitN(r.Name, ".", 2)[0] == query) {
+		return true
+	}
+	if r.NodeID == query || r.HostID == query || strings.ToLower(r.PublicKey) == query {
+		return true
+	}
+	ip := net.ParseIP(query)
+	if ip == nil {
+		return false
+	}
+	for _, addr := range r.Addresses {
+		if addrIP, _, err := net.ParseCIDR(addr); err == nil {
+			if addrIP.Equal(ip) {
+				return true
+			}
+		} else if net.ParseIP(addr).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getResolveEntries - collects the nodes of this host, the peer nodes from the peer ids, peers without ids with
+// their /32 and /128 allowed ips and the names of the hosts file entries written by netclient
+func getResolveEntries() []resolveOut {
+	host := config.Netclient()
+	entries := []resolveOut{}
+	for _, node := range config.GetNodes() {
+		entry := resolveOut{
+			Name:      strings.ToLower(host.Name + "." + node.Network),
+			Network:   node.Network,
+			Server:    node.Server,
+			NodeID:    node.ID.String(),
+			HostID:    host.ID.String(),
+			PublicKey: host.PublicKey.String(),
+			Addresses: []string{},
+			Self:      true,
+		}
+		if node.Address.IP != nil {
+			entry.Addresses = append(entry.Addresses, node.Address.IP.String())
+		}
+		if node.Address6.IP != nil {
+			entry.Addresses = append(entry.Addresses, node.Address6.IP.String())
+		}
+		entries = append(entries, entry)
+	}
+	for _, server := range sortedKeys(host.HostPeers) {
+		for _, peer := range host.HostPeers[server] {
+			key := peer.PublicKey.String()
+			ids := host.HostPeerIDs[server][key]
+			if len(ids) == 0 {
+				entry := resolveOut{Server: server, PublicKey: key, Addresses: []string{}}
+				for _, allowedIP := range peer.AllowedIPs {
+					// ranges routed to the peer, i.e. egress ranges, are not addresses of the peer
+					if ones, bits := allowedIP.Mask.Size(); ones == bits {
+						entry.Addresses = append(entry.Addresses, allowedIP.String())
+					}
+				}
+				entries = append(entries, entry)
+				continue
+			}
+			for _, nodeID := range sortedKeys(ids) {
+				id := ids[nodeID]
+				entry := resolveOut{
+					Network:   id.Network,
+					Server:    server,
+					NodeID:    id.ID,
+					HostID:    id.HostID,
+					PublicKey: key,
+					Addresses: []string{},
+				}
+				if id.Name != "" {
+					entry.Name = strings.ToLower(id.Name + "." + id.Network)
+				}
+				if id.Address != "" {
+					entry.Addresses = append(entry.Addresses, id.Address)
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	addHostsFileNames(entries)
+	return entries
+}
+
+// addHostsFileNames - names the entries without a name after the netclient hosts file entries of their address
+func addHostsFileNames(entries []resolveOut) {
+	hosts, err := txeh.NewHostsDefault()
+	if err != nil {
+		return
+	}
+	names := make(map[string][]string)
+	for _, line := range *hosts.GetHostFileLines() {
+		if _, _, ok := parseHostsComment(line.Comment); ok || line.Comment == etcHostsPeerComment {
+			names[line.Address] = append(names[line.Address], line.Hostnames...)
+		}
+	}
+	for i := range entries {
+		if entries[i].Name != "" {
+			continue
+		}
+		for _, addr := range entries[i].Addresses {
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil {
+				ip = net.ParseIP(addr)
+			}
+			if ip == nil {
+				continue
+			}
+			if found := names[ip.String()]; len(found) > 0 {
+				sort.Strings(found)
+				entries[i].Name = found[0]
+				break
+			}
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/nmproxy/router"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
@@ -32,8 +33,11 @@ func Uninstall() ([]error, error) {
 			allfaults = append(allfaults, err)
 		}
 	}
-	if err := deleteAllDNS(); err != nil {
-		logger.Log(0, "failed to delete entries from /etc/hosts", err.Error())
+	if err := getDNSBackend().deleteAll(); err != nil {
+		logger.Log(0, "failed to remove dns", err.Error())
+	}
+	if err := router.DisableKillSwitch(); err != nil {
+		logger.Log(0, "failed to remove kill switch", err.Error())
 	}
 
 	if err = daemon.CleanUp(); err != nil {
@@ -56,11 +60,16 @@ func LeaveNetwork(network string, isDaemon bool) ([]error, error) {
 	if err := deleteLocalNetwork(&node); err != nil {
 		faults = append(faults, fmt.Errorf("error deleting wireguard interface %w", err))
 	}
-	if err := deleteNetworkDNS(network); err != nil {
+	if err := getDNSBackend().deleteNetwork(network); err != nil {
 		faults = append(faults, fmt.Errorf("error deleting dns entries %w", err))
 	}
 	// re-configure interface if daemon is calling leave
-	if isDaemon {
+	if isDaemon && config.PerNetworkIfaces() {
+		if err := wireguard.SyncNetworkInterfaces(); err != nil {
+			faults = append(faults, fmt.Errorf("failed to close interface during node removal - %v", err.Error()))
+		}
+		configureDNS()
+	} else if isDaemon {
 		nc := wireguard.GetInterface()
 		nc.Iface.Close()
 		nc = wireguard.NewNCIface(config.Netclient(), config.GetNodes())
@@ -71,6 +80,7 @@ func LeaveNetwork(network string, isDaemon bool) ([]error, error) {
 			if err = wireguard.SetPeers(); err != nil {
 				faults = append(faults, fmt.Errorf("issue setting peers after node removal - %v", err.Error()))
 			}
+			configureDNS()
 		}
 	} else { // was called from CLI so restart daemon
 		if err := daemon.Restart(); err != nil {
@@ -0,0 +1,385 @@
+// Package lan - discovers the peers on the local networks of the host so they are reached directly
+package lan
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/nmproxy/wg"
+	"github.com/gravitl/netmaker/logger"
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// DefaultPort - udp port of the announcements if not configured
+	DefaultPort = 51830
+	// announceInterval - interval of the announcements
+	announceInterval = time.Second * 15
+	// endpointTimeout - how long a lan address stays in use without a reply of the peer
+	endpointTimeout = announceInterval * 3
+	// endpointConfirmTimeout - time given to a wireguard handshake over a new lan address, an established session
+	// only renews its handshake after two minutes
+	endpointConfirmTimeout = time.Minute * 3
+	// endpointRetryInterval - how long a lan address without handshake is left unused before it is tried again
+	endpointRetryInterval = time.Minute * 10
+)
+
+// group - link-local scoped ipv4 group of the announcements, link-local ipv6 addresses can't serve as wireguard
+// endpoints so discovery is ipv4 only
+var group = &net.UDPAddr{IP: net.IPv4(239, 255, 0, 114)}
+
+// endpoint - lan address of a peer and the last reply of the peer; the address is only kept in use once a
+// wireguard handshake over it confirms it
+type endpoint struct {
+	addr      *net.UDPAddr
+	seen      time.Time
+	since     time.Time // when the peer was pointed to the address
+	confirmed bool
+	failed    time.Time // when the address was given up for the endpoint of the peer, zero if in use
+}
+
+var endpoints = make(map[string]endpoint) // lan addresses by peer key
+var endpointsMutex = sync.RWMutex{}       // used to mutex access to endpoints
+
+// GetEndpoint - lan address of a peer found by discovery, unless no handshake followed over it
+func GetEndpoint(peerKey string) (*net.UDPAddr, bool) {
+	endpointsMutex.RLock()
+	defer endpointsMutex.RUnlock()
+	e, found := endpoints[peerKey]
+	if !found || !e.failed.IsZero() {
+		return nil, false
+	}
+	return e.addr, true
+}
+
+// SetEndpoints - sets the endpoint of the peers found on the lan to their lan address
+func SetEndpoints(peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	for i := range peers {
+		if addr, found := GetEndpoint(peers[i].PublicKey.String()); found {
+			peers[i].Endpoint = addr
+		}
+	}
+	return peers
+}
+
+// Discover - multicasts announcements on the physical interfaces and answers the announcements of the peers; wireguard
+// keys can't sign, so a peer answers with a reply sealed with nacl box for the announcer, which proves the key and
+// the listen port of the peer and returns the nonce of the announcement; a peer goes back to its regular endpoint
+// when no wireguard handshake follows over its lan address; changed is called whenever a peer is found on or lost
+// from the lan, all lan addresses are dropped when the context is done
+func Discover(ctx context.Context, port int, changed func()) error {
+	if config.PerNetworkIfaces() {
+		return errors.New("lan discovery is not supported with an interface per network")
+	}
+	if port == 0 {
+		port = DefaultPort
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	d := &discovery{
+		conn:    conn,
+		pc:      ipv4.NewPacketConn(conn),
+		port:    port,
+		joined:  make(map[int]bool),
+		changed: changed,
+	}
+	if err := d.pc.SetMulticastTTL(1); err != nil {
+		logger.Log(1, "failed to set ttl of announcements", err.Error())
+	}
+	if err := d.pc.SetMulticastLoopback(false); err != nil {
+		logger.Log(1, "failed to disable loopback of announcements", err.Error())
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	defer d.clear()
+	go d.listen()
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		d.announce()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			d.expire()
+		}
+	}
+}
+
+// == private ==
+
+// discovery - state of the announcer and responder
+type discovery struct {
+	conn    *net.UDPConn
+	pc      *ipv4.PacketConn
+	port    int
+	joined  map[int]bool // interfaces the group is joined on, by index
+	changed func()
+	mutex   sync.Mutex // used to mutex access to nonces
+	nonces  [2][nonceSize]byte
+}
+
+// discovery.announce - sends an announcement on every physical interface, joining the group on new interfaces
+func (d *discovery) announce() {
+	a := announcement{Sender: config.Netclient().PublicKey}
+	if _, err := rand.Read(a.Nonce[:]); err != nil {
+		logger.Log(1, "failed to create announcement", err.Error())
+		return
+	}
+	// replies to the previous announcement are still accepted
+	d.mutex.Lock()
+	d.nonces[1] = d.nonces[0]
+	d.nonces[0] = a.Nonce
+	d.mutex.Unlock()
+	msg := encodeAnnouncement(&a)
+	for _, iface := range getInterfaces() {
+		iface := iface
+		if iface.Flags&net.FlagMulticast != 0 {
+			if !d.joined[iface.Index] {
+				if err := d.pc.JoinGroup(&iface, group); err != nil {
+					logger.Log(3, "failed to join discovery group on", iface.Name, err.Error())
+				} else {
+					d.joined[iface.Index] = true
+				}
+			}
+			if err := d.pc.SetMulticastInterface(&iface); err == nil {
+				if _, err := d.conn.WriteToUDP(msg, &net.UDPAddr{IP: group.IP, Port: d.port}); err == nil {
+					continue
+				}
+			}
+		}
+		for _, ipNet := range getNetworks(&iface) {
+			if _, err := d.conn.WriteToUDP(msg, &net.UDPAddr{IP: broadcastAddr(ipNet), Port: d.port}); err != nil {
+				logger.Log(3, "failed to broadcast announcement on", iface.Name, err.Error())
+			}
+		}
+	}
+}
+
+// discovery.listen - handles the announcements and replies of the peers until the connection is closed
+func (d *discovery) listen() {
+	buf := make([]byte, 512)
+	for {
+		n, source, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log(1, "failed to read discovery message", err.Error())
+			continue
+		}
+		if !onLink(source.IP) {
+			continue
+		}
+		switch messageType(buf[:n]) {
+		case messageAnnounce:
+			d.handleAnnouncement(buf[:n], source)
+		case messageReply:
+			d.handleReply(buf[:n], source)
+		}
+	}
+}
+
+// discovery.handleAnnouncement - answers the announcement of a peer with the listen port of the host
+func (d *discovery) handleAnnouncement(buf []byte, source *net.UDPAddr) {
+	a, err := decodeAnnouncement(buf)
+	if err != nil {
+		return
+	}
+	host := config.Netclient()
+	if a.Sender == host.PublicKey || !isPeer(a.Sender) {
+		return
+	}
+	msg, err := encodeReply(&reply{
+		Sender:     host.PublicKey,
+		Reciever:   a.Sender,
+		Nonce:      a.Nonce,
+		ListenPort: host.ListenPort,
+	}, host.PrivateKey)
+	if err != nil {
+		logger.Log(1, "failed to create discovery reply", err.Error())
+		return
+	}
+	if _, err := d.conn.WriteToUDP(msg, source); err != nil {
+		logger.Log(3, "failed to answer announcement of peer", a.Sender.String(), err.Error())
+	}
+}
+
+// discovery.handleReply - verifies the reply of a peer to an announcement of the host and points the peer to
+// the address the reply came from
+func (d *discovery) handleReply(buf []byte, source *net.UDPAddr) {
+	r, err := decodeReplyHeader(buf)
+	if err != nil {
+		return
+	}
+	host := config.Netclient()
+	if r.Reciever != host.PublicKey || !isPeer(r.Sender) {
+		return
+	}
+	if err := openReply(buf, r, host.PrivateKey); err != nil {
+		logger.Log(1, "dropping discovery reply of peer", r.Sender.String(), err.Error())
+		return
+	}
+	d.mutex.Lock()
+	fresh := r.Nonce == d.nonces[0] || r.Nonce == d.nonces[1]
+	d.mutex.Unlock()
+	if !fresh || r.ListenPort == 0 {
+		return
+	}
+	addr := &net.UDPAddr{IP: source.IP, Port: r.ListenPort}
+	endpointsMutex.Lock()
+	current, found := endpoints[r.Sender.String()]
+	if found && current.addr.String() == addr.String() {
+		current.seen = time.Now()
+		endpoints[r.Sender.String()] = current
+		endpointsMutex.Unlock()
+		return
+	}
+	endpoints[r.Sender.String()] = endpoint{addr: addr, seen: time.Now(), since: time.Now()}
+	endpointsMutex.Unlock()
+	logger.Log(0, "found peer", r.Sender.String(), "on the lan at", addr.String())
+	d.changed()
+}
+
+// discovery.expire - drops the lan addresses of the peers which stopped replying or left the networks of the host,
+// gives up the addresses no handshake followed over and tries them again after a while
+func (d *discovery) expire() {
+	peers := make(map[string]wgtypes.Peer)
+	if wgPeers, err := wg.GetPeers(ncutils.GetInterfaceName()); err == nil {
+		for _, peer := range wgPeers {
+			peers[peer.PublicKey.String()] = peer
+		}
+	}
+	expired := false
+	endpointsMutex.Lock()
+	for key, e := range endpoints {
+		peerKey, err := wgtypes.ParseKey(key)
+		if err != nil || time.Since(e.seen) >= endpointTimeout || !isPeer(peerKey) {
+			logger.Log(0, "lost peer", key, "on the lan at", e.addr.String())
+			delete(endpoints, key)
+			expired = true
+			continue
+		}
+		peer, found := peers[key]
+		switch {
+		case e.confirmed:
+		case !e.failed.IsZero():
+			if time.Since(e.failed) >= endpointRetryInterval {
+				logger.Log(1, "trying peer", key, "on the lan at", e.addr.String(), "again")
+				e.failed = time.Time{}
+				e.since = time.Now()
+				expired = true
+			}
+		case found && handshakeConfirms(&e, &peer):
+			logger.Log(1, "handshake with peer", key, "on the lan at", e.addr.String())
+			e.confirmed = true
+		case time.Since(e.since) >= endpointConfirmTimeout:
+			logger.Log(0, "no handshake with peer", key, "on the lan at", e.addr.String(), "- using its endpoint")
+			e.failed = time.Now()
+			expired = true
+		}
+		endpoints[key] = e
+	}
+	endpointsMutex.Unlock()
+	if expired {
+		d.changed()
+	}
+}
+
+// handshakeConfirms - checks if wireguard completed a handshake with the peer since it was pointed to the lan address
+// and still sends to it
+func handshakeConfirms(e *endpoint, peer *wgtypes.Peer) bool {
+	return peer.LastHandshakeTime.After(e.since) && peer.Endpoint != nil && peer.Endpoint.String() == e.addr.String()
+}
+
+// discovery.clear - drops all lan addresses
+func (d *discovery) clear() {
+	endpointsMutex.Lock()
+	cleared := len(endpoints) > 0
+	endpoints = make(map[string]endpoint)
+	endpointsMutex.Unlock()
+	if cleared {
+		d.changed()
+	}
+}
+
+// isPeer - checks if the key belongs to a peer of the host
+func isPeer(key wgtypes.Key) bool {
+	for _, peer := range config.GetHostPeerList() {
+		if peer.PublicKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// getInterfaces - up, non loopback interfaces other than the netmaker interface able to multicast or broadcast
+func getInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logger.Log(1, "failed to read interfaces", err.Error())
+		return nil
+	}
+	physical := []net.Interface{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagPointToPoint != 0 ||
+			iface.Flags&(net.FlagMulticast|net.FlagBroadcast) == 0 || iface.Name == ncutils.GetInterfaceName() {
+			continue
+		}
+		physical = append(physical, iface)
+	}
+	return physical
+}
+
+// getNetworks - ipv4 networks of an interface
+func getNetworks(iface *net.Interface) []*net.IPNet {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	networks := []*net.IPNet{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			networks = append(networks, ipNet)
+		}
+	}
+	return networks
+}
+
+// onLink - checks if the ip is in one of the networks of the physical interfaces
+func onLink(ip net.IP) bool {
+	for _, iface := range getInterfaces() {
+		iface := iface
+		for _, ipNet := range getNetworks(&iface) {
+			if ipNet.Contains(ip) && !ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// broadcastAddr - directed broadcast address of an ipv4 network
+func broadcastAddr(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
@@ -0,0 +1,118 @@
+package lan
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// messageAnnounce - announcement multicast by a host
+	messageAnnounce = 1
+	// messageReply - sealed reply of a peer to an announcement
+	messageReply = 2
+	// nonceSize - size of the nonce of an announcement
+	nonceSize = 16
+	// announceSize - magic, type, sender key, nonce
+	announceSize = len(magic) + 1 + 32 + nonceSize
+	// replyPayloadSize - nonce of the announcement, listen port
+	replyPayloadSize = nonceSize + 2
+	// replySize - magic, type, sender key, receiver key, box nonce, sealed payload
+	replySize = len(magic) + 1 + 32 + 32 + 24 + replyPayloadSize + box.Overhead
+)
+
+// magic - marks the discovery messages of netclient
+const magic = "NMLD"
+
+var errInvalidMessage = errors.New("invalid discovery message")
+
+// announcement - wireguard public key of a host and a nonce the peers have to return in their replies
+type announcement struct {
+	Sender wgtypes.Key
+	Nonce  [nonceSize]byte
+}
+
+// reply - answer of a peer to an announcement, the listen port is sealed for the announcer with the wireguard
+// keys of both hosts, which authenticates the peer
+type reply struct {
+	Sender     wgtypes.Key
+	Reciever   wgtypes.Key
+	Nonce      [nonceSize]byte
+	ListenPort int
+}
+
+// encodeAnnouncement - creates an announcement packet
+func encodeAnnouncement(a *announcement) []byte {
+	buf := make([]byte, 0, announceSize)
+	buf = append(buf, magic...)
+	buf = append(buf, messageAnnounce)
+	buf = append(buf, a.Sender[:]...)
+	return append(buf, a.Nonce[:]...)
+}
+
+// encodeReply - creates a reply packet sealed with the private key of the host for the announcer
+func encodeReply(r *reply, privKey wgtypes.Key) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, replyPayloadSize)
+	copy(payload, r.Nonce[:])
+	binary.BigEndian.PutUint16(payload[nonceSize:], uint16(r.ListenPort))
+	buf := make([]byte, 0, replySize)
+	buf = append(buf, magic...)
+	buf = append(buf, messageReply)
+	buf = append(buf, r.Sender[:]...)
+	buf = append(buf, r.Reciever[:]...)
+	buf = append(buf, nonce[:]...)
+	return box.Seal(buf, payload, &nonce, (*[32]byte)(&r.Reciever), (*[32]byte)(&privKey)), nil
+}
+
+// messageType - type of a discovery packet, 0 if it is not one
+func messageType(buf []byte) byte {
+	if len(buf) <= len(magic) || string(buf[:len(magic)]) != magic {
+		return 0
+	}
+	return buf[len(magic)]
+}
+
+// decodeAnnouncement - reads an announcement packet
+func decodeAnnouncement(buf []byte) (*announcement, error) {
+	if len(buf) != announceSize || messageType(buf) != messageAnnounce {
+		return nil, errInvalidMessage
+	}
+	a := &announcement{}
+	buf = buf[len(magic)+1:]
+	copy(a.Sender[:], buf[:32])
+	copy(a.Nonce[:], buf[32:])
+	return a, nil
+}
+
+// decodeReplyHeader - reads the keys of a reply packet without opening it
+func decodeReplyHeader(buf []byte) (*reply, error) {
+	if len(buf) != replySize || messageType(buf) != messageReply {
+		return nil, errInvalidMessage
+	}
+	r := &reply{}
+	buf = buf[len(magic)+1:]
+	copy(r.Sender[:], buf[:32])
+	copy(r.Reciever[:], buf[32:64])
+	return r, nil
+}
+
+// openReply - opens a reply sealed by the sender for the host
+func openReply(buf []byte, r *reply, privKey wgtypes.Key) error {
+	var nonce [24]byte
+	sealed := buf[len(magic)+1+64:]
+	copy(nonce[:], sealed[:24])
+	payload, ok := box.Open(nil, sealed[24:], &nonce, (*[32]byte)(&r.Sender), (*[32]byte)(&privKey))
+	if !ok || len(payload) != replyPayloadSize {
+		return errors.New("failed to open reply")
+	}
+	copy(r.Nonce[:], payload[:nonceSize])
+	r.ListenPort = int(binary.BigEndian.Uint16(payload[nonceSize:]))
+	return nil
+}
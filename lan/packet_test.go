@@ -0,0 +1,125 @@
+package lan
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestAnnouncement(t *testing.T) {
+	is := is.New(t)
+	a := &announcement{Sender: newTestKey(t).PublicKey(), Nonce: [nonceSize]byte{1, 2, 3}}
+	buf := encodeAnnouncement(a)
+	is.Equal(len(buf), announceSize)
+	is.Equal(messageType(buf), byte(messageAnnounce))
+	decoded, err := decodeAnnouncement(buf)
+	is.NoErr(err)
+	is.Equal(decoded, a)
+	t.Run("truncated", func(t *testing.T) {
+		_, err := decodeAnnouncement(buf[:announceSize-1])
+		is.Equal(err, errInvalidMessage)
+	})
+	t.Run("other magic", func(t *testing.T) {
+		other := append([]byte("XXXX"), buf[len(magic):]...)
+		is.Equal(messageType(other), byte(0))
+		_, err := decodeAnnouncement(other)
+		is.Equal(err, errInvalidMessage)
+	})
+}
+
+func TestReply(t *testing.T) {
+	is := is.New(t)
+	peerKey, hostKey := newTestKey(t), newTestKey(t)
+	r := &reply{
+		Sender:     peerKey.PublicKey(),
+		Reciever:   hostKey.PublicKey(),
+		Nonce:      [nonceSize]byte{4, 5, 6},
+		ListenPort: 51821,
+	}
+	buf, err := encodeReply(r, peerKey)
+	is.NoErr(err)
+	is.Equal(len(buf), replySize)
+	is.Equal(messageType(buf), byte(messageReply))
+	t.Run("open", func(t *testing.T) {
+		header, err := decodeReplyHeader(buf)
+		is.NoErr(err)
+		is.Equal(header.Sender, r.Sender)
+		is.Equal(header.Reciever, r.Reciever)
+		is.NoErr(openReply(buf, header, hostKey))
+		is.Equal(header, r)
+	})
+	t.Run("other receiver", func(t *testing.T) {
+		header, err := decodeReplyHeader(buf)
+		is.NoErr(err)
+		is.True(openReply(buf, header, newTestKey(t)) != nil)
+	})
+	t.Run("forged sender", func(t *testing.T) {
+		forged := append([]byte{}, buf...)
+		other := newTestKey(t).PublicKey()
+		copy(forged[len(magic)+1:], other[:])
+		header, err := decodeReplyHeader(forged)
+		is.NoErr(err)
+		is.True(openReply(forged, header, hostKey) != nil)
+	})
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte{}, buf...)
+		tampered[len(tampered)-1] ^= 1
+		header, err := decodeReplyHeader(tampered)
+		is.NoErr(err)
+		is.True(openReply(tampered, header, hostKey) != nil)
+	})
+	t.Run("announcement as reply", func(t *testing.T) {
+		_, err := decodeReplyHeader(encodeAnnouncement(&announcement{}))
+		is.Equal(err, errInvalidMessage)
+	})
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	is := is.New(t)
+	tests := []struct {
+		network *net.IPNet
+		want    string
+	}{
+		{&net.IPNet{IP: net.IPv4(192, 168, 1, 20), Mask: net.CIDRMask(24, 32)}, "192.168.1.255"},
+		{&net.IPNet{IP: net.IPv4(10, 1, 2, 3), Mask: net.CIDRMask(16, 32)}, "10.1.255.255"},
+		{&net.IPNet{IP: net.IPv4(172, 16, 5, 9), Mask: net.CIDRMask(30, 32)}, "172.16.5.11"},
+		{&net.IPNet{IP: net.IPv4(192, 168, 1, 20), Mask: net.CIDRMask(32, 32)}, "192.168.1.20"},
+		// ipv4 networks of interfaces may come with a 16 byte mask
+		{&net.IPNet{IP: net.IPv4(192, 168, 1, 20), Mask: net.CIDRMask(120, 128)}, "192.168.1.255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network.String(), func(t *testing.T) {
+			is.Equal(broadcastAddr(tt.network).String(), tt.want)
+		})
+	}
+}
+
+func TestHandshakeConfirms(t *testing.T) {
+	is := is.New(t)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 51821}
+	e := &endpoint{addr: addr, since: time.Now()}
+	t.Run("handshake over the lan", func(t *testing.T) {
+		is.True(handshakeConfirms(e, &wgtypes.Peer{LastHandshakeTime: time.Now().Add(time.Second), Endpoint: addr}))
+	})
+	t.Run("handshake before", func(t *testing.T) {
+		is.Equal(handshakeConfirms(e, &wgtypes.Peer{LastHandshakeTime: time.Now().Add(-time.Minute), Endpoint: addr}), false)
+	})
+	t.Run("roamed to another address", func(t *testing.T) {
+		other := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51821}
+		is.Equal(handshakeConfirms(e, &wgtypes.Peer{LastHandshakeTime: time.Now().Add(time.Second), Endpoint: other}), false)
+	})
+	t.Run("no handshake", func(t *testing.T) {
+		is.Equal(handshakeConfirms(e, &wgtypes.Peer{Endpoint: addr}), false)
+	})
+}
+
+func newTestKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
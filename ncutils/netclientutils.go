@@ -536,3 +536,11 @@ func GetInterfaceName() string {
 	}
 	return "netmaker"
 }
+
+// GetNetworkInterfaceName - gets the name of the n-th per network wireguard interface
+func GetNetworkInterfaceName(n int) string {
+	if runtime.GOOS == "darwin" {
+		return fmt.Sprintf("utun%d", 69+n)
+	}
+	return fmt.Sprintf("netmaker%d", n)
+}
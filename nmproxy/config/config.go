@@ -182,16 +182,23 @@ func (c *Config) GetRelayedStatus(server string) bool {
 	return c.GetSettings(server).IsRelayed
 }
 
-// Config.SetBehindNATStatus - sets NAT status for the device
+// Config.SetBehindNATStatus - sets NAT status for the device, from the nat type if it could be classified
 func (c *Config) SetNATStatus() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if c.HostInfo.PrivIp != nil && proxy.IsPublicIP(c.HostInfo.PrivIp) {
+	switch c.HostInfo.NAT.Type {
+	case proxy.NATNone:
 		logger.Log(1, "Host is public facing!!!")
-	} else {
+	case proxy.NATUnknown, "":
+		if c.HostInfo.PrivIp != nil && proxy.IsPublicIP(c.HostInfo.PrivIp) {
+			logger.Log(1, "Host is public facing!!!")
+		} else {
+			c.isBehindNAT = true
+		}
+	default:
+		logger.Log(1, "Host is behind", c.HostInfo.NAT.Type, "NAT")
 		c.isBehindNAT = true
 	}
-
 }
 
 // NatAutoSwitchDone - check if nat automatically swithed on already for devices behind NAT
@@ -209,6 +216,14 @@ func (c *Config) IsBehindNAT() bool {
 	return c.isBehindNAT
 }
 
+// Config.NeedsProxy - checks if the proxy helps peers to reach the host, i.e. the host is behind a nat that is
+// symmetric or could not be classified; peers punch through cone nats without it
+func (c *Config) NeedsProxy() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.isBehindNAT && !c.HostInfo.NAT.IsCone()
+}
+
 // Config.GetServerConn - fetches the server connection
 func (c *Config) GetServerConn() *net.UDPConn {
 	return c.serverConn
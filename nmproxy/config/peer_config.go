@@ -13,6 +13,14 @@ import (
 
 var extPeerMapMutex = sync.Mutex{}
 
+// legacyPeers - hashes of the peers each server marked as sending unauthenticated proxy messages, kept across
+// proxy restarts as the servers only send them with peer updates
+var legacyPeers = make(map[string]map[string]struct{})
+
+// peerAuth - whether the peers were seen sending authenticated proxy messages, by peer key hash
+var peerAuth = make(map[string]bool)
+var legacyPeerMutex = sync.RWMutex{} // used to mutex access to legacyPeers and peerAuth
+
 // wgIfaceConf - interface config
 type wgIfaceConf struct {
 	iface            *wg.WGIface
@@ -95,26 +103,37 @@ func (c *Config) GetDevicePubKey() (publicKey wgtypes.Key) {
 	return
 }
 
-// Config.GetAllProxyPeers - fetches all peers in the network
+// Config.GetAllProxyPeers - fetches a copy of the map of all peers in the network
 func (c *Config) GetAllProxyPeers() models.PeerConnMap {
-	return c.ifaceConfig.proxyPeerMap
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	peers := make(models.PeerConnMap, len(c.ifaceConfig.proxyPeerMap))
+	for peerKey, peerConn := range c.ifaceConfig.proxyPeerMap {
+		peers[peerKey] = peerConn
+	}
+	return peers
 }
 
 // Config.UpdateProxyPeers - updates all peers in the network
 func (c *Config) UpdateProxyPeers(peers *models.PeerConnMap) {
 	if peers != nil {
+		c.mutex.Lock()
 		c.ifaceConfig.proxyPeerMap = *peers
+		c.mutex.Unlock()
 	}
 }
 
 // Config.SavePeer - saves peer to the config
 func (c *Config) SavePeer(connConf *models.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.ifaceConfig.proxyPeerMap[connConf.Key.String()] = connConf
 }
 
 // Config.GetPeer - fetches the peer by network and pubkey
 func (c *Config) GetPeer(peerPubKey string) (models.Conn, bool) {
-
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	if peerConn, found := c.ifaceConfig.proxyPeerMap[peerPubKey]; found {
 		return *peerConn, found
 	}
@@ -127,7 +146,9 @@ func (c *Config) UpdatePeer(updatedPeer *models.Conn) {
 
 	if peerConf, found := c.ifaceConfig.proxyPeerMap[updatedPeer.Key.String()]; found {
 		peerConf.Mutex.Lock()
+		c.mutex.Lock()
 		c.ifaceConfig.proxyPeerMap[updatedPeer.Key.String()] = updatedPeer
+		c.mutex.Unlock()
 		peerConf.Mutex.Unlock()
 	}
 }
@@ -152,7 +173,9 @@ func (c *Config) RemovePeer(peerPubKey string) {
 		peerConf.Mutex.Lock()
 		peerConf.StopConn()
 		peerConf.Mutex.Unlock()
+		c.mutex.Lock()
 		delete(c.ifaceConfig.proxyPeerMap, peerPubKey)
+		c.mutex.Unlock()
 		GetCfg().DeletePeerHash(peerConf.Key.String())
 
 	}
@@ -182,12 +205,15 @@ func (c *Config) GetNetworkPeerMap() models.PeerConnMap {
 
 // Config.SavePeerByHash - saves peer by its publicKey hash to the config
 func (c *Config) SavePeerByHash(peerInfo *models.RemotePeer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.ifaceConfig.peerHashMap[models.ConvPeerKeyToHash(peerInfo.PeerKey)] = peerInfo
 }
 
 // Config.GetPeerInfoByHash - fetches the peerInfo by its pubKey hash
 func (c *Config) GetPeerInfoByHash(peerKeyHash string) (models.RemotePeer, bool) {
-
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	if peerInfo, found := c.ifaceConfig.peerHashMap[peerKeyHash]; found {
 		return *peerInfo, found
 	}
@@ -196,15 +222,18 @@ func (c *Config) GetPeerInfoByHash(peerKeyHash string) (models.RemotePeer, bool)
 
 // Config.DeletePeerHash - deletes peer by its pubkey hash from config
 func (c *Config) DeletePeerHash(peerKey string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	delete(c.ifaceConfig.peerHashMap, models.ConvPeerKeyToHash(peerKey))
 }
 
 // Config.GetExtClientInfo - fetches ext. client from the config by it's endpoint
 func (c *Config) GetExtClientInfo(udpAddr *net.UDPAddr) (models.RemotePeer, bool) {
-
 	if udpAddr == nil {
 		return models.RemotePeer{}, false
 	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	if peerInfo, found := c.ifaceConfig.extSrcIpMap[udpAddr.String()]; found {
 		return *peerInfo, found
 	}
@@ -214,11 +243,15 @@ func (c *Config) GetExtClientInfo(udpAddr *net.UDPAddr) (models.RemotePeer, bool
 
 // Config.SaveExtClientInfo - saves the ext. client info to config
 func (c *Config) SaveExtClientInfo(peerInfo *models.RemotePeer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.ifaceConfig.extSrcIpMap[peerInfo.Endpoint.String()] = peerInfo
 }
 
 // Config.DeleteExtClientInfo - deletes the ext. client info from the config
 func (c *Config) DeleteExtClientInfo(udpAddr *net.UDPAddr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	delete(c.ifaceConfig.extSrcIpMap, udpAddr.String())
 }
 
@@ -251,6 +284,8 @@ func (c *Config) DeleteExtWaitCfg(peerKey string) {
 
 // Config.SaveRelayedPeer - saves relayed peer to config
 func (c *Config) SaveRelayedPeer(relayedNodePubKey string, peer *models.RemotePeer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if _, ok := c.ifaceConfig.relayPeerMap[models.ConvPeerKeyToHash(relayedNodePubKey)]; !ok {
 		c.ifaceConfig.relayPeerMap[models.ConvPeerKeyToHash(relayedNodePubKey)] = make(map[string]*models.RemotePeer)
 	}
@@ -265,12 +300,13 @@ func (c *Config) CheckIfRelayedNodeExists(peerHash string) bool {
 
 // Config.GetRelayedPeer - fectches the relayed peer
 func (c *Config) GetRelayedPeer(srcKeyHash, dstPeerHash string) (models.RemotePeer, bool) {
-
-	if c.CheckIfRelayedNodeExists(srcKeyHash) {
-		if peer, found := c.ifaceConfig.relayPeerMap[srcKeyHash][dstPeerHash]; found {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if relayedPeers, found := c.ifaceConfig.relayPeerMap[srcKeyHash]; found {
+		if peer, found := relayedPeers[dstPeerHash]; found {
 			return *peer, found
 		}
-	} else if c.CheckIfRelayedNodeExists(dstPeerHash) {
+	} else if _, found := c.ifaceConfig.relayPeerMap[dstPeerHash]; found {
 		if peer, found := c.ifaceConfig.relayPeerMap[dstPeerHash][dstPeerHash]; found {
 			return *peer, found
 		}
@@ -283,7 +319,9 @@ func (c *Config) DeleteRelayedPeers() {
 	peersMap := c.GetAllProxyPeers()
 	for _, peer := range peersMap {
 		if peer.IsRelayed {
+			c.mutex.Lock()
 			delete(c.ifaceConfig.relayPeerMap, models.ConvPeerKeyToHash(peer.Key.String()))
+			c.mutex.Unlock()
 		}
 	}
 }
@@ -292,12 +330,16 @@ func (c *Config) DeleteRelayedPeers() {
 func (c *Config) UpdateListenPortForRelayedPeer(port int, srcKeyHash, dstPeerHash string) {
 	if c.CheckIfRelayedNodeExists(srcKeyHash) {
 		if peer, found := c.ifaceConfig.relayPeerMap[srcKeyHash][dstPeerHash]; found {
+			c.mutex.Lock()
 			peer.Endpoint.Port = port
+			c.mutex.Unlock()
 			c.SaveRelayedPeer(srcKeyHash, peer)
 		}
 	} else if c.CheckIfRelayedNodeExists(dstPeerHash) {
 		if peer, found := c.ifaceConfig.relayPeerMap[dstPeerHash][dstPeerHash]; found {
+			c.mutex.Lock()
 			peer.Endpoint.Port = port
+			c.mutex.Unlock()
 			c.SaveRelayedPeer(dstPeerHash, peer)
 		}
 	}
@@ -323,6 +365,8 @@ func (c *Config) GetNoProxyPeers() models.PeerConnMap {
 
 // Config.GetNoProxyPeer - fetches no proxy peer
 func (c *Config) GetNoProxyPeer(peerIp net.IP) (models.Conn, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	if connConf, found := c.ifaceConfig.noProxyPeerMap[peerIp.String()]; found {
 		return *connConf, found
 	}
@@ -332,11 +376,15 @@ func (c *Config) GetNoProxyPeer(peerIp net.IP) (models.Conn, bool) {
 
 // Config.UpdateNoProxyPeers - updates no proxy peers in the config
 func (c *Config) UpdateNoProxyPeers(peers *models.PeerConnMap) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.ifaceConfig.noProxyPeerMap = *peers
 }
 
 // Config.SaveNoProxyPeer - adds non proxy peer to config
 func (c *Config) SaveNoProxyPeer(peer *models.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.ifaceConfig.noProxyPeerMap[peer.Config.PeerEndpoint.IP.String()] = peer
 }
 
@@ -346,7 +394,9 @@ func (c *Config) DeleteNoProxyPeer(peerIP string) {
 		peerConf.Mutex.Lock()
 		peerConf.StopConn()
 		peerConf.Mutex.Unlock()
+		c.mutex.Lock()
 		delete(c.ifaceConfig.noProxyPeerMap, peerIP)
+		c.mutex.Unlock()
 	}
 }
 
@@ -368,3 +418,124 @@ func (c *Config) GetPeersIDsAndAddrs(server, peerKey string) (map[string]nm_mode
 
 	return make(map[string]nm_models.IDandAddr), false
 }
+
+// Config.GetPeerKeyByHash - fetches the public key of a peer or of a node relayed by this host by its pubkey hash
+func (c *Config) GetPeerKeyByHash(peerKeyHash string) (wgtypes.Key, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	peerKey := ""
+	if peerInfo, found := c.ifaceConfig.peerHashMap[peerKeyHash]; found {
+		peerKey = peerInfo.PeerKey
+	} else {
+		for _, relayedPeers := range c.ifaceConfig.relayPeerMap {
+			if peer, found := relayedPeers[peerKeyHash]; found {
+				peerKey = peer.PeerKey
+				break
+			}
+		}
+	}
+	if peerKey == "" {
+		return wgtypes.Key{}, false
+	}
+	key, err := wgtypes.ParseKey(peerKey)
+	if err != nil {
+		return wgtypes.Key{}, false
+	}
+	return key, true
+}
+
+// Config.GetPeerEndpointByHash - fetches the endpoint of a peer or of a node relayed by this host by its pubkey hash
+func (c *Config) GetPeerEndpointByHash(peerKeyHash string) (*net.UDPAddr, bool) {
+	if peerInfo, found := c.ifaceConfig.peerHashMap[peerKeyHash]; found && peerInfo.Endpoint != nil {
+		return peerInfo.Endpoint, true
+	}
+	if peer, found := c.ifaceConfig.relayPeerMap[peerKeyHash][peerKeyHash]; found && peer.Endpoint != nil {
+		return peer.Endpoint, true
+	}
+	return nil, false
+}
+
+// Config.GetRelayKey - fetches the public key of the relay peer at the relay endpoint, several hosts may share
+// the address of the endpoint behind a nat so the port has to match as well
+func (c *Config) GetRelayKey(relayEndpoint *net.UDPAddr) (wgtypes.Key, bool) {
+	if relayEndpoint == nil {
+		return wgtypes.Key{}, false
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, peer := range c.ifaceConfig.proxyPeerMap {
+		if !peer.IsRelayed && peer.Config.PeerEndpoint != nil && peer.Config.PeerEndpoint.IP.Equal(relayEndpoint.IP) &&
+			peer.Config.PeerEndpoint.Port == relayEndpoint.Port {
+			return peer.Key, true
+		}
+	}
+	return wgtypes.Key{}, false
+}
+
+// SetLegacyPeers - sets the peers of a server that send unauthenticated proxy messages, as listed by the server;
+// once a server lists legacy peers, unauthenticated messages are only accepted from the peers listed
+func SetLegacyPeers(server string, peerKeys []string) {
+	hashes := make(map[string]struct{}, len(peerKeys))
+	for _, peerKey := range peerKeys {
+		hashes[models.ConvPeerKeyToHash(peerKey)] = struct{}{}
+	}
+	legacyPeerMutex.Lock()
+	defer legacyPeerMutex.Unlock()
+	if len(hashes) == 0 {
+		delete(legacyPeers, server)
+		return
+	}
+	legacyPeers[server] = hashes
+}
+
+// SetPeerAuthenticated - records whether a peer was seen sending authenticated proxy messages, a peer seen sending
+// an authenticated message stays authenticated so spoofed unauthenticated messages can not downgrade it
+func SetPeerAuthenticated(peerKeyHash string, authenticated bool) {
+	legacyPeerMutex.Lock()
+	defer legacyPeerMutex.Unlock()
+	if seen, found := peerAuth[peerKeyHash]; found && (seen || !authenticated) {
+		return
+	}
+	if authenticated {
+		logger.Log(1, "peer", peerKeyHash, "sends authenticated proxy messages")
+	} else {
+		logger.Log(1, "peer", peerKeyHash, "sends unauthenticated proxy messages")
+	}
+	peerAuth[peerKeyHash] = authenticated
+}
+
+// Config.AcceptsUnauthenticated - checks if unauthenticated proxy messages of the peer are accepted outside of strict
+// mode; until a server lists legacy peers any peer not seen sending authenticated messages is accepted
+func (c *Config) AcceptsUnauthenticated(peerKeyHash string) bool {
+	legacyPeerMutex.RLock()
+	defer legacyPeerMutex.RUnlock()
+	if isListedLegacy(peerKeyHash) {
+		return true
+	}
+	return len(legacyPeers) == 0 && !peerAuth[peerKeyHash]
+}
+
+// Config.IsPeerLegacy - checks if the peer is sent unauthenticated proxy transport messages outside of strict mode,
+// either because a server lists it or, until a server lists legacy peers, because it was only seen sending
+// unauthenticated messages
+func (c *Config) IsPeerLegacy(peerKeyHash string) bool {
+	legacyPeerMutex.RLock()
+	defer legacyPeerMutex.RUnlock()
+	if isListedLegacy(peerKeyHash) {
+		return true
+	}
+	authenticated, found := peerAuth[peerKeyHash]
+	return len(legacyPeers) == 0 && found && !authenticated
+}
+
+// == private ==
+
+// isListedLegacy - checks if a server lists the peer as legacy, the caller holds legacyPeerMutex
+func isListedLegacy(peerKeyHash string) bool {
+	for _, hashes := range legacyPeers {
+		if _, found := hashes[peerKeyHash]; found {
+			return true
+		}
+	}
+	return false
+}
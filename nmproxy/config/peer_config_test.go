@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+)
+
+func TestPeerAuthentication(t *testing.T) {
+	is := is.New(t)
+	InitializeCfg()
+	defer Reset()
+	defer func() {
+		legacyPeers = make(map[string]map[string]struct{})
+		peerAuth = make(map[string]bool)
+	}()
+	c := GetCfg()
+	legacy, upgraded, listed := newTestKey(t).String(), newTestKey(t).String(), newTestKey(t).String()
+	legacyHash, upgradedHash, listedHash := models.ConvPeerKeyToHash(legacy), models.ConvPeerKeyToHash(upgraded),
+		models.ConvPeerKeyToHash(listed)
+	t.Run("no legacy peers listed", func(t *testing.T) {
+		is.True(c.AcceptsUnauthenticated(legacyHash))
+		is.True(!c.IsPeerLegacy(legacyHash))
+		SetPeerAuthenticated(legacyHash, false)
+		is.True(c.IsPeerLegacy(legacyHash))
+		SetPeerAuthenticated(upgradedHash, true)
+		is.True(!c.AcceptsUnauthenticated(upgradedHash))
+		is.True(!c.IsPeerLegacy(upgradedHash))
+	})
+	t.Run("authenticated stays authenticated", func(t *testing.T) {
+		SetPeerAuthenticated(upgradedHash, false)
+		is.True(!c.IsPeerLegacy(upgradedHash))
+		SetPeerAuthenticated(legacyHash, true)
+		is.True(!c.IsPeerLegacy(legacyHash))
+		is.True(!c.AcceptsUnauthenticated(legacyHash))
+	})
+	t.Run("legacy peers listed", func(t *testing.T) {
+		SetLegacyPeers("server", []string{listed})
+		is.True(c.AcceptsUnauthenticated(listedHash))
+		is.True(c.IsPeerLegacy(listedHash))
+		unknown := models.ConvPeerKeyToHash(newTestKey(t).String())
+		SetPeerAuthenticated(unknown, false)
+		is.True(!c.AcceptsUnauthenticated(unknown))
+		is.True(!c.IsPeerLegacy(unknown))
+		SetLegacyPeers("server", nil)
+		is.True(c.AcceptsUnauthenticated(unknown))
+		is.True(c.IsPeerLegacy(unknown))
+	})
+}
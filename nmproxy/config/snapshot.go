@@ -0,0 +1,115 @@
+package config
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	proxy "github.com/gravitl/netclient/nmproxy/models"
+)
+
+// Config.Snapshot - copies the state of the proxy under the config mutex, the maps the proxy manager works on
+// directly are only consistent when called from the manager loop
+func (c *Config) Snapshot() proxy.Snapshot {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	s := proxy.Snapshot{
+		Time:              time.Now(),
+		Running:           c.ProxyStatus,
+		BehindNAT:         c.isBehindNAT,
+		HostInfo:          c.HostInfo,
+		Peers:             []proxy.PeerSnapshot{},
+		NoProxyPeers:      []proxy.PeerSnapshot{},
+		PeerHashes:        []proxy.RemotePeerSnapshot{},
+		ExtClients:        []proxy.RemotePeerSnapshot{},
+		ExtClientsWaiting: []proxy.RemotePeerSnapshot{},
+		RelayedRoutes:     []proxy.RelayedRouteSnapshot{},
+	}
+	for _, conn := range c.ifaceConfig.proxyPeerMap {
+		s.Peers = append(s.Peers, snapshotPeer(conn))
+	}
+	for _, conn := range c.ifaceConfig.noProxyPeerMap {
+		s.NoProxyPeers = append(s.NoProxyPeers, snapshotPeer(conn))
+	}
+	for hash, peer := range c.ifaceConfig.peerHashMap {
+		s.PeerHashes = append(s.PeerHashes, snapshotRemotePeer(hash, peer))
+	}
+	for _, peer := range c.ifaceConfig.extSrcIpMap {
+		s.ExtClients = append(s.ExtClients, snapshotRemotePeer("", peer))
+	}
+	extPeerMapMutex.Lock()
+	for _, peer := range c.ifaceConfig.extClientWaitMap {
+		s.ExtClientsWaiting = append(s.ExtClientsWaiting, snapshotRemotePeer("", peer))
+	}
+	extPeerMapMutex.Unlock()
+	for relayedHash, peers := range c.ifaceConfig.relayPeerMap {
+		for peerHash, peer := range peers {
+			s.RelayedRoutes = append(s.RelayedRoutes, proxy.RelayedRouteSnapshot{
+				RelayedNodeHash: relayedHash,
+				PeerHash:        peerHash,
+				PeerKey:         peer.PeerKey,
+				Endpoint:        addrString(peer.Endpoint),
+			})
+		}
+	}
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].Key < s.Peers[j].Key })
+	sort.Slice(s.NoProxyPeers, func(i, j int) bool { return s.NoProxyPeers[i].Key < s.NoProxyPeers[j].Key })
+	sort.Slice(s.PeerHashes, func(i, j int) bool { return s.PeerHashes[i].Key < s.PeerHashes[j].Key })
+	sort.Slice(s.ExtClients, func(i, j int) bool { return s.ExtClients[i].Key < s.ExtClients[j].Key })
+	sort.Slice(s.ExtClientsWaiting, func(i, j int) bool { return s.ExtClientsWaiting[i].Key < s.ExtClientsWaiting[j].Key })
+	sort.Slice(s.RelayedRoutes, func(i, j int) bool {
+		if s.RelayedRoutes[i].RelayedNodeHash != s.RelayedRoutes[j].RelayedNodeHash {
+			return s.RelayedRoutes[i].RelayedNodeHash < s.RelayedRoutes[j].RelayedNodeHash
+		}
+		return s.RelayedRoutes[i].PeerHash < s.RelayedRoutes[j].PeerHash
+	})
+	return s
+}
+
+// == private ==
+
+// snapshotPeer - copies the proxy connection of a peer
+func snapshotPeer(conn *proxy.Conn) proxy.PeerSnapshot {
+	p := proxy.PeerSnapshot{
+		Key:             conn.Key.String(),
+		IsExtClient:     conn.IsExtClient,
+		IsRelayed:       conn.IsRelayed,
+		RelayedEndpoint: addrString(conn.RelayedEndpoint),
+		ProxyStatus:     conn.Config.ProxyStatus,
+		LocalAddr:       addrString(conn.Config.LocalConnAddr),
+		RemoteEndpoint:  addrString(conn.Config.RemoteConnAddr),
+		PeerEndpoint:    addrString(conn.Config.PeerEndpoint),
+		Servers:         []string{},
+	}
+	for server := range conn.ServerMap {
+		p.Servers = append(p.Servers, server)
+	}
+	sort.Strings(p.Servers)
+	if conn.Config.Traffic != nil {
+		p.TrafficSent = conn.Config.Traffic.Sent.Load()
+		p.TrafficReceived = conn.Config.Traffic.Received.Load()
+	}
+	return p
+}
+
+// snapshotRemotePeer - copies a peer the proxy passes received packets to
+func snapshotRemotePeer(hash string, peer *proxy.RemotePeer) proxy.RemotePeerSnapshot {
+	p := proxy.RemotePeerSnapshot{
+		Key:         peer.PeerKey,
+		Hash:        hash,
+		Endpoint:    addrString(peer.Endpoint),
+		IsExtClient: peer.IsExtClient,
+	}
+	if peer.LocalConn != nil {
+		p.LocalAddr = peer.LocalConn.LocalAddr().String()
+	}
+	return p
+}
+
+// addrString - address as a string, empty if not set
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
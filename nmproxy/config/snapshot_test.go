@@ -0,0 +1,82 @@
+package config
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	proxy "github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSnapshot(t *testing.T) {
+	is := is.New(t)
+	InitializeCfg()
+	defer Reset()
+	c := GetCfg()
+	first, second, noProxy := newTestKey(t), newTestKey(t), newTestKey(t)
+	endpoint := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51722}
+	traffic := &proxy.Traffic{}
+	traffic.Sent.Add(10)
+	traffic.Received.Add(20)
+	// saved out of order, the snapshot sorts by key
+	for _, key := range []wgtypes.Key{second, first} {
+		c.SavePeer(newTestConn(key, endpoint, traffic, true))
+		c.SavePeerByHash(&proxy.RemotePeer{PeerKey: key.String(), Endpoint: endpoint})
+	}
+	c.SaveNoProxyPeer(newTestConn(noProxy, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 51821}, nil, false))
+	c.SaveExtClientInfo(&proxy.RemotePeer{PeerKey: noProxy.String(), Endpoint: endpoint, IsExtClient: true})
+	c.SaveRelayedPeer(first.String(), &proxy.RemotePeer{PeerKey: second.String(), Endpoint: endpoint})
+	s := c.Snapshot()
+	is.True(s.Running)
+	is.Equal(len(s.Peers), 2)
+	is.True(s.Peers[0].Key < s.Peers[1].Key)
+	is.Equal(s.Peers[0].PeerEndpoint, endpoint.String())
+	is.Equal(s.Peers[0].Servers, []string{"server"})
+	is.Equal(s.Peers[0].TrafficSent, int64(10))
+	is.Equal(s.Peers[0].TrafficReceived, int64(20))
+	is.Equal(len(s.NoProxyPeers), 1)
+	is.Equal(s.NoProxyPeers[0].Key, noProxy.String())
+	is.Equal(s.NoProxyPeers[0].ProxyStatus, false)
+	is.Equal(len(s.PeerHashes), 2)
+	is.Equal(s.PeerHashes[0].Hash, proxy.ConvPeerKeyToHash(s.PeerHashes[0].Key))
+	is.Equal(len(s.ExtClients), 1)
+	is.True(s.ExtClients[0].IsExtClient)
+	is.Equal(s.ExtClientsWaiting, []proxy.RemotePeerSnapshot{})
+	is.Equal(s.RelayedRoutes, []proxy.RelayedRouteSnapshot{{
+		RelayedNodeHash: proxy.ConvPeerKeyToHash(first.String()),
+		PeerHash:        proxy.ConvPeerKeyToHash(second.String()),
+		PeerKey:         second.String(),
+		Endpoint:        endpoint.String(),
+	}})
+	t.Run("copy of the peers", func(t *testing.T) {
+		peers := c.GetAllProxyPeers()
+		delete(peers, first.String())
+		_, found := c.GetPeer(first.String())
+		is.True(found)
+	})
+}
+
+func newTestKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+// newTestConn - proxy connection of a peer of the server "server"
+func newTestConn(key wgtypes.Key, endpoint *net.UDPAddr, traffic *proxy.Traffic, proxyStatus bool) *proxy.Conn {
+	return &proxy.Conn{
+		Key:   key,
+		Mutex: &sync.RWMutex{},
+		Config: proxy.Proxy{
+			PeerPublicKey: key,
+			PeerEndpoint:  endpoint,
+			ProxyStatus:   proxyStatus,
+			Traffic:       traffic,
+		},
+		ServerMap: map[string]struct{}{"server": {}},
+	}
+}
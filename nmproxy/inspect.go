@@ -0,0 +1,110 @@
+package nmproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/manager"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netmaker/logger"
+)
+
+const (
+	// inspectDir - directory in the netclient directory only accessible by root, holding the inspect socket
+	inspectDir = "proxy"
+	// inspectSocket - unix socket serving the snapshots of the proxy of the daemon
+	inspectSocket = "proxy.sock"
+	// inspectTimeout - how long a snapshot may wait for the proxy manager
+	inspectTimeout = time.Second * 5
+)
+
+// Inspect - fetches a snapshot of the proxy from the daemon
+func Inspect() (models.Snapshot, error) {
+	var s models.Snapshot
+	client := http.Client{
+		Timeout: inspectTimeout * 2,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", inspectSocketPath())
+			},
+		},
+	}
+	resp, err := client.Get("http://proxy/inspect")
+	if err != nil {
+		return s, fmt.Errorf("failed to reach the proxy of the daemon, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("proxy of the daemon returned %s", resp.Status)
+	}
+	return s, json.NewDecoder(resp.Body).Decode(&s)
+}
+
+// == private ==
+
+// serveInspect - serves read only snapshots of the proxy on the inspect socket until the context is done
+func serveInspect(ctx context.Context) {
+	// the socket is created with the umask of the daemon, the directory keeps other users from connecting
+	dir := ncconfig.GetNetclientPath() + inspectDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Log(0, "failed to create proxy inspect directory: ", err.Error())
+		return
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		logger.Log(0, "failed to restrict proxy inspect directory: ", err.Error())
+		return
+	}
+	path := inspectSocketPath()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log(0, "failed to remove stale proxy inspect socket: ", err.Error())
+		return
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		logger.Log(0, "failed to listen on proxy inspect socket: ", err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inspect", handleInspect)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: inspectTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log(0, "proxy inspect socket failed: ", err.Error())
+	}
+	os.Remove(path)
+}
+
+// inspectSocketPath - path of the inspect socket
+func inspectSocketPath() string {
+	return filepath.Join(ncconfig.GetNetclientPath()+inspectDir, inspectSocket)
+}
+
+// handleInspect - answers with a snapshot of the proxy as json
+func handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), inspectTimeout)
+	defer cancel()
+	s, err := manager.Inspect(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		logger.Log(1, "failed to write proxy snapshot: ", err.Error())
+	}
+}
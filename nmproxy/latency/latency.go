@@ -0,0 +1,131 @@
+// Package latency - measures the round trip times, jitter and loss to the peers with sequenced probes
+package latency
+
+import (
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netmaker/logger"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ProbeInterval - interval of the probes sent to each peer
+	ProbeInterval = time.Second * 5
+	// UnreachableLatency - latency reported to the server while no probe in the window was answered
+	UnreachableLatency = 999
+	// windowSize - probes per peer the statistics are computed over
+	windowSize = 60
+	// probeTimeout - how long a probe may go unanswered before it counts as lost
+	probeTimeout = time.Second * 2
+	// latencyFile - state file holding the statistics of the peers
+	latencyFile = "latency.yml"
+)
+
+var windows = make(map[string]*window) // probe windows by peer key
+var windowsMutex = sync.Mutex{}        // used to mutex access to windows
+var latencySaved time.Time             // last write of the state file
+
+// Next - records a probe sent to the peer now and returns the id to be carried by the probe; tunnel is set when
+// the probe is sent through the tunnel
+func Next(peerKey string, tunnel bool) uint32 {
+	windowsMutex.Lock()
+	w, found := windows[peerKey]
+	if !found || w.tunnel != tunnel {
+		// probes of both kinds don't mix in a window, the proxy was switched on or off
+		w = newWindow(tunnel)
+		windows[peerKey] = w
+	}
+	seq := w.next(time.Now())
+	save := time.Since(latencySaved) >= ProbeInterval
+	if save {
+		latencySaved = time.Now()
+	}
+	windowsMutex.Unlock()
+	if save {
+		saveLatencies()
+	}
+	return seq
+}
+
+// Record - records the reply of the peer to a probe, returns false if the probe was not sent by Next or was answered
+func Record(peerKey string, id uint32) bool {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+	w, found := windows[peerKey]
+	if !found {
+		return false
+	}
+	return w.record(id, time.Now())
+}
+
+// Get - statistics of the probes to the peer
+func Get(peerKey string) (models.PeerLatency, bool) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+	w, found := windows[peerKey]
+	if !found {
+		return models.PeerLatency{}, false
+	}
+	return w.stats(time.Now()), true
+}
+
+// MetricLatency - median round trip time to the peer in milliseconds for the metrics, UnreachableLatency if no
+// probe in the window was answered
+func MetricLatency(peerKey string) uint64 {
+	l, found := Get(peerKey)
+	if !found || l.Received == 0 {
+		return UnreachableLatency
+	}
+	return uint64(math.Round(l.P50))
+}
+
+// Remove - drops the probes to a peer
+func Remove(peerKey string) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+	delete(windows, peerKey)
+}
+
+// GetPeerLatencies - reads the statistics of the peers written by the daemon, by peer key
+func GetPeerLatencies() (map[string]models.PeerLatency, error) {
+	latencies := make(map[string]models.PeerLatency)
+	data, err := os.ReadFile(ncconfig.GetNetclientPath() + latencyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return latencies, nil
+		}
+		return latencies, err
+	}
+	return latencies, yaml.Unmarshal(data, &latencies)
+}
+
+// == private ==
+
+// saveLatencies - writes the statistics of the peers to the state file read by GetPeerLatencies, the windows of
+// peers no longer probed are dropped
+func saveLatencies() {
+	now := time.Now()
+	latencies := make(map[string]models.PeerLatency)
+	windowsMutex.Lock()
+	for peerKey, w := range windows {
+		if len(w.samples) == 0 || now.Sub(w.samples[len(w.samples)-1].sent) > windowSize*ProbeInterval {
+			delete(windows, peerKey)
+			continue
+		}
+		latencies[peerKey] = w.stats(now)
+	}
+	windowsMutex.Unlock()
+	data, err := yaml.Marshal(latencies)
+	if err != nil {
+		logger.Log(1, "failed to marshal peer latencies: ", err.Error())
+		return
+	}
+	if err := os.WriteFile(ncconfig.GetNetclientPath()+latencyFile, data, 0644); err != nil {
+		logger.Log(1, "failed to save peer latencies: ", err.Error())
+	}
+}
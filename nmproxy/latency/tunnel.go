@@ -0,0 +1,144 @@
+package latency
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netmaker/logger"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// tunnelMagic - marks the icmp echoes of the tunnel probes, other echoes on the raw sockets are ignored
+const tunnelMagic = "NMLP"
+
+// tunnelProber - icmp sockets and the peers probed through the tunnel
+type tunnelProber struct {
+	conn4   *net.IPConn
+	conn6   *net.IPConn
+	id      int
+	mutex   sync.Mutex        // used to mutex access to targets
+	targets map[string]string // peer key by tunnel address
+}
+
+// ProbeTunnel - probes the peers with icmp echoes to their tunnel addresses until the context is done, for hosts
+// with the proxy switched off; targets returns the tunnel address of each peer by peer key
+func ProbeTunnel(ctx context.Context, targets func() map[string]net.IP) error {
+	t := &tunnelProber{
+		id:      (os.Getpid() + 1) & 0xffff,
+		targets: make(map[string]string),
+	}
+	var err4, err6 error
+	t.conn4, err4 = listenICMP("ip4:icmp", "0.0.0.0")
+	t.conn6, err6 = listenICMP("ip6:ipv6-icmp", "::")
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	if err4 != nil {
+		logger.Log(1, "probing ipv6 tunnel addresses only: ", err4.Error())
+	}
+	if err6 != nil {
+		logger.Log(1, "probing ipv4 tunnel addresses only: ", err6.Error())
+	}
+	for _, conn := range []*net.IPConn{t.conn4, t.conn6} {
+		if conn == nil {
+			continue
+		}
+		defer conn.Close()
+		go t.listen(conn)
+	}
+	ticker := time.NewTicker(ProbeInterval)
+	defer ticker.Stop()
+	for {
+		t.probe(targets())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// == private ==
+
+// tunnelProber.probe - sends the next probe to each peer
+func (t *tunnelProber) probe(targets map[string]net.IP) {
+	byAddr := make(map[string]string, len(targets))
+	for peerKey, addr := range targets {
+		byAddr[addr.String()] = peerKey
+	}
+	t.mutex.Lock()
+	t.targets = byAddr
+	t.mutex.Unlock()
+	for peerKey, addr := range targets {
+		conn, request := t.conn4, icmp.Type(ipv4.ICMPTypeEcho)
+		if addr.To4() == nil {
+			conn, request = t.conn6, ipv6.ICMPTypeEchoRequest
+		}
+		if conn == nil {
+			continue
+		}
+		id := Next(peerKey, true)
+		data := make([]byte, len(tunnelMagic)+4)
+		copy(data, tunnelMagic)
+		binary.BigEndian.PutUint32(data[len(tunnelMagic):], id)
+		msg := icmp.Message{
+			Type: request,
+			Body: &icmp.Echo{ID: t.id, Seq: int(id & 0xffff), Data: data},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteTo(b, &net.IPAddr{IP: addr}); err != nil {
+			logger.Log(3, "failed to probe peer", peerKey, "through the tunnel", err.Error())
+		}
+	}
+}
+
+// tunnelProber.listen - records the echo replies of the peers until the socket is closed
+func (t *tunnelProber) listen(conn *net.IPConn) {
+	proto, reply := 1, icmp.Type(ipv4.ICMPTypeEchoReply)
+	if conn == t.conn6 {
+		proto, reply = 58, ipv6.ICMPTypeEchoReply
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != reply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.ID != t.id || len(echo.Data) != len(tunnelMagic)+4 || string(echo.Data[:len(tunnelMagic)]) != tunnelMagic {
+			continue
+		}
+		t.mutex.Lock()
+		peerKey, found := t.targets[from.(*net.IPAddr).IP.String()]
+		t.mutex.Unlock()
+		if found {
+			Record(peerKey, binary.BigEndian.Uint32(echo.Data[len(tunnelMagic):]))
+		}
+	}
+}
+
+// listenICMP - opens a raw icmp socket
+func listenICMP(network, address string) (*net.IPConn, error) {
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.IPConn), nil
+}
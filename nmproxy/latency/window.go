@@ -0,0 +1,118 @@
+package latency
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gravitl/netclient/nmproxy/models"
+)
+
+// sample - probe of a window
+type sample struct {
+	seq      uint32
+	sent     time.Time
+	rtt      time.Duration
+	answered bool
+}
+
+// window - last windowSize probes to a peer, in the order they were sent; the probes carry their sequence number
+// masked with the random nonce of the window, replies can't be forged by hosts not seeing the probes
+type window struct {
+	samples []sample
+	seq     uint32 // sequence number of the last probe
+	nonce   uint32
+	tunnel  bool
+}
+
+// newWindow - returns a window with a random nonce
+func newWindow(tunnel bool) *window {
+	w := &window{tunnel: tunnel}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err == nil {
+		w.nonce = binary.LittleEndian.Uint32(b[:])
+	}
+	return w
+}
+
+// window.next - records a probe sent now and returns the id to be carried by the probe, never 0
+func (w *window) next(now time.Time) uint32 {
+	w.seq++
+	if w.seq^w.nonce == 0 {
+		w.seq++
+	}
+	w.samples = append(w.samples, sample{seq: w.seq, sent: now})
+	if len(w.samples) > windowSize {
+		w.samples = append(w.samples[:0], w.samples[len(w.samples)-windowSize:]...)
+	}
+	return w.seq ^ w.nonce
+}
+
+// window.record - records the reply to the probe with the id, returns false if the probe is not in the window or
+// was answered
+func (w *window) record(id uint32, now time.Time) bool {
+	seq := id ^ w.nonce
+	for i := len(w.samples) - 1; i >= 0; i-- {
+		s := &w.samples[i]
+		if s.seq != seq {
+			continue
+		}
+		if s.answered {
+			return false
+		}
+		s.answered = true
+		s.rtt = now.Sub(s.sent)
+		return true
+	}
+	return false
+}
+
+// window.stats - computes the rtt percentiles, jitter and loss of the window; probes neither answered nor timed out
+// are left out
+func (w *window) stats(now time.Time) models.PeerLatency {
+	l := models.PeerLatency{Tunnel: w.tunnel, Updated: now}
+	rtts := []float64{}
+	var last float64
+	var diffs float64
+	for _, s := range w.samples {
+		if !s.answered {
+			if now.Sub(s.sent) >= probeTimeout {
+				l.Sent++
+			}
+			continue
+		}
+		l.Sent++
+		l.Received++
+		rtt := float64(s.rtt.Microseconds()) / 1000
+		if len(rtts) > 0 {
+			diffs += math.Abs(rtt - last)
+		}
+		last = rtt
+		rtts = append(rtts, rtt)
+	}
+	if l.Sent > 0 {
+		l.Loss = float64(l.Sent-l.Received) / float64(l.Sent)
+	}
+	if len(rtts) > 1 {
+		l.Jitter = diffs / float64(len(rtts)-1)
+	}
+	sort.Float64s(rtts)
+	l.P50 = percentile(rtts, 50)
+	l.P90 = percentile(rtts, 90)
+	l.P99 = percentile(rtts, 99)
+	return l
+}
+
+// percentile - nearest rank percentile of sorted values, 0 if there are none
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
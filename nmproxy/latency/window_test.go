@@ -0,0 +1,136 @@
+package latency
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+)
+
+func TestWindowNext(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	tests := []struct {
+		name  string
+		seq   uint32
+		nonce uint32
+		want  []uint32
+	}{
+		{"first", 0, 0, []uint32{1, 2, 3}},
+		{"rollover skips 0", math.MaxUint32 - 1, 0, []uint32{math.MaxUint32, 1, 2}},
+		{"masked with the nonce", 0, 0xff, []uint32{0xfe, 0xfd, 0xfc}},
+		{"id 0 skipped", 0xfe, 0xff, []uint32{0x1ff, 0x1fe, 0x1fd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &window{seq: tt.seq, nonce: tt.nonce}
+			for _, want := range tt.want {
+				is.Equal(w.next(now), want)
+			}
+		})
+	}
+	t.Run("keeps the last probes", func(t *testing.T) {
+		w := &window{}
+		for i := 0; i < windowSize+10; i++ {
+			w.next(now)
+		}
+		is.Equal(len(w.samples), windowSize)
+		is.Equal(w.samples[0].seq, uint32(11))
+		is.True(!w.record(10, now))
+		is.True(w.record(11, now))
+	})
+	t.Run("random nonce", func(t *testing.T) {
+		a, b := newWindow(false), newWindow(false)
+		is.True(a.nonce != b.nonce)
+	})
+}
+
+func TestWindowRecord(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	w := newWindow(false)
+	id := w.next(now)
+	tests := []struct {
+		name string
+		id   uint32
+		want bool
+	}{
+		{"other nonce", id ^ 0x5a5a5a5a, false},
+		{"answered", id, true},
+		{"duplicate", id, false},
+		{"not sent", w.nonce ^ 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is.Equal(w.record(tt.id, now.Add(time.Millisecond*20)), tt.want)
+		})
+	}
+	is.Equal(w.samples[0].rtt, time.Millisecond*20)
+}
+
+func TestWindowStats(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	tests := []struct {
+		name string
+		// rtts of the probes in milliseconds, negative for unanswered probes
+		rtts       []int
+		sentBefore time.Duration
+		want       models.PeerLatency
+	}{
+		{"no probes", nil, 0, models.PeerLatency{}},
+		{"all answered", []int{10, 20, 10, 20}, time.Second,
+			models.PeerLatency{Sent: 4, Received: 4, Jitter: 10, P50: 10, P90: 20, P99: 20}},
+		{"timed out probes are lost", []int{10, -1, 30, -1}, probeTimeout,
+			models.PeerLatency{Sent: 4, Received: 2, Loss: 0.5, Jitter: 20, P50: 10, P90: 30, P99: 30}},
+		{"pending probes are left out", []int{10, -1}, probeTimeout / 2,
+			models.PeerLatency{Sent: 1, Received: 1, P50: 10, P90: 10, P99: 10}},
+		{"all lost", []int{-1, -1, -1}, probeTimeout, models.PeerLatency{Sent: 3, Loss: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &window{}
+			sent := now.Add(-tt.sentBefore)
+			for _, rtt := range tt.rtts {
+				id := w.next(sent)
+				if rtt >= 0 {
+					w.record(id, sent.Add(time.Duration(rtt)*time.Millisecond))
+				}
+			}
+			l := w.stats(now)
+			l.Updated = time.Time{}
+			is.Equal(l, tt.want)
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	is := is.New(t)
+	hundred := make([]float64, 100)
+	for i := range hundred {
+		hundred[i] = float64(i + 1)
+	}
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{"none", nil, 50, 0},
+		{"one", []float64{7}, 99, 7},
+		{"median of two", []float64{1, 2}, 50, 1},
+		{"median of three", []float64{1, 2, 3}, 50, 2},
+		{"p90 of ten", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 9},
+		{"p99 of ten", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 99, 10},
+		{"p50 of hundred", hundred, 50, 50},
+		{"p99 of hundred", hundred, 99, 99},
+		{"p0", []float64{1, 2}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is.Equal(percentile(tt.sorted, tt.p), tt.want)
+		})
+	}
+}
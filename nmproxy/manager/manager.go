@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/gravitl/netclient/lan"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy/config"
 	"github.com/gravitl/netclient/nmproxy/models"
@@ -19,6 +20,25 @@ import (
 
 type proxyPayload nm_models.ProxyManagerPayload
 
+var inspectChan = make(chan chan models.Snapshot) // snapshot requests served by the manager loop
+
+// Inspect - takes a snapshot of the proxy between two updates of the manager, so the peer maps it changes in
+// place are consistent
+func Inspect(ctx context.Context) (models.Snapshot, error) {
+	reply := make(chan models.Snapshot, 1)
+	select {
+	case inspectChan <- reply:
+	case <-ctx.Done():
+		return models.Snapshot{}, ctx.Err()
+	}
+	select {
+	case s := <-reply:
+		return s, nil
+	case <-ctx.Done():
+		return models.Snapshot{}, ctx.Err()
+	}
+}
+
 func getRecieverType(m *nm_models.ProxyManagerPayload) *proxyPayload {
 	mI := proxyPayload(*m)
 	return &mI
@@ -31,6 +51,8 @@ func Start(ctx context.Context, managerChan chan *nm_models.HostPeerUpdate) {
 		case <-ctx.Done():
 			logger.Log(0, "shutting down proxy manager...")
 			return
+		case reply := <-inspectChan:
+			reply <- config.GetCfg().Snapshot()
 		case mI := <-managerChan:
 			if mI == nil {
 				continue
@@ -226,6 +248,7 @@ func (m *proxyPayload) processPayload() error {
 			}
 			gCfg.DeletePeerHash(peerConn.Key.String())
 			gCfg.RemovePeer(peerConn.Key.String())
+			delete(peerConnMap, peerPubKey)
 		}
 	}
 
@@ -277,7 +300,8 @@ func (m *proxyPayload) processPayload() error {
 			if err == nil {
 				logger.Log(3, fmt.Sprintf("---------> comparing peer endpoint: onDevice: %s, Proxy: %s", devPeer.Endpoint.String(),
 					currentPeer.Config.LocalConnAddr.String()))
-				if devPeer.Endpoint.String() != currentPeer.Config.LocalConnAddr.String() {
+				if _, onLAN := lan.GetEndpoint(currentPeer.Key.String()); !onLAN &&
+					devPeer.Endpoint.String() != currentPeer.Config.LocalConnAddr.String() {
 					logger.Log(1, "---------> endpoint is not set to proxy: ", currentPeer.Key.String())
 					currentPeer.StopConn()
 					currentPeer.Mutex.Unlock()
@@ -362,7 +386,8 @@ func (m *proxyPayload) processPayload() error {
 			if err == nil {
 				logger.Log(3, fmt.Sprintf("--------->[noProxy] comparing peer endpoint: onDevice: %s, Proxy: %s", devPeer.Endpoint.String(),
 					noProxypeer.Config.LocalConnAddr.String()))
-				if devPeer.Endpoint.String() != noProxypeer.Config.LocalConnAddr.String() {
+				if _, onLAN := lan.GetEndpoint(noProxypeer.Key.String()); !onLAN &&
+					devPeer.Endpoint.String() != noProxypeer.Config.LocalConnAddr.String() {
 					logger.Log(1, "---------> endpoint is not set to proxy: ", noProxypeer.Key.String())
 					noProxypeer.StopConn()
 					noProxypeer.Mutex.Unlock()
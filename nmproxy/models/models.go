@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -15,6 +17,38 @@ const (
 	NmProxyPort = 51722
 	// default CIDR for proxy peers
 	DefaultCIDR = "127.0.0.1/8"
+	// loopback address for the local endpoints of ipv6 peers, told apart by port
+	LoopbackIP6 = "::1"
+)
+
+// NAT behaviors as defined by RFC 4787, discovered as described by RFC 5780
+const (
+	// BehaviorUnknown - the behavior could not be discovered, e.g. the stun server lacks RFC 5780 support
+	BehaviorUnknown = "unknown"
+	// BehaviorEndpointIndependent - the same mapping is used for, or packets are accepted from, any destination
+	BehaviorEndpointIndependent = "endpoint-independent"
+	// BehaviorAddressDependent - the mapping or filter depends on the destination address
+	BehaviorAddressDependent = "address-dependent"
+	// BehaviorAddressAndPortDependent - the mapping or filter depends on the destination address and port
+	BehaviorAddressAndPortDependent = "address-and-port-dependent"
+)
+
+// NAT types derived from the mapping and filtering behavior
+const (
+	// NATUnknown - the nat could not be classified
+	NATUnknown = "unknown"
+	// NATNone - the host is reachable on its own address
+	NATNone = "none"
+	// NATFullCone - endpoint independent mapping and filtering
+	NATFullCone = "full-cone"
+	// NATRestrictedCone - endpoint independent mapping, address dependent filtering
+	NATRestrictedCone = "restricted-cone"
+	// NATPortRestrictedCone - endpoint independent mapping, address and port dependent filtering
+	NATPortRestrictedCone = "port-restricted-cone"
+	// NATCone - endpoint independent mapping, unknown filtering
+	NATCone = "cone"
+	// NATSymmetric - mapping depends on the destination, hole punching fails
+	NATSymmetric = "symmetric"
 )
 
 // PeerConnMap - type for peer conn config map
@@ -29,7 +63,26 @@ type Proxy struct {
 	RemoteConnAddr *net.UDPAddr
 	LocalConnAddr  *net.UDPAddr
 	ListenPort     int
-	ProxyStatus    bool
+	// ProxyListenPort - proxy port configured on the peer, ListenPort is the port its nat maps it to
+	ProxyListenPort int
+	ProxyStatus     bool
+	// Traffic - counters of the data path, kept across resets of the proxy
+	Traffic *Traffic
+}
+
+// Traffic - bytes proxied to and from a peer, updated atomically on the data path
+type Traffic struct {
+	Sent     atomic.Int64
+	Received atomic.Int64
+	// counters at the last flush to the metrics
+	flushedSent     atomic.Int64
+	flushedReceived atomic.Int64
+}
+
+// Traffic.Flush - returns the bytes proxied since the last flush
+func (t *Traffic) Flush() (sent, received int64) {
+	s, r := t.Sent.Load(), t.Received.Load()
+	return s - t.flushedSent.Swap(s), r - t.flushedReceived.Swap(r)
 }
 
 // Conn is a peer Connection configuration
@@ -56,15 +109,136 @@ type RemotePeer struct {
 	LocalConn   net.Conn
 	CancelFunc  context.CancelFunc
 	CommChan    chan *net.UDPAddr
+	Traffic     *Traffic
 }
 
 // HostInfo - struct for host information
 type HostInfo struct {
-	PublicIp     net.IP
-	PrivIp       net.IP
-	PubPort      int
-	PrivPort     int
-	ProxyEnabled bool
+	PublicIp     net.IP       `json:"public_ip"`
+	PrivIp       net.IP       `json:"priv_ip"`
+	PrivIp6      net.IP       `json:"priv_ip6,omitempty"` // set when the proxy also listens on ipv6 next to ipv4
+	PubPort      int          `json:"pub_port"`
+	PrivPort     int          `json:"priv_port"`
+	ProxyEnabled bool         `json:"proxy_enabled"`
+	RelayedAddr  *net.UDPAddr `json:"relayed_addr,omitempty"` // address allocated on the turn server, nil without turn
+	NAT          NATInfo      `json:"nat"`
+}
+
+// NATInfo - nat behavior of the host
+type NATInfo struct {
+	Mapping   string `json:"mapping" yaml:"mapping"`
+	Filtering string `json:"filtering" yaml:"filtering"`
+	Type      string `json:"type" yaml:"type"`
+}
+
+// NATInfo.IsCone - checks if the mapping is endpoint independent (cone or no nat), peers can reach the host on the
+// address found by stun
+func (n NATInfo) IsCone() bool {
+	return n.Mapping == BehaviorEndpointIndependent
+}
+
+// kinds of candidate addresses of a peer
+const (
+	// CandidateLAN - address of an interface of the peer
+	CandidateLAN = "lan"
+	// CandidatePublic - public address of the peer, as seen by the server or found by stun
+	CandidatePublic = "public"
+	// CandidateProxyPort - proxy port of the peer on its public address
+	CandidateProxyPort = "proxy-port"
+	// CandidateRelay - relay node or turn relay forwarding to the peer
+	CandidateRelay = "relay"
+)
+
+// Candidate - address a peer may be reached on
+type Candidate struct {
+	Kind string `json:"kind" yaml:"kind"`
+	Addr string `json:"addr" yaml:"addr"`
+}
+
+// PeerPath - candidate path to a peer with its measured reachability
+type PeerPath struct {
+	Candidate `yaml:",inline"`
+	// RTT - smoothed round trip time of the probes in milliseconds
+	RTT       float64 `json:"rtt_ms" yaml:"rtt_ms"`
+	Reachable bool    `json:"reachable" yaml:"reachable"`
+	// Lost - probes lost since the last answered probe
+	Lost   int  `json:"lost" yaml:"lost"`
+	Active bool `json:"active" yaml:"active"`
+}
+
+// PeerProxyMetric - state of the proxy to a peer and its latency published with the metrics of a node
+type PeerProxyMetric struct {
+	// Path - active path to the peer, nil on the endpoint provided by the server
+	Path *PeerPath `json:"path,omitempty"`
+	// Latency - round trip times, jitter and loss of the probes to the peer
+	Latency *PeerLatency `json:"latency,omitempty"`
+}
+
+// PeerLatency - round trip times, jitter and loss of the sequenced probes to a peer over a sliding window
+type PeerLatency struct {
+	// Sent - probes in the window that were answered or timed out
+	Sent     int `json:"sent" yaml:"sent"`
+	Received int `json:"received" yaml:"received"`
+	// Loss - share of the sent probes that were not answered, 0 to 1
+	Loss float64 `json:"loss" yaml:"loss"`
+	// P50, P90, P99 - percentiles of the round trip times in milliseconds
+	P50 float64 `json:"rtt_p50_ms" yaml:"rtt_p50_ms"`
+	P90 float64 `json:"rtt_p90_ms" yaml:"rtt_p90_ms"`
+	P99 float64 `json:"rtt_p99_ms" yaml:"rtt_p99_ms"`
+	// Jitter - mean difference of the round trip times of consecutive answered probes in milliseconds
+	Jitter float64 `json:"jitter_ms" yaml:"jitter_ms"`
+	// Tunnel - probed with icmp echoes through the tunnel instead of proxy metric packets
+	Tunnel  bool      `json:"tunnel" yaml:"tunnel"`
+	Updated time.Time `json:"updated" yaml:"updated"`
+}
+
+// Snapshot - state of the proxy taken at once for inspection
+type Snapshot struct {
+	Time      time.Time `json:"time"`
+	Running   bool      `json:"running"`
+	BehindNAT bool      `json:"behind_nat"`
+	HostInfo  HostInfo  `json:"host_info"`
+	// Peers - proxied peers, PeerConnMap
+	Peers        []PeerSnapshot `json:"peers"`
+	NoProxyPeers []PeerSnapshot `json:"no_proxy_peers"`
+	// PeerHashes - peers by the hash of their key, as found in the trailers of the proxy packets
+	PeerHashes        []RemotePeerSnapshot `json:"peer_hashes"`
+	ExtClients        []RemotePeerSnapshot `json:"ext_clients"`
+	ExtClientsWaiting []RemotePeerSnapshot `json:"ext_clients_waiting"`
+	// RelayedRoutes - peers the host relays packets to, by the hashes of the relayed node and the peer
+	RelayedRoutes []RelayedRouteSnapshot `json:"relayed_routes"`
+}
+
+// PeerSnapshot - proxy connection of a peer
+type PeerSnapshot struct {
+	Key             string   `json:"key"`
+	IsExtClient     bool     `json:"is_ext_client"`
+	IsRelayed       bool     `json:"is_relayed"`
+	RelayedEndpoint string   `json:"relayed_endpoint,omitempty"`
+	ProxyStatus     bool     `json:"proxy_status"`
+	LocalAddr       string   `json:"local_addr"`      // loopback address wireguard sends the packets of the peer to
+	RemoteEndpoint  string   `json:"remote_endpoint"` // address the proxy sends the packets of the peer to
+	PeerEndpoint    string   `json:"peer_endpoint"`   // endpoint of the peer as provided by the server
+	Servers         []string `json:"servers"`
+	TrafficSent     int64    `json:"traffic_sent"`
+	TrafficReceived int64    `json:"traffic_received"`
+}
+
+// RemotePeerSnapshot - peer the proxy passes received packets to
+type RemotePeerSnapshot struct {
+	Key         string `json:"key"`
+	Hash        string `json:"hash,omitempty"`
+	Endpoint    string `json:"endpoint"`
+	IsExtClient bool   `json:"is_ext_client"`
+	LocalAddr   string `json:"local_addr,omitempty"`
+}
+
+// RelayedRouteSnapshot - route of the relay to a peer of a relayed node
+type RelayedRouteSnapshot struct {
+	RelayedNodeHash string `json:"relayed_node_hash"`
+	PeerHash        string `json:"peer_hash"`
+	PeerKey         string `json:"peer_key"`
+	Endpoint        string `json:"endpoint"`
 }
 
 // ConvPeerKeyToHash - converts peer key to a md5 hash
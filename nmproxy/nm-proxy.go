@@ -2,11 +2,14 @@ package nmproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
+	ncconfig "github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/nmproxy/config"
 	"github.com/gravitl/netclient/nmproxy/manager"
+	"github.com/gravitl/netclient/nmproxy/peer"
 	"github.com/gravitl/netclient/nmproxy/server"
 	"github.com/gravitl/netclient/nmproxy/stun"
 	"github.com/gravitl/netmaker/logger"
@@ -31,19 +34,65 @@ func Start(ctx context.Context, wg *sync.WaitGroup, mgmChan chan *models.HostPee
 	}
 	config.InitializeCfg()
 	defer config.Reset()
-	config.GetCfg().SetHostInfo(stun.GetHostInfo(stunAddr, stunPort, proxyPort))
-	logger.Log(0, fmt.Sprintf("HOSTINFO: %+v", config.GetCfg().GetHostInfo()))
-	if config.GetCfg().HostInfo.PrivIp == nil || config.GetCfg().HostInfo.PublicIp == nil {
+	addr, addr6, err := discoverHostInfo(stunAddr, stunPort, proxyPort)
+	if err != nil {
 		logger.FatalLog("failed to create proxy, check if stun is configured correctly on your server: ",
 			fmt.Sprintf("%s:%d", stunAddr, stunPort))
 	}
-	config.GetCfg().SetNATStatus()
-	// start the netclient proxy server
-	err := server.NmProxyServer.CreateProxyServer(proxyPort, 0, config.GetCfg().GetHostInfo().PrivIp.String())
-	if err != nil {
+	if err := server.NmProxyServer.CreateProxyServer(proxyPort, 0, addr, addr6); err != nil {
 		logger.FatalLog("failed to create proxy: ", err.Error())
 	}
 	config.GetCfg().SetServerConn(server.NmProxyServer.Server)
+	if turnCfg := ncconfig.Netclient().Proxy.Turn; turnCfg.Server != "" {
+		if _, err := server.NmProxyServer.StartTurn(ctx, turnCfg.Server, turnCfg.Username, turnCfg.Password); err != nil {
+			logger.Log(0, "failed to allocate turn relay, proxying without it: ", err.Error())
+		}
+	}
 	go manager.Start(ctx, mgmChan)
+	go peer.ProbeNoProxyPeers(ctx)
+	go serveInspect(ctx)
 	server.NmProxyServer.Listen(ctx)
 }
+
+// Rebind - re-runs stun and moves the proxy listeners to the current private address of the host, the peers and
+// the interfaces are kept
+func Rebind(stunAddr string, stunPort int) error {
+	if !config.GetCfg().IsProxyRunning() {
+		return errors.New("proxy is not running")
+	}
+	return server.NmProxyServer.Rebind(func() (string, string, error) {
+		return discoverHostInfo(stunAddr, stunPort, server.NmProxyServer.Config.Port)
+	})
+}
+
+// discoverHostInfo - finds the private and public address of the host and its nat with stun and returns the ipv4
+// and ipv6 address for the proxy to listen on, the proxy port must not be bound
+func discoverHostInfo(stunAddr string, stunPort, proxyPort int) (addr, addr6 string, err error) {
+	hostInfo := stun.GetHostInfo(stunAddr, stunPort, proxyPort)
+	logger.Log(0, fmt.Sprintf("HOSTINFO: %+v", hostInfo))
+	if hostInfo.PrivIp == nil || hostInfo.PublicIp == nil {
+		return "", "", errors.New("stun failed")
+	}
+	network := "udp4"
+	if hostInfo.PrivIp.To4() == nil {
+		network = "udp6"
+	}
+	hostInfo.NAT = stun.DiscoverNAT(network, stunAddr, stunPort, proxyPort, ncconfig.Netclient().Proxy.StunServers)
+	logger.Log(0, fmt.Sprintf("NAT: %+v", hostInfo.NAT))
+	if err := stun.SaveNATInfo(hostInfo.NAT); err != nil {
+		logger.Log(1, "failed to save nat info: ", err.Error())
+	}
+	// listen on both address families if available
+	if privIP := hostInfo.PrivIp; privIP.To4() != nil {
+		addr = privIP.String()
+		if privIP6 := stun.GetPrivIP6(stunAddr, stunPort); privIP6 != nil {
+			hostInfo.PrivIp6 = privIP6
+			addr6 = privIP6.String()
+		}
+	} else {
+		addr6 = privIP.String()
+	}
+	config.GetCfg().SetHostInfo(hostInfo)
+	config.GetCfg().SetNATStatus()
+	return addr, addr6, nil
+}
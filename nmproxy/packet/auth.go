@@ -0,0 +1,247 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ProxyAuthMessage - trailer of an authenticated proxy transport message, the macs cover the payload and the
+// trailer up to the macs; MAC is keyed with the static key pair of the sender and receiver, RelayMAC with the
+// static key pair of the sender and the relay forwarding the packet and is zero for direct packets; the counter
+// increases with each packet from the sender to the receiver so replayed packets can be dropped
+type ProxyAuthMessage struct {
+	Type     MessageType
+	Version  uint32
+	Sender   [PeerKeyHashSize]byte
+	Reciever [PeerKeyHashSize]byte
+	Counter  uint64
+	MAC      [ProxyMACSize]byte
+	RelayMAC [ProxyMACSize]byte
+}
+
+// sessionKey - static key pair of the host and a peer
+type sessionKey struct {
+	priv wgtypes.Key
+	peer wgtypes.Key
+}
+
+// session - mac key of a static key pair and the key hashes of both sides
+type session struct {
+	key       [blake2s.Size]byte
+	localHash [PeerKeyHashSize]byte
+	peerHash  [PeerKeyHashSize]byte
+	// counter - counter of the last packet sent, starts at the time the session was created so it keeps increasing
+	// across restarts of the sender
+	counter uint64
+}
+
+// replayKey - sender and receiver of the packets a replay filter applies to
+type replayKey struct {
+	sender   [PeerKeyHashSize]byte
+	reciever [PeerKeyHashSize]byte
+}
+
+// replayFilter - highest counter received and which of the counters of the window below it were received
+type replayFilter struct {
+	mutex  sync.Mutex
+	last   uint64
+	window [ProxyReplayWindow / 64]uint64
+}
+
+// authHeaderSize - part of the trailer covered by the macs
+const authHeaderSize = MessageProxyAuthTransportSize - 2*ProxyMACSize
+
+var sessions = make(map[sessionKey]*session) // cache of the derived mac keys and key hashes
+var sessionsMutex = sync.RWMutex{}           // used to mutex access to sessions
+var replayFilters = make(map[replayKey]*replayFilter)
+var replayFiltersMutex = sync.RWMutex{} // used to mutex access to replayFilters
+
+// ProcessAuthPacketBeforeSending - appends an authenticated proxy transport trailer, relayKey is the
+// public key of the relay the packet is sent through, nil for direct packets
+func ProcessAuthPacketBeforeSending(buf []byte, n int, privKey, dstKey wgtypes.Key, relayKey *wgtypes.Key) ([]byte, int, string, string) {
+	buf = AppendAuthTrailer(buf[:n], privKey, dstKey, relayKey)
+	s := getSession(privKey, dstKey)
+	return buf, len(buf), hex.EncodeToString(s.localHash[:]), hex.EncodeToString(s.peerHash[:])
+}
+
+// AppendAuthTrailer - appends an authenticated proxy transport trailer to the packet without allocating when the
+// buffer has room for it, relayKey is the public key of the relay the packet is sent through, nil for direct packets
+func AppendAuthTrailer(buf []byte, privKey, dstKey wgtypes.Key, relayKey *wgtypes.Key) []byte {
+	s := getSession(privKey, dstKey)
+	m := ProxyAuthMessage{
+		Type:     MessageProxyAuthTransportType,
+		Version:  ProxyAuthVersion,
+		Sender:   s.localHash,
+		Reciever: s.peerHash,
+		Counter:  atomic.AddUint64(&s.counter, 1),
+	}
+	var trailer [MessageProxyAuthTransportSize]byte
+	m.encode(trailer[:])
+	m.MAC = s.mac(buf, trailer[:authHeaderSize])
+	if relayKey != nil {
+		m.RelayMAC = getSession(privKey, *relayKey).mac(buf, trailer[:authHeaderSize])
+	}
+	m.encode(trailer[:])
+	return append(buf, trailer[:]...)
+}
+
+// ExtractAuthInfo - extracts an authenticated proxy transport trailer from the data buffer
+func ExtractAuthInfo(buffer []byte, n int) (int, *ProxyAuthMessage, error) {
+	if n < MessageProxyAuthTransportSize {
+		return n, nil, errors.New("proxy message not found")
+	}
+	trailer := buffer[n-MessageProxyAuthTransportSize : n]
+	if MessageType(binary.LittleEndian.Uint32(trailer)) != MessageProxyAuthTransportType {
+		return n, nil, errors.New("not an authenticated proxy message")
+	}
+	msg := &ProxyAuthMessage{}
+	msg.decode(trailer)
+	if msg.Version != ProxyAuthVersion {
+		return n, nil, fmt.Errorf("unsupported proxy message version %d", msg.Version)
+	}
+	return n - MessageProxyAuthTransportSize, msg, nil
+}
+
+// VerifyProxyMAC - verifies the mac of a payload for the receiver, or the relay mac if relay is set;
+// the payload is the data buffer without the trailer
+func VerifyProxyMAC(payload []byte, msg *ProxyAuthMessage, privKey, srcKey wgtypes.Key, relay bool) bool {
+	var trailer [MessageProxyAuthTransportSize]byte
+	msg.encode(trailer[:])
+	expected := msg.MAC
+	if relay {
+		expected = msg.RelayMAC
+	}
+	mac := getSession(privKey, srcKey).mac(payload, trailer[:authHeaderSize])
+	return subtle.ConstantTimeCompare(mac[:], expected[:]) == 1
+}
+
+// StreamCertMAC - mac binding the public key of a stream certificate to the static key pair of the host and a
+// peer, the certificate of a peer presenting it can only come from the peer
+func StreamCertMAC(privKey, peerKey wgtypes.Key, publicKeyInfo []byte) [ProxyMACSize]byte {
+	return getSession(privKey, peerKey).mac(publicKeyInfo, []byte(streamCertLabel))
+}
+
+// CheckReplay - checks that the counter of a packet with a verified mac was not received before from the sender
+// for the receiver and is not older than the replay window, and records it
+func CheckReplay(msg *ProxyAuthMessage) bool {
+	key := replayKey{sender: msg.Sender, reciever: msg.Reciever}
+	replayFiltersMutex.RLock()
+	f, ok := replayFilters[key]
+	replayFiltersMutex.RUnlock()
+	if !ok {
+		replayFiltersMutex.Lock()
+		if f, ok = replayFilters[key]; !ok {
+			f = &replayFilter{}
+			replayFilters[key] = f
+		}
+		replayFiltersMutex.Unlock()
+	}
+	return f.check(msg.Counter)
+}
+
+// HasRelayMAC - checks if the sender added a mac for the relay
+func (m *ProxyAuthMessage) HasRelayMAC() bool {
+	return !isZero(m.RelayMAC[:])
+}
+
+// ProxyAuthMessage.encode - writes the trailer to b in little endian, b holds MessageProxyAuthTransportSize bytes
+func (m *ProxyAuthMessage) encode(b []byte) {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(m.Type))
+	binary.LittleEndian.PutUint32(b[4:8], m.Version)
+	copy(b[8:24], m.Sender[:])
+	copy(b[24:40], m.Reciever[:])
+	binary.LittleEndian.PutUint64(b[40:48], m.Counter)
+	copy(b[48:64], m.MAC[:])
+	copy(b[64:80], m.RelayMAC[:])
+}
+
+// ProxyAuthMessage.decode - reads the trailer from b, b holds MessageProxyAuthTransportSize bytes
+func (m *ProxyAuthMessage) decode(b []byte) {
+	m.Type = MessageType(binary.LittleEndian.Uint32(b[0:4]))
+	m.Version = binary.LittleEndian.Uint32(b[4:8])
+	copy(m.Sender[:], b[8:24])
+	copy(m.Reciever[:], b[24:40])
+	m.Counter = binary.LittleEndian.Uint64(b[40:48])
+	copy(m.MAC[:], b[48:64])
+	copy(m.RelayMAC[:], b[64:80])
+}
+
+// replayFilter.check - accepts a counter above the highest one or within the window below it if not seen yet
+func (f *replayFilter) check(counter uint64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if counter > f.last {
+		shift := counter - f.last
+		if shift >= ProxyReplayWindow {
+			f.window = [ProxyReplayWindow / 64]uint64{}
+		} else {
+			for i := f.last + 1; i < counter; i++ {
+				f.window[(i/64)%uint64(len(f.window))] &^= 1 << (i % 64)
+			}
+		}
+		f.last = counter
+		f.window[(counter/64)%uint64(len(f.window))] |= 1 << (counter % 64)
+		return true
+	}
+	if f.last-counter >= ProxyReplayWindow {
+		return false
+	}
+	word, bit := (counter/64)%uint64(len(f.window)), uint64(1)<<(counter%64)
+	if f.window[word]&bit != 0 {
+		return false
+	}
+	f.window[word] |= bit
+	return true
+}
+
+// session.mac - keyed blake2s mac of the payload and header
+func (s *session) mac(payload, header []byte) (mac [ProxyMACSize]byte) {
+	h, err := blake2s.New128(s.key[:])
+	if err != nil {
+		return
+	}
+	h.Write(payload)
+	h.Write(header)
+	h.Sum(mac[:0])
+	return
+}
+
+// getSession - derives the mac key of a static key pair from their shared secret, both sides derive the same key;
+// the derivation is cached since it runs a scalar multiplication
+func getSession(privKey, peerKey wgtypes.Key) *session {
+	sessionsMutex.RLock()
+	s, ok := sessions[sessionKey{priv: privKey, peer: peerKey}]
+	sessionsMutex.RUnlock()
+	if ok {
+		return s
+	}
+	localKey := privKey.PublicKey()
+	s = &session{
+		localHash: md5.Sum([]byte(localKey.String())),
+		peerHash:  md5.Sum([]byte(peerKey.String())),
+		counter:   uint64(time.Now().UnixNano()),
+	}
+	priv := NoisePrivateKey(privKey)
+	ss := sharedSecret(&priv, NoisePublicKey(peerKey))
+	first, second := localKey[:], peerKey[:]
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	hmac2(&s.key, ss[:], []byte(proxyAuthLabel), append(append([]byte{}, first...), second...))
+	setZero(ss[:])
+	sessionsMutex.Lock()
+	sessions[sessionKey{priv: privKey, peer: peerKey}] = s
+	sessionsMutex.Unlock()
+	return s
+}
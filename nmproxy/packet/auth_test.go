@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// BenchmarkAppendAuthTrailer - authenticates a packet of the default mtu in a buffer with room for the trailer
+func BenchmarkAppendAuthTrailer(b *testing.B) {
+	privKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	pubKey := peerKey.PublicKey()
+	buf := make([]byte, 1420, 1420+MessageProxyAuthTransportSize)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		AppendAuthTrailer(buf, privKey, pubKey, nil)
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	is := is.New(t)
+	sender, receiver, relay := newKey(t), newKey(t), newKey(t)
+	payload := []byte("wireguard transport message")
+	seal := func(relayKey *wgtypes.Key) ([]byte, int, *ProxyAuthMessage) {
+		buf := AppendAuthTrailer(append([]byte{}, payload...), sender, receiver.PublicKey(), relayKey)
+		n, msg, err := ExtractAuthInfo(buf, len(buf))
+		is.NoErr(err)
+		return buf, n, msg
+	}
+	t.Run("verify", func(t *testing.T) {
+		buf, n, msg := seal(nil)
+		is.Equal(buf[:n], payload)
+		is.True(VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), false))
+		is.True(!msg.HasRelayMAC())
+	})
+	t.Run("tampered payload", func(t *testing.T) {
+		buf, n, msg := seal(nil)
+		buf[0] ^= 1
+		is.True(!VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), false))
+	})
+	t.Run("tampered trailer", func(t *testing.T) {
+		buf, n, msg := seal(nil)
+		msg.Counter++
+		is.True(!VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), false))
+		buf, n, msg = seal(nil)
+		msg.Reciever[0] ^= 1
+		is.True(!VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), false))
+	})
+	t.Run("wrong keys", func(t *testing.T) {
+		buf, n, msg := seal(nil)
+		is.True(!VerifyProxyMAC(buf[:n], msg, relay, sender.PublicKey(), false))
+		is.True(!VerifyProxyMAC(buf[:n], msg, receiver, relay.PublicKey(), false))
+	})
+	t.Run("relay", func(t *testing.T) {
+		relayKey := relay.PublicKey()
+		buf, n, msg := seal(&relayKey)
+		is.True(msg.HasRelayMAC())
+		is.True(VerifyProxyMAC(buf[:n], msg, relay, sender.PublicKey(), true))
+		is.True(VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), false))
+		// the receiver can't forge the relay mac and the relay can't forge the mac
+		is.True(!VerifyProxyMAC(buf[:n], msg, receiver, sender.PublicKey(), true))
+		is.True(!VerifyProxyMAC(buf[:n], msg, relay, sender.PublicKey(), false))
+	})
+	t.Run("relay without relay mac", func(t *testing.T) {
+		buf, n, msg := seal(nil)
+		is.True(!VerifyProxyMAC(buf[:n], msg, relay, sender.PublicKey(), true))
+	})
+	t.Run("replay", func(t *testing.T) {
+		_, _, first := seal(nil)
+		_, _, second := seal(nil)
+		is.True(second.Counter > first.Counter)
+		is.True(CheckReplay(second))
+		is.True(CheckReplay(first))
+		is.True(!CheckReplay(first))
+		is.True(!CheckReplay(second))
+	})
+	t.Run("downgrade", func(t *testing.T) {
+		buf, n, _ := seal(nil)
+		// stripped trailer
+		_, _, err := ExtractAuthInfo(buf[:n], n)
+		is.True(err != nil)
+		// legacy trailer
+		legacy, ln, _, _ := ProcessPacketBeforeSending(append([]byte{}, payload...), len(payload),
+			sender.PublicKey().String(), receiver.PublicKey().String())
+		_, _, err = ExtractAuthInfo(legacy, ln)
+		is.True(err != nil)
+		// older version
+		binary.LittleEndian.PutUint32(buf[n+4:], ProxyAuthVersion-1)
+		_, _, err = ExtractAuthInfo(buf, len(buf))
+		is.True(err != nil)
+	})
+}
+
+func TestReplayFilter(t *testing.T) {
+	is := is.New(t)
+	f := &replayFilter{}
+	is.True(f.check(100))
+	is.True(!f.check(100))
+	t.Run("out of order within window", func(t *testing.T) {
+		is.True(f.check(102))
+		is.True(f.check(101))
+		is.True(!f.check(101))
+	})
+	t.Run("too old", func(t *testing.T) {
+		is.True(f.check(100 + ProxyReplayWindow))
+		is.True(!f.check(100))
+		is.True(f.check(101 + 64))
+	})
+	t.Run("jump beyond window", func(t *testing.T) {
+		last := uint64(100 + 3*ProxyReplayWindow)
+		is.True(f.check(last))
+		is.True(f.check(last - 1))
+		is.True(!f.check(last - ProxyReplayWindow))
+	})
+	t.Run("window slot reused", func(t *testing.T) {
+		g := &replayFilter{}
+		is.True(g.check(5))
+		is.True(g.check(5 + ProxyReplayWindow - 1))
+		// the slot of 5 is cleared for 5 + window but 5 stays too old
+		is.True(g.check(5 + ProxyReplayWindow))
+		is.True(!g.check(5))
+		is.True(!g.check(5 + ProxyReplayWindow))
+	})
+}
+
+func newKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -96,7 +96,7 @@ func CreateMetricPacket(id uint32, sender, reciever wgtypes.Key) ([]byte, error)
 		Reciever:  reciever,
 		TimeStamp: time.Now().UnixMilli(),
 	}
-	logger.Log(1, fmt.Sprintf("----------> $$ CREATED PACKET: %+v\n", msg))
+	logger.Log(3, fmt.Sprintf("----------> $$ CREATED PACKET: %+v\n", msg))
 	var buff [MessageMetricSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	err := binary.Write(writer, binary.LittleEndian, msg)
@@ -0,0 +1,124 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ProxySignalMessage - header of a signal between two proxies, followed by the payload sealed with the static
+// key pair of the sender and receiver
+type ProxySignalMessage struct {
+	Type     MessageType
+	Sender   wgtypes.Key
+	Reciever wgtypes.Key
+}
+
+// ProxyPunchMessage - struct for hole punching probe message; the session id stays between the two peers, the mac
+// covers it and the header and is keyed with the static key pair of the peers
+type ProxyPunchMessage struct {
+	Type   MessageType
+	Action ProxyActionType
+	Sender wgtypes.Key
+	MAC    [ProxyMACSize]byte
+}
+
+// CreateSignalPacket - creates a signal message carrying the payload sealed for the receiver
+func CreateSignalPacket(payload []byte, privKey, dstKey wgtypes.Key) ([]byte, error) {
+	m := ProxySignalMessage{
+		Type:     MessageProxySignalType,
+		Sender:   privKey.PublicKey(),
+		Reciever: dstKey,
+	}
+	var buff [MessageProxySignalSize]byte
+	writer := bytes.NewBuffer(buff[:0])
+	if err := binary.Write(writer, binary.LittleEndian, m); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	sealed := box.Seal(nonce[:], payload, &nonce, (*[32]byte)(&dstKey), (*[32]byte)(&privKey))
+	return append(writer.Bytes(), sealed...), nil
+}
+
+// ConsumeSignalMsg - decodes the header of a signal message
+func ConsumeSignalMsg(buf []byte) (*ProxySignalMessage, error) {
+	var msg ProxySignalMessage
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != MessageProxySignalType {
+		return nil, errors.New("not proxy signal message")
+	}
+	return &msg, nil
+}
+
+// OpenSignal - opens the payload of a signal message sent to the holder of privKey
+func OpenSignal(buf []byte, msg *ProxySignalMessage, privKey wgtypes.Key) ([]byte, error) {
+	if len(buf) < MessageProxySignalSize+24 {
+		return nil, errors.New("short proxy signal message")
+	}
+	sealed := buf[MessageProxySignalSize:]
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	payload, ok := box.Open(nil, sealed[24:], &nonce, (*[32]byte)(&msg.Sender), (*[32]byte)(&privKey))
+	if !ok {
+		return nil, errors.New("could not open proxy signal message")
+	}
+	return payload, nil
+}
+
+// CreatePunchPacket - creates a hole punching probe or the answer to one for the peer in the session
+func CreatePunchPacket(action ProxyActionType, session [PunchSessionSize]byte, privKey, peerKey wgtypes.Key) ([]byte, error) {
+	m := ProxyPunchMessage{
+		Type:   MessageProxyPunchType,
+		Action: action,
+		Sender: privKey.PublicKey(),
+	}
+	buf, err := m.encode()
+	if err != nil {
+		return nil, err
+	}
+	m.MAC = getSession(privKey, peerKey).mac(session[:], buf[:MessageProxyPunchSize-ProxyMACSize])
+	return m.encode()
+}
+
+// VerifyPunchMsg - checks that a hole punching message was sent by its sender in the session
+func VerifyPunchMsg(msg *ProxyPunchMessage, session [PunchSessionSize]byte, privKey wgtypes.Key) bool {
+	buf, err := msg.encode()
+	if err != nil {
+		return false
+	}
+	mac := getSession(privKey, msg.Sender).mac(session[:], buf[:MessageProxyPunchSize-ProxyMACSize])
+	return subtle.ConstantTimeCompare(mac[:], msg.MAC[:]) == 1
+}
+
+// ConsumePunchMsg - decodes hole punching message
+func ConsumePunchMsg(buf []byte) (*ProxyPunchMessage, error) {
+	var msg ProxyPunchMessage
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != MessageProxyPunchType {
+		return nil, errors.New("not proxy punch message")
+	}
+	return &msg, nil
+}
+
+// ProxyPunchMessage.encode - encodes the message
+func (m *ProxyPunchMessage) encode() ([]byte, error) {
+	var buff [MessageProxyPunchSize]byte
+	writer := bytes.NewBuffer(buff[:0])
+	if err := binary.Write(writer, binary.LittleEndian, m); err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
+}
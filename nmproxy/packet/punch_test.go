@@ -0,0 +1,83 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestPunchMsg(t *testing.T) {
+	is := is.New(t)
+	sender, receiver, other := newKey(t), newKey(t), newKey(t)
+	session := [PunchSessionSize]byte{1, 2, 3}
+	create := func(action ProxyActionType) *ProxyPunchMessage {
+		buf, err := CreatePunchPacket(action, session, sender, receiver.PublicKey())
+		is.NoErr(err)
+		is.Equal(len(buf), MessageProxyPunchSize)
+		msg, err := ConsumePunchMsg(buf)
+		is.NoErr(err)
+		return msg
+	}
+	t.Run("verify", func(t *testing.T) {
+		msg := create(PunchAck)
+		is.Equal(msg.Action, PunchAck)
+		is.Equal(msg.Sender, sender.PublicKey())
+		is.True(VerifyPunchMsg(msg, session, receiver))
+	})
+	t.Run("other session", func(t *testing.T) {
+		is.True(!VerifyPunchMsg(create(PunchAck), [PunchSessionSize]byte{1, 2, 4}, receiver))
+	})
+	t.Run("probe as ack", func(t *testing.T) {
+		msg := create(PunchProbe)
+		msg.Action = PunchAck
+		is.True(!VerifyPunchMsg(msg, session, receiver))
+	})
+	t.Run("forged sender", func(t *testing.T) {
+		msg := create(PunchAck)
+		msg.Sender = other.PublicKey()
+		is.True(!VerifyPunchMsg(msg, session, receiver))
+	})
+	t.Run("other receiver", func(t *testing.T) {
+		is.True(!VerifyPunchMsg(create(PunchAck), session, other))
+	})
+}
+
+func TestSignal(t *testing.T) {
+	is := is.New(t)
+	sender, receiver, relay := newKey(t), newKey(t), newKey(t)
+	payload := []byte(`{"kind":"offer"}`)
+	buf, err := CreateSignalPacket(payload, sender, receiver.PublicKey())
+	is.NoErr(err)
+	relayKey := relay.PublicKey()
+	buf = AppendAuthTrailer(buf, sender, receiver.PublicKey(), &relayKey)
+	n, authMsg, err := ExtractAuthInfo(buf, len(buf))
+	is.NoErr(err)
+	t.Run("relay verifies", func(t *testing.T) {
+		is.True(VerifyProxyMAC(buf[:n], authMsg, relay, sender.PublicKey(), true))
+	})
+	t.Run("open", func(t *testing.T) {
+		is.True(VerifyProxyMAC(buf[:n], authMsg, receiver, sender.PublicKey(), false))
+		msg, err := ConsumeSignalMsg(buf[:n])
+		is.NoErr(err)
+		is.Equal(msg.Sender, sender.PublicKey())
+		is.Equal(msg.Reciever, receiver.PublicKey())
+		opened, err := OpenSignal(buf[:n], msg, receiver)
+		is.NoErr(err)
+		is.Equal(opened, payload)
+	})
+	t.Run("relay can't open", func(t *testing.T) {
+		msg, err := ConsumeSignalMsg(buf[:n])
+		is.NoErr(err)
+		_, err = OpenSignal(buf[:n], msg, relay)
+		is.True(err != nil)
+	})
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte{}, buf[:n]...)
+		tampered[n-1] ^= 1
+		is.True(!VerifyProxyMAC(tampered, authMsg, relay, sender.PublicKey(), true))
+		msg, err := ConsumeSignalMsg(tampered)
+		is.NoErr(err)
+		_, err = OpenSignal(tampered, msg, receiver)
+		is.True(err != nil)
+	})
+}
@@ -49,11 +49,34 @@ const (
 	// MessageProxyTransportSize - constant for proxy transport message size
 	MessageProxyTransportSize = 36
 
+	// MessageProxyAuthTransportSize - constant for authenticated proxy transport message size
+	MessageProxyAuthTransportSize = 80
+
+	// MessageProxySignalSize - constant for proxy signal message header size
+	MessageProxySignalSize = 68
+
+	// MessageProxyPunchSize - constant for proxy punch message size
+	MessageProxyPunchSize = 56
+
+	// PunchSessionSize - constant for the size of the id of a hole punching session
+	PunchSessionSize = 16
+
+	// ProxyMACSize - constant for the size of the macs of the authenticated proxy transport message
+	ProxyMACSize = 16
+
+	// ProxyAuthVersion - constant for the version of the authenticated proxy transport message, 2 added the counter
+	ProxyAuthVersion = 2
+
+	// ProxyReplayWindow - constant for the number of counters below the highest one accepted out of order
+	ProxyReplayWindow = 1024
+
 	// constants for wg handshake identifiers
 	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
 	wGIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
 	wGLabelMAC1       = "mac1----"
 	wGLabelCookie     = "cookie--"
+	proxyAuthLabel    = "netmaker proxy auth v1"
+	streamCertLabel   = "netmaker proxy stream certificate v1"
 
 	// MessageTransportType - constant for wg message transport type
 	MessageTransportType MessageType = 4
@@ -70,8 +93,23 @@ const (
 	// MessageProxyUpdateType - constant for proxy update message
 	MessageProxyUpdateType MessageType = 7
 
+	// MessageProxyAuthTransportType - constant for authenticated proxy transport message
+	MessageProxyAuthTransportType MessageType = 8
+
+	// MessageProxySignalType - constant for encrypted signal message between proxies
+	MessageProxySignalType MessageType = 9
+
+	// MessageProxyPunchType - constant for hole punching probe message
+	MessageProxyPunchType MessageType = 10
+
 	// UpdateListenPort - constant update listen port proxy action
 	UpdateListenPort ProxyActionType = 1
+
+	// PunchProbe - constant for the punch action probing a candidate endpoint
+	PunchProbe ProxyActionType = 2
+
+	// PunchAck - constant for the punch action answering a probe
+	PunchAck ProxyActionType = 3
 )
 
 func mixKey(dst, c *[blake2s.Size]byte, data []byte) {
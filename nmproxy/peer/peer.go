@@ -3,15 +3,16 @@ package peer
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lan"
 	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/latency"
 	"github.com/gravitl/netclient/nmproxy/models"
-	"github.com/gravitl/netclient/nmproxy/packet"
 	"github.com/gravitl/netclient/nmproxy/proxy"
 	"github.com/gravitl/netclient/nmproxy/wg"
 	"github.com/gravitl/netmaker/logger"
@@ -29,11 +30,13 @@ func AddNew(server string, peer wgtypes.PeerConfig, peerConf nm_models.PeerConf,
 		peer.PersistentKeepaliveInterval = &d
 	}
 	c := models.Proxy{
-		PeerPublicKey: peer.PublicKey,
-		IsExtClient:   peerConf.IsExtClient,
-		PeerConf:      peer,
-		ListenPort:    int(peerConf.PublicListenPort),
-		ProxyStatus:   peerConf.Proxy,
+		PeerPublicKey:   peer.PublicKey,
+		IsExtClient:     peerConf.IsExtClient,
+		PeerConf:        peer,
+		ListenPort:      int(peerConf.PublicListenPort),
+		ProxyListenPort: peerConf.ProxyListenPort,
+		ProxyStatus:     peerConf.Proxy,
+		Traffic:         &models.Traffic{},
 	}
 	p := proxy.New(c)
 	peerPort := int(peerConf.PublicListenPort)
@@ -53,7 +56,7 @@ func AddNew(server string, peer wgtypes.PeerConfig, peerConf nm_models.PeerConf,
 		peerEndpointIP = relayTo.IP
 		peerPort = relayTo.Port
 	}
-	peerEndpoint, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", peerEndpointIP, peerPort))
+	peerEndpoint, err := net.ResolveUDPAddr("udp", net.JoinHostPort(peerEndpointIP.String(), strconv.Itoa(peerPort)))
 	if err != nil {
 		return err
 	}
@@ -84,6 +87,7 @@ func AddNew(server string, peer wgtypes.PeerConfig, peerConf nm_models.PeerConf,
 		IsExtClient: peerConf.IsExtClient,
 		Endpoint:    peerEndpoint,
 		LocalConn:   p.LocalConn,
+		Traffic:     p.Config.Traffic,
 	}
 	if peerConf.Proxy || peerConf.IsExtClient {
 		logger.Log(1, "-----> saving as proxy peer: ", connConf.Key.String())
@@ -99,10 +103,15 @@ func AddNew(server string, peer wgtypes.PeerConfig, peerConf nm_models.PeerConf,
 	return nil
 }
 
-// SetPeersEndpointToProxy - sets peer endpoints to local addresses connected to proxy
+// SetPeersEndpointToProxy - sets peer endpoints to local addresses connected to proxy, peers found on the lan
+// are reached directly
 func SetPeersEndpointToProxy(peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
 	logger.Log(1, "Setting peers endpoints to proxy...")
 	for i := range peers {
+		if addr, found := lan.GetEndpoint(peers[i].PublicKey.String()); found {
+			peers[i].Endpoint = addr
+			continue
+		}
 		proxyPeer, found := config.GetCfg().GetPeer(peers[i].PublicKey.String())
 		if found {
 			proxyPeer.Mutex.RLock()
@@ -126,6 +135,11 @@ func SetPeersEndpointToProxy(peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
 // StartMetricsCollectionForHostPeers - starts metrics collection when host proxy setting is off
 func StartMetricsCollectionForHostPeers(ctx context.Context) {
 	logger.Log(1, "Starting Metrics Thread...")
+	go func() {
+		if err := latency.ProbeTunnel(ctx, getTunnelAddrs); err != nil {
+			logger.Log(0, "failed to probe the latency of the peers through the tunnel: ", err.Error())
+		}
+	}()
 	ticker := time.NewTicker(metrics.MetricCollectionInterval)
 	for {
 		select {
@@ -143,6 +157,26 @@ func StartMetricsCollectionForHostPeers(ctx context.Context) {
 	}
 }
 
+// ProbeNoProxyPeers - probes the peers without a proxy, ext clients included, through the tunnel until the context is
+// done, for hosts with the proxy switched on; only a proxy answers the metric packets sent to the peers
+func ProbeNoProxyPeers(ctx context.Context) {
+	err := latency.ProbeTunnel(ctx, func() map[string]net.IP {
+		addrs := make(map[string]net.IP)
+		if config.GetCfg().IsIfaceNil() {
+			return addrs
+		}
+		for peerKey, addr := range getTunnelAddrs() {
+			if peer, found := config.GetCfg().GetPeer(peerKey); !found || !peer.Config.ProxyStatus {
+				addrs[peerKey] = addr
+			}
+		}
+		return addrs
+	})
+	if err != nil {
+		logger.Log(0, "failed to probe the latency of the peers without a proxy: ", err.Error())
+	}
+}
+
 func collectMetricsForServerPeers(server string, peerIDAndAddrMap nm_models.HostPeerMap) {
 
 	ifacePeers, err := wg.GetPeers(config.GetCfg().GetIface().Name)
@@ -157,23 +191,37 @@ func collectMetricsForServerPeers(server string, peerIDAndAddrMap nm_models.Host
 			for peerID := range peerIDMap {
 				metric.NodeConnectionStatus[peerID] = connectionStatus
 			}
-			metric.LastRecordedLatency = 999
+			metric.LastRecordedLatency = latency.MetricLatency(peer.PublicKey.String())
 			metric.TrafficRecieved = metric.TrafficRecieved + peer.ReceiveBytes
 			metric.TrafficSent = metric.TrafficSent + peer.TransmitBytes
 			metrics.UpdateMetric(server, peer.PublicKey.String(), &metric)
-			pkt, err := packet.CreateMetricPacket(uuid.New().ID(), config.GetCfg().GetDevicePubKey(), peer.PublicKey)
-			if err == nil {
-				conn := config.GetCfg().GetServerConn()
-				if conn != nil {
-					_, err = conn.WriteToUDP(pkt, peer.Endpoint)
-					if err != nil {
-						logger.Log(1, "Failed to send to metric pkt: ", err.Error())
-					}
-				}
-
-			}
 		}
 
 	}
 
 }
+
+// getTunnelAddrs - address of each peer of the interface within the network range of a node, by peer key
+func getTunnelAddrs() map[string]net.IP {
+	addrs := make(map[string]net.IP)
+	ifacePeers, err := wg.GetPeers(config.GetCfg().GetIface().Name)
+	if err != nil {
+		return addrs
+	}
+	nodes := ncconfig.GetNodes()
+	for _, peer := range ifacePeers {
+		for _, allowedIP := range peer.AllowedIPs {
+			ones, bits := allowedIP.Mask.Size()
+			if ones != bits {
+				continue
+			}
+			for _, node := range nodes {
+				if (node.NetworkRange.IP != nil && node.NetworkRange.Contains(allowedIP.IP)) ||
+					(node.NetworkRange6.IP != nil && node.NetworkRange6.Contains(allowedIP.IP)) {
+					addrs[peer.PublicKey.String()] = allowedIP.IP
+				}
+			}
+		}
+	}
+	return addrs
+}
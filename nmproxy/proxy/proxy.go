@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strconv"
 
 	"github.com/gravitl/netclient/nmproxy/common"
 	"github.com/gravitl/netclient/nmproxy/config"
@@ -27,23 +28,11 @@ func (p *Proxy) Start() error {
 	var err error
 	p.RemoteConn = p.Config.PeerEndpoint
 	logger.Log(0, fmt.Sprintf("----> Established Remote Conn with RPeer: %s, ----> RAddr: %s", p.Config.PeerPublicKey.String(), p.RemoteConn.String()))
-	addr, err := GetFreeIp(models.DefaultCIDR, config.GetCfg().GetInterfaceListenPort())
-	if err != nil {
-		logger.Log(1, "Failed to get freeIp: ", err.Error())
-		return err
+	if p.RemoteConn.IP.To4() == nil {
+		err = p.dialLocal6()
+	} else {
+		err = p.dialLocal()
 	}
-	wgListenAddr, err := GetInterfaceListenAddr(config.GetCfg().GetInterfaceListenPort())
-	if err != nil {
-		logger.Log(1, "failed to get wg listen addr: ", err.Error())
-		return err
-	}
-	if runtime.GOOS == "darwin" { // on darwin need listen on alias ip that was added to lo0
-		wgListenAddr.IP = net.ParseIP(addr)
-	}
-	p.LocalConn, err = net.DialUDP("udp", &net.UDPAddr{
-		IP:   net.ParseIP(addr),
-		Port: models.NmProxyPort,
-	}, wgListenAddr)
 	if err != nil {
 		logger.Log(0, "failed dialing to local Wireguard port,Err: %v\n", err.Error())
 		return err
@@ -67,6 +56,42 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// Proxy.dialLocal - dials the local Wireguard port from a free address of the loopback range
+func (p *Proxy) dialLocal() error {
+	addr, err := GetFreeIp(models.DefaultCIDR, config.GetCfg().GetInterfaceListenPort())
+	if err != nil {
+		logger.Log(1, "Failed to get freeIp: ", err.Error())
+		return err
+	}
+	wgListenAddr, err := GetInterfaceListenAddr(config.GetCfg().GetInterfaceListenPort(), false)
+	if err != nil {
+		logger.Log(1, "failed to get wg listen addr: ", err.Error())
+		return err
+	}
+	if runtime.GOOS == "darwin" { // on darwin need listen on alias ip that was added to lo0
+		wgListenAddr.IP = net.ParseIP(addr)
+	}
+	p.LocalConn, err = net.DialUDP("udp", &net.UDPAddr{
+		IP:   net.ParseIP(addr),
+		Port: models.NmProxyPort,
+	}, wgListenAddr)
+	return err
+}
+
+// Proxy.dialLocal6 - dials the local Wireguard port for an ipv6 peer, ipv6 has a single loopback
+// address so the local endpoints of ipv6 peers are told apart by port instead of by address
+func (p *Proxy) dialLocal6() error {
+	wgListenAddr, err := GetInterfaceListenAddr(config.GetCfg().GetInterfaceListenPort(), true)
+	if err != nil {
+		logger.Log(1, "failed to get wg listen addr: ", err.Error())
+		return err
+	}
+	p.LocalConn, err = net.DialUDP("udp6", &net.UDPAddr{
+		IP: net.ParseIP(models.LoopbackIP6),
+	}, wgListenAddr)
+	return err
+}
+
 // Proxy.Close - removes peer conn from proxy and closes all the opened connections locally
 func (p *Proxy) Close() {
 	logger.Log(0, "------> Closing Proxy for ", p.Config.PeerPublicKey.String())
@@ -79,7 +104,7 @@ func (p *Proxy) Close() {
 			return
 		}
 
-		if host != "127.0.0.1" {
+		if host != "127.0.0.1" && host != models.LoopbackIP6 {
 			_, err = common.RunCmd(fmt.Sprintf("ifconfig lo0 -alias %s 255.255.255.255", host), true)
 			if err != nil {
 				logger.Log(0, "Failed to add alias: ", err.Error())
@@ -89,10 +114,13 @@ func (p *Proxy) Close() {
 	}
 }
 
-// GetInterfaceListenAddr - gets interface listen addr
-func GetInterfaceListenAddr(port int) (*net.UDPAddr, error) {
+// GetInterfaceListenAddr - gets interface listen addr, on the ipv6 loopback if ipv6 is set
+func GetInterfaceListenAddr(port int, ipv6 bool) (*net.UDPAddr, error) {
 	locallistenAddr := "127.0.0.1"
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", locallistenAddr, port))
+	if ipv6 {
+		locallistenAddr = models.LoopbackIP6
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(locallistenAddr, strconv.Itoa(port)))
 	if err != nil {
 		return udpAddr, err
 	}
@@ -11,15 +11,26 @@ import (
 	"time"
 
 	"github.com/c-robinson/iplib"
-	"github.com/google/uuid"
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lan"
 	"github.com/gravitl/netclient/nmproxy/common"
 	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/latency"
 	"github.com/gravitl/netclient/nmproxy/models"
 	"github.com/gravitl/netclient/nmproxy/packet"
 	"github.com/gravitl/netclient/nmproxy/server"
 	"github.com/gravitl/netclient/nmproxy/wg"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/metrics"
+	nm_models "github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// fallbackCheckInterval - interval for checking if a peer has to be moved to another path
+	fallbackCheckInterval = time.Second * 30
+	// fallbackDelay - time given to the handshakes of a peer on a path before falling back to the next
+	fallbackDelay = time.Minute
 )
 
 // New - gets new proxy config
@@ -29,53 +40,46 @@ func New(config models.Proxy) *Proxy {
 	return p
 }
 
-// Proxy.toRemote - proxies data from the interface to remote peer
+// Proxy.toRemote - proxies data from the interface to remote peer, the packets read with one syscall are sent
+// with one syscall
 func (p *Proxy) toRemote(wg *sync.WaitGroup) {
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
-	buf := make([]byte, 65000)
 	defer wg.Done()
+	conn, ok := p.LocalConn.(*net.UDPConn)
+	if !ok {
+		logger.Log(0, "local conn of peer is not a udp conn: ", p.Config.PeerPublicKey.String())
+		return
+	}
+	reader := server.NewBatchReader(conn, localPacketSize())
+	defer reader.Close()
+	bufs := make([][]byte, 0)
 	for {
 		select {
 		case <-p.Ctx.Done():
 			return
 		default:
 
-			n, err := p.LocalConn.Read(buf)
+			datagrams, err := reader.Read()
 			if err != nil {
 				logger.Log(1, "error reading: ", err.Error())
 				continue
 			}
-
-			go func(n int, cfg models.Proxy) {
-				peerConnCfg := models.Conn{}
-				if p.Config.ProxyStatus {
-					peerConnCfg, _ = config.GetCfg().GetPeer(cfg.PeerPublicKey.String())
-				} else {
-					peerConnCfg, _ = config.GetCfg().GetNoProxyPeer(p.Config.PeerEndpoint.IP)
-				}
-				for server := range peerConnCfg.ServerMap {
-					metric := metrics.GetMetric(server, cfg.PeerPublicKey.String())
-					metric.TrafficSent += int64(n)
-					metrics.UpdateMetric(server, cfg.PeerPublicKey.String(), &metric)
+			addTrailer := p.trailer()
+			bufs = bufs[:0]
+			for _, d := range datagrams {
+				buf := d.Data
+				if p.Config.Traffic != nil {
+					p.Config.Traffic.Sent.Add(int64(len(buf)))
 				}
-
-			}(n, p.Config)
-
-			var srcPeerKeyHash, dstPeerKeyHash string
-			if p.Config.ProxyStatus {
-				buf, n, srcPeerKeyHash, dstPeerKeyHash = packet.ProcessPacketBeforeSending(buf, n,
-					config.GetCfg().GetDevicePubKey().String(), p.Config.PeerPublicKey.String())
-				if err != nil {
-					logger.Log(1, "failed to process pkt before sending: ", err.Error())
+				if addTrailer != nil {
+					buf = addTrailer(buf)
 				}
+				bufs = append(bufs, buf)
 			}
-
-			logger.Log(3, fmt.Sprintf("PROXING TO REMOTE!!!---> %s >>>>> %s >>>>> %s [[ SrcPeerHash: %s, DstPeerHash: %s ]]\n",
-				p.LocalConn.LocalAddr().String(), server.NmProxyServer.Server.LocalAddr().String(), p.RemoteConn.String(), srcPeerKeyHash, dstPeerKeyHash))
-
-			_, err = server.NmProxyServer.Server.WriteToUDP(buf[:n], p.RemoteConn)
-			if err != nil {
+			if logger.Verbosity >= 3 {
+				logger.Log(3, fmt.Sprintf("PROXING TO REMOTE!!!---> %s >>>>> %s >>>>> %s [[ Packets: %d ]]\n",
+					p.LocalConn.LocalAddr().String(), server.NmProxyServer.LocalAddr().String(), p.RemoteConn.String(), len(bufs)))
+			}
+			if err := server.NmProxyServer.WriteBatch(bufs, p.RemoteConn); err != nil {
 				logger.Log(1, "Failed to send to remote: ", err.Error())
 			}
 
@@ -84,6 +88,43 @@ func (p *Proxy) toRemote(wg *sync.WaitGroup) {
 
 }
 
+// Proxy.trailer - appends the proxy transport trailer, authenticated unless the peer or the configuration
+// requires the legacy trailer; nil when the peer is not proxied; the keys are looked up once per batch
+func (p *Proxy) trailer() func([]byte) []byte {
+	if !p.Config.ProxyStatus {
+		return nil
+	}
+	privKey, pubKey := config.GetCfg().GetDeviceKeys()
+	peerKey := p.Config.PeerPublicKey
+	auth := ncconfig.Netclient().Proxy.Auth
+	if auth == ncconfig.ProxyAuthLegacy ||
+		(auth != ncconfig.ProxyAuthStrict && config.GetCfg().IsPeerLegacy(models.ConvPeerKeyToHash(peerKey.String()))) {
+		return func(buf []byte) []byte {
+			buf, _, _, _ = packet.ProcessPacketBeforeSending(buf, len(buf), pubKey.String(), peerKey.String())
+			return buf
+		}
+	}
+	var relayKey *wgtypes.Key
+	if peer, found := config.GetCfg().GetPeer(peerKey.String()); found && peer.IsRelayed {
+		if key, found := config.GetCfg().GetRelayKey(peer.RelayedEndpoint); found {
+			relayKey = &key
+		}
+	}
+	return func(buf []byte) []byte {
+		return packet.AppendAuthTrailer(buf, privKey, peerKey, relayKey)
+	}
+}
+
+// localPacketSize - size of the buffers read from the interface, room for a packet of the mtu and the trailer
+func localPacketSize() int {
+	mtu := ncconfig.Netclient().MTU
+	if mtu < 1500 {
+		mtu = 1500
+	}
+	// wireguard adds up to 32 bytes of header and padding to a packet of the mtu
+	return mtu + 32 + packet.MessageProxyAuthTransportSize
+}
+
 // Proxy.Reset - resets peer's conn
 func (p *Proxy) Reset() {
 	logger.Log(0, "Resetting proxy connection for peer: ", p.Config.PeerPublicKey.String())
@@ -139,6 +180,7 @@ func (p *Proxy) startMetricsThread(wg *sync.WaitGroup) {
 	ticker := time.NewTicker(metrics.MetricCollectionInterval)
 	defer ticker.Stop()
 	defer wg.Done()
+	defer p.flushTraffic()
 	for {
 		select {
 		case <-p.Ctx.Done():
@@ -150,6 +192,7 @@ func (p *Proxy) startMetricsThread(wg *sync.WaitGroup) {
 			} else {
 				peerConnCfg, _ = config.GetCfg().GetNoProxyPeer(p.Config.PeerEndpoint.IP)
 			}
+			p.flushTraffic()
 			for server := range peerConnCfg.ServerMap {
 				peerIDsAndAddrs, found := config.GetCfg().GetPeersIDsAndAddrs(server, peerConnCfg.Config.PeerPublicKey.String())
 				if !found {
@@ -157,27 +200,144 @@ func (p *Proxy) startMetricsThread(wg *sync.WaitGroup) {
 				}
 				metric := metrics.GetMetric(server, p.Config.PeerPublicKey.String())
 				metric.NodeConnectionStatus = make(map[string]bool)
-				metric.LastRecordedLatency = 999
+				metric.LastRecordedLatency = latency.MetricLatency(p.Config.PeerPublicKey.String())
 				connectionStatus := PeerConnectionStatus(p.Config.PeerPublicKey.String())
 				for peerID := range peerIDsAndAddrs {
 					metric.NodeConnectionStatus[peerID] = connectionStatus
 				}
 				metrics.UpdateMetric(server, p.Config.PeerPublicKey.String(), &metric)
 			}
+		}
+	}
+}
 
-			pkt, err := packet.CreateMetricPacket(uuid.New().ID(), config.GetCfg().GetDevicePubKey(), p.Config.PeerPublicKey)
-			if err == nil {
-				logger.Log(3, "-----------> Sending metric packet to: ", p.RemoteConn.String())
-				_, err = server.NmProxyServer.Server.WriteToUDP(pkt, p.RemoteConn)
-				if err != nil {
-					logger.Log(1, "Failed to send to metric pkt: ", err.Error())
-				}
+// Proxy.probeLatency - sends sequenced metric packets to the peer, the replies measure the latency of the peer
+func (p *Proxy) probeLatency(wg *sync.WaitGroup) {
+	ticker := time.NewTicker(latency.ProbeInterval)
+	defer ticker.Stop()
+	defer wg.Done()
+	for {
+		id := latency.Next(p.Config.PeerPublicKey.String(), false)
+		pkt, err := packet.CreateMetricPacket(id, config.GetCfg().GetDevicePubKey(), p.Config.PeerPublicKey)
+		if err == nil {
+			logger.Log(3, "-----------> Sending metric packet to: ", p.RemoteConn.String())
+			_, err = server.NmProxyServer.WriteToUDP(server.AppendAuthTrailer(pkt, p.Config.PeerPublicKey), p.RemoteConn)
+			if err != nil {
+				logger.Log(1, "Failed to send to metric pkt: ", err.Error())
+			}
 
-			} else {
-				logger.Log(0, "failed to create metric pkt: ", err.Error())
+		} else {
+			logger.Log(0, "failed to create metric pkt: ", err.Error())
+		}
+		select {
+		case <-p.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Proxy.flushTraffic - adds the traffic counted on the data path since the last flush to the metrics of the peer
+func (p *Proxy) flushTraffic() {
+	if p.Config.Traffic == nil {
+		return
+	}
+	sent, received := p.Config.Traffic.Flush()
+	if sent == 0 && received == 0 {
+		return
+	}
+	metrics.UpdateMetricByPeer(p.Config.PeerPublicKey.String(), &nm_models.ProxyMetric{
+		TrafficSent:     sent,
+		TrafficRecieved: received,
+	}, true)
+}
+
+// Proxy.watchTransport - punches a hole to the peer, then moves it to the turn relay and then to a stream while its
+// handshakes keep failing, or right away to a stream when the stream transport is configured; unless the stream
+// transport is configured the peer goes back to udp once the path probes sent over udp are answered again
+func (p *Proxy) watchTransport(wg *sync.WaitGroup) {
+	defer wg.Done()
+	// peers sending to the relayed address need a permission on the turn server
+	if err := server.NmProxyServer.PermitTurn(p.RemoteConn); err == nil {
+		defer server.NmProxyServer.UnpermitTurn(p.RemoteConn)
+	} else if !errors.Is(err, server.ErrNoTurn) {
+		logger.Log(1, "failed to permit peer on the turn relay", p.Config.PeerPublicKey.String(), err.Error())
+	}
+	transport := ncconfig.Netclient().Proxy.Transport
+	switched := time.Now()
+	punched, punchedRouted := false, false
+	ticker := time.NewTicker(fallbackCheckInterval)
+	defer ticker.Stop()
+	for {
+		if transport != ncconfig.ProxyTransportStream && server.HasRoute(p.RemoteConn) &&
+			time.Since(switched) > fallbackDelay && server.IsUDPReachable(p.Config.PeerPublicKey) {
+			server.RouteViaUDP(p.RemoteConn)
+			switched = time.Now()
+		} else if !punchedRouted && transport != ncconfig.ProxyTransportStream && server.HasRoute(p.RemoteConn) &&
+			time.Since(switched) > fallbackDelay {
+			// the signals of the punch reach the peer over the stream or the turn relay the peer is reached on
+			punchedRouted = true
+			if err := server.NmProxyServer.Punch(p.Config.PeerPublicKey); err != nil {
+				logger.Log(1, "failed to punch a hole to peer", p.Config.PeerPublicKey.String(), err.Error())
+			}
+		} else if transport == ncconfig.ProxyTransportStream ||
+			(time.Since(switched) > fallbackDelay && !PeerConnectionStatus(p.Config.PeerPublicKey.String())) {
+			if !punched && transport != ncconfig.ProxyTransportStream && !server.HasRoute(p.RemoteConn) &&
+				server.SignalsRelayed(p.Config.PeerPublicKey) {
+				// a punched hole replaces the connection of the peer, the fallback continues if it fails
+				punched = true
+				if err := server.NmProxyServer.Punch(p.Config.PeerPublicKey); err != nil {
+					logger.Log(1, "failed to punch a hole to peer", p.Config.PeerPublicKey.String(), err.Error())
+				} else {
+					switched = time.Now()
+				}
+			} else if p.fallback(transport) {
+				switched = time.Now()
 			}
 		}
+		select {
+		case <-p.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Proxy.fallback - moves the peer from udp to the turn relay if one is allocated, and from udp or the turn relay
+// to a stream unless the udp transport is configured; returns true if the path of the peer changed
+func (p *Proxy) fallback(transport string) bool {
+	viaTurn := server.IsTurnRoute(p.RemoteConn)
+	if !server.HasRoute(p.RemoteConn) && transport != ncconfig.ProxyTransportStream {
+		err := server.NmProxyServer.RouteViaTurn(p.RemoteConn)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, server.ErrNoTurn) {
+			logger.Log(1, "failed to relay peer through turn", p.Config.PeerPublicKey.String(), err.Error())
+		}
+	}
+	if transport == ncconfig.ProxyTransportUDP || (server.HasRoute(p.RemoteConn) && !viaTurn) {
+		return false
 	}
+	if err := server.NmProxyServer.DialStream(p.RemoteConn, p.Config.PeerPublicKey); err != nil {
+		logger.Log(1, "failed to dial proxy stream to peer", p.Config.PeerPublicKey.String(), err.Error())
+		return false
+	}
+	return true
+}
+
+// Proxy.watchPaths - proxies to the peer over the best of its endpoint, its proxy port on the public address of
+// the endpoint and the addresses the peer signals
+func (p *Proxy) watchPaths(wg *sync.WaitGroup) {
+	defer wg.Done()
+	var candidates []models.Candidate
+	if endpoint := p.Config.PeerConf.Endpoint; endpoint != nil && p.Config.ProxyListenPort != 0 {
+		addr := &net.UDPAddr{IP: endpoint.IP, Port: p.Config.ProxyListenPort}
+		if addr.String() != p.RemoteConn.String() {
+			candidates = append(candidates, models.Candidate{Kind: models.CandidateProxyPort, Addr: addr.String()})
+		}
+	}
+	server.NmProxyServer.SelectPaths(p.Ctx, p.Config.PeerPublicKey, p.RemoteConn, candidates)
 }
 
 // Proxy.ProxyPeer proxies data from Wireguard to the remote peer and vice-versa
@@ -188,12 +348,27 @@ func (p *Proxy) ProxyPeer() {
 	go p.toRemote(wg)
 	wg.Add(1)
 	go p.startMetricsThread(wg)
+	if p.Config.ProxyStatus {
+		// peers without a proxy are probed through the tunnel
+		wg.Add(1)
+		go p.probeLatency(wg)
+	}
+	if p.Config.ProxyStatus && !p.Config.IsExtClient {
+		wg.Add(1)
+		go p.watchTransport(wg)
+		wg.Add(1)
+		go p.watchPaths(wg)
+	}
 	wg.Wait()
 
 }
 
 // Proxy.updateEndpoint - updates peer endpoint to point to proxy
 func (p *Proxy) updateEndpoint() error {
+	if _, found := lan.GetEndpoint(p.Config.PeerPublicKey.String()); found {
+		// the peer is reached directly on the lan
+		return nil
+	}
 	udpAddr, err := net.ResolveUDPAddr("udp", p.LocalConn.LocalAddr().String())
 	if err != nil {
 		return err
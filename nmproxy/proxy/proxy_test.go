@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestGetInterfaceListenAddr(t *testing.T) {
+	is := is.New(t)
+	t.Run("ipv4", func(t *testing.T) {
+		addr, err := GetInterfaceListenAddr(51821, false)
+		is.NoErr(err)
+		is.True(addr.IP.Equal(net.ParseIP("127.0.0.1")))
+		is.Equal(addr.Port, 51821)
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		addr, err := GetInterfaceListenAddr(51821, true)
+		is.NoErr(err)
+		is.True(addr.IP.Equal(net.IPv6loopback))
+		is.Equal(addr.Port, 51821)
+	})
+}
@@ -58,6 +58,12 @@ type firewallController interface {
 	SaveRules(server, ruleTableName string, ruleTable ruletable)
 	// FlushAll - clears all rules from netmaker chains and deletes the chains
 	FlushAll()
+	// InsertKillSwitchRules - drops egress traffic not leaving through the netmaker interface except for allowed destinations
+	InsertKillSwitchRules(cfg KillSwitchCfg) error
+	// RemoveKillSwitchRules - removes the kill switch rules
+	RemoveKillSwitchRules() error
+	// KillSwitchActive - checks if the kill switch rules are installed
+	KillSwitchActive() bool
 }
 
 // Init - initialises the firewall controller,return a close func to flush all rules
@@ -4,6 +4,8 @@
 package router
 
 import (
+	"errors"
+
 	"github.com/gravitl/netmaker/models"
 )
 
@@ -54,6 +56,18 @@ func (unimplementedFirewall) DeleteRuleTable(server, ruleTableName string) {
 
 }
 
+func (unimplementedFirewall) InsertKillSwitchRules(cfg KillSwitchCfg) error {
+	return errors.New("kill switch is not supported on this OS")
+}
+
+func (unimplementedFirewall) RemoveKillSwitchRules() error {
+	return nil
+}
+
+func (unimplementedFirewall) KillSwitchActive() bool {
+	return false
+}
+
 // newFirewall returns an unimplemented Firewall manager
 func newFirewall() (firewallController, error) {
 	return unimplementedFirewall{}, nil
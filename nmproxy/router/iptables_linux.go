@@ -3,6 +3,7 @@ package router
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -24,6 +25,9 @@ const (
 	iptableFWDChain     = "FORWARD"
 	nattablePRTChain    = "POSTROUTING"
 	netmakerSignature   = "NETMAKER"
+	iptableOUTChain     = "OUTPUT"
+	killSwitchChain     = "netmakerkillswitch"
+	killSwitchSignature = "NETMAKER-KILLSWITCH"
 )
 
 type iptablesManager struct {
@@ -751,3 +755,91 @@ func appendNetmakerCommentToRule(ruleSpec []string) []string {
 	ruleSpec = append(ruleSpec, "-m", "comment", "--comment", netmakerSignature)
 	return ruleSpec
 }
+
+// iptablesManager.InsertKillSwitchRules - (re)creates the kill switch chain and jumps to it from the OUTPUT chain
+func (i *iptablesManager) InsertKillSwitchRules(cfg KillSwitchCfg) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	for _, iptablesClient := range []*iptables.IPTables{i.ipv4Client, i.ipv6Client} {
+		if err := iptablesClient.ClearChain(defaultIpTable, killSwitchChain); err != nil {
+			return fmt.Errorf("couldn't create %s chain %s, error: %v", iptablesProtoToString(iptablesClient.Proto()), killSwitchChain, err)
+		}
+		rules := killSwitchRuleSpecs(&cfg, iptablesClient.Proto() == iptables.ProtocolIPv4)
+		for _, ruleSpec := range rules {
+			if err := iptablesClient.Append(defaultIpTable, killSwitchChain, ruleSpec...); err != nil {
+				logger.Log(1, fmt.Sprintf("failed to add rule: %v, Err: %v ", ruleSpec, err.Error()))
+			}
+		}
+		jumpRule := []string{"-j", killSwitchChain, "-m", "comment", "--comment", killSwitchSignature}
+		exists, err := iptablesClient.Exists(defaultIpTable, iptableOUTChain, jumpRule...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := iptablesClient.Insert(defaultIpTable, iptableOUTChain, 1, jumpRule...); err != nil {
+				return fmt.Errorf("failed to add rule: %v, Err: %v ", jumpRule, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// killSwitchRuleSpecs - rules of the kill switch chain for ipv4 or ipv6: traffic leaves through the loopback and the
+// netclient interfaces, as encrypted wireguard traffic or to the allowed destinations, anything else is dropped;
+// established connections get no exception so traffic of connections opened before the kill switch can not leak
+func killSwitchRuleSpecs(cfg *KillSwitchCfg, isIpv4 bool) [][]string {
+	rules := [][]string{
+		{"-o", "lo", "-j", "ACCEPT"},
+	}
+	for _, iface := range killSwitchIfaces(cfg) {
+		rules = append(rules, []string{"-o", iface, "-j", "ACCEPT"})
+	}
+	rules = append(rules, []string{"-m", "mark", "--mark", strconv.Itoa(cfg.FwMark), "-j", "ACCEPT"})
+	if isIpv4 {
+		rules = append(rules, []string{"-p", "udp", "--dport", "67", "-j", "ACCEPT"})
+	} else {
+		rules = append(rules, []string{"-p", "udp", "--dport", "547", "-j", "ACCEPT"},
+			[]string{"-p", "ipv6-icmp", "-j", "ACCEPT"})
+	}
+	for _, addr := range cfg.AllowedAddrs {
+		if (addr.To4() != nil) == isIpv4 {
+			rules = append(rules, []string{"-d", addr.String(), "-j", "ACCEPT"})
+		}
+	}
+	for _, lan := range cfg.LANRanges {
+		if isAddrIpv4(lan.String()) == isIpv4 {
+			rules = append(rules, []string{"-d", lan.String(), "-j", "ACCEPT"})
+		}
+	}
+	rules = append(rules, []string{"-j", "DROP"})
+	return rules
+}
+
+// iptablesManager.RemoveKillSwitchRules - removes the jump rule and the kill switch chain
+func (i *iptablesManager) RemoveKillSwitchRules() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	var lastErr error
+	jumpRule := []string{"-j", killSwitchChain, "-m", "comment", "--comment", killSwitchSignature}
+	for _, iptablesClient := range []*iptables.IPTables{i.ipv4Client, i.ipv6Client} {
+		if err := iptablesClient.DeleteIfExists(defaultIpTable, iptableOUTChain, jumpRule...); err != nil {
+			lastErr = err
+		}
+		exists, err := iptablesClient.ChainExists(defaultIpTable, killSwitchChain)
+		if err != nil || !exists {
+			continue
+		}
+		if err := iptablesClient.ClearAndDeleteChain(defaultIpTable, killSwitchChain); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// iptablesManager.KillSwitchActive - checks if the kill switch chain exists
+func (i *iptablesManager) KillSwitchActive() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	exists, err := i.ipv4Client.ChainExists(defaultIpTable, killSwitchChain)
+	return err == nil && exists
+}
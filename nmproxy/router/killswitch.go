@@ -0,0 +1,66 @@
+package router
+
+import (
+	"net"
+
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// KillSwitchCfg - traffic allowed to leave the host outside of the netmaker interface while the kill switch is on
+type KillSwitchCfg struct {
+	// FwMark - mark carried by wireguard's own (encrypted) traffic
+	FwMark int
+	// Interfaces - netclient wireguard interfaces
+	Interfaces []string
+	// AllowedAddrs - peer endpoints, netmaker api and broker addresses
+	AllowedAddrs []net.IP
+	// LANRanges - local networks reachable while the kill switch is on, empty if LAN access is not allowed
+	LANRanges []net.IPNet
+}
+
+// EnableKillSwitch - installs or refreshes the kill switch rules
+func EnableKillSwitch(cfg KillSwitchCfg) error {
+	ctrl, err := getFirewallController()
+	if err != nil {
+		return err
+	}
+	logger.Log(1, "enabling kill switch")
+	return ctrl.InsertKillSwitchRules(cfg)
+}
+
+// DisableKillSwitch - removes the kill switch rules
+func DisableKillSwitch() error {
+	ctrl, err := getFirewallController()
+	if err != nil {
+		return err
+	}
+	logger.Log(1, "disabling kill switch")
+	return ctrl.RemoveKillSwitchRules()
+}
+
+// IsKillSwitchActive - returns true if kill switch rules are installed
+func IsKillSwitchActive() bool {
+	ctrl, err := getFirewallController()
+	if err != nil {
+		return false
+	}
+	return ctrl.KillSwitchActive()
+}
+
+// killSwitchIfaces - returns the netclient interfaces, defaulting to the shared netmaker interface
+func killSwitchIfaces(cfg *KillSwitchCfg) []string {
+	if len(cfg.Interfaces) == 0 {
+		return []string{ncutils.GetInterfaceName()}
+	}
+	return cfg.Interfaces
+}
+
+// getFirewallController - returns the running firewall controller, a new one is created
+// when the firewall has not been initialised (no ingress/egress) or when called from the cli
+func getFirewallController() (firewallController, error) {
+	if fwCrtl != nil {
+		return fwCrtl, nil
+	}
+	return newFirewall()
+}
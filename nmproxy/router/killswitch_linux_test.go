@@ -0,0 +1,59 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/matryer/is"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	cfg := &KillSwitchCfg{
+		FwMark:       51820,
+		Interfaces:   []string{"netmaker"},
+		AllowedAddrs: []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")},
+		LANRanges:    []net.IPNet{{IP: net.IPv4(192, 168, 1, 0), Mask: net.CIDRMask(24, 32)}},
+	}
+	t.Run("iptables ipv4", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(killSwitchRuleSpecs(cfg, true), [][]string{
+			{"-o", "lo", "-j", "ACCEPT"},
+			{"-o", "netmaker", "-j", "ACCEPT"},
+			{"-m", "mark", "--mark", "51820", "-j", "ACCEPT"},
+			{"-p", "udp", "--dport", "67", "-j", "ACCEPT"},
+			{"-d", "203.0.113.7", "-j", "ACCEPT"},
+			{"-d", "192.168.1.0/24", "-j", "ACCEPT"},
+			{"-j", "DROP"},
+		})
+	})
+	t.Run("iptables ipv6", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(killSwitchRuleSpecs(cfg, false), [][]string{
+			{"-o", "lo", "-j", "ACCEPT"},
+			{"-o", "netmaker", "-j", "ACCEPT"},
+			{"-m", "mark", "--mark", "51820", "-j", "ACCEPT"},
+			{"-p", "udp", "--dport", "547", "-j", "ACCEPT"},
+			{"-p", "ipv6-icmp", "-j", "ACCEPT"},
+			{"-d", "2001:db8::7", "-j", "ACCEPT"},
+			{"-j", "DROP"},
+		})
+	})
+	t.Run("nftables", func(t *testing.T) {
+		is := is.New(t)
+		rules := killSwitchExprs(cfg)
+		// loopback, mark, dhcp, dhcpv6, icmpv6, the interface, two allowed addresses and the lan
+		is.Equal(len(rules), 9)
+		var ifaces []string
+		for _, exprs := range rules {
+			for i, e := range exprs {
+				_, ct := e.(*expr.Ct)
+				is.True(!ct) // no exception for established connections
+				if meta, ok := e.(*expr.Meta); ok && meta.Key == expr.MetaKeyOIFNAME {
+					ifaces = append(ifaces, string(exprs[i+1].(*expr.Cmp).Data))
+				}
+			}
+		}
+		is.Equal(ifaces, []string{"lo\x00", "netmaker\x00"})
+	})
+}
@@ -48,6 +48,8 @@ func init() {
 var (
 	filterTable = &nftables.Table{Name: defaultIpTable, Family: nftables.TableFamilyINet}
 	natTable    = &nftables.Table{Name: defaultNatTable, Family: nftables.TableFamilyINet}
+	// kill switch lives in its own table so flushing the filter table does not disable it
+	killSwitchTable = &nftables.Table{Name: killSwitchChain, Family: nftables.TableFamilyINet}
 
 	nfJumpRules []ruleInfo
 	// filter table netmaker jump rules
@@ -1758,8 +1760,167 @@ func (n *nftablesManager) FlushAll() {
 	}
 }
 
+// nftables.InsertKillSwitchRules - (re)creates the kill switch table with an output chain dropping non tunnel traffic
+func (n *nftablesManager) InsertKillSwitchRules(cfg KillSwitchCfg) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.conn.AddTable(killSwitchTable)
+	n.conn.FlushTable(killSwitchTable)
+	policy := new(nftables.ChainPolicy)
+	*policy = nftables.ChainPolicyAccept
+	chain := n.conn.AddChain(&nftables.Chain{
+		Name:     iptableOUTChain,
+		Table:    killSwitchTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   policy,
+	})
+	rules := killSwitchExprs(&cfg)
+	for _, exprs := range rules {
+		exprs = append(exprs, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept})
+		n.conn.AddRule(&nftables.Rule{
+			Table: killSwitchTable,
+			Chain: chain,
+			Exprs: exprs,
+		})
+	}
+	n.conn.AddRule(&nftables.Rule{
+		Table: killSwitchTable,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		},
+	})
+	return n.conn.Flush()
+}
+
+// nftables.RemoveKillSwitchRules - deletes the kill switch table
+func (n *nftablesManager) RemoveKillSwitchRules() error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, err := n.getTable(killSwitchTable.Name); err != nil {
+		return nil
+	}
+	n.conn.DelTable(killSwitchTable)
+	return n.conn.Flush()
+}
+
+// nftables.KillSwitchActive - checks if the kill switch table exists
+func (n *nftablesManager) KillSwitchActive() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	_, err := n.getTable(killSwitchTable.Name)
+	return err == nil
+}
+
 // private functions
 
+// killSwitchExprs - matches of the traffic the kill switch accepts: traffic leaving through the loopback and the
+// netclient interfaces, encrypted wireguard traffic and traffic to the allowed destinations; established connections
+// get no exception so traffic of connections opened before the kill switch can not leak
+func killSwitchExprs(cfg *KillSwitchCfg) [][]expr.Any {
+	rules := [][]expr.Any{
+		{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("lo\x00")},
+		},
+		{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(cfg.FwMark))},
+		},
+		nfUDPDestPortExprs(unix.NFPROTO_IPV4, 67),
+		nfUDPDestPortExprs(unix.NFPROTO_IPV6, 547),
+		{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+		},
+	}
+	for _, iface := range killSwitchIfaces(cfg) {
+		rules = append(rules, []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(iface + "\x00")},
+		})
+	}
+	for _, addr := range cfg.AllowedAddrs {
+		bits := ipv6Len * 8
+		if addr.To4() != nil {
+			bits = ipv4Len * 8
+		}
+		rules = append(rules, nfDestNetExprs(net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}))
+	}
+	for _, lan := range cfg.LANRanges {
+		rules = append(rules, nfDestNetExprs(lan))
+	}
+	return rules
+}
+
+// nfUDPDestPortExprs - matches udp traffic of the given protocol family to a destination port
+func nfUDPDestPortExprs(family byte, port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// nfDestNetExprs - matches traffic destined to the given network
+func nfDestNetExprs(dst net.IPNet) []expr.Any {
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		mask := dst.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[net.IPv6len-net.IPv4len:]
+		}
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       ipv4DestOffset,
+				Len:          ipv4Len,
+			},
+			&expr.Bitwise{
+				DestRegister:   1,
+				SourceRegister: 1,
+				Len:            ipv4Len,
+				Mask:           mask,
+				Xor:            zeroXor,
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip4.Mask(mask)},
+		}
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       ipv6DestOffset,
+			Len:          ipv6Len,
+		},
+		&expr.Bitwise{
+			DestRegister:   1,
+			SourceRegister: 1,
+			Len:            ipv6Len,
+			Mask:           dst.Mask,
+			Xor:            zeroXor6,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: dst.IP.To16().Mask(dst.Mask)},
+	}
+}
+
 //lint:ignore U1000 might be useful in future
 func (n *nftablesManager) getTable(tableName string) (*nftables.Table, error) {
 	tables, err := n.conn.ListTables()
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/gravitl/netmaker/logger"
+	"golang.org/x/net/ipv4"
+)
+
+// batchSize - packets read or written with one syscall
+const batchSize = 32
+
+// batchConn - udp socket reading and writing several packets per syscall
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Datagram - packet of a batch and the address it came from
+type Datagram struct {
+	Data   []byte
+	Source *net.UDPAddr
+}
+
+// batch - buffers and messages of a batched read
+type batch struct {
+	msgs   []ipv4.Message
+	bufs   [][]byte
+	dgrams []Datagram
+}
+
+var batchPools = make(map[int]*sync.Pool) // pools of batches by buffer size
+var batchPoolsMutex = sync.Mutex{}        // used to mutex access to batchPools
+
+// BatchReader - reads the packets of a udp socket in batches
+type BatchReader struct {
+	conn  batchConn
+	batch *batch
+	size  int
+}
+
+// NewBatchReader - reads up to batchSize packets of up to size bytes per syscall from the socket, the buffers
+// come from a pool and go back to it when the reader is closed
+func NewBatchReader(conn *net.UDPConn, size int) *BatchReader {
+	return &BatchReader{
+		conn:  newBatchConn(conn),
+		batch: getBatchPool(size).Get().(*batch),
+		size:  size,
+	}
+}
+
+// BatchReader.Read - reads the next batch, the packets stay valid until the next read; a packet may be extended
+// up to the buffer size without allocating
+func (r *BatchReader) Read() ([]Datagram, error) {
+	b := r.batch
+	n, err := r.conn.ReadBatch(b.msgs, 0)
+	if err != nil {
+		return nil, err
+	}
+	b.dgrams = b.dgrams[:0]
+	for i := 0; i < n; i++ {
+		source, _ := b.msgs[i].Addr.(*net.UDPAddr)
+		b.dgrams = append(b.dgrams, Datagram{Data: b.bufs[i][:b.msgs[i].N], Source: source})
+	}
+	return b.dgrams, nil
+}
+
+// BatchReader.Close - returns the buffers to the pool, the socket is left open
+func (r *BatchReader) Close() {
+	if r.batch == nil {
+		return
+	}
+	getBatchPool(r.size).Put(r.batch)
+	r.batch = nil
+}
+
+// ProxyServer.WriteBatch - sends packets to one address like WriteToUDP, packets sent over udp take one syscall
+// per batch
+func (p *ProxyServer) WriteBatch(bufs [][]byte, addr *net.UDPAddr) error {
+	if r := getRoute(addr); r != nil {
+		for _, b := range bufs {
+			if _, err := r.write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	conn := p.batchConnFor(addr)
+	if conn == nil {
+		for _, b := range bufs {
+			if _, err := p.writeDirect(b, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := writePool.Get().(*writeBatch)
+	defer writePool.Put(w)
+	for len(bufs) > 0 {
+		n := len(bufs)
+		if n > batchSize {
+			n = batchSize
+		}
+		for i := 0; i < n; i++ {
+			w.bufs[i] = bufs[i]
+			w.msgs[i].Buffers = w.bufs[i : i+1]
+			w.msgs[i].Addr = addr
+		}
+		err := sendBatch(conn, w.msgs[:n])
+		for i := 0; i < n; i++ {
+			w.bufs[i] = nil
+			w.msgs[i].Addr = nil
+		}
+		if err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+// == private ==
+
+// writeBatch - messages of a batched write
+type writeBatch struct {
+	msgs []ipv4.Message
+	bufs [][]byte
+}
+
+var writePool = sync.Pool{
+	New: func() any {
+		return &writeBatch{
+			msgs: make([]ipv4.Message, batchSize),
+			bufs: make([][]byte, batchSize),
+		}
+	},
+}
+
+// relayQueue - packets relayed while a batch of a listener is handled, sent with one syscall per listener once
+// the whole batch is handled; the packets point into the buffers of the batch
+type relayQueue struct {
+	server *ProxyServer
+	bufs   [2][][]byte
+	addrs  [2][]*net.UDPAddr
+	msgs   []ipv4.Message
+}
+
+// relayQueue.add - queues a packet, packets for a stream, the turn relay or a listener that can't batch the
+// address are sent right away
+func (q *relayQueue) add(b []byte, addr *net.UDPAddr) error {
+	if r := getRoute(addr); r != nil {
+		_, err := r.write(b)
+		return err
+	}
+	conn := q.server.batchConnFor(addr)
+	if conn == nil {
+		_, err := q.server.writeDirect(b, addr)
+		return err
+	}
+	i := 0
+	if batch, _ := q.server.batchConns(); conn != batch {
+		i = 1
+	}
+	q.bufs[i] = append(q.bufs[i], b)
+	q.addrs[i] = append(q.addrs[i], addr)
+	return nil
+}
+
+// relayQueue.flush - sends the queued packets
+func (q *relayQueue) flush() {
+	batch, batch6 := q.server.batchConns()
+	for i, conn := range [2]batchConn{batch, batch6} {
+		if len(q.bufs[i]) == 0 {
+			continue
+		}
+		// the listeners are gone if they are being replaced, the packets are dropped then
+		if conn != nil {
+			q.msgs = q.msgs[:0]
+			for j := range q.bufs[i] {
+				q.msgs = append(q.msgs, ipv4.Message{Buffers: q.bufs[i][j : j+1], Addr: q.addrs[i][j]})
+			}
+			if err := sendBatch(conn, q.msgs); err != nil {
+				logger.Log(1, "Failed to relay to remote: ", err.Error())
+			}
+		}
+		for j := range q.bufs[i] {
+			q.bufs[i][j] = nil
+			q.addrs[i][j] = nil
+		}
+		q.bufs[i] = q.bufs[i][:0]
+		q.addrs[i] = q.addrs[i][:0]
+	}
+}
+
+// sendBatch - writes the messages, issuing further syscalls until the kernel took all of them
+func sendBatch(conn batchConn, msgs []ipv4.Message) error {
+	for len(msgs) > 0 {
+		n, err := conn.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// ProxyServer.batchConnFor - batched socket of the listener of the address family of the destination, nil if the
+// listener is a dual stack socket which only batches ipv6 destinations
+func (p *ProxyServer) batchConnFor(addr *net.UDPAddr) batchConn {
+	if addr == nil {
+		return nil
+	}
+	p.listenersMutex.RLock()
+	defer p.listenersMutex.RUnlock()
+	if p.Server6 != nil && addr.IP.To4() == nil {
+		return p.batch6
+	}
+	if (addr.IP.To4() != nil) != isIPv4Conn(p.Server) {
+		return nil
+	}
+	return p.batch
+}
+
+// ProxyServer.batchConns - returns the batched sockets of the ipv4, or only, listener and the ipv6 listener
+func (p *ProxyServer) batchConns() (batchConn, batchConn) {
+	p.listenersMutex.RLock()
+	defer p.listenersMutex.RUnlock()
+	return p.batch, p.batch6
+}
+
+// isIPv4Conn - checks if the socket is an ipv4 socket
+func isIPv4Conn(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() != nil
+}
+
+// getBatchPool - pool of the batches with buffers of the size
+func getBatchPool(size int) *sync.Pool {
+	batchPoolsMutex.Lock()
+	defer batchPoolsMutex.Unlock()
+	pool, ok := batchPools[size]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() any {
+				b := &batch{
+					msgs:   make([]ipv4.Message, batchSize),
+					bufs:   make([][]byte, batchSize),
+					dgrams: make([]Datagram, 0, batchSize),
+				}
+				for i := range b.bufs {
+					b.bufs[i] = make([]byte, size)
+					b.msgs[i].Buffers = b.bufs[i : i+1]
+				}
+				return b
+			},
+		}
+		batchPools[size] = pool
+	}
+	return pool
+}
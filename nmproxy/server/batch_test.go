@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+// benchmarkPacketSize - size of the packets of the benchmarks, a full packet of the default mtu
+const benchmarkPacketSize = 1420
+
+// newBenchmarkServer - proxy server and a receiver draining the packets sent to it over loopback
+func newBenchmarkServer(b *testing.B) (*ProxyServer, *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		conn.Close()
+		receiver.Close()
+	})
+	go func() {
+		buf := make([]byte, benchmarkPacketSize)
+		for {
+			if _, _, err := receiver.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+	p := &ProxyServer{Server: conn, batch: newBatchConn(conn)}
+	return p, receiver.LocalAddr().(*net.UDPAddr)
+}
+
+// benchmarkPackets - a batch of packets
+func benchmarkPackets() [][]byte {
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, benchmarkPacketSize)
+	}
+	return bufs
+}
+
+// BenchmarkWriteToUDP - sends a batch of packets with one syscall per packet
+func BenchmarkWriteToUDP(b *testing.B) {
+	p, addr := newBenchmarkServer(b)
+	bufs := benchmarkPackets()
+	b.SetBytes(int64(batchSize * benchmarkPacketSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, buf := range bufs {
+			if _, err := p.WriteToUDP(buf, addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkWriteBatch - sends a batch of packets with one syscall per batch
+func BenchmarkWriteBatch(b *testing.B) {
+	p, addr := newBenchmarkServer(b)
+	bufs := benchmarkPackets()
+	b.SetBytes(int64(batchSize * benchmarkPacketSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.WriteBatch(bufs, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// pathProbeInterval - interval of the probes sent on each path to a peer
+	pathProbeInterval = time.Second * 10
+	// pathSignalInterval - interval for sending the candidates of the host to a peer again
+	pathSignalInterval = time.Minute * 5
+	// pathLossThreshold - probes lost in a row before a path is considered unreachable
+	pathLossThreshold = 3
+	// pathSwitchRatio - a path replaces the active path when its rtt is below this share of the rtt of the active path
+	pathSwitchRatio = 0.75
+	// maxRemoteCandidates - candidates accepted from a peer
+	maxRemoteCandidates = 16
+	// pathsFile - state file holding the paths to the peers
+	pathsFile = "paths.yml"
+)
+
+// pathRoute - sends the packets for the endpoint of a peer over udp to another address of the peer
+type pathRoute struct {
+	server *ProxyServer
+	addr   *net.UDPAddr
+}
+
+// pathRoute.write - sends a packet to the address of the active path
+func (r *pathRoute) write(b []byte) (int, error) {
+	return r.server.writeDirect(b, r.addr)
+}
+
+// path - candidate path to a peer
+type path struct {
+	models.PeerPath
+	addr  *net.UDPAddr
+	probe uint32 // id of the unanswered probe, 0 if none
+	sent  time.Time
+}
+
+// pathSet - paths to a peer, the endpoint provided by the server is the default path
+type pathSet struct {
+	endpoint *net.UDPAddr
+	paths    map[string]*path // by address
+	active   string           // address of the active path
+	route    *pathRoute       // route to the active path, nil on the default path
+}
+
+var pathSets = make(map[string]*pathSet)                   // paths by peer key
+var pathProbes = make(map[uint32]string)                   // peer key by id of the unanswered probes
+var remoteCandidates = make(map[string][]models.Candidate) // candidates signaled by the peers, by peer key
+var pathsSaved time.Time                                   // last write of the state file
+var pathsMutex = sync.Mutex{}                              // used to mutex access to the paths
+
+// ProxyServer.SelectPaths - probes the endpoint of the peer, the candidates and the candidates signaled by the peer
+// with metric packets and proxies the packets for the endpoint over the reachable path with the lowest rtt until
+// the context is done; the turn relay and streams chosen by the fallback take precedence
+func (p *ProxyServer) SelectPaths(ctx context.Context, peerKey wgtypes.Key, endpoint *net.UDPAddr, candidates []models.Candidate) {
+	set := &pathSet{
+		endpoint: endpoint,
+		paths:    make(map[string]*path),
+		active:   endpoint.String(),
+	}
+	pathsMutex.Lock()
+	pathSets[peerKey.String()] = set
+	pathsMutex.Unlock()
+	defer p.endPaths(peerKey, set)
+	p.signalCandidates(peerKey, signalCandidates)
+	probeTicker := time.NewTicker(pathProbeInterval)
+	defer probeTicker.Stop()
+	signalTicker := time.NewTicker(pathSignalInterval)
+	defer signalTicker.Stop()
+	p.probePaths(peerKey, set, candidates)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signalTicker.C:
+			p.signalCandidates(peerKey, signalCandidates)
+		case <-probeTicker.C:
+			p.probePaths(peerKey, set, candidates)
+		}
+	}
+}
+
+// IsUDPReachable - checks if a path to the peer answers the probes sent over udp
+func IsUDPReachable(peerKey wgtypes.Key) bool {
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+	set := pathSets[peerKey.String()]
+	if set == nil {
+		return false
+	}
+	for _, pa := range set.paths {
+		if pa.Reachable {
+			return true
+		}
+	}
+	return false
+}
+
+// GetActivePaths - active paths to the peers, by peer key
+func GetActivePaths() map[string]models.PeerPath {
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+	paths := make(map[string]models.PeerPath)
+	for peerKey, set := range pathSets {
+		if pa, found := set.paths[set.active]; found {
+			paths[peerKey] = pa.PeerPath
+		}
+	}
+	return paths
+}
+
+// GetPeerPaths - reads the paths to the peers chosen by the proxy of the daemon, by peer key
+func GetPeerPaths() (map[string][]models.PeerPath, error) {
+	paths := make(map[string][]models.PeerPath)
+	data, err := os.ReadFile(ncconfig.GetNetclientPath() + pathsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return paths, nil
+		}
+		return paths, err
+	}
+	return paths, yaml.Unmarshal(data, &paths)
+}
+
+// == private ==
+
+// ProxyServer.signalCandidates - sends the candidates of the host to the peer
+func (p *ProxyServer) signalCandidates(peerKey wgtypes.Key, kind string) {
+	sig := signal{
+		Kind:       kind,
+		Candidates: p.localCandidates(),
+	}
+	if err := p.sendSignal(peerKey, sig); err != nil {
+		logger.Log(1, "failed to send candidates to peer", peerKey.String(), err.Error())
+	}
+}
+
+// ProxyServer.handleCandidates - records the candidates of a peer and answers with the candidates of the host
+func (p *ProxyServer) handleCandidates(peerKey wgtypes.Key, sig signal) {
+	var candidates []models.Candidate
+	for _, candidate := range sig.Candidates {
+		switch candidate.Kind {
+		case models.CandidateLAN, models.CandidatePublic, models.CandidateProxyPort, models.CandidateRelay:
+		default:
+			continue
+		}
+		if _, err := net.ResolveUDPAddr("udp", candidate.Addr); err != nil || len(candidates) == maxRemoteCandidates {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	logger.Log(3, "received", strconv.Itoa(len(candidates)), "candidates of peer", peerKey.String())
+	pathsMutex.Lock()
+	remoteCandidates[peerKey.String()] = candidates
+	pathsMutex.Unlock()
+	if sig.Kind == signalCandidates {
+		p.signalCandidates(peerKey, signalCandidatesAnswer)
+	}
+}
+
+// ProxyServer.probePaths - accounts for the probes lost since the last round, switches to the best path and sends
+// the next round of probes
+func (p *ProxyServer) probePaths(peerKey wgtypes.Key, set *pathSet, candidates []models.Candidate) {
+	kind := models.CandidatePublic
+	if peer, found := config.GetCfg().GetPeer(peerKey.String()); found && peer.IsRelayed {
+		kind = models.CandidateRelay
+	}
+	pathsMutex.Lock()
+	all := append([]models.Candidate{{Kind: kind, Addr: set.endpoint.String()}}, candidates...)
+	all = append(all, remoteCandidates[peerKey.String()]...)
+	seen := make(map[string]bool)
+	for _, candidate := range all {
+		if seen[candidate.Addr] {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", candidate.Addr)
+		if err != nil {
+			continue
+		}
+		seen[addr.String()] = true
+		if pa, found := set.paths[addr.String()]; found {
+			pa.Kind = candidate.Kind
+			continue
+		}
+		set.paths[addr.String()] = &path{
+			PeerPath: models.PeerPath{Candidate: models.Candidate{Kind: candidate.Kind, Addr: addr.String()}},
+			addr:     addr,
+		}
+	}
+	probes := make(map[uint32]*net.UDPAddr)
+	for addr, pa := range set.paths {
+		if pa.probe != 0 {
+			delete(pathProbes, pa.probe)
+			pa.probe = 0
+			pa.Lost++
+			if pa.Lost >= pathLossThreshold {
+				pa.Reachable = false
+			}
+		}
+		if !seen[addr] {
+			delete(set.paths, addr)
+			continue
+		}
+		pa.probe = newProbeID()
+		pa.sent = time.Now()
+		pathProbes[pa.probe] = peerKey.String()
+		probes[pa.probe] = pa.addr
+	}
+	p.selectPath(peerKey, set)
+	save := time.Since(pathsSaved) >= pathProbeInterval
+	if save {
+		pathsSaved = time.Now()
+	}
+	pathsMutex.Unlock()
+	pubKey := config.GetCfg().GetDevicePubKey()
+	for id, addr := range probes {
+		pkt, err := packet.EncodePacketMetricMsg(&packet.MetricMessage{
+			Type:      packet.MessageMetricsType,
+			ID:        id,
+			Sender:    pubKey,
+			Reciever:  peerKey,
+			TimeStamp: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			logger.Log(1, "failed to create path probe: ", err.Error())
+			continue
+		}
+		if _, err := p.writeDirect(AppendAuthTrailer(pkt, peerKey), addr); err != nil {
+			logger.Log(3, "failed to send path probe to", addr.String(), err.Error())
+		}
+	}
+	if save {
+		savePaths()
+	}
+}
+
+// handlePathProbe - records the rtt of the path a probe was sent on, returns false if the metric packet is not a probe;
+// only replies from the address probed show the path is reachable, not those received over a stream or the turn
+// relay or from another address
+func handlePathProbe(id uint32, source *net.UDPAddr, tunneled bool) bool {
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+	peerKey, found := pathProbes[id]
+	if !found {
+		return false
+	}
+	delete(pathProbes, id)
+	set := pathSets[peerKey]
+	if set == nil || tunneled {
+		return true
+	}
+	for _, pa := range set.paths {
+		if pa.probe != id {
+			continue
+		}
+		if !pa.addr.IP.Equal(source.IP) || pa.addr.Port != source.Port {
+			logger.Log(1, "dropping reply to path probe of", pa.Addr, "from", source.String())
+			return true
+		}
+		rtt := float64(time.Since(pa.sent).Microseconds()) / 1000
+		if pa.Reachable {
+			pa.RTT = pa.RTT*7/8 + rtt/8
+		} else {
+			pa.RTT = rtt
+		}
+		pa.probe = 0
+		pa.Lost = 0
+		pa.Reachable = true
+	}
+	return true
+}
+
+// ProxyServer.selectPath - switches to the reachable path with the lowest rtt if the active path is unreachable or
+// the rtt is well below the rtt of the active path, and to the default path if no path is reachable
+func (p *ProxyServer) selectPath(peerKey wgtypes.Key, set *pathSet) {
+	var best *path
+	for _, pa := range set.paths {
+		if !pa.Reachable {
+			continue
+		}
+		if best == nil || pa.RTT < best.RTT || (pa.RTT == best.RTT && candidatePriority(pa.Kind) < candidatePriority(best.Kind)) {
+			best = pa
+		}
+	}
+	next := set.active
+	active := set.paths[set.active]
+	if best == nil {
+		next = set.endpoint.String()
+	} else if active == nil || !active.Reachable || best.RTT < active.RTT*pathSwitchRatio {
+		next = best.Addr
+	}
+	for addr, pa := range set.paths {
+		pa.Active = addr == next
+	}
+	if next != set.active {
+		logger.Log(0, "switching path to peer", peerKey.String(), "from", set.active, "to", next)
+		set.active = next
+		if set.route != nil {
+			removeRoute(set.route)
+			set.route = nil
+		}
+	}
+	if set.route != nil || next == set.endpoint.String() {
+		return
+	}
+	if r := getRoute(set.endpoint); r != nil {
+		// the turn relay or a stream replaced udp for the peer, the path is taken once the peer is back on udp
+		return
+	}
+	set.route = &pathRoute{server: p, addr: set.paths[next].addr}
+	registerRoute(set.endpoint, set.route)
+}
+
+// ProxyServer.endPaths - goes back to the default path when the peer is closed
+func (p *ProxyServer) endPaths(peerKey wgtypes.Key, set *pathSet) {
+	pathsMutex.Lock()
+	if pathSets[peerKey.String()] == set {
+		delete(pathSets, peerKey.String())
+	}
+	for _, pa := range set.paths {
+		delete(pathProbes, pa.probe)
+	}
+	if set.route != nil {
+		removeRoute(set.route)
+	}
+	pathsMutex.Unlock()
+	savePaths()
+}
+
+// candidatePriority - preference of a kind of candidate when paths have the same rtt, lower is better
+func candidatePriority(kind string) int {
+	switch kind {
+	case models.CandidateLAN:
+		return 0
+	case models.CandidatePublic:
+		return 1
+	case models.CandidateProxyPort:
+		return 2
+	}
+	return 3
+}
+
+// newProbeID - returns a random id not used by another unanswered probe
+func newProbeID() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			continue
+		}
+		if id := binary.LittleEndian.Uint32(b[:]); id != 0 && pathProbes[id] == "" {
+			return id
+		}
+	}
+}
+
+// savePaths - writes the paths to the peers to the state file read by GetPeerPaths
+func savePaths() {
+	pathsMutex.Lock()
+	paths := make(map[string][]models.PeerPath)
+	for peerKey, set := range pathSets {
+		for _, pa := range set.paths {
+			paths[peerKey] = append(paths[peerKey], pa.PeerPath)
+		}
+		sort.Slice(paths[peerKey], func(i, j int) bool {
+			return paths[peerKey][i].Addr < paths[peerKey][j].Addr
+		})
+	}
+	pathsMutex.Unlock()
+	data, err := yaml.Marshal(paths)
+	if err != nil {
+		logger.Log(1, "failed to marshal peer paths: ", err.Error())
+		return
+	}
+	if err := os.WriteFile(ncconfig.GetNetclientPath()+pathsFile, data, 0644); err != nil {
+		logger.Log(1, "failed to save peer paths: ", err.Error())
+	}
+}
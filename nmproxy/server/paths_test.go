@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+)
+
+func TestSelectPath(t *testing.T) {
+	is := is.New(t)
+	p := &ProxyServer{}
+	peerKey := newTestKey(t).PublicKey()
+	endpoint := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51821}
+	lan := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 51722}
+	public := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51722}
+	newSet := func(paths ...*path) *pathSet {
+		set := &pathSet{endpoint: endpoint, paths: make(map[string]*path), active: endpoint.String()}
+		for _, pa := range paths {
+			set.paths[pa.Addr] = pa
+		}
+		return set
+	}
+	newPath := func(kind string, addr *net.UDPAddr, rtt float64, reachable bool) *path {
+		return &path{
+			PeerPath: models.PeerPath{Candidate: models.Candidate{Kind: kind, Addr: addr.String()}, RTT: rtt, Reachable: reachable},
+			addr:     addr,
+		}
+	}
+	t.Run("lowest rtt", func(t *testing.T) {
+		set := newSet(newPath(models.CandidatePublic, endpoint, 40, true), newPath(models.CandidateLAN, lan, 2, true))
+		p.selectPath(peerKey, set)
+		defer removeRoute(set.route)
+		is.Equal(set.active, lan.String())
+		is.True(set.paths[lan.String()].Active)
+		is.True(!set.paths[endpoint.String()].Active)
+		is.Equal(getRoute(endpoint), set.route)
+	})
+	t.Run("rtt not well below the active path", func(t *testing.T) {
+		set := newSet(newPath(models.CandidatePublic, endpoint, 40, true), newPath(models.CandidateProxyPort, public, 35, true))
+		p.selectPath(peerKey, set)
+		is.Equal(set.active, endpoint.String())
+		is.Equal(getRoute(endpoint), nil)
+	})
+	t.Run("active path unreachable", func(t *testing.T) {
+		set := newSet(newPath(models.CandidatePublic, endpoint, 40, false), newPath(models.CandidateProxyPort, public, 35, true))
+		p.selectPath(peerKey, set)
+		defer removeRoute(set.route)
+		is.Equal(set.active, public.String())
+	})
+	t.Run("priority on the same rtt", func(t *testing.T) {
+		set := newSet(newPath(models.CandidateProxyPort, public, 2, true), newPath(models.CandidateLAN, lan, 2, true))
+		p.selectPath(peerKey, set)
+		defer removeRoute(set.route)
+		is.Equal(set.active, lan.String())
+	})
+	t.Run("back to the endpoint", func(t *testing.T) {
+		set := newSet(newPath(models.CandidatePublic, endpoint, 40, true), newPath(models.CandidateLAN, lan, 2, true))
+		p.selectPath(peerKey, set)
+		set.paths[lan.String()].Reachable = false
+		set.paths[endpoint.String()].Reachable = false
+		p.selectPath(peerKey, set)
+		is.Equal(set.active, endpoint.String())
+		is.Equal(set.route, nil)
+		is.Equal(getRoute(endpoint), nil)
+	})
+	t.Run("stream takes precedence", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		s, err := newStream(client, endpoint.String())
+		is.NoErr(err)
+		registerRoute(endpoint, s)
+		defer RouteViaUDP(endpoint)
+		set := newSet(newPath(models.CandidateLAN, lan, 2, true))
+		p.selectPath(peerKey, set)
+		is.Equal(set.active, lan.String())
+		is.Equal(set.route, nil)
+		is.Equal(getRoute(endpoint), s)
+	})
+}
+
+func TestHandlePathProbe(t *testing.T) {
+	is := is.New(t)
+	peerKey := newTestKey(t).PublicKey()
+	endpoint := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51821}
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 51821}
+	pa := &path{
+		PeerPath: models.PeerPath{Candidate: models.Candidate{Kind: models.CandidatePublic, Addr: endpoint.String()}},
+		addr:     endpoint,
+	}
+	pathSets[peerKey.String()] = &pathSet{endpoint: endpoint, paths: map[string]*path{pa.Addr: pa}, active: pa.Addr}
+	defer delete(pathSets, peerKey.String())
+	probe := func() uint32 {
+		pa.probe = newProbeID()
+		pa.sent = time.Now()
+		pathProbes[pa.probe] = peerKey.String()
+		return pa.probe
+	}
+	t.Run("not a probe", func(t *testing.T) {
+		is.True(!handlePathProbe(1, endpoint, false))
+	})
+	t.Run("other address", func(t *testing.T) {
+		is.True(handlePathProbe(probe(), other, false))
+		is.True(!pa.Reachable)
+	})
+	t.Run("tunneled", func(t *testing.T) {
+		is.True(handlePathProbe(probe(), endpoint, true))
+		is.True(!pa.Reachable)
+	})
+	t.Run("reachable", func(t *testing.T) {
+		pa.Lost = 2
+		is.True(handlePathProbe(probe(), endpoint, false))
+		is.True(pa.Reachable)
+		is.Equal(pa.Lost, 0)
+		is.Equal(pa.probe, uint32(0))
+	})
+	t.Run("answered once", func(t *testing.T) {
+		id := probe()
+		is.True(handlePathProbe(id, endpoint, false))
+		is.True(!handlePathProbe(id, endpoint, false))
+	})
+}
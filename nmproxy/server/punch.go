@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// punchDelay - time between sending the offer and probing, for the signals to reach the peer
+	punchDelay = time.Second * 2
+	// punchTimeout - how long both sides probe the candidates of each other
+	punchTimeout = time.Second * 5
+	// punchProbeInterval - interval of the probes sent to each candidate
+	punchProbeInterval = time.Millisecond * 200
+)
+
+// ErrPunchInProgress - returned when a hole is already being punched to the peer
+var ErrPunchInProgress = errors.New("hole punching in progress")
+
+// punch - hole punching session with a peer
+type punch struct {
+	peer    wgtypes.Key
+	answers chan signal
+	done    chan *net.UDPAddr
+}
+
+var punches = make(map[[packet.PunchSessionSize]byte]*punch) // hole punching sessions by id
+var punchesMutex = sync.Mutex{}                              // used to mutex access to punches
+
+// ProxyServer.Punch - offers the candidates of the host to the peer and, once it answers, probes the candidates of
+// the peer at the same time as the peer probes the candidates of the host; on success both switch the endpoint
+// of each other to the punched address
+func (p *ProxyServer) Punch(peerKey wgtypes.Key) error {
+	var session [packet.PunchSessionSize]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return err
+	}
+	pu, err := startPunch(session, peerKey, false)
+	if err != nil {
+		return err
+	}
+	offer := signal{
+		Kind:       signalPunchOffer,
+		Session:    session[:],
+		Candidates: publicCandidates(),
+		Start:      time.Now().Add(punchDelay).UnixMilli(),
+	}
+	if err := p.sendSignal(peerKey, offer); err != nil {
+		endPunch(session)
+		return err
+	}
+	logger.Log(1, "offered candidates for hole punching to peer", peerKey.String(), fmt.Sprint(offer.Candidates))
+	go func() {
+		defer endPunch(session)
+		select {
+		case answer := <-pu.answers:
+			p.probe(session, pu, answer.Candidates, time.UnixMilli(offer.Start))
+		case <-time.After(punchDelay):
+			logger.Log(1, "peer", peerKey.String(), "did not answer the hole punching offer")
+		}
+	}()
+	return nil
+}
+
+// ProxyServer.handlePunchSignal - answers an offer of a peer or passes the answer of a peer to the session
+func (p *ProxyServer) handlePunchSignal(peerKey wgtypes.Key, sig signal) {
+	if len(sig.Session) != packet.PunchSessionSize {
+		logger.Log(1, "dropping punch signal without session from peer", peerKey.String())
+		return
+	}
+	var session [packet.PunchSessionSize]byte
+	copy(session[:], sig.Session)
+	if sig.Kind == signalPunchOffer {
+		p.answerPunch(session, peerKey, sig)
+		return
+	}
+	if pu := getPunch(session); pu != nil && pu.peer == peerKey {
+		select {
+		case pu.answers <- sig:
+		default:
+		}
+	}
+}
+
+// ProxyServer.answerPunch - answers an offer with the candidates of the host and probes the candidates offered
+func (p *ProxyServer) answerPunch(session [packet.PunchSessionSize]byte, peerKey wgtypes.Key, offer signal) {
+	// when both peers offer at the same time the offer of the peer with the greater key wins
+	_, pubKey := config.GetCfg().GetDeviceKeys()
+	pu, err := startPunch(session, peerKey, bytes.Compare(peerKey[:], pubKey[:]) > 0)
+	if err != nil {
+		// the offer arrived over both the server and the proxy path, or the offer of the host wins
+		return
+	}
+	answer := signal{
+		Kind:       signalPunchAnswer,
+		Session:    session[:],
+		Candidates: publicCandidates(),
+		Start:      offer.Start,
+	}
+	if err := p.sendSignal(peerKey, answer); err != nil {
+		logger.Log(1, "failed to answer hole punching offer of peer", peerKey.String(), err.Error())
+		endPunch(session)
+		return
+	}
+	go func() {
+		defer endPunch(session)
+		p.probe(session, pu, offer.Candidates, time.UnixMilli(offer.Start))
+	}()
+}
+
+// ProxyServer.probe - probes the candidates from start on until a probe is answered or the timeout passes, and
+// switches the endpoint of the peer to the candidate answering
+func (p *ProxyServer) probe(session [packet.PunchSessionSize]byte, pu *punch, candidates []models.Candidate, start time.Time) {
+	var addrs []*net.UDPAddr
+	for _, candidate := range candidates {
+		addr, err := net.ResolveUDPAddr("udp", candidate.Addr)
+		if err != nil {
+			logger.Log(1, "ignoring invalid candidate", candidate.Addr, "of peer", pu.peer.String())
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	probe, err := packet.CreatePunchPacket(packet.PunchProbe, session, privKey, pu.peer)
+	if err != nil {
+		logger.Log(1, "failed to create punch probe: ", err.Error())
+		return
+	}
+	time.Sleep(time.Until(start))
+	timeout := time.After(punchTimeout)
+	ticker := time.NewTicker(punchProbeInterval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range addrs {
+			if _, err := p.writeDirect(probe, addr); err != nil {
+				logger.Log(3, "failed to send punch probe to", addr.String(), err.Error())
+			}
+		}
+		select {
+		case addr := <-pu.done:
+			logger.Log(0, "punched a hole to peer", pu.peer.String(), "at", addr.String())
+			switchEndpoint(pu.peer, addr)
+			return
+		case <-timeout:
+			logger.Log(1, "failed to punch a hole to peer", pu.peer.String())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProxyServer.handlePunch - answers the probes of a peer and ends the session once the peer answers a probe; only
+// messages the peer authenticated for the session are taken
+func (p *ProxyServer) handlePunch(buf []byte, n int, source *net.UDPAddr) {
+	msg, err := packet.ConsumePunchMsg(buf[:n])
+	if err != nil {
+		logger.Log(1, "failed to decode punch message: ", err.Error())
+		return
+	}
+	session, pu := getPeerPunch(msg.Sender)
+	if pu == nil {
+		return
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	if !packet.VerifyPunchMsg(msg, session, privKey) {
+		logger.Log(1, "dropping punch message with invalid mac from", source.String())
+		return
+	}
+	switch msg.Action {
+	case packet.PunchProbe:
+		ack, err := packet.CreatePunchPacket(packet.PunchAck, session, privKey, pu.peer)
+		if err != nil {
+			logger.Log(1, "failed to create punch ack: ", err.Error())
+			return
+		}
+		if _, err := p.writeDirect(ack, source); err != nil {
+			logger.Log(1, "failed to answer punch probe of", source.String(), err.Error())
+		}
+	case packet.PunchAck:
+		select {
+		case pu.done <- source:
+		default:
+		}
+	}
+}
+
+// switchEndpoint - proxies the packets of the peer to the punched address
+func switchEndpoint(peerKey wgtypes.Key, addr *net.UDPAddr) {
+	peer, found := config.GetCfg().GetPeer(peerKey.String())
+	if !found || peer.Config.PeerEndpoint == nil || peer.Config.PeerEndpoint.String() == addr.String() {
+		return
+	}
+	logger.Log(1, "--------> Resetting Proxy Conn For Peer ", peerKey.String(), "on punched address", addr.String())
+	peer.Config.PeerEndpoint = addr
+	config.GetCfg().UpdatePeer(&peer)
+	config.GetCfg().ResetPeer(peerKey.String())
+}
+
+// startPunch - registers a session, fails if it is registered already or if a hole is already being punched to the
+// peer unless the other sessions with the peer are to be ended
+func startPunch(session [packet.PunchSessionSize]byte, peerKey wgtypes.Key, replace bool) (*punch, error) {
+	punchesMutex.Lock()
+	defer punchesMutex.Unlock()
+	if _, found := punches[session]; found {
+		return nil, ErrPunchInProgress
+	}
+	for id, pu := range punches {
+		if pu.peer != peerKey {
+			continue
+		}
+		if !replace {
+			return nil, ErrPunchInProgress
+		}
+		delete(punches, id)
+	}
+	pu := &punch{
+		peer:    peerKey,
+		answers: make(chan signal, 1),
+		done:    make(chan *net.UDPAddr, 1),
+	}
+	punches[session] = pu
+	return pu, nil
+}
+
+// getPunch - fetches a session, nil if it ended
+func getPunch(session [packet.PunchSessionSize]byte) *punch {
+	punchesMutex.Lock()
+	defer punchesMutex.Unlock()
+	return punches[session]
+}
+
+// getPeerPunch - fetches the session with a peer, nil if there is none
+func getPeerPunch(peerKey wgtypes.Key) ([packet.PunchSessionSize]byte, *punch) {
+	punchesMutex.Lock()
+	defer punchesMutex.Unlock()
+	for session, pu := range punches {
+		if pu.peer == peerKey {
+			return session, pu
+		}
+	}
+	return [packet.PunchSessionSize]byte{}, nil
+}
+
+// endPunch - removes a session
+func endPunch(session [packet.PunchSessionSize]byte) {
+	punchesMutex.Lock()
+	defer punchesMutex.Unlock()
+	delete(punches, session)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// route - path replacing udp for the packets to an address, a stream, the turn relay or another address of the peer
+type route interface {
+	write(b []byte) (int, error)
+}
+
+var routes = make(map[string]route) // routes by the udp address whose packets they carry
+var routesMutex = sync.RWMutex{}    // used to mutex access to routes
+
+// registerRoute - sends the packets for addr over the route
+func registerRoute(addr *net.UDPAddr, r route) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	routes[addr.String()] = r
+}
+
+// getRoute - fetches the route of the packets for addr, nil if they are sent over udp
+func getRoute(addr *net.UDPAddr) route {
+	if addr == nil {
+		return nil
+	}
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+	return routes[addr.String()]
+}
+
+// removeRoute - sends the packets carried by the route over udp again
+func removeRoute(r route) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	for addr, registered := range routes {
+		if registered == r {
+			delete(routes, addr)
+		}
+	}
+}
+
+// HasRoute - checks if the packets for addr are sent over a stream or the turn relay, not over udp to another
+// path of the peer
+func HasRoute(addr *net.UDPAddr) bool {
+	r := getRoute(addr)
+	_, udp := r.(*pathRoute)
+	return r != nil && !udp
+}
+
+// RouteViaUDP - sends the packets for addr over udp again, closing the stream or dropping the turn route that
+// carried them
+func RouteViaUDP(addr *net.UDPAddr) {
+	switch r := getRoute(addr).(type) {
+	case *stream:
+		logger.Log(0, "proxying packets for", addr.String(), "over udp again")
+		r.close()
+	case *turnRoute:
+		logger.Log(0, "proxying packets for", addr.String(), "over udp again")
+		removeRoute(r)
+	}
+}
+
+// bindRoute - sends the packets for the endpoint of a peer over the route the peer sent a packet on, only packets
+// with an authenticated trailer can move the peer to a route
+func bindRoute(source *net.UDPAddr, srcPeerKeyHash string, authMsg *packet.ProxyAuthMessage) {
+	r := getRoute(source)
+	if r == nil || authMsg == nil {
+		return
+	}
+	endpoint, found := config.GetCfg().GetPeerEndpointByHash(srcPeerKeyHash)
+	if !found || getRoute(endpoint) == r {
+		return
+	}
+	logger.Log(0, "proxying packets for", endpoint.String(), "over the route of", source.String())
+	registerRoute(endpoint, r)
+}
@@ -2,17 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	ncconfig "github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/latency"
 	"github.com/gravitl/netclient/nmproxy/models"
 	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netclient/nmproxy/turn"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/metrics"
 	nm_models "github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var (
@@ -22,7 +29,7 @@ var (
 
 const (
 	// constant for proxy server buffer size
-	defaultBodySize = 65000 + packet.MessageProxyTransportSize
+	defaultBodySize = 65000 + packet.MessageProxyAuthTransportSize
 )
 
 // Config - struct for proxy server config
@@ -35,6 +42,22 @@ type Config struct {
 type ProxyServer struct {
 	Config Config
 	Server *net.UDPConn
+	// Server6 - ipv6 listener when the proxy listens on both address families, Server is the ipv4 listener then
+	Server6 *net.UDPConn
+	// batched reads and writes of Server and Server6
+	batch  batchConn
+	batch6 batchConn
+	// workers - further sockets listening on the proxy port with SO_REUSEPORT, the kernel spreads the peers over
+	// them and the listeners
+	workers []*net.UDPConn
+	// listenersMutex - guards the udp listeners and their batched sockets, they are replaced when rebinding
+	listenersMutex sync.RWMutex
+	// tcp listeners accepting the stream transport, for peers that can't reach the proxy over udp
+	streamListeners []net.Listener
+	tlsConfig       *tls.Config
+	wsListener      *connListener
+	// turn - client of the turn relay, nil if no turn server is configured
+	turn *turn.Client
 }
 
 // ProxyServer.Close - closes the proxy server
@@ -59,53 +82,160 @@ func (p *ProxyServer) Close() {
 		config.GetCfg().StopFw()
 	}
 	// close server connection
-	NmProxyServer.Server.Close()
+	p.closeStreams()
+	if p.turn != nil {
+		p.turn.Close()
+	}
+	p.listenersMutex.Lock()
+	defer p.listenersMutex.Unlock()
+	p.closeListeners()
+}
+
+// ProxyServer.Rebind - moves the listeners to the current addresses of the host after its private address changed,
+// the peers and the interfaces are kept; discover is run once the proxy port is released, i.e. to re-run stun,
+// and returns the ipv4 and ipv6 address to listen on
+func (p *ProxyServer) Rebind(discover func() (addr, addr6 string, err error)) error {
+	p.closeStreams()
+	p.listenersMutex.Lock()
+	p.closeListeners()
+	p.Server, p.Server6 = nil, nil
+	p.batch, p.batch6 = nil, nil
+	p.listenersMutex.Unlock()
+	addr, addr6, err := discover()
+	if err != nil {
+		return err
+	}
+	p.listenersMutex.Lock()
+	err = p.CreateProxyServer(p.Config.Port, p.Config.BodySize, addr, addr6)
+	p.listenersMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	config.GetCfg().SetServerConn(p.Server)
+	p.listenStreams()
+	p.serveListeners()
+	return nil
+}
+
+// ProxyServer.LocalAddr - returns the local address of the listener, the zero address while rebinding
+func (p *ProxyServer) LocalAddr() net.Addr {
+	server, _ := p.listeners()
+	if server == nil {
+		return &net.UDPAddr{}
+	}
+	return server.LocalAddr()
 }
 
-// Proxy.Listen - begins listening for packets
+// ProxyServer.WriteToUDP - sends a packet over the stream replacing udp for the destination if there is one,
+// otherwise from the listener of the address family of the destination
+func (p *ProxyServer) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if r := getRoute(addr); r != nil {
+		return r.write(b)
+	}
+	return p.writeDirect(b, addr)
+}
+
+// ProxyServer.writeDirect - sends a packet over udp from the listener of the address family of the destination
+func (p *ProxyServer) writeDirect(b []byte, addr *net.UDPAddr) (int, error) {
+	server, server6 := p.listeners()
+	if server6 != nil && addr != nil && addr.IP.To4() == nil {
+		return server6.WriteToUDP(b, addr)
+	}
+	return server.WriteToUDP(b, addr)
+}
+
+// Proxy.Listen - begins listening for packets, returns once the context is done and the proxy server is closed
 func (p *ProxyServer) Listen(ctx context.Context) {
+	p.listenStreams()
+	p.serveListeners()
+	<-ctx.Done()
+	p.Close()
+}
 
-	// Buffer with indicated body size
-	buffer := make([]byte, p.Config.BodySize)
-	go func() {
-		<-ctx.Done()
-		p.Close()
-	}()
-	for {
+// ProxyServer.serveListeners - serves each udp listener in its own goroutine until it is closed
+func (p *ProxyServer) serveListeners() {
+	p.listenersMutex.RLock()
+	defer p.listenersMutex.RUnlock()
+	for _, conn := range p.workers {
+		go p.serve(conn)
+	}
+	if p.Server6 != nil {
+		go p.serve(p.Server6)
+	}
+	go p.serve(p.Server)
+}
 
-		// Read Packet
-		n, source, err := p.Server.ReadFromUDP(buffer)
+// ProxyServer.listeners - returns the ipv4, or only, listener and the ipv6 listener, nil if there is none
+func (p *ProxyServer) listeners() (*net.UDPConn, *net.UDPConn) {
+	p.listenersMutex.RLock()
+	defer p.listenersMutex.RUnlock()
+	return p.Server, p.Server6
+}
+
+// ProxyServer.closeListeners - closes the udp listeners, the caller holds listenersMutex
+func (p *ProxyServer) closeListeners() {
+	for _, conn := range append([]*net.UDPConn{p.Server, p.Server6}, p.workers...) {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	p.workers = nil
+}
+
+// ProxyServer.serve - handles the packets received on a listener in batches, the packets relayed while handling
+// a batch are sent together once it is handled
+func (p *ProxyServer) serve(conn *net.UDPConn) {
+	reader := NewBatchReader(conn, p.Config.BodySize)
+	defer reader.Close()
+	queue := &relayQueue{server: p}
+	for {
+		datagrams, err := reader.Read()
 		if err != nil {
 			logger.Log(3, "failed to read from server: ", err.Error())
 			return
 		}
-		if !handleNoProxyPeer(buffer[:], n, source) {
-			proxyTransportMsg := true
-			var srcPeerKeyHash, dstPeerKeyHash string
-			n, srcPeerKeyHash, dstPeerKeyHash, err = packet.ExtractInfo(buffer, n)
-			if err != nil {
-				logger.Log(2, "proxy transport message not found: ", err.Error())
-				proxyTransportMsg = false
-			}
-			if proxyTransportMsg {
-				p.proxyIncomingPacket(buffer[:], source, n, srcPeerKeyHash, dstPeerKeyHash)
-				continue
-			} else {
-				// unknown peer to proxy -> check if extclient and handle it
-				if handleExtClients(buffer[:], n, source) {
-					continue
-				}
-
-			}
+		for _, d := range datagrams {
+			p.handlePacket(d.Data, len(d.Data), d.Source, false, queue)
 		}
+		queue.flush()
+	}
+}
 
-		p.handleMsgs(buffer, n, source)
+// ProxyServer.handlePacket - handles a packet received over udp, a stream or the turn relay; streams and the turn
+// relay are tunneled and only carry the messages of proxy peers; relayed packets are queued if a queue is given
+func (p *ProxyServer) handlePacket(buffer []byte, n int, source *net.UDPAddr, tunneled bool, queue *relayQueue) {
+	if tunneled || !handleNoProxyPeer(buffer[:], n, source) {
+		if authMsg := p.extractAuthInfo(buffer, n); authMsg != nil {
+			p.proxyIncomingPacket(buffer[:], source, n-packet.MessageProxyAuthTransportSize,
+				hex.EncodeToString(authMsg.Sender[:]), hex.EncodeToString(authMsg.Reciever[:]), authMsg, tunneled, queue)
+			return
+		}
+		proxyTransportMsg := true
+		var srcPeerKeyHash, dstPeerKeyHash string
+		var err error
+		n, srcPeerKeyHash, dstPeerKeyHash, err = packet.ExtractInfo(buffer, n)
+		if err != nil {
+			logger.Log(2, "proxy transport message not found: ", err.Error())
+			proxyTransportMsg = false
+		}
+		if proxyTransportMsg {
+			p.proxyIncomingPacket(buffer[:], source, n, srcPeerKeyHash, dstPeerKeyHash, nil, tunneled, queue)
+			return
+		} else if !tunneled {
+			// unknown peer to proxy -> check if extclient and handle it
+			if handleExtClients(buffer[:], n, source) {
+				return
+			}
 
+		}
 	}
 
+	p.handleMsgs(buffer, n, source, tunneled, nil)
 }
 
-func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
+// ProxyServer.handleMsgs - handles the messages of the proxy itself, authMsg is the verified trailer of the message
+// and nil for messages without one, which have to be authorized as sent by the peer they name as sender
+func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr, tunneled bool, authMsg *packet.ProxyAuthMessage) {
 
 	msgType := binary.LittleEndian.Uint32(buffer[:4])
 	switch packet.MessageType(msgType) {
@@ -115,12 +245,25 @@ func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
 		if err == nil {
 			logger.Log(3, fmt.Sprintf("------->Recieved Metric Pkt: %+v, FROM:%s\n", metricMsg, source.String()))
 			_, pubKey := config.GetCfg().GetDeviceKeys()
+			// replies are sent back by the receiver of the probe
+			sender := metricMsg.Sender
+			if metricMsg.Reply == 1 {
+				sender = metricMsg.Reciever
+			}
+			if !p.authorizeMsg(buffer, n, sender, authMsg, metricMsg.Sender != pubKey && metricMsg.Reciever != pubKey) {
+				return
+			}
+			if metricMsg.Sender == pubKey && metricMsg.Reply == 1 && handlePathProbe(metricMsg.ID, source, tunneled) {
+				return
+			}
 			if metricMsg.Sender == pubKey {
-				metric := nm_models.ProxyMetric{}
-				latency := time.Now().UnixMilli() - metricMsg.TimeStamp
-				metric.LastRecordedLatency = uint64(latency)
-				metric.TrafficRecieved = int64(n)
-				metrics.UpdateMetricByPeer(metricMsg.Reciever.String(), &metric, false)
+				// duplicate replies and replies to probes out of the window are not measured
+				if latency.Record(metricMsg.Reciever.String(), metricMsg.ID) {
+					metric := nm_models.ProxyMetric{}
+					metric.LastRecordedLatency = latency.MetricLatency(metricMsg.Reciever.String())
+					metric.TrafficRecieved = int64(n)
+					metrics.UpdateMetricByPeer(metricMsg.Reciever.String(), &metric, false)
+				}
 				if metricMsg.ListenPort != 0 &&
 					config.GetCfg().HostInfo.PubPort != int(metricMsg.ListenPort) {
 					// update public listen port
@@ -143,14 +286,23 @@ func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
 				} else {
 					logger.Log(1, "--------> failed to encode metric reply message")
 				}
-				_, err = NmProxyServer.Server.WriteToUDP(buffer[:n], source)
+				reply := buffer[:n]
+				if authMsg != nil && err == nil {
+					reply = AppendAuthTrailer(buf, metricMsg.Sender)
+				}
+				// the reply takes the path of the probe, path probes sent over udp tell if udp works
+				if tunneled {
+					_, err = NmProxyServer.WriteToUDP(reply, source)
+				} else {
+					_, err = NmProxyServer.writeDirect(reply, source)
+				}
 				if err != nil {
 					logger.Log(0, "Failed to send metric packet to remote: ", err.Error())
 				}
 
 			} else {
-				// metric packet needs to be relayed
-				if config.GetCfg().IsGlobalRelay() {
+				// metric packet needs to be relayed, authenticated packets to relay carry the trailer for the receiver
+				if authMsg == nil && config.GetCfg().IsGlobalRelay() {
 					var srcPeerKeyHash, dstPeerKeyHash string
 					if metricMsg.Reply == 1 {
 						dstPeerKeyHash = models.ConvPeerKeyToHash(metricMsg.Sender.String())
@@ -168,7 +320,7 @@ func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
 					} else {
 						logger.Log(1, "--------> failed to encode metric relay message")
 					}
-					p.relayPacket(buffer, source, n, srcPeerKeyHash, dstPeerKeyHash)
+					p.relayPacket(buffer, source, n, srcPeerKeyHash, dstPeerKeyHash, nil)
 					return
 				}
 			}
@@ -178,6 +330,10 @@ func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
 	case packet.MessageProxyUpdateType:
 		msg, err := packet.ConsumeProxyUpdateMsg(buffer[:n])
 		if err == nil {
+			if !p.authorizeMsg(buffer, n, msg.Sender, authMsg,
+				config.GetCfg().IsGlobalRelay() && config.GetCfg().GetDevicePubKey() != msg.Reciever) {
+				return
+			}
 			switch msg.Action {
 			case packet.UpdateListenPort:
 				if peer, found := config.GetCfg().GetPeer(msg.Sender.String()); found {
@@ -207,6 +363,10 @@ func (p *ProxyServer) handleMsgs(buffer []byte, n int, source *net.UDPAddr) {
 
 			}
 		}
+	case packet.MessageProxySignalType:
+		logger.Log(3, "dropping signal without authenticated trailer from", source.String())
+	case packet.MessageProxyPunchType:
+		p.handlePunch(buffer, n, source)
 	// consume handshake message for ext clients
 	case packet.MessageInitiationType:
 		priv, pub := config.GetCfg().GetDeviceKeys()
@@ -254,14 +414,9 @@ func handleExtClients(buffer []byte, n int, source *net.UDPAddr) bool {
 			logger.Log(1, "Failed to proxy to Wg local interface: ", err.Error())
 			//continue
 		}
-		go func(n int, peerKey string) {
-
-			metric := nm_models.ProxyMetric{
-				TrafficRecieved: int64(n),
-			}
-			metrics.UpdateMetricByPeer(peerKey, &metric, true)
-
-		}(n, peerInfo.PeerKey)
+		if peerInfo.Traffic != nil {
+			peerInfo.Traffic.Received.Add(int64(n))
+		}
 		isExtClient = true
 	}
 	return isExtClient
@@ -270,33 +425,38 @@ func handleExtClients(buffer []byte, n int, source *net.UDPAddr) bool {
 func handleNoProxyPeer(buffer []byte, n int, source *net.UDPAddr) bool {
 	fromNoProxyPeer := false
 	if peerInfo, found := config.GetCfg().GetNoProxyPeer(source.IP); found {
-		logger.Log(3, fmt.Sprintf("PROXING No Proxy Peer TO LOCAL!!!---> %s <<<< %s <<<<<<<< %s   [[ SourceIP: [%s] ]]\n",
-			peerInfo.LocalConn.RemoteAddr(), peerInfo.LocalConn.LocalAddr(),
-			fmt.Sprintf("%s:%d", source.IP.String(), source.Port), source.IP.String()))
+		if logger.Verbosity >= 3 {
+			logger.Log(3, fmt.Sprintf("PROXING No Proxy Peer TO LOCAL!!!---> %s <<<< %s <<<<<<<< %s   [[ SourceIP: [%s] ]]\n",
+				peerInfo.LocalConn.RemoteAddr(), peerInfo.LocalConn.LocalAddr(),
+				fmt.Sprintf("%s:%d", source.IP.String(), source.Port), source.IP.String()))
+		}
 		_, err := peerInfo.LocalConn.Write(buffer[:n])
 		if err != nil {
 			logger.Log(1, "Failed to proxy to Wg local interface: ", err.Error())
 		}
-		go func(n int, peerKey string) {
-
-			metric := nm_models.ProxyMetric{
-				TrafficRecieved: int64(n),
-			}
-			metrics.UpdateMetricByPeer(peerKey, &metric, true)
-
-		}(n, peerInfo.Config.PeerPublicKey.String())
+		if peerInfo.Config.Traffic != nil {
+			peerInfo.Config.Traffic.Received.Add(int64(n))
+		}
 		fromNoProxyPeer = true
 	}
 	return fromNoProxyPeer
 }
 
-func (p *ProxyServer) relayPacket(buffer []byte, source *net.UDPAddr, n int, srcPeerKeyHash, dstPeerKeyHash string) {
+// ProxyServer.relayPacket - relays a packet to the peer it is addressed to, queued if a queue is given
+func (p *ProxyServer) relayPacket(buffer []byte, source *net.UDPAddr, n int, srcPeerKeyHash, dstPeerKeyHash string, queue *relayQueue) {
 	// check for routing map and relay to right proxy
 	if remotePeer, ok := config.GetCfg().GetRelayedPeer(srcPeerKeyHash, dstPeerKeyHash); ok {
 
-		logger.Log(3, fmt.Sprintf("--------> Relaying PKT [ SourceIP: %s:%d ], [ SourceKeyHash: %s ], [ DstIP: %s ], [ DstHashKey: %s ] \n",
-			source.IP.String(), source.Port, srcPeerKeyHash, remotePeer.Endpoint.String(), dstPeerKeyHash))
-		_, err := p.Server.WriteToUDP(buffer[:n], remotePeer.Endpoint)
+		if logger.Verbosity >= 3 {
+			logger.Log(3, fmt.Sprintf("--------> Relaying PKT [ SourceIP: %s:%d ], [ SourceKeyHash: %s ], [ DstIP: %s ], [ DstHashKey: %s ] \n",
+				source.IP.String(), source.Port, srcPeerKeyHash, remotePeer.Endpoint.String(), dstPeerKeyHash))
+		}
+		var err error
+		if queue != nil {
+			err = queue.add(buffer[:n], remotePeer.Endpoint)
+		} else {
+			_, err = p.WriteToUDP(buffer[:n], remotePeer.Endpoint)
+		}
 		if err != nil {
 			logger.Log(1, "Failed to relay to remote: ", err.Error())
 		}
@@ -305,34 +465,139 @@ func (p *ProxyServer) relayPacket(buffer []byte, source *net.UDPAddr, n int, src
 	}
 }
 
-func (p *ProxyServer) proxyIncomingPacket(buffer []byte, source *net.UDPAddr, n int, srcPeerKeyHash, dstPeerKeyHash string) {
+// ProxyServer.extractAuthInfo - returns the authenticated proxy transport trailer of a packet, nil if it has none
+func (p *ProxyServer) extractAuthInfo(buffer []byte, n int) *packet.ProxyAuthMessage {
+	_, authMsg, err := packet.ExtractAuthInfo(buffer, n)
+	if err != nil {
+		return nil
+	}
+	return authMsg
+}
+
+// ProxyServer.authorizePacket - verifies the trailer of a proxy message before it is relayed or delivered;
+// unauthenticated messages are only accepted outside of strict mode from peers not seen sending authenticated
+// messages, or only from the peers listed as legacy once a server lists them, and replayed messages are dropped
+func (p *ProxyServer) authorizePacket(buffer []byte, n int, srcPeerKeyHash string, authMsg *packet.ProxyAuthMessage, relay bool) bool {
+	if authMsg == nil {
+		if ncconfig.Netclient().Proxy.Auth == ncconfig.ProxyAuthStrict {
+			logger.Log(3, "dropping unauthenticated proxy message from", srcPeerKeyHash)
+			return false
+		}
+		if _, found := config.GetCfg().GetPeerKeyByHash(srcPeerKeyHash); !found {
+			logger.Log(3, "dropping unauthenticated proxy message from unknown peer", srcPeerKeyHash)
+			return false
+		}
+		if !config.GetCfg().AcceptsUnauthenticated(srcPeerKeyHash) {
+			logger.Log(3, "dropping unauthenticated proxy message from", srcPeerKeyHash)
+			return false
+		}
+		config.SetPeerAuthenticated(srcPeerKeyHash, false)
+		return true
+	}
+	srcKey, found := config.GetCfg().GetPeerKeyByHash(srcPeerKeyHash)
+	if !found {
+		logger.Log(3, "dropping proxy message from unknown peer", srcPeerKeyHash)
+		return false
+	}
+	if relay && !authMsg.HasRelayMAC() {
+		// the sender knows the key of this host as it is a peer of it
+		logger.Log(3, "dropping proxy message to relay without relay mac from", srcKey.String())
+		return false
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	if !packet.VerifyProxyMAC(buffer[:n], authMsg, privKey, srcKey, relay) {
+		logger.Log(1, "dropping proxy message with invalid mac from", srcKey.String())
+		return false
+	}
+	if !packet.CheckReplay(authMsg) {
+		logger.Log(3, "dropping replayed proxy message from", srcKey.String())
+		return false
+	}
+	config.SetPeerAuthenticated(srcPeerKeyHash, true)
+	return true
+}
+
+// ProxyServer.authorizeMsg - checks a message of the proxy itself was sent by the peer it names as sender, either
+// by the verified trailer of the message or by authorizing it as an unauthenticated message of that peer
+func (p *ProxyServer) authorizeMsg(buffer []byte, n int, sender wgtypes.Key, authMsg *packet.ProxyAuthMessage, relay bool) bool {
+	senderHash := models.ConvPeerKeyToHash(sender.String())
+	if authMsg != nil {
+		if hex.EncodeToString(authMsg.Sender[:]) != senderHash {
+			logger.Log(1, "dropping proxy message of", senderHash, "sent by", hex.EncodeToString(authMsg.Sender[:]))
+			return false
+		}
+		return true
+	}
+	return p.authorizePacket(buffer, n, senderHash, nil, relay)
+}
+
+// AppendAuthTrailer - appends the authenticated proxy transport trailer for the peer to a message of the proxy
+// itself, messages to peers sent unauthenticated messages are left without one
+func AppendAuthTrailer(buf []byte, peerKey wgtypes.Key) []byte {
+	auth := ncconfig.Netclient().Proxy.Auth
+	if auth == ncconfig.ProxyAuthLegacy ||
+		(auth != ncconfig.ProxyAuthStrict && config.GetCfg().IsPeerLegacy(models.ConvPeerKeyToHash(peerKey.String()))) {
+		return buf
+	}
+	var relayKey *wgtypes.Key
+	if peer, found := config.GetCfg().GetPeer(peerKey.String()); found && peer.IsRelayed {
+		if key, found := config.GetCfg().GetRelayKey(peer.RelayedEndpoint); found {
+			relayKey = &key
+		}
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	return packet.AppendAuthTrailer(buf, privKey, peerKey, relayKey)
+}
+
+func (p *ProxyServer) proxyIncomingPacket(buffer []byte, source *net.UDPAddr, n int, srcPeerKeyHash, dstPeerKeyHash string,
+	authMsg *packet.ProxyAuthMessage, tunneled bool, queue *relayQueue) {
 	var err error
 	//logger.Log(0,"--------> RECV PKT , [SRCKEYHASH: %s], SourceIP: [%s] \n", srcPeerKeyHash, source.IP.String())
 
 	if config.GetCfg().GetDeviceKeyHash() != dstPeerKeyHash && config.GetCfg().IsGlobalRelay() {
-		p.relayPacket(buffer, source, n+packet.MessageProxyTransportSize, srcPeerKeyHash, dstPeerKeyHash)
+		if !p.authorizePacket(buffer, n, srcPeerKeyHash, authMsg, true) {
+			return
+		}
+		bindRoute(source, srcPeerKeyHash, authMsg)
+		trailerSize := packet.MessageProxyTransportSize
+		if authMsg != nil {
+			trailerSize = packet.MessageProxyAuthTransportSize
+		}
+		p.relayPacket(buffer, source, n+trailerSize, srcPeerKeyHash, dstPeerKeyHash, queue)
 		return
 	}
 
 	if peerInfo, ok := config.GetCfg().GetPeerInfoByHash(srcPeerKeyHash); ok {
+		if !p.authorizePacket(buffer, n, srcPeerKeyHash, authMsg, false) {
+			return
+		}
+		bindRoute(source, srcPeerKeyHash, authMsg)
+		if n >= 4 && authMsg != nil {
+			switch packet.MessageType(binary.LittleEndian.Uint32(buffer[:4])) {
+			case packet.MessageProxySignalType:
+				p.handleSignal(buffer, n)
+				return
+			case packet.MessageMetricsType, packet.MessageProxyUpdateType:
+				p.handleMsgs(buffer, n, source, tunneled, authMsg)
+				return
+			}
+		} else if n >= 4 && packet.MessageType(binary.LittleEndian.Uint32(buffer[:4])) == packet.MessageProxySignalType {
+			return
+		}
 
-		logger.Log(3, fmt.Sprintf("PROXING TO LOCAL!!!---> %s <<<< %s <<<<<<<< %s   [[ RECV PKT [SRCKEYHASH: %s], [DSTKEYHASH: %s], SourceIP: [%s] ]]\n",
-			peerInfo.LocalConn.RemoteAddr(), peerInfo.LocalConn.LocalAddr(),
-			fmt.Sprintf("%s:%d", source.IP.String(), source.Port), srcPeerKeyHash, dstPeerKeyHash, source.IP.String()))
+		if logger.Verbosity >= 3 {
+			logger.Log(3, fmt.Sprintf("PROXING TO LOCAL!!!---> %s <<<< %s <<<<<<<< %s   [[ RECV PKT [SRCKEYHASH: %s], [DSTKEYHASH: %s], SourceIP: [%s] ]]\n",
+				peerInfo.LocalConn.RemoteAddr(), peerInfo.LocalConn.LocalAddr(),
+				fmt.Sprintf("%s:%d", source.IP.String(), source.Port), srcPeerKeyHash, dstPeerKeyHash, source.IP.String()))
+		}
 		_, err = peerInfo.LocalConn.Write(buffer[:n])
 		if err != nil {
 			logger.Log(1, "Failed to proxy to Wg local interface: ", err.Error())
 			//continue
 		}
-
-		go func(n int, peerKey string) {
-
-			metric := nm_models.ProxyMetric{
-				TrafficRecieved: int64(n),
-			}
-			metrics.UpdateMetricByPeer(peerKey, &metric, true)
-
-		}(n, peerInfo.PeerKey)
+		if peerInfo.Traffic != nil {
+			peerInfo.Traffic.Received.Add(int64(n))
+		}
 		return
 
 	}
@@ -342,24 +607,65 @@ func (p *ProxyServer) proxyIncomingPacket(buffer []byte, source *net.UDPAddr, n
 // ProxyServer.CreateProxyServer - creats a proxy listener
 // port - port for proxy to listen on localhost
 // bodySize - leave 0 to use default
-// addr - the address for proxy to listen on
-func (p *ProxyServer) CreateProxyServer(port, bodySize int, addr string) (err error) {
+// addr - the ipv4 address for proxy to listen on, empty on ipv6 only hosts
+// addr6 - the ipv6 address for proxy to listen on, empty if not available
+func (p *ProxyServer) CreateProxyServer(port, bodySize int, addr, addr6 string) (err error) {
 	if p == nil {
 		p = &ProxyServer{}
 	}
 	p.Config.Port = port
 	p.Config.BodySize = bodySize
 	p.setDefaults()
-	p.Server, err = net.ListenUDP("udp", &net.UDPAddr{
+	p.Server6 = nil
+	// the workers of a previous listener would keep the port bound and take its share of the packets
+	for _, conn := range p.workers {
+		conn.Close()
+	}
+	p.workers = nil
+	defer func() {
+		if err == nil {
+			p.batch = newBatchConn(p.Server)
+		}
+		p.batch6 = nil
+		if p.Server6 != nil {
+			p.batch6 = newBatchConn(p.Server6)
+		}
+	}()
+	if addr == "" && addr6 == "" {
+		p.Server, err = p.listenUDP("udp", &net.UDPAddr{
+			Port: p.Config.Port,
+		})
+		return
+	}
+	if addr == "" {
+		p.Server, err = p.listenUDP("udp6", &net.UDPAddr{
+			Port: p.Config.Port,
+			IP:   net.ParseIP(addr6),
+		})
+		return
+	}
+	p.Server, err = p.listenUDP("udp4", &net.UDPAddr{
 		Port: p.Config.Port,
 		IP:   net.ParseIP(addr),
 	})
+	if err != nil || addr6 == "" {
+		return
+	}
+	server6, err6 := p.listenUDP("udp6", &net.UDPAddr{
+		Port: p.Config.Port,
+		IP:   net.ParseIP(addr6),
+	})
+	if err6 != nil {
+		logger.Log(0, "failed to listen on ipv6, proxying ipv4 peers only: ", err6.Error())
+		return
+	}
+	p.Server6 = server6
 	return
 }
 
 func (p *ProxyServer) KeepAlive(ip string, port int) {
 	for {
-		_, _ = p.Server.WriteToUDP([]byte("hello-proxy"), &net.UDPAddr{
+		_, _ = p.WriteToUDP([]byte("hello-proxy"), &net.UDPAddr{
 			IP:   net.ParseIP(ip),
 			Port: port,
 		})
@@ -368,6 +674,37 @@ func (p *ProxyServer) KeepAlive(ip string, port int) {
 	}
 }
 
+// ProxyServer.listenUDP - listens on the address, with the configured number of workers further sockets listen on
+// it with SO_REUSEPORT and are served by their own goroutine
+func (p *ProxyServer) listenUDP(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	workers := ncconfig.Netclient().Proxy.Workers
+	if workers <= 1 {
+		return net.ListenUDP(network, addr)
+	}
+	if !reusePortSupported {
+		logger.Log(0, "proxy workers are only supported on linux, listening on a single socket")
+		return net.ListenUDP(network, addr)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	conns := make([]*net.UDPConn, 0, workers)
+	for i := 0; i < workers; i++ {
+		conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		if addr.Port == 0 {
+			// the further sockets have to share the port picked for the first one
+			addr = conn.LocalAddr().(*net.UDPAddr)
+		}
+	}
+	p.workers = append(p.workers, conns[1:]...)
+	return conns[0], nil
+}
+
 // Proxy.setDefaults - sets all defaults of proxy listener
 func (p *ProxyServer) setDefaults() {
 	p.setDefaultBodySize()
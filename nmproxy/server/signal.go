@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// kinds of signals
+const (
+	signalPunchOffer       = "offer"
+	signalPunchAnswer      = "answer"
+	signalCandidates       = "candidates"
+	signalCandidatesAnswer = "candidates-answer"
+)
+
+// signalVersion - version of the signal format, signals of other versions are dropped
+const signalVersion = 1
+
+// Signaler - sends the payload of a signal to the host of a peer through a server, which relays it to the host;
+// set by the netclient, which seals the payload for the peer
+type Signaler func(server string, peerKey wgtypes.Key, payload []byte) error
+
+var signaler Signaler
+
+// relaysSignals - checks if a server relays signals, servers before host signal relaying drop them so signals
+// only reach peers over the proxy path: directly, through the relay of the peer or over a stream or the turn relay
+var relaysSignals func(server string) bool
+
+// signal - sealed message exchanged by two peers, the candidates to punch a hole to or to choose a path from
+type signal struct {
+	Version    int                `json:"version"`
+	Kind       string             `json:"kind"`
+	Session    []byte             `json:"session,omitempty"`
+	Candidates []models.Candidate `json:"candidates"`
+	// Start - unix time in milliseconds when both peers start probing
+	Start int64 `json:"start,omitempty"`
+}
+
+// SetSignaler - relays signals through the servers relaying them besides the proxy path of the peer
+func SetSignaler(s Signaler, relays func(server string) bool) {
+	signaler = s
+	relaysSignals = relays
+}
+
+// SignalsRelayed - checks if signals reach the peer through a server, and not only over the proxy path
+func SignalsRelayed(peerKey wgtypes.Key) bool {
+	peer, found := config.GetCfg().GetPeer(peerKey.String())
+	if !found || signaler == nil || relaysSignals == nil {
+		return false
+	}
+	for server := range peer.ServerMap {
+		if relaysSignals(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSignal - handles the payload of a signal of a peer relayed by a server, opened by the netclient
+func (p *ProxyServer) HandleSignal(peerKey wgtypes.Key, payload []byte) {
+	if !config.GetCfg().IsProxyRunning() {
+		return
+	}
+	p.handleSignalPayload(peerKey, payload)
+}
+
+// == private ==
+
+// ProxyServer.handleSignal - opens a signal of a peer received on the proxy path; the trailer of the signal was
+// verified like the one of a transport message, relays verify it before relaying the signal
+func (p *ProxyServer) handleSignal(buf []byte, n int) {
+	msg, err := packet.ConsumeSignalMsg(buf[:n])
+	if err != nil {
+		logger.Log(1, "failed to decode signal message: ", err.Error())
+		return
+	}
+	privKey, pubKey := config.GetCfg().GetDeviceKeys()
+	if msg.Reciever != pubKey {
+		return
+	}
+	payload, err := packet.OpenSignal(buf[:n], msg, privKey)
+	if err != nil {
+		logger.Log(1, "dropping signal from peer", msg.Sender.String(), err.Error())
+		return
+	}
+	p.handleSignalPayload(msg.Sender, payload)
+}
+
+// ProxyServer.handleSignalPayload - handles the opened signal of a peer
+func (p *ProxyServer) handleSignalPayload(peerKey wgtypes.Key, payload []byte) {
+	if _, found := config.GetCfg().GetPeer(peerKey.String()); !found {
+		logger.Log(3, "dropping signal from unknown peer", peerKey.String())
+		return
+	}
+	var sig signal
+	if err := json.Unmarshal(payload, &sig); err != nil {
+		logger.Log(1, "dropping malformed signal from peer", peerKey.String())
+		return
+	}
+	if sig.Version != signalVersion {
+		logger.Log(1, "dropping signal of version", strconv.Itoa(sig.Version), "from peer", peerKey.String())
+		return
+	}
+	switch sig.Kind {
+	case signalPunchOffer, signalPunchAnswer:
+		p.handlePunchSignal(peerKey, sig)
+	case signalCandidates, signalCandidatesAnswer:
+		p.handleCandidates(peerKey, sig)
+	}
+}
+
+// ProxyServer.sendSignal - seals the signal for the peer and sends it over the proxy path of the peer with an
+// authenticated trailer, and through a server of the peer relaying signals
+func (p *ProxyServer) sendSignal(peerKey wgtypes.Key, sig signal) error {
+	peer, found := config.GetCfg().GetPeer(peerKey.String())
+	if !found {
+		return errors.New("peer not found")
+	}
+	sig.Version = signalVersion
+	payload, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	msg, err := packet.CreateSignalPacket(payload, privKey, peerKey)
+	if err != nil {
+		return err
+	}
+	var relayKey *wgtypes.Key
+	if peer.IsRelayed {
+		if key, found := config.GetCfg().GetRelayKey(peer.RelayedEndpoint); found {
+			relayKey = &key
+		}
+	}
+	msg = packet.AppendAuthTrailer(msg, privKey, peerKey, relayKey)
+	sent := false
+	if peer.Config.RemoteConnAddr != nil {
+		if _, err := p.WriteToUDP(msg, peer.Config.RemoteConnAddr); err == nil {
+			sent = true
+		}
+	}
+	if signaler != nil && relaysSignals != nil {
+		for server := range peer.ServerMap {
+			if !relaysSignals(server) {
+				continue
+			}
+			if err := signaler(server, peerKey, payload); err != nil {
+				logger.Log(1, "failed to send signal to peer through", server, peerKey.String(), err.Error())
+				continue
+			}
+			sent = true
+			break
+		}
+	}
+	if !sent {
+		return errors.New("no path to send signal to peer")
+	}
+	return nil
+}
+
+// publicCandidates - addresses peers may reach the proxy on over the internet: the address found by stun and, for
+// nats preserving ports, the proxy port on the public address
+func publicCandidates() []models.Candidate {
+	hostInfo := config.GetCfg().GetHostInfo()
+	if hostInfo.PublicIp == nil {
+		return nil
+	}
+	candidates := []models.Candidate{{
+		Kind: models.CandidatePublic,
+		Addr: net.JoinHostPort(hostInfo.PublicIp.String(), strconv.Itoa(hostInfo.PubPort)),
+	}}
+	if port := NmProxyServer.Config.Port; port != 0 && port != hostInfo.PubPort {
+		candidates = append(candidates, models.Candidate{
+			Kind: models.CandidateProxyPort,
+			Addr: net.JoinHostPort(hostInfo.PublicIp.String(), strconv.Itoa(port)),
+		})
+	}
+	return candidates
+}
+
+// ProxyServer.localCandidates - all addresses peers may reach the proxy on: the addresses of the interfaces of the host
+// the proxy listens on, the public addresses and the address relayed by the turn server
+func (p *ProxyServer) localCandidates() []models.Candidate {
+	var candidates []models.Candidate
+	iface := ""
+	if !config.GetCfg().IsIfaceNil() {
+		iface = config.GetCfg().GetIface().Name
+	}
+	for _, i := range ncconfig.Netclient().Interfaces {
+		ip := i.Address.IP
+		if i.Name == iface || ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || !p.listensOn(ip) {
+			continue
+		}
+		candidates = append(candidates, models.Candidate{
+			Kind: models.CandidateLAN,
+			Addr: net.JoinHostPort(ip.String(), strconv.Itoa(p.Config.Port)),
+		})
+	}
+	candidates = append(candidates, publicCandidates()...)
+	if relayed := config.GetCfg().GetHostInfo().RelayedAddr; relayed != nil {
+		candidates = append(candidates, models.Candidate{Kind: models.CandidateRelay, Addr: relayed.String()})
+	}
+	return candidates
+}
+
+// ProxyServer.listensOn - checks if packets to the ip reach one of the listeners
+func (p *ProxyServer) listensOn(ip net.IP) bool {
+	server, server6 := p.listeners()
+	for _, conn := range []*net.UDPConn{server, server6} {
+		if conn == nil {
+			continue
+		}
+		local := conn.LocalAddr().(*net.UDPAddr)
+		if local.IP.Equal(ip) || (local.IP.IsUnspecified() && (local.IP.To4() == nil) == (ip.To4() == nil)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported - several sockets may listen on the proxy port
+const reusePortSupported = true
+
+// newBatchConn - batches the reads and writes of the socket with recvmmsg and sendmmsg
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if isIPv4Conn(conn) {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// reusePort - sets SO_REUSEPORT so the kernel spreads the peers over the sockets listening on the proxy port
+func reusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	if err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+)
+
+// reusePortSupported - several sockets may listen on the proxy port
+const reusePortSupported = false
+
+// singleConn - reads and writes one packet per syscall where recvmmsg and sendmmsg are not available
+type singleConn struct {
+	conn *net.UDPConn
+}
+
+// newBatchConn - returns the socket reading and writing one packet per syscall
+func newBatchConn(conn *net.UDPConn) batchConn {
+	return singleConn{conn: conn}
+}
+
+// singleConn.ReadBatch - reads one packet into the first message
+func (c singleConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.conn.ReadFromUDP(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N = n
+	ms[0].Addr = addr
+	return 1, nil
+}
+
+// singleConn.WriteBatch - writes the messages one by one
+func (c singleConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i := range ms {
+		addr, _ := ms[i].Addr.(*net.UDPAddr)
+		if _, err := c.conn.WriteToUDP(ms[i].Buffers[0], addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
+
+// reusePort - SO_REUSEPORT is only used on linux
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
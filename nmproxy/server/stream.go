@@ -0,0 +1,532 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ncconfig "github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netclient/nmproxy/packet"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// streamMagic - preamble sent by the dialing side of a stream, tells plain tcp streams apart from tls and websocket
+	streamMagic = "NMS1"
+	// streamPath - http path of the websocket stream
+	streamPath = "/nmproxy"
+	// streamHeaderSize - size of the length prefix of a packet on a stream
+	streamHeaderSize = 2
+	// streamTimeout - timeout for dialing a stream and for the preamble of an accepted stream
+	streamTimeout = time.Second * 10
+	// streamWriteTimeout - timeout for writing a packet to a stream, a stream that stalls is closed
+	streamWriteTimeout = time.Second * 5
+	// tlsRecordTypeHandshake - first byte of a tls client hello
+	tlsRecordTypeHandshake = 0x16
+)
+
+// oidStreamCertMAC - private certificate extension holding the mac binding the certificate key to the wireguard keys
+// of the proxy and the dialing peer
+var oidStreamCertMAC = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44924, 1, 1}
+
+// errUnpinnedCert - the certificate of a stream was not issued for the static key pair of the host and the peer
+var errUnpinnedCert = errors.New("stream certificate is not bound to the peer key")
+
+// stream - proxy packets framed with a length prefix over a tcp, tls or websocket connection
+type stream struct {
+	conn  net.Conn
+	addr  *net.UDPAddr // remote address, packets received on the stream have it as source
+	mutex sync.Mutex
+}
+
+// newStream - wraps a connection with the preamble already exchanged
+func newStream(conn net.Conn, remoteAddr string) (*stream, error) {
+	addr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{conn: conn, addr: addr}, nil
+}
+
+// stream.write - sends a packet
+func (s *stream) write(b []byte) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errors.New("packet too large for stream")
+	}
+	frame := make([]byte, streamHeaderSize+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[streamHeaderSize:], b)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.close()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stream.read - receives a packet into buffer
+func (s *stream) read(buffer []byte) (int, error) {
+	var header [streamHeaderSize]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buffer) {
+		return 0, fmt.Errorf("packet of %d bytes exceeds buffer", n)
+	}
+	return io.ReadFull(s.conn, buffer[:n])
+}
+
+// stream.close - closes the connection and stops sending packets over the stream
+func (s *stream) close() {
+	s.conn.Close()
+	removeRoute(s)
+}
+
+// ProxyServer.DialStream - dials a stream to the proxy of the peer at endpoint and sends the packets for endpoint
+// over it, the tcp port dialed is the configured stream port or the port of endpoint
+func (p *ProxyServer) DialStream(endpoint *net.UDPAddr, peerKey wgtypes.Key) error {
+	if _, ok := getRoute(endpoint).(*stream); ok {
+		return nil
+	}
+	cfg := ncconfig.Netclient().Proxy
+	port := endpoint.Port
+	if cfg.StreamPort != 0 {
+		port = cfg.StreamPort
+	}
+	addr := net.JoinHostPort(endpoint.IP.String(), strconv.Itoa(port))
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	conn, err := dialStream(cfg.Stream, addr, privKey, peerKey)
+	if err != nil {
+		return err
+	}
+	s, err := newStream(conn, addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	logger.Log(0, "proxying packets for", endpoint.String(), "over a", cfg.Stream, "stream to", addr)
+	registerRoute(endpoint, s)
+	go p.serveStream(s)
+	return nil
+}
+
+// dialStream - dials a stream of the given kind to the proxy of the peer and sends the preamble
+func dialStream(kind, addr string, privKey, peerKey wgtypes.Key) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: streamTimeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(streamTimeout))
+	if kind == ncconfig.ProxyStreamTLS || kind == ncconfig.ProxyStreamWebSocket {
+		tlsConn := tls.Client(conn, streamClientConfig(privKey, peerKey))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if kind == ncconfig.ProxyStreamWebSocket {
+		wsDialer := websocket.Dialer{
+			NetDialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+				return conn, nil
+			},
+			HandshakeTimeout: streamTimeout,
+		}
+		ws, resp, err := wsDialer.Dial("wss://"+addr+streamPath, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		conn = &wsConn{Conn: ws}
+	}
+	if _, err := conn.Write([]byte(streamMagic)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ProxyServer.serveStream - handles the packets received on a stream until it is closed
+func (p *ProxyServer) serveStream(s *stream) {
+	// replies to packets received on the stream go back over it
+	registerRoute(s.addr, s)
+	defer s.close()
+	buffer := make([]byte, p.Config.BodySize)
+	for {
+		n, err := s.read(buffer)
+		if err != nil {
+			logger.Log(1, "proxy stream with", s.addr.String(), "closed: ", err.Error())
+			return
+		}
+		p.handlePacket(buffer, n, s.addr, true, nil)
+	}
+}
+
+// ProxyServer.listenStreams - accepts streams on the tcp ports of the proxy port and the configured stream port
+func (p *ProxyServer) listenStreams() {
+	certs, err := newStreamCerts()
+	if err != nil {
+		logger.Log(0, "failed to create proxy stream certificate key, accepting plain tcp streams only: ", err.Error())
+	} else {
+		p.tlsConfig = &tls.Config{GetCertificate: certs.get}
+	}
+	p.wsListener = newConnListener()
+	go func(l net.Listener) {
+		_ = http.Serve(l, http.HandlerFunc(p.serveWebSocket))
+	}(p.wsListener)
+	ports := []int{p.Config.Port}
+	if port := ncconfig.Netclient().Proxy.StreamPort; port != 0 && port != p.Config.Port {
+		ports = append(ports, port)
+	}
+	server, server6 := p.listeners()
+	for _, conn := range []*net.UDPConn{server, server6} {
+		if conn == nil {
+			continue
+		}
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		for _, port := range ports {
+			l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+			if err != nil {
+				logger.Log(0, "failed to listen for proxy streams: ", err.Error())
+				continue
+			}
+			p.streamListeners = append(p.streamListeners, l)
+			go p.acceptStreams(l)
+		}
+	}
+}
+
+// ProxyServer.closeStreams - stops accepting streams and closes the open ones
+func (p *ProxyServer) closeStreams() {
+	for _, l := range p.streamListeners {
+		l.Close()
+	}
+	p.streamListeners = nil
+	if p.wsListener != nil {
+		p.wsListener.Close()
+	}
+	routesMutex.RLock()
+	open := make(map[*stream]struct{})
+	for _, r := range routes {
+		if s, ok := r.(*stream); ok {
+			open[s] = struct{}{}
+		}
+	}
+	routesMutex.RUnlock()
+	for s := range open {
+		s.close()
+	}
+}
+
+// ProxyServer.acceptStreams - accepts streams until the listener is closed
+func (p *ProxyServer) acceptStreams(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logger.Log(3, "stopped accepting proxy streams: ", err.Error())
+			return
+		}
+		go p.handleStreamConn(conn, true)
+	}
+}
+
+// ProxyServer.handleStreamConn - tells the kind of an accepted stream apart by its first bytes
+func (p *ProxyServer) handleStreamConn(conn net.Conn, allowTLS bool) {
+	_ = conn.SetReadDeadline(time.Now().Add(streamTimeout))
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(len(streamMagic))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	switch {
+	case allowTLS && head[0] == tlsRecordTypeHandshake && p.tlsConfig != nil:
+		tlsConn := tls.Server(peeked, p.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Log(3, "proxy stream tls handshake failed: ", err.Error())
+			conn.Close()
+			return
+		}
+		p.handleStreamConn(tlsConn, false)
+	case string(head) == "GET ":
+		_ = conn.SetReadDeadline(time.Time{})
+		p.wsListener.push(peeked)
+	case string(head) == streamMagic:
+		_, _ = reader.Discard(len(streamMagic))
+		_ = conn.SetReadDeadline(time.Time{})
+		s, err := newStream(peeked, conn.RemoteAddr().String())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		p.serveStream(s)
+	default:
+		logger.Log(3, "dropping unknown stream from", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// ProxyServer.serveWebSocket - handles a websocket stream
+func (p *ProxyServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != streamPath {
+		http.NotFound(w, r)
+		return
+	}
+	// the dialing proxies are no browsers, there is no origin to check
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &wsConn{Conn: ws}
+	_ = conn.SetReadDeadline(time.Now().Add(streamTimeout))
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil || string(magic) != streamMagic {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	s, err := newStream(conn, r.RemoteAddr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	p.serveStream(s)
+}
+
+// streamClientConfig - tls config of a stream dialed to a peer; the certificates of the proxies are self signed, so
+// instead of a chain the certificate must carry the mac binding its key to the static key pair of the host and
+// the peer, which only the peer can create; the server name tells the peer the key hash of the host
+func streamClientConfig(privKey, peerKey wgtypes.Key) *tls.Config {
+	return &tls.Config{
+		ServerName:         models.ConvPeerKeyToHash(privKey.PublicKey().String()),
+		InsecureSkipVerify: true, //nolint:gosec // verified by VerifyPeerCertificate
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errUnpinnedCert
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			return verifyStreamCert(cert, privKey, peerKey)
+		},
+	}
+}
+
+// verifyStreamCert - checks that the certificate carries the mac of its key for the static key pair
+func verifyStreamCert(cert *x509.Certificate, privKey, peerKey wgtypes.Key) error {
+	expected := packet.StreamCertMAC(privKey, peerKey, cert.RawSubjectPublicKeyInfo)
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidStreamCertMAC) {
+			continue
+		}
+		var mac []byte
+		if _, err := asn1.Unmarshal(ext.Value, &mac); err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(mac, expected[:]) != 1 {
+			return errUnpinnedCert
+		}
+		return nil
+	}
+	return errUnpinnedCert
+}
+
+// streamCerts - certificates of the tls streams, one per dialing peer as each carries the mac for the peer
+type streamCerts struct {
+	key   *ecdsa.PrivateKey
+	certs map[wgtypes.Key]*tls.Certificate
+	mutex sync.Mutex
+}
+
+// newStreamCerts - creates the key of the stream certificates
+func newStreamCerts() (*streamCerts, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCerts{key: key, certs: make(map[wgtypes.Key]*tls.Certificate)}, nil
+}
+
+// streamCerts.get - returns the certificate for the peer whose key hash is the server name of the client hello,
+// handshakes of unknown peers fail
+func (c *streamCerts) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	peerKey, found := config.GetCfg().GetPeerKeyByHash(hello.ServerName)
+	if !found {
+		return nil, errors.New("proxy stream from unknown peer " + hello.ServerName)
+	}
+	privKey, _ := config.GetCfg().GetDeviceKeys()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cert, ok := c.certs[peerKey]; ok {
+		return cert, nil
+	}
+	cert, err := newStreamCert(c.key, privKey, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	c.certs[peerKey] = cert
+	return cert, nil
+}
+
+// newStreamCert - creates a self signed certificate of the tls streams carrying the mac of its key for the static
+// key pair of the host and the peer
+func newStreamCert(key *ecdsa.PrivateKey, privKey, peerKey wgtypes.Key) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	publicKeyInfo, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := packet.StreamCertMAC(privKey, peerKey, publicKeyInfo)
+	value, err := asn1.Marshal(mac[:])
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: "netmaker proxy"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().AddDate(1, 0, 0),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oidStreamCertMAC, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// wsConn - websocket connection read and written as a byte stream, each write is sent as one binary message
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+// wsConn.Read - reads from the current message and moves on to the next one once it is consumed
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// wsConn.Write - sends b as a binary message
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// wsConn.SetDeadline - sets the read and write deadlines
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// peekedConn - connection whose first bytes were read ahead to tell the kind of stream
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// peekedConn.Read - reads the bytes read ahead first
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connListener - listener handing accepted websocket connections to the http server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// connListener.push - hands a connection to the http server
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// connListener.Accept - waits for the next connection
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// connListener.Close - stops the http server
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// connListener.Addr - the listener has no address of its own
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestStreamFraming(t *testing.T) {
+	is := is.New(t)
+	client, server := net.Pipe()
+	defer server.Close()
+	s, err := newStream(client, "127.0.0.1:51821")
+	is.NoErr(err)
+	r, err := newStream(server, "127.0.0.1:51822")
+	is.NoErr(err)
+	packets := [][]byte{[]byte("first"), {}, []byte(strings.Repeat("x", 1500))}
+	go func() {
+		for _, pkt := range packets {
+			_, _ = s.write(pkt)
+		}
+	}()
+	buffer := make([]byte, 2000)
+	for _, pkt := range packets {
+		n, err := r.read(buffer)
+		is.NoErr(err)
+		is.Equal(buffer[:n], pkt)
+	}
+	t.Run("too large", func(t *testing.T) {
+		_, err := s.write(make([]byte, 0x10000))
+		is.True(err != nil)
+	})
+	t.Run("exceeds buffer", func(t *testing.T) {
+		go func() {
+			_, _ = s.write(make([]byte, 100))
+		}()
+		_, err := r.read(make([]byte, 10))
+		is.True(err != nil)
+	})
+}
+
+func TestStreamCert(t *testing.T) {
+	is := is.New(t)
+	hostKey, peerKey, otherKey := newTestKey(t), newTestKey(t), newTestKey(t)
+	certs, err := newStreamCerts()
+	is.NoErr(err)
+	cert, err := newStreamCert(certs.key, hostKey, peerKey.PublicKey())
+	is.NoErr(err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	is.NoErr(err)
+	t.Run("pinned", func(t *testing.T) {
+		is.NoErr(verifyStreamCert(leaf, peerKey, hostKey.PublicKey()))
+	})
+	t.Run("other peer", func(t *testing.T) {
+		is.Equal(verifyStreamCert(leaf, otherKey, hostKey.PublicKey()), errUnpinnedCert)
+	})
+	t.Run("other host", func(t *testing.T) {
+		is.Equal(verifyStreamCert(leaf, peerKey, otherKey.PublicKey()), errUnpinnedCert)
+	})
+	t.Run("handshake", func(t *testing.T) {
+		is.NoErr(streamHandshake(cert, peerKey, hostKey.PublicKey()))
+	})
+	t.Run("handshake with unpinned certificate", func(t *testing.T) {
+		unpinned, err := newStreamCert(certs.key, otherKey, peerKey.PublicKey())
+		is.NoErr(err)
+		is.True(streamHandshake(unpinned, peerKey, hostKey.PublicKey()) != nil)
+	})
+}
+
+func TestWSConn(t *testing.T) {
+	is := is.New(t)
+	received := make(chan []byte, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s, err := newStream(&wsConn{Conn: ws}, "127.0.0.1:51821")
+		if err != nil {
+			return
+		}
+		defer s.conn.Close()
+		buffer := make([]byte, 2000)
+		for {
+			n, err := s.read(buffer)
+			if err != nil {
+				return
+			}
+			received <- append([]byte{}, buffer[:n]...)
+			_, _ = s.write(buffer[:n])
+		}
+	}))
+	defer srv.Close()
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	is.NoErr(err)
+	resp.Body.Close()
+	s, err := newStream(&wsConn{Conn: ws}, "127.0.0.1:51822")
+	is.NoErr(err)
+	defer s.conn.Close()
+	buffer := make([]byte, 2000)
+	for _, pkt := range [][]byte{[]byte("first"), []byte(strings.Repeat("x", 1500))} {
+		_, err := s.write(pkt)
+		is.NoErr(err)
+		is.Equal(<-received, pkt)
+		n, err := s.read(buffer)
+		is.NoErr(err)
+		is.Equal(buffer[:n], pkt)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	is := is.New(t)
+	client, server := net.Pipe()
+	defer server.Close()
+	s, err := newStream(client, "127.0.0.1:51821")
+	is.NoErr(err)
+	endpoint := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51822}
+	registerRoute(s.addr, s)
+	t.Run("unauthenticated packets don't bind", func(t *testing.T) {
+		bindRoute(s.addr, "hash", nil)
+		is.Equal(getRoute(endpoint), nil)
+	})
+	t.Run("back to udp", func(t *testing.T) {
+		registerRoute(endpoint, s)
+		is.True(HasRoute(endpoint))
+		RouteViaUDP(endpoint)
+		is.Equal(getRoute(endpoint), nil)
+		is.Equal(getRoute(s.addr), nil)
+		_, err := client.Write([]byte{0})
+		is.True(err != nil) // the stream was closed
+	})
+}
+
+func newTestKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// streamHandshake - runs a tls handshake of a stream dialed by the peer against a server presenting cert
+func streamHandshake(cert *tls.Certificate, privKey, peerKey wgtypes.Key) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{*cert}}).Handshake()
+		server.Close()
+	}()
+	return tls.Client(client, streamClientConfig(privKey, peerKey)).Handshake()
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/nmproxy/turn"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// ErrNoTurn - returned when no turn relay is allocated
+var ErrNoTurn = errors.New("no turn relay allocated")
+
+// turnRoute - sends the packets for a peer through the turn relay
+type turnRoute struct {
+	client *turn.Client
+	peer   *net.UDPAddr
+}
+
+// turnRoute.write - sends a packet to the peer from the relayed address
+func (r *turnRoute) write(b []byte) (int, error) {
+	return r.client.WriteTo(b, r.peer)
+}
+
+// ProxyServer.StartTurn - allocates a relayed address on the turn server, packets peers send to it are handled like
+// packets received on the proxy port and answered through the relay
+func (p *ProxyServer) StartTurn(ctx context.Context, serverAddr, username, password string) (*net.UDPAddr, error) {
+	client, err := turn.New(serverAddr, username, password, p.handleTurnPacket)
+	if err != nil {
+		return nil, err
+	}
+	p.turn = client
+	relayed, err := client.Allocate()
+	if err != nil {
+		p.turn = nil
+		client.Close()
+		return nil, err
+	}
+	setRelayedAddr(relayed)
+	go client.Run(ctx, setRelayedAddr)
+	return relayed, nil
+}
+
+// setRelayedAddr - records the relayed address in the host info
+func setRelayedAddr(relayed *net.UDPAddr) {
+	hostInfo := config.GetCfg().GetHostInfo()
+	hostInfo.RelayedAddr = relayed
+	config.GetCfg().SetHostInfo(hostInfo)
+}
+
+// ProxyServer.handleTurnPacket - handles a packet a peer sent to the relayed address
+func (p *ProxyServer) handleTurnPacket(b []byte, peer *net.UDPAddr) {
+	if _, ok := getRoute(peer).(*turnRoute); !ok {
+		registerRoute(peer, &turnRoute{client: p.turn, peer: peer})
+	}
+	p.handlePacket(b, len(b), peer, true, nil)
+}
+
+// ProxyServer.PermitTurn - lets the peer at endpoint send to the relayed address
+func (p *ProxyServer) PermitTurn(endpoint *net.UDPAddr) error {
+	if p.turn == nil {
+		return ErrNoTurn
+	}
+	return p.turn.Permit(endpoint.IP)
+}
+
+// ProxyServer.UnpermitTurn - releases the permission of the peer at endpoint
+func (p *ProxyServer) UnpermitTurn(endpoint *net.UDPAddr) {
+	if p.turn != nil {
+		p.turn.Unpermit(endpoint.IP)
+	}
+}
+
+// ProxyServer.RouteViaTurn - sends the packets for endpoint through the turn relay
+func (p *ProxyServer) RouteViaTurn(endpoint *net.UDPAddr) error {
+	if p.turn == nil {
+		return ErrNoTurn
+	}
+	if err := p.turn.Bind(endpoint); err != nil {
+		return err
+	}
+	logger.Log(0, "proxying packets for", endpoint.String(), "through the turn relay")
+	registerRoute(endpoint, &turnRoute{client: p.turn, peer: endpoint})
+	return nil
+}
+
+// IsTurnRoute - checks if the packets for addr are sent through the turn relay
+func IsTurnRoute(addr *net.UDPAddr) bool {
+	_, ok := getRoute(addr).(*turnRoute)
+	return ok
+}
@@ -0,0 +1,282 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/gravitl/netmaker/logger"
+	"gopkg.in/yaml.v3"
+	"gortc.io/stun"
+)
+
+const (
+	// natFile - state file holding the nat behavior discovered by the proxy of the daemon
+	natFile = "nat.yml"
+	// probeTimeout - how long to wait for the response to a binding request before it is retransmitted
+	probeTimeout = time.Millisecond * 500
+	// probeAttempts - binding requests sent per test before the test is considered to get no response
+	probeAttempts = 3
+	// CHANGE-REQUEST flags of RFC 5780
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// errNoResponse - no response to any of the binding requests of a test
+var errNoResponse = errors.New("no response from stun server")
+
+// bindingResponse - addresses returned by a stun server
+type bindingResponse struct {
+	mapped *net.UDPAddr
+	other  *net.UDPAddr // OTHER-ADDRESS of an RFC 5780 server, nil otherwise
+}
+
+// DiscoverNAT - classifies the mapping and filtering behavior of the nat in front of the proxy port as described by
+// RFC 5780; when the stun server lacks RFC 5780 support the mapping is classified by comparing the mappings
+// returned by the additional stun servers and the filtering stays unknown
+func DiscoverNAT(network, stunHostAddr string, stunPort, proxyPort int, servers []string) (nat models.NATInfo) {
+	nat = models.NATInfo{
+		Mapping:   models.BehaviorUnknown,
+		Filtering: models.BehaviorUnknown,
+		Type:      models.NATUnknown,
+	}
+	s, err := net.ResolveUDPAddr(network, net.JoinHostPort(stunHostAddr, strconv.Itoa(stunPort)))
+	if err != nil {
+		logger.Log(1, "failed to resolve udp addr: ", err.Error())
+		return
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: proxyPort})
+	if err != nil {
+		logger.Log(1, "failed to listen on the proxy port for nat discovery, using a random port: ", err.Error())
+		if conn, err = net.ListenUDP(network, nil); err != nil {
+			logger.Log(1, "failed to listen for nat discovery: ", err.Error())
+			return
+		}
+	}
+	defer conn.Close()
+	// test I: mapping returned by the primary address of the server
+	res, err := bindingRequest(conn, s)
+	if err != nil {
+		logger.Log(1, "nat discovery failed: ", err.Error())
+		return
+	}
+	if res.other != nil {
+		// the filtering tests go first, the mapping tests open the filter for the alternate address
+		nat.Filtering = discoverFiltering(conn, s)
+		nat.Mapping = discoverMapping(conn, s, res)
+	} else {
+		logger.Log(1, "stun server", s.String(), "does not support RFC 5780, comparing the mappings of other servers")
+		nat.Mapping = compareMappings(conn, network, res.mapped, servers)
+	}
+	nat.Type = natType(nat, isLocalAddr(res.mapped, conn.LocalAddr().(*net.UDPAddr).Port))
+	return
+}
+
+// SaveNATInfo - writes the nat behavior to the state file read by GetNATInfo
+func SaveNATInfo(nat models.NATInfo) error {
+	data, err := yaml.Marshal(nat)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.GetNetclientPath()+natFile, data, 0644)
+}
+
+// GetNATInfo - reads the nat behavior discovered by the proxy of the daemon
+func GetNATInfo() (models.NATInfo, error) {
+	nat := models.NATInfo{
+		Mapping:   models.BehaviorUnknown,
+		Filtering: models.BehaviorUnknown,
+		Type:      models.NATUnknown,
+	}
+	data, err := os.ReadFile(config.GetNetclientPath() + natFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nat, nil
+		}
+		return nat, err
+	}
+	return nat, yaml.Unmarshal(data, &nat)
+}
+
+// == private ==
+
+// discoverMapping - RFC 5780 mapping tests II and III
+func discoverMapping(conn *net.UDPConn, s *net.UDPAddr, res bindingResponse) string {
+	// test II: alternate address, primary port
+	res2, err := bindingRequest(conn, &net.UDPAddr{IP: res.other.IP, Port: s.Port})
+	if err != nil {
+		logger.Log(1, "nat mapping test II failed: ", err.Error())
+		return models.BehaviorUnknown
+	}
+	if res2.mapped.String() == res.mapped.String() {
+		return models.BehaviorEndpointIndependent
+	}
+	// test III: alternate address and port
+	res3, err := bindingRequest(conn, res.other)
+	if err != nil {
+		logger.Log(1, "nat mapping test III failed: ", err.Error())
+		return models.BehaviorUnknown
+	}
+	if res3.mapped.String() == res2.mapped.String() {
+		return models.BehaviorAddressDependent
+	}
+	return models.BehaviorAddressAndPortDependent
+}
+
+// discoverFiltering - RFC 5780 filtering tests II and III, a server rejecting CHANGE-REQUEST leaves the filtering unknown
+func discoverFiltering(conn *net.UDPConn, s *net.UDPAddr) string {
+	// test II: response from the alternate address and port
+	_, err := bindingRequest(conn, s, changeRequest(changeIP|changePort))
+	if err == nil {
+		return models.BehaviorEndpointIndependent
+	}
+	if !errors.Is(err, errNoResponse) {
+		logger.Log(1, "nat filtering test II failed: ", err.Error())
+		return models.BehaviorUnknown
+	}
+	// test III: response from the alternate port
+	_, err = bindingRequest(conn, s, changeRequest(changePort))
+	if err == nil {
+		return models.BehaviorAddressDependent
+	}
+	if !errors.Is(err, errNoResponse) {
+		logger.Log(1, "nat filtering test III failed: ", err.Error())
+		return models.BehaviorUnknown
+	}
+	return models.BehaviorAddressAndPortDependent
+}
+
+// compareMappings - compares the mapping of the primary server with the mappings of the other servers; servers differ
+// in address, so a different mapping can't tell address dependent from address and port dependent mapping and is
+// reported as address dependent
+func compareMappings(conn *net.UDPConn, network string, mapped *net.UDPAddr, servers []string) string {
+	behavior := models.BehaviorUnknown
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr(network, server)
+		if err != nil {
+			logger.Log(1, "failed to resolve stun server", server, err.Error())
+			continue
+		}
+		res, err := bindingRequest(conn, addr)
+		if err != nil {
+			logger.Log(1, "binding request to stun server", server, "failed:", err.Error())
+			continue
+		}
+		if res.mapped.String() != mapped.String() {
+			return models.BehaviorAddressDependent
+		}
+		behavior = models.BehaviorEndpointIndependent
+	}
+	return behavior
+}
+
+// natType - derives the nat type from the behavior
+func natType(nat models.NATInfo, public bool) string {
+	if public {
+		return models.NATNone
+	}
+	switch nat.Mapping {
+	case models.BehaviorEndpointIndependent:
+		switch nat.Filtering {
+		case models.BehaviorEndpointIndependent:
+			return models.NATFullCone
+		case models.BehaviorAddressDependent:
+			return models.NATRestrictedCone
+		case models.BehaviorAddressAndPortDependent:
+			return models.NATPortRestrictedCone
+		}
+		return models.NATCone
+	case models.BehaviorAddressDependent, models.BehaviorAddressAndPortDependent:
+		return models.NATSymmetric
+	}
+	return models.NATUnknown
+}
+
+// isLocalAddr - checks if the mapped address is an address of the host on the local port, i.e. there is no nat
+func isLocalAddr(mapped *net.UDPAddr, port int) bool {
+	if mapped.Port != port {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// changeRequest - CHANGE-REQUEST attribute asking the server to respond from another address or port
+func changeRequest(flags byte) stun.Setter {
+	return stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, flags}}
+}
+
+// bindingRequest - sends a binding request to the server and waits for the response, retransmitting it on timeout;
+// the response may come from another address of the server
+func bindingRequest(conn *net.UDPConn, server *net.UDPAddr, setters ...stun.Setter) (res bindingResponse, err error) {
+	message, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, setters...)...)
+	if err != nil {
+		return res, err
+	}
+	buf := make([]byte, 1500)
+	for i := 0; i < probeAttempts; i++ {
+		if _, err := conn.WriteToUDP(message.Raw, server); err != nil {
+			return res, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(probeTimeout)); err != nil {
+			return res, err
+		}
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return res, err
+			}
+			if !stun.IsMessage(buf[:n]) {
+				continue
+			}
+			m := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if m.Decode() != nil || m.TransactionID != message.TransactionID {
+				continue
+			}
+			if m.Type.Class == stun.ClassErrorResponse {
+				var code stun.ErrorCodeAttribute
+				if err := code.GetFrom(m); err != nil {
+					return res, errors.New("binding request rejected")
+				}
+				return res, errors.New("binding request rejected: " + code.String())
+			}
+			return parseBindingResponse(m)
+		}
+	}
+	return res, errNoResponse
+}
+
+// parseBindingResponse - reads the mapped address, falling back to the MAPPED-ADDRESS of RFC 3489 servers, and the
+// alternate address of the server
+func parseBindingResponse(m *stun.Message) (res bindingResponse, err error) {
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(m); err == nil {
+		res.mapped = &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}
+	} else {
+		var addr stun.MappedAddress
+		if err := addr.GetFrom(m); err != nil {
+			return res, errors.New("binding response without mapped address")
+		}
+		res.mapped = &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	}
+	var other stun.OtherAddress
+	if err := other.GetFrom(m); err == nil {
+		res.other = &net.UDPAddr{IP: other.IP, Port: other.Port}
+	}
+	return res, nil
+}
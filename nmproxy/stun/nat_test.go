@@ -0,0 +1,139 @@
+package stun
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gravitl/netclient/nmproxy/models"
+	"github.com/matryer/is"
+	"gortc.io/stun"
+)
+
+func TestNATType(t *testing.T) {
+	is := is.New(t)
+	tests := []struct {
+		name      string
+		mapping   string
+		filtering string
+		public    bool
+		want      string
+	}{
+		{"public", models.BehaviorEndpointIndependent, models.BehaviorAddressAndPortDependent, true, models.NATNone},
+		{"public unknown", models.BehaviorUnknown, models.BehaviorUnknown, true, models.NATNone},
+		{"full cone", models.BehaviorEndpointIndependent, models.BehaviorEndpointIndependent, false, models.NATFullCone},
+		{"restricted cone", models.BehaviorEndpointIndependent, models.BehaviorAddressDependent, false, models.NATRestrictedCone},
+		{"port restricted cone", models.BehaviorEndpointIndependent, models.BehaviorAddressAndPortDependent, false, models.NATPortRestrictedCone},
+		{"cone with unknown filtering", models.BehaviorEndpointIndependent, models.BehaviorUnknown, false, models.NATCone},
+		{"symmetric", models.BehaviorAddressDependent, models.BehaviorEndpointIndependent, false, models.NATSymmetric},
+		{"port symmetric", models.BehaviorAddressAndPortDependent, models.BehaviorUnknown, false, models.NATSymmetric},
+		{"unknown", models.BehaviorUnknown, models.BehaviorEndpointIndependent, false, models.NATUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nat := models.NATInfo{Mapping: tt.mapping, Filtering: tt.filtering}
+			is.Equal(natType(nat, tt.public), tt.want)
+		})
+	}
+}
+
+func TestParseBindingResponse(t *testing.T) {
+	is := is.New(t)
+	mapped := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 40000}
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 3479}
+	t.Run("xor mapped address", func(t *testing.T) {
+		res, err := parseBindingResponse(newResponse(t,
+			&stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port},
+			&stun.MappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1}))
+		is.NoErr(err)
+		is.Equal(res.mapped.String(), mapped.String())
+		is.Equal(res.other, nil)
+	})
+	t.Run("ipv6 xor mapped address", func(t *testing.T) {
+		ip := net.ParseIP("2001:db8::7")
+		res, err := parseBindingResponse(newResponse(t, &stun.XORMappedAddress{IP: ip, Port: mapped.Port}))
+		is.NoErr(err)
+		is.True(res.mapped.IP.Equal(ip))
+	})
+	t.Run("mapped address of rfc 3489 server", func(t *testing.T) {
+		res, err := parseBindingResponse(newResponse(t, &stun.MappedAddress{IP: mapped.IP, Port: mapped.Port}))
+		is.NoErr(err)
+		is.Equal(res.mapped.String(), mapped.String())
+	})
+	t.Run("other address", func(t *testing.T) {
+		res, err := parseBindingResponse(newResponse(t,
+			&stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port},
+			&stun.OtherAddress{IP: other.IP, Port: other.Port}))
+		is.NoErr(err)
+		is.Equal(res.other.String(), other.String())
+	})
+	t.Run("no mapped address", func(t *testing.T) {
+		_, err := parseBindingResponse(newResponse(t, &stun.OtherAddress{IP: other.IP, Port: other.Port}))
+		is.True(err != nil)
+	})
+}
+
+func TestBindingRequest(t *testing.T) {
+	is := is.New(t)
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			res := &stun.Message{TransactionID: req.TransactionID}
+			if req.Contains(stun.AttrChangeRequest) {
+				_ = res.Build(stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+					&stun.ErrorCodeAttribute{Code: stun.CodeBadRequest, Reason: []byte("no alternate address")})
+			} else {
+				_ = res.Build(stun.BindingSuccess, &stun.XORMappedAddress{IP: addr.IP, Port: addr.Port})
+			}
+			// a stale response of another transaction goes first
+			stale := &stun.Message{}
+			_ = stale.Build(stun.TransactionID, stun.BindingSuccess, &stun.XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+			_, _ = server.WriteToUDP(stale.Raw, addr)
+			_, _ = server.WriteToUDP(res.Raw, addr)
+		}
+	}()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer conn.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	t.Run("mapped", func(t *testing.T) {
+		res, err := bindingRequest(conn, serverAddr)
+		is.NoErr(err)
+		is.Equal(res.mapped.String(), conn.LocalAddr().String())
+	})
+	t.Run("rejected", func(t *testing.T) {
+		_, err := bindingRequest(conn, serverAddr, changeRequest(changeIP|changePort))
+		is.True(err != nil)
+		is.True(err != errNoResponse)
+	})
+	t.Run("no response", func(t *testing.T) {
+		silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		is.NoErr(err)
+		defer silent.Close()
+		_, err = bindingRequest(conn, silent.LocalAddr().(*net.UDPAddr))
+		is.Equal(err, errNoResponse)
+	})
+}
+
+// newResponse - binding success response with the attributes as received from a server
+func newResponse(t *testing.T, setters ...stun.Setter) *stun.Message {
+	m, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.BindingSuccess}, setters...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &stun.Message{Raw: append([]byte{}, m.Raw...)}
+	if err := received.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
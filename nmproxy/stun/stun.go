@@ -1,20 +1,64 @@
 package stun
 
 import (
-	"fmt"
 	"net"
 	"strconv"
-	"strings"
 
 	"github.com/gravitl/netclient/nmproxy/models"
 	"github.com/gravitl/netmaker/logger"
 	"gortc.io/stun"
 )
 
-// GetHostInfo - calls stun server for udp hole punch and fetches host info
+// GlobalUnicast6 - any ipv6 global unicast address, used to look up the source address of the ipv6 default route
+const GlobalUnicast6 = "2000::1"
+
+// GetHostInfo - calls stun server for udp hole punch and fetches host info, over ipv4 if the host has an ipv4
+// route to the stun server and over ipv6 otherwise
 func GetHostInfo(stunHostAddr string, stunPort, proxyPort int) (info models.HostInfo) {
+	if !hasRoute("udp4", stunHostAddr, stunPort) {
+		logger.Log(1, "no ipv4 route to the stun server, using ipv6")
+		return getHostInfo("udp6", stunHostAddr, stunPort, proxyPort)
+	}
+	return getHostInfo("udp4", stunHostAddr, stunPort, proxyPort)
+}
+
+// GetPrivIP6 - returns the local ipv6 address used to reach the stun server or, if it has no ipv6 address,
+// the ipv6 default route; no packets are sent
+func GetPrivIP6(stunHostAddr string, stunPort int) net.IP {
+	s, err := net.ResolveUDPAddr("udp6", net.JoinHostPort(stunHostAddr, strconv.Itoa(stunPort)))
+	if err != nil {
+		s = &net.UDPAddr{IP: net.ParseIP(GlobalUnicast6), Port: stunPort}
+	}
+	conn, err := net.DialUDP("udp6", nil, s)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if !ip.IsGlobalUnicast() {
+		return nil
+	}
+	return ip
+}
+
+// hasRoute - checks if the stun server has an address of the network, udp4 or udp6, and the host has a route to
+// it; no packets are sent
+func hasRoute(network, stunHostAddr string, stunPort int) bool {
+	s, err := net.ResolveUDPAddr(network, net.JoinHostPort(stunHostAddr, strconv.Itoa(stunPort)))
+	if err != nil {
+		return false
+	}
+	conn, err := net.DialUDP(network, nil, s)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func getHostInfo(network, stunHostAddr string, stunPort, proxyPort int) (info models.HostInfo) {
 
-	s, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", stunHostAddr, stunPort))
+	s, err := net.ResolveUDPAddr(network, net.JoinHostPort(stunHostAddr, strconv.Itoa(stunPort)))
 	if err != nil {
 		logger.Log(1, "failed to resolve udp addr: ", err.Error())
 		return
@@ -23,7 +67,7 @@ func GetHostInfo(stunHostAddr string, stunPort, proxyPort int) (info models.Host
 		IP:   net.ParseIP(""),
 		Port: proxyPort,
 	}
-	conn, err := net.DialUDP("udp", l, s)
+	conn, err := net.DialUDP(network, l, s)
 	if err != nil {
 		logger.Log(1, "failed to dial: ", err.Error())
 		return
@@ -35,9 +79,9 @@ func GetHostInfo(stunHostAddr string, stunPort, proxyPort int) (info models.Host
 		return
 	}
 	defer c.Close()
-	re := strings.Split(conn.LocalAddr().String(), ":")
-	info.PrivIp = net.ParseIP(re[0])
-	info.PrivPort, _ = strconv.Atoi(re[1])
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	info.PrivIp = localAddr.IP
+	info.PrivPort = localAddr.Port
 	// Building binding request with random transaction id.
 	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
 	// Sending request to STUN server, waiting for response message.
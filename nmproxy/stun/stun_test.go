@@ -0,0 +1,20 @@
+package stun
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestHasRoute(t *testing.T) {
+	is := is.New(t)
+	t.Run("ipv4 address", func(t *testing.T) {
+		is.True(hasRoute("udp4", "127.0.0.1", 3478))
+	})
+	t.Run("ipv6 address over ipv4", func(t *testing.T) {
+		is.Equal(hasRoute("udp4", "::1", 3478), false)
+	})
+	t.Run("ipv4 address over ipv6", func(t *testing.T) {
+		is.Equal(hasRoute("udp6", "127.0.0.1", 3478), false)
+	})
+}
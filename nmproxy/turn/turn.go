@@ -0,0 +1,499 @@
+package turn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netmaker/logger"
+	"gortc.io/stun"
+)
+
+const (
+	// allocationLifetime - lifetime requested for the allocation, refreshed well before it expires
+	allocationLifetime = time.Minute * 10
+	// permissionRefreshInterval - permissions expire after 5 minutes and channel bindings after 10
+	permissionRefreshInterval = time.Minute * 4
+	// rtoInitial - initial retransmission timeout of requests, doubled on every retransmission
+	rtoInitial = time.Millisecond * 500
+	// rtoMax - cap of the retransmission timeout
+	rtoMax = time.Second * 4
+	// maxTransmissions - number of times a request is sent before giving up
+	maxTransmissions = 5
+	// protoUDP - REQUESTED-TRANSPORT value for udp relaying
+	protoUDP = 17
+	// channelMin, channelMax - range of the channel numbers
+	channelMin = 0x4000
+	channelMax = 0x7fff
+	// channelHeaderSize - size of the channel number and length prefixing channel data
+	channelHeaderSize = 4
+)
+
+var (
+	// ErrTimeout - the turn server did not answer a request
+	ErrTimeout = errors.New("turn server did not respond")
+	// ErrNotAllocated - the client has no relayed address
+	ErrNotAllocated = errors.New("turn allocation not created")
+)
+
+// Handler - called with the packets peers send to the relayed address, b is only valid during the call
+type Handler func(b []byte, peer *net.UDPAddr)
+
+// Client - turn client (RFC 5766/8656) relaying udp through an allocation with long-term credentials
+type Client struct {
+	conn     *net.UDPConn
+	server   *net.UDPAddr
+	username string
+	password string
+	handler  Handler
+
+	mutex        sync.Mutex
+	realm        stun.Realm
+	nonce        stun.Nonce
+	relayed      *net.UDPAddr
+	lifetime     time.Duration
+	transactions map[[stun.TransactionIDSize]byte]chan *stun.Message
+	permissions  map[string]int // permitted peer ips, by the number of users
+	channels     map[string]uint16
+	channelPeers map[uint16]*net.UDPAddr
+	nextChannel  uint16
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// New - creates a client of the turn server at serverAddr (host:port) and starts reading from it
+func New(serverAddr, username, password string, handler Handler) (*Client, error) {
+	server, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if server.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:         conn,
+		server:       server,
+		username:     username,
+		password:     password,
+		handler:      handler,
+		transactions: make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+		permissions:  make(map[string]int),
+		channels:     make(map[string]uint16),
+		channelPeers: make(map[uint16]*net.UDPAddr),
+		nextChannel:  channelMin,
+		done:         make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Client.Allocate - creates the allocation and returns the relayed address
+func (c *Client) Allocate() (*net.UDPAddr, error) {
+	res, err := c.request(stun.MethodAllocate,
+		stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{protoUDP, 0, 0, 0}},
+		lifetimeAttr(allocationLifetime))
+	if err != nil {
+		return nil, err
+	}
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(res, stun.AttrXORRelayedAddress); err != nil {
+		return nil, fmt.Errorf("allocation without relayed address: %w", err)
+	}
+	addr := &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+	c.mutex.Lock()
+	c.relayed = addr
+	c.lifetime = getLifetime(res)
+	c.mutex.Unlock()
+	logger.Log(0, "allocated turn relay", addr.String(), "on", c.server.String())
+	return addr, nil
+}
+
+// Client.RelayedAddr - returns the relayed address, nil before the allocation
+func (c *Client) RelayedAddr() *net.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.relayed
+}
+
+// Client.Run - keeps the allocation, permissions and channel bindings alive until ctx is done, a lost
+// allocation is created again and reported through relayed
+func (c *Client) Run(ctx context.Context, relayed func(*net.UDPAddr)) {
+	defer c.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-time.After(c.refreshInterval()):
+		}
+		if _, err := c.request(stun.MethodRefresh, lifetimeAttr(allocationLifetime)); err != nil {
+			logger.Log(0, "failed to refresh turn allocation, allocating again: ", err.Error())
+			previous := c.RelayedAddr()
+			c.resetBindings()
+			addr, err := c.Allocate()
+			if err != nil {
+				logger.Log(0, "failed to allocate turn relay: ", err.Error())
+				continue
+			}
+			if relayed != nil && (previous == nil || previous.String() != addr.String()) {
+				relayed(addr)
+			}
+		}
+		c.refreshBindings()
+	}
+}
+
+// Client.Permit - allows a peer ip to send to the relayed address, kept until every Permit call is matched by Unpermit
+func (c *Client) Permit(ip net.IP) error {
+	if c.RelayedAddr() == nil {
+		return ErrNotAllocated
+	}
+	c.mutex.Lock()
+	c.permissions[ip.String()]++
+	first := c.permissions[ip.String()] == 1
+	c.mutex.Unlock()
+	if !first {
+		return nil
+	}
+	if _, err := c.request(stun.MethodCreatePermission, peerAddrAttr(&net.UDPAddr{IP: ip})); err != nil {
+		c.Unpermit(ip)
+		return err
+	}
+	return nil
+}
+
+// Client.Unpermit - releases a permission, it expires on the server once unused
+func (c *Client) Unpermit(ip net.IP) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.permissions[ip.String()] <= 1 {
+		delete(c.permissions, ip.String())
+		return
+	}
+	c.permissions[ip.String()]--
+}
+
+// Client.Bind - binds a channel to a peer, which also permits its ip; packets to the peer are then sent as channel
+// data instead of send indications
+func (c *Client) Bind(peer *net.UDPAddr) error {
+	if c.RelayedAddr() == nil {
+		return ErrNotAllocated
+	}
+	c.mutex.Lock()
+	number, found := c.channels[peer.String()]
+	if !found {
+		if c.nextChannel > channelMax {
+			c.mutex.Unlock()
+			return errors.New("out of turn channels")
+		}
+		number = c.nextChannel
+		c.nextChannel++
+	}
+	c.mutex.Unlock()
+	if found {
+		return nil
+	}
+	if _, err := c.request(stun.MethodChannelBind, channelAttr(number), peerAddrAttr(peer)); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.channels[peer.String()] = number
+	c.channelPeers[number] = peer
+	return nil
+}
+
+// Client.WriteTo - sends a packet to a peer through the relay
+func (c *Client) WriteTo(b []byte, peer *net.UDPAddr) (int, error) {
+	c.mutex.Lock()
+	number, bound := c.channels[peer.String()]
+	c.mutex.Unlock()
+	if bound {
+		frame := make([]byte, channelHeaderSize+len(b))
+		binary.BigEndian.PutUint16(frame[0:2], number)
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(b)))
+		copy(frame[channelHeaderSize:], b)
+		if _, err := c.conn.WriteToUDP(frame, c.server); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication),
+		peerAddrAttr(peer), stun.RawAttribute{Type: stun.AttrData, Value: b})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.WriteToUDP(m.Raw, c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Client.Close - releases the allocation and closes the client
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.RelayedAddr() != nil {
+			// best effort, the allocation expires on the server anyway
+			if m, buildErr := c.buildRequest(stun.MethodRefresh, lifetimeAttr(0)); buildErr == nil {
+				_, _ = c.conn.WriteToUDP(m.Raw, c.server)
+			}
+		}
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Client.refreshInterval - interval for refreshing the allocation and the bindings
+func (c *Client) refreshInterval() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lifetime > 0 && c.lifetime/2 < permissionRefreshInterval {
+		return c.lifetime / 2
+	}
+	return permissionRefreshInterval
+}
+
+// Client.refreshBindings - refreshes the permissions and channel bindings
+func (c *Client) refreshBindings() {
+	c.mutex.Lock()
+	setters := []stun.Setter{}
+	for ip := range c.permissions {
+		setters = append(setters, peerAddrAttr(&net.UDPAddr{IP: net.ParseIP(ip)}))
+	}
+	channels := make(map[uint16]*net.UDPAddr, len(c.channelPeers))
+	for number, peer := range c.channelPeers {
+		channels[number] = peer
+	}
+	c.mutex.Unlock()
+	if len(setters) > 0 {
+		if _, err := c.request(stun.MethodCreatePermission, setters...); err != nil {
+			logger.Log(1, "failed to refresh turn permissions: ", err.Error())
+		}
+	}
+	for number, peer := range channels {
+		if _, err := c.request(stun.MethodChannelBind, channelAttr(number), peerAddrAttr(peer)); err != nil {
+			logger.Log(1, "failed to refresh turn channel to", peer.String(), err.Error())
+		}
+	}
+}
+
+// Client.resetBindings - forgets the channels of a lost allocation, the permissions are created again on refresh
+func (c *Client) resetBindings() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.relayed = nil
+	c.channels = make(map[string]uint16)
+	c.channelPeers = make(map[uint16]*net.UDPAddr)
+	c.nextChannel = channelMin
+}
+
+// Client.buildRequest - builds a request, authenticated once the server sent its realm and nonce
+func (c *Client) buildRequest(method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+	c.mutex.Lock()
+	realm, nonce := c.realm, c.nonce
+	c.mutex.Unlock()
+	all := append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)
+	if nonce != nil {
+		all = append(all, stun.NewUsername(c.username), realm, nonce,
+			stun.NewLongTermIntegrity(c.username, realm.String(), c.password))
+	}
+	all = append(all, stun.Fingerprint)
+	return stun.Build(all...)
+}
+
+// Client.request - sends a request and waits for the success response, answering a challenge for credentials
+// or a stale nonce once
+func (c *Client) request(method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+	for attempt := 0; ; attempt++ {
+		m, err := c.buildRequest(method, setters...)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(m)
+		if err != nil {
+			return nil, err
+		}
+		if res.Type.Class == stun.ClassSuccessResponse {
+			return res, nil
+		}
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil {
+			return nil, fmt.Errorf("turn request %v failed: %w", method, err)
+		}
+		if attempt == 0 && (code.Code == stun.CodeUnauthorized || code.Code == stun.CodeStaleNonce) {
+			var realm stun.Realm
+			var nonce stun.Nonce
+			if err := nonce.GetFrom(res); err != nil {
+				return nil, fmt.Errorf("turn request %v failed: %d %s", method, code.Code, code.Reason)
+			}
+			c.mutex.Lock()
+			if err := realm.GetFrom(res); err == nil {
+				c.realm = realm
+			}
+			c.nonce = nonce
+			c.mutex.Unlock()
+			continue
+		}
+		return nil, fmt.Errorf("turn request %v failed: %d %s", method, code.Code, code.Reason)
+	}
+}
+
+// Client.roundTrip - sends a request with retransmissions until the response arrives
+func (c *Client) roundTrip(m *stun.Message) (*stun.Message, error) {
+	ch := make(chan *stun.Message, 1)
+	c.mutex.Lock()
+	c.transactions[m.TransactionID] = ch
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.transactions, m.TransactionID)
+		c.mutex.Unlock()
+	}()
+	rto := rtoInitial
+	for i := 0; i < maxTransmissions; i++ {
+		if _, err := c.conn.WriteToUDP(m.Raw, c.server); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(rto)
+		select {
+		case res := <-ch:
+			timer.Stop()
+			return res, nil
+		case <-c.done:
+			timer.Stop()
+			return nil, net.ErrClosed
+		case <-timer.C:
+		}
+		if rto *= 2; rto > rtoMax {
+			rto = rtoMax
+		}
+	}
+	return nil, ErrTimeout
+}
+
+// Client.readLoop - dispatches responses to the pending requests and relayed packets to the handler
+func (c *Client) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				logger.Log(0, "turn client stopped reading: ", err.Error())
+			}
+			return
+		}
+		if !from.IP.Equal(c.server.IP) || from.Port != c.server.Port {
+			continue
+		}
+		c.handle(buf[:n])
+	}
+}
+
+// Client.handle - handles a packet from the turn server
+func (c *Client) handle(b []byte) {
+	if len(b) >= channelHeaderSize && b[0]&0xc0 == 0x40 {
+		number := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		c.mutex.Lock()
+		peer := c.channelPeers[number]
+		c.mutex.Unlock()
+		if peer == nil || channelHeaderSize+length > len(b) {
+			return
+		}
+		c.handler(b[channelHeaderSize:channelHeaderSize+length], peer)
+		return
+	}
+	if !stun.IsMessage(b) {
+		return
+	}
+	m := new(stun.Message)
+	m.Raw = b
+	if err := m.Decode(); err != nil {
+		logger.Log(3, "failed to decode message from turn server: ", err.Error())
+		return
+	}
+	switch m.Type.Class {
+	case stun.ClassIndication:
+		if m.Type.Method != stun.MethodData {
+			return
+		}
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+			return
+		}
+		data, err := m.Get(stun.AttrData)
+		if err != nil {
+			return
+		}
+		c.handler(data, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+	case stun.ClassSuccessResponse, stun.ClassErrorResponse:
+		c.mutex.Lock()
+		ch, found := c.transactions[m.TransactionID]
+		c.mutex.Unlock()
+		if !found {
+			return
+		}
+		// the read buffer is reused, the response is handed over decoded from a copy
+		res := new(stun.Message)
+		res.Raw = append([]byte{}, b...)
+		if err := res.Decode(); err != nil {
+			return
+		}
+		select {
+		case ch <- res:
+		default:
+		}
+	}
+}
+
+// lifetimeAttr - LIFETIME attribute
+func lifetimeAttr(lifetime time.Duration) stun.Setter {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(lifetime/time.Second))
+	return stun.RawAttribute{Type: stun.AttrLifetime, Value: v}
+}
+
+// getLifetime - reads the LIFETIME attribute of a response, the requested lifetime if missing
+func getLifetime(m *stun.Message) time.Duration {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil || len(v) != 4 {
+		return allocationLifetime
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+}
+
+// channelAttr - CHANNEL-NUMBER attribute
+func channelAttr(number uint16) stun.Setter {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v, number)
+	return stun.RawAttribute{Type: stun.AttrChannelNumber, Value: v}
+}
+
+// peerAddrAttr - XOR-PEER-ADDRESS attribute
+func peerAddrAttr(peer *net.UDPAddr) stun.Setter {
+	return peerAddr{XORMappedAddress: stun.XORMappedAddress{IP: peer.IP, Port: peer.Port}}
+}
+
+// peerAddr - xor address added as XOR-PEER-ADDRESS
+type peerAddr struct {
+	stun.XORMappedAddress
+}
+
+// peerAddr.AddTo - adds the address as XOR-PEER-ADDRESS
+func (a peerAddr) AddTo(m *stun.Message) error {
+	return a.XORMappedAddress.AddToAs(m, stun.AttrXORPeerAddress)
+}
@@ -0,0 +1,243 @@
+package turn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gortc.io/stun"
+)
+
+const (
+	testRealm    = "netmaker"
+	testNonce    = "nonce"
+	testUsername = "user"
+	testPassword = "pass"
+)
+
+// testServer - local turn server with a single allocation
+type testServer struct {
+	conn     *net.UDPConn
+	relay    *net.UDPConn
+	mutex    sync.Mutex
+	client   *net.UDPAddr
+	permits  map[string]bool
+	channels map[uint16]*net.UDPAddr
+}
+
+func newTestServer(t *testing.T) *testServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{conn: conn, relay: relay, permits: make(map[string]bool), channels: make(map[uint16]*net.UDPAddr)}
+	go s.serve()
+	go s.serveRelay()
+	t.Cleanup(func() {
+		conn.Close()
+		relay.Close()
+	})
+	return s
+}
+
+func (s *testServer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		if b[0]&0xc0 == 0x40 {
+			s.mutex.Lock()
+			peer := s.channels[binary.BigEndian.Uint16(b[0:2])]
+			s.mutex.Unlock()
+			if peer != nil {
+				_, _ = s.relay.WriteToUDP(b[4:4+int(binary.BigEndian.Uint16(b[2:4]))], peer)
+			}
+			continue
+		}
+		m := new(stun.Message)
+		m.Raw = append([]byte{}, b...)
+		if err := m.Decode(); err != nil {
+			continue
+		}
+		if m.Type.Class == stun.ClassIndication {
+			var peer stun.XORMappedAddress
+			data, err := m.Get(stun.AttrData)
+			if err == nil && peer.GetFromAs(m, stun.AttrXORPeerAddress) == nil && s.permitted(peer.IP) {
+				_, _ = s.relay.WriteToUDP(data, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+			}
+			continue
+		}
+		if stun.NewLongTermIntegrity(testUsername, testRealm, testPassword).Check(m) != nil {
+			res := stun.MustBuild(&transactionID{m.TransactionID}, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+				stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewRealm(testRealm), stun.NewNonce(testNonce))
+			_, _ = s.conn.WriteToUDP(res.Raw, from)
+			continue
+		}
+		setters := []stun.Setter{&transactionID{m.TransactionID}, stun.NewType(m.Type.Method, stun.ClassSuccessResponse)}
+		switch m.Type.Method {
+		case stun.MethodAllocate:
+			s.mutex.Lock()
+			s.client = from
+			s.mutex.Unlock()
+			relayed := s.relay.LocalAddr().(*net.UDPAddr)
+			setters = append(setters, peerAddr{stun.XORMappedAddress{IP: relayed.IP, Port: relayed.Port}}.as(stun.AttrXORRelayedAddress),
+				lifetimeAttr(allocationLifetime))
+		case stun.MethodCreatePermission, stun.MethodChannelBind:
+			var peer stun.XORMappedAddress
+			if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+				continue
+			}
+			s.mutex.Lock()
+			s.permits[peer.IP.String()] = true
+			if v, err := m.Get(stun.AttrChannelNumber); err == nil {
+				s.channels[binary.BigEndian.Uint16(v)] = &net.UDPAddr{IP: peer.IP, Port: peer.Port}
+			}
+			s.mutex.Unlock()
+		}
+		res := stun.MustBuild(setters...)
+		_, _ = s.conn.WriteToUDP(res.Raw, from)
+	}
+}
+
+func (s *testServer) serveRelay() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !s.permitted(from.IP) {
+			continue
+		}
+		s.mutex.Lock()
+		client := s.client
+		var number uint16
+		for channel, peer := range s.channels {
+			if peer.String() == from.String() {
+				number = channel
+			}
+		}
+		s.mutex.Unlock()
+		if number != 0 {
+			frame := make([]byte, 4+n)
+			binary.BigEndian.PutUint16(frame[0:2], number)
+			binary.BigEndian.PutUint16(frame[2:4], uint16(n))
+			copy(frame[4:], buf[:n])
+			_, _ = s.conn.WriteToUDP(frame, client)
+			continue
+		}
+		m := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication),
+			peerAddrAttr(from), stun.RawAttribute{Type: stun.AttrData, Value: buf[:n]})
+		_, _ = s.conn.WriteToUDP(m.Raw, client)
+	}
+}
+
+func (s *testServer) permitted(ip net.IP) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.permits[ip.String()]
+}
+
+// transactionID - sets the transaction id of the request a response answers
+type transactionID struct {
+	id [stun.TransactionIDSize]byte
+}
+
+func (t *transactionID) AddTo(m *stun.Message) error {
+	m.TransactionID = t.id
+	m.WriteHeader()
+	return nil
+}
+
+// as - adds the address as the given attribute
+func (a peerAddr) as(t stun.AttrType) stun.Setter {
+	return attrSetter(func(m *stun.Message) error { return a.XORMappedAddress.AddToAs(m, t) })
+}
+
+type attrSetter func(m *stun.Message) error
+
+func (f attrSetter) AddTo(m *stun.Message) error { return f(m) }
+
+func TestRelay(t *testing.T) {
+	server := newTestServer(t)
+	received := make(chan []byte, 1)
+	client, err := New(server.conn.LocalAddr().String(), testUsername, testPassword, func(b []byte, peer *net.UDPAddr) {
+		received <- append([]byte{}, b...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	relayed, err := client.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed.String() != server.relay.LocalAddr().String() {
+		t.Fatalf("relayed address %s, expected %s", relayed, server.relay.LocalAddr())
+	}
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerUDPAddr := peer.LocalAddr().(*net.UDPAddr)
+	read := func() []byte {
+		buf := make([]byte, 1500)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second * 2))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	expect := func(want []byte) {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("received %q, expected %q", got, want)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatal("nothing received through the relay")
+		}
+	}
+
+	// send and data indications
+	if err := client.Permit(peerUDPAddr.IP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo([]byte("to peer"), peerUDPAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); string(got) != "to peer" {
+		t.Fatalf("peer received %q", got)
+	}
+	if _, err := peer.WriteToUDP([]byte("from peer"), relayed); err != nil {
+		t.Fatal(err)
+	}
+	expect([]byte("from peer"))
+
+	// channel data
+	if err := client.Bind(peerUDPAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo([]byte("over channel"), peerUDPAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); string(got) != "over channel" {
+		t.Fatalf("peer received %q", got)
+	}
+	if _, err := peer.WriteToUDP([]byte("channel reply"), relayed); err != nil {
+		t.Fatal(err)
+	}
+	expect([]byte("channel reply"))
+}
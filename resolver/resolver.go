@@ -0,0 +1,347 @@
+// Package resolver - stub dns server answering the names of the netmaker networks from memory
+// and forwarding all other queries to the upstream resolvers
+package resolver
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recordTTL - ttl of the answers for netmaker names, kept short as records change with the network
+const recordTTL = 60
+
+// record - address of a netmaker name as delivered by a server
+type record struct {
+	addr    net.IP
+	server  string
+	network string
+}
+
+var records = make(map[string][]record) // by fqdn, lowercase with trailing dot
+var searchDomains = []string{}          // network domains tried for unqualified names
+var upstreams = []string{}              // upstream resolvers as host:port
+var peerNames = make(map[string]string) // names of the peer addresses without a record, by address
+var storeMutex = sync.RWMutex{}         // used to mutex access to records, searchDomains and upstreams
+
+// Update - applies a dns update of a server to the records
+func Update(server string, entry models.DNSUpdate) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	switch entry.Action {
+	case models.DNSInsert:
+		addRecord(server, entry.Name, entry.Address)
+	case models.DNSDeleteByName:
+		delete(records, fqdn(entry.Name))
+	case models.DNSDeleteByIP:
+		removeAddress(entry.Address)
+	case models.DNSReplaceName:
+		current, ok := records[fqdn(entry.Name)]
+		if !ok {
+			logger.Log(2, "failed to find dns address for host", entry.Name)
+			return
+		}
+		delete(records, fqdn(entry.Name))
+		for _, r := range current {
+			addRecord(r.server, entry.NewName, r.addr.String())
+		}
+	case models.DNSReplaceIP:
+		removeAddress(entry.Address)
+		addRecord(server, entry.Name, entry.NewAddress)
+	}
+}
+
+// SetRecords - replaces the records of a server with the full set of its entries
+func SetRecords(server string, entries []models.DNSUpdate) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	removeRecords(func(r record) bool { return r.server == server })
+	for _, entry := range entries {
+		if entry.Action != models.DNSInsert {
+			logger.Log(0, "invalid dns actions", entry.Action.String())
+			continue
+		}
+		addRecord(server, entry.Name, entry.Address)
+	}
+}
+
+// DeleteNetwork - removes the records of a network
+func DeleteNetwork(network string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	removeRecords(func(r record) bool { return r.network == strings.ToLower(network) })
+	for addr, name := range peerNames {
+		if networkOf(name) == strings.ToLower(network) {
+			delete(peerNames, addr)
+		}
+	}
+}
+
+// DeleteAll - removes all records
+func DeleteAll() {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	records = make(map[string][]record)
+	peerNames = make(map[string]string)
+}
+
+// SetPeerNames - sets the names of the peer addresses, used to answer reverse queries for addresses without a record
+func SetPeerNames(names map[string]string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	peerNames = make(map[string]string)
+	for addr, name := range names {
+		if ip := net.ParseIP(addr); ip != nil {
+			peerNames[ip.String()] = fqdn(name)
+		}
+	}
+}
+
+// SetSearchDomains - sets the network domains tried for unqualified names, in order
+func SetSearchDomains(domains []string) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	searchDomains = []string{}
+	for _, domain := range domains {
+		searchDomains = append(searchDomains, fqdn(domain))
+	}
+}
+
+// SetUpstreams - sets the resolvers queries for other names are forwarded to
+func SetUpstreams(servers []net.IP) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	upstreams = []string{}
+	for _, server := range servers {
+		upstreams = append(upstreams, net.JoinHostPort(server.String(), "53"))
+	}
+}
+
+// == private ==
+
+// addRecord - adds the address of a name, the network is the last label of the name
+func addRecord(server, name, address string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		logger.Log(1, "invalid address", address, "for dns entry", name)
+		return
+	}
+	name = fqdn(name)
+	network := networkOf(name)
+	for _, r := range records[name] {
+		if r.addr.Equal(ip) {
+			return
+		}
+	}
+	records[name] = append(records[name], record{addr: ip, server: server, network: network})
+}
+
+func removeAddress(address string) {
+	ip := net.ParseIP(address)
+	removeRecords(func(r record) bool { return r.addr.Equal(ip) })
+}
+
+func removeRecords(match func(record) bool) {
+	for name, current := range records {
+		kept := []record{}
+		for _, r := range current {
+			if !match(r) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(records, name)
+		} else {
+			records[name] = kept
+		}
+	}
+}
+
+// lookup - returns the records of a name, unqualified names are tried with each search domain;
+// found is true if the name is within a network domain and therefore must not be forwarded
+func lookup(name string) (result []record, found bool) {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	if result, ok := records[name]; ok {
+		return result, true
+	}
+	if strings.Count(name, ".") == 1 {
+		for _, domain := range searchDomains {
+			if result, ok := records[strings.TrimSuffix(name, ".")+"."+domain]; ok {
+				return result, true
+			}
+		}
+	}
+	for _, domain := range searchDomains {
+		if strings.HasSuffix(name, "."+domain) || name == domain {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// lookupAddr - returns the names of an address
+func lookupAddr(ip net.IP) []string {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	names := []string{}
+	for name, current := range records {
+		for _, r := range current {
+			if r.addr.Equal(ip) {
+				names = append(names, name)
+			}
+		}
+	}
+	if name, ok := peerNames[ip.String()]; ok && len(names) == 0 {
+		names = append(names, name)
+	}
+	return names
+}
+
+func getUpstreams() []string {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	return append([]string{}, upstreams...)
+}
+
+// answer - builds the response to a query for a netmaker name or address, ok is false if the query must be forwarded
+func answer(query *dnsmessage.Message) (response []byte, ok bool) {
+	if len(query.Questions) != 1 || query.Questions[0].Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	question := query.Questions[0]
+	name := strings.ToLower(question.Name.String())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	builder.EnableCompression()
+	header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: recordTTL}
+	answers := 0
+	if question.Type == dnsmessage.TypePTR {
+		ip := parseReverseName(name)
+		if ip == nil {
+			return nil, false
+		}
+		names := lookupAddr(ip)
+		if len(names) == 0 {
+			return nil, false
+		}
+		if err := startAnswers(&builder, question); err != nil {
+			return nil, false
+		}
+		for _, target := range names {
+			ptr, err := dnsmessage.NewName(target)
+			if err != nil {
+				continue
+			}
+			header.Type = dnsmessage.TypePTR
+			if err := builder.PTRResource(header, dnsmessage.PTRResource{PTR: ptr}); err != nil {
+				return nil, false
+			}
+		}
+		response, err := builder.Finish()
+		return response, err == nil
+	}
+	result, found := lookup(name)
+	if !found {
+		return nil, false
+	}
+	if len(result) == 0 {
+		builder = dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeNameError,
+		})
+	}
+	if err := startAnswers(&builder, question); err != nil {
+		return nil, false
+	}
+	for _, r := range result {
+		switch {
+		case r.addr.To4() != nil && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeALL):
+			var a dnsmessage.AResource
+			copy(a.A[:], r.addr.To4())
+			header.Type = dnsmessage.TypeA
+			if err := builder.AResource(header, a); err != nil {
+				return nil, false
+			}
+			answers++
+		case r.addr.To4() == nil && (question.Type == dnsmessage.TypeAAAA || question.Type == dnsmessage.TypeALL):
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], r.addr.To16())
+			header.Type = dnsmessage.TypeAAAA
+			if err := builder.AAAAResource(header, aaaa); err != nil {
+				return nil, false
+			}
+			answers++
+		}
+	}
+	logger.Log(3, "answered", question.Type.String(), name, "with", strconv.Itoa(answers), "records")
+	response, err := builder.Finish()
+	return response, err == nil
+}
+
+func startAnswers(builder *dnsmessage.Builder, question dnsmessage.Question) error {
+	if err := builder.StartQuestions(); err != nil {
+		return err
+	}
+	if err := builder.Question(question); err != nil {
+		return err
+	}
+	return builder.StartAnswers()
+}
+
+// parseReverseName - returns the address of an in-addr.arpa or ip6.arpa name
+func parseReverseName(name string) net.IP {
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				b.WriteString(":")
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// networkOf - returns the network of a name, the last label
+func networkOf(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	return labels[len(labels)-1]
+}
+
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
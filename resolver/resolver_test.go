@@ -0,0 +1,165 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseReverseName(t *testing.T) {
+	is := is.New(t)
+	t.Run("ipv4", func(t *testing.T) {
+		is.Equal(parseReverseName("4.3.2.10.in-addr.arpa."), net.ParseIP("10.2.3.4").To4())
+	})
+	t.Run("ipv4 partial", func(t *testing.T) {
+		is.Equal(parseReverseName("3.2.10.in-addr.arpa."), nil)
+	})
+	t.Run("ipv4 invalid label", func(t *testing.T) {
+		is.Equal(parseReverseName("x.3.2.10.in-addr.arpa."), nil)
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."
+		is.True(parseReverseName(name).Equal(net.ParseIP("2001:db8::1")))
+	})
+	t.Run("ipv6 partial", func(t *testing.T) {
+		is.Equal(parseReverseName("8.b.d.0.1.0.0.2.ip6.arpa."), nil)
+	})
+	t.Run("not reverse", func(t *testing.T) {
+		is.Equal(parseReverseName("host.netmaker."), nil)
+	})
+}
+
+func TestLookup(t *testing.T) {
+	is := is.New(t)
+	setupRecords()
+	t.Run("fqdn", func(t *testing.T) {
+		result, found := lookup("host.netmaker.")
+		is.True(found)
+		is.Equal(len(result), 2)
+	})
+	t.Run("search domain", func(t *testing.T) {
+		result, found := lookup("host.")
+		is.True(found)
+		is.Equal(len(result), 2)
+	})
+	t.Run("search domain order", func(t *testing.T) {
+		result, found := lookup("shared.")
+		is.True(found)
+		is.Equal(len(result), 1)
+		is.Equal(result[0].network, "netmaker")
+	})
+	t.Run("search domain only for single labels", func(t *testing.T) {
+		_, found := lookup("host.example.")
+		is.Equal(found, false)
+	})
+	t.Run("unknown name in network domain", func(t *testing.T) {
+		result, found := lookup("missing.netmaker.")
+		is.True(found)
+		is.Equal(len(result), 0)
+	})
+	t.Run("network domain", func(t *testing.T) {
+		_, found := lookup("netmaker.")
+		is.True(found)
+	})
+	t.Run("other name", func(t *testing.T) {
+		_, found := lookup("example.com.")
+		is.Equal(found, false)
+	})
+}
+
+func TestAnswer(t *testing.T) {
+	is := is.New(t)
+	setupRecords()
+	t.Run("a", func(t *testing.T) {
+		msg := ask(t, "host.netmaker.", dnsmessage.TypeA)
+		is.Equal(msg.RCode, dnsmessage.RCodeSuccess)
+		is.True(msg.Authoritative)
+		is.Equal(len(msg.Answers), 1)
+		is.Equal(msg.Answers[0].Body.(*dnsmessage.AResource).A, [4]byte{10, 0, 0, 1})
+	})
+	t.Run("aaaa", func(t *testing.T) {
+		msg := ask(t, "HOST.netmaker.", dnsmessage.TypeAAAA)
+		is.Equal(len(msg.Answers), 1)
+		is.True(net.IP(msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]).Equal(net.ParseIP("fd00::1")))
+	})
+	t.Run("unqualified", func(t *testing.T) {
+		msg := ask(t, "host.", dnsmessage.TypeA)
+		is.Equal(len(msg.Answers), 1)
+	})
+	t.Run("no record of type", func(t *testing.T) {
+		msg := ask(t, "shared.other.", dnsmessage.TypeAAAA)
+		is.Equal(msg.RCode, dnsmessage.RCodeSuccess)
+		is.Equal(len(msg.Answers), 0)
+	})
+	t.Run("nxdomain", func(t *testing.T) {
+		msg := ask(t, "missing.netmaker.", dnsmessage.TypeA)
+		is.Equal(msg.RCode, dnsmessage.RCodeNameError)
+		is.Equal(len(msg.Answers), 0)
+	})
+	t.Run("ptr of record", func(t *testing.T) {
+		msg := ask(t, "1.0.0.10.in-addr.arpa.", dnsmessage.TypePTR)
+		is.Equal(len(msg.Answers), 1)
+		is.Equal(msg.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(), "host.netmaker.")
+	})
+	t.Run("ptr of peer", func(t *testing.T) {
+		msg := ask(t, "9.0.0.10.in-addr.arpa.", dnsmessage.TypePTR)
+		is.Equal(len(msg.Answers), 1)
+		is.Equal(msg.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(), "peer.netmaker.")
+	})
+	t.Run("forward", func(t *testing.T) {
+		for _, q := range []struct {
+			name  string
+			qtype dnsmessage.Type
+		}{
+			{"example.com.", dnsmessage.TypeA},
+			{"8.8.8.8.in-addr.arpa.", dnsmessage.TypePTR},
+		} {
+			_, ok := answer(newQuery(t, q.name, q.qtype))
+			is.Equal(ok, false)
+		}
+	})
+}
+
+// setupRecords - fills the store with the records of two networks, netmaker searched first
+func setupRecords() {
+	DeleteAll()
+	SetRecords("server", []models.DNSUpdate{
+		{Action: models.DNSInsert, Name: "host.netmaker", Address: "10.0.0.1"},
+		{Action: models.DNSInsert, Name: "host.netmaker", Address: "fd00::1"},
+		{Action: models.DNSInsert, Name: "shared.netmaker", Address: "10.0.0.2"},
+		{Action: models.DNSInsert, Name: "shared.other", Address: "10.1.0.2"},
+	})
+	SetSearchDomains([]string{"netmaker", "other"})
+	SetPeerNames(map[string]string{"10.0.0.9": "peer.netmaker", "10.0.0.1": "ignored.netmaker"})
+}
+
+func newQuery(t *testing.T, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+// ask - answers a query that must not be forwarded and parses the response
+func ask(t *testing.T, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	response, ok := answer(newQuery(t, name, qtype))
+	if !ok {
+		t.Fatalf("query for %s was not answered", name)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1 || !msg.Response {
+		t.Fatalf("invalid response header %+v", msg.Header)
+	}
+	return msg
+}
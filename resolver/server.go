@@ -0,0 +1,274 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netmaker/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Port - port the stub resolver listens on
+	Port = 53
+	// forwardTimeout - how long to wait for an upstream resolver before trying the next one
+	forwardTimeout = time.Second * 2
+	maxUDPSize     = 4096
+)
+
+// listener - udp and tcp sockets of a listen address
+type listener struct {
+	udp *net.UDPConn
+	tcp *net.TCPListener
+}
+
+var listeners = make(map[string]*listener) // by listen address
+var listenerMutex = sync.Mutex{}           // used to mutex access to listeners
+var running bool                           // true between Open and Close
+
+// Open - starts the stub resolver, the listen addresses are set with Listen
+func Open() {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	logger.Log(2, "starting stub resolver")
+	running = true
+}
+
+// Close - stops the stub resolver and closes all listeners
+func Close() {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	running = false
+	for addr, l := range listeners {
+		l.close()
+		delete(listeners, addr)
+	}
+	logger.Log(0, "stub resolver closed")
+}
+
+// IsRunning - checks if the stub resolver is running in this process
+func IsRunning() bool {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	return running
+}
+
+// Listen - listens on the given addresses and closes the listeners of other addresses
+func Listen(addrs []net.IP) error {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	if !running {
+		return errors.New("stub resolver is not running")
+	}
+	wanted := make(map[string]struct{})
+	var lastErr error
+	for _, ip := range addrs {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(Port))
+		wanted[addr] = struct{}{}
+		if _, ok := listeners[addr]; ok {
+			continue
+		}
+		l, err := listen(addr)
+		if err != nil {
+			logger.Log(0, "stub resolver failed to listen on", addr, err.Error())
+			lastErr = err
+			continue
+		}
+		logger.Log(1, "stub resolver listening on", addr)
+		listeners[addr] = l
+	}
+	for addr, l := range listeners {
+		if _, ok := wanted[addr]; !ok {
+			logger.Log(1, "stub resolver stopped listening on", addr)
+			l.close()
+			delete(listeners, addr)
+		}
+	}
+	return lastErr
+}
+
+// == private ==
+
+func listen(addr string) (*listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port, Zone: udpAddr.Zone})
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	l := &listener{udp: udp, tcp: tcp}
+	go l.serveUDP()
+	go l.serveTCP()
+	return l, nil
+}
+
+func (l *listener) close() {
+	l.udp.Close()
+	l.tcp.Close()
+}
+
+func (l *listener) serveUDP() {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, source, err := l.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Log(0, "stub resolver failed to read query", err.Error())
+			}
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if response := handleQuery(query, source.IP, "udp"); response != nil {
+				if _, err := l.udp.WriteToUDP(response, source); err != nil {
+					logger.Log(1, "stub resolver failed to send response", err.Error())
+				}
+			}
+		}()
+	}
+}
+
+func (l *listener) serveTCP() {
+	for {
+		conn, err := l.tcp.AcceptTCP()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Log(0, "stub resolver failed to accept connection", err.Error())
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				if err := conn.SetDeadline(time.Now().Add(forwardTimeout * 5)); err != nil {
+					return
+				}
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				response := handleQuery(query, conn.RemoteAddr().(*net.TCPAddr).IP, "tcp")
+				if response == nil || writeTCPMessage(conn, response) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handleQuery - answers queries for netmaker names and forwards all others, queries from remote hosts are
+// only answered for netmaker names so the resolver cannot be used as an open resolver through the tunnel
+func handleQuery(query []byte, source net.IP, network string) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || msg.Response {
+		return nil
+	}
+	if response, ok := answer(&msg); ok {
+		return response
+	}
+	if !isLocalAddr(source) {
+		return refuse(&msg)
+	}
+	for _, upstream := range getUpstreams() {
+		response, err := forward(query, upstream, network)
+		if err != nil {
+			logger.Log(2, "failed to forward query to", upstream, err.Error())
+			continue
+		}
+		return response
+	}
+	return refuse(&msg)
+}
+
+// forward - sends the query to an upstream resolver and returns its response
+func forward(query []byte, upstream, network string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// refuse - builds a refused response
+func refuse(query *dnsmessage.Message) []byte {
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               query.ID,
+			Response:         true,
+			RecursionDesired: query.RecursionDesired,
+			RCode:            dnsmessage.RCodeRefused,
+		},
+		Questions: query.Questions,
+	}
+	data, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	data := make([]byte, 2, len(msg)+2)
+	binary.BigEndian.PutUint16(data, uint16(len(msg)))
+	_, err := conn.Write(append(data, msg...))
+	return err
+}
+
+// isLocalAddr - checks if an address belongs to this host
+func isLocalAddr(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
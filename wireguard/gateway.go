@@ -0,0 +1,248 @@
+package wireguard
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var resolvedHosts = make(map[string][]net.IP) // last successful resolution of api/broker hosts
+var resolvedHostsMutex = sync.RWMutex{}       // used to mutex access to resolvedHosts, read by the kill switch
+var gatewayIface string                       // interface currently routing internet traffic, if any
+
+const (
+	// GatewayFwMark - firewall mark set on wireguard's own traffic when routing through an internet gateway
+	GatewayFwMark = 51821
+	// GatewayRouteTable - routing table holding the default route through the netmaker interface
+	GatewayRouteTable = 51821
+	// RouteTablePriority - priority of the rule looking up a custom route table of peer routes, ahead of the
+	// gateway rules
+	RouteTablePriority = 28000
+)
+
+// NCIface.UpdateInternetGateway - re-evaluates the host peers for an internet gateway
+// and sets up/tears down full tunnel routing if it changed
+func (n *NCIface) UpdateInternetGateway() error {
+	var gateway *net.UDPAddr
+	if n.Network != "" {
+		node := config.GetNode(n.Network)
+		gateway = getNetworkInternetGateway(&node)
+	} else {
+		gateway = getInternetGateway(config.GetNodes())
+	}
+	if gateway != nil {
+		resolveServerHosts()
+	}
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+	if gateway.String() == n.InternetGateway.String() {
+		if gateway == nil || gatewayIface != n.Name {
+			return nil
+		}
+		// peers and servers may have changed, the bypass rules of their addresses have to follow
+		return n.refreshGatewayBypass()
+	}
+	if gateway != nil || n.Network == "" || gatewayIface == n.Name {
+		setInternetGatewayCfg(gateway)
+	}
+	n.InternetGateway = gateway
+	firewallMark := 0
+	if gateway != nil {
+		firewallMark = GatewayFwMark
+	}
+	n.Config.FirewallMark = &firewallMark
+	if err := apply(n.Name, &wgtypes.Config{FirewallMark: &firewallMark}); err != nil {
+		return err
+	}
+	return n.applyInternetGateway()
+}
+
+// NCIface.applyInternetGateway - sets up full tunnel routing if an internet gateway is present, removes it otherwise
+func (n *NCIface) applyInternetGateway() error {
+	if n.InternetGateway == nil {
+		return n.releaseInternetGateway()
+	}
+	if gatewayIface != "" && gatewayIface != n.Name {
+		logger.Log(0, "internet traffic is already routed through", gatewayIface, "- ignoring gateway", n.InternetGateway.String())
+		return nil
+	}
+	logger.Log(0, "routing internet traffic through gateway", n.InternetGateway.String())
+	gatewayIface = n.Name
+	return n.setInternetGateway()
+}
+
+// NCIface.releaseInternetGateway - removes full tunnel routing unless it is owned by another interface
+func (n *NCIface) releaseInternetGateway() error {
+	if gatewayIface != "" && gatewayIface != n.Name {
+		return nil
+	}
+	gatewayIface = ""
+	return n.resetInternetGateway()
+}
+
+// getInternetGateway - returns the endpoint of a peer advertising a default route,
+// only servers with at least one connected node are considered
+func getInternetGateway(nodes config.NodeMap) *net.UDPAddr {
+	for server, peers := range config.Netclient().HostPeers {
+		if !isServerConnected(nodes, server) {
+			continue
+		}
+		for _, peer := range peers {
+			if peer.Endpoint != nil && len(getDefaultRoutes(peer.AllowedIPs)) > 0 {
+				return peer.Endpoint
+			}
+		}
+	}
+	return nil
+}
+
+// getNetworkInternetGateway - returns the endpoint of a peer of the network advertising a default route
+func getNetworkInternetGateway(node *config.Node) *net.UDPAddr {
+	if !node.Connected {
+		return nil
+	}
+	for _, peer := range config.GetInterfacePeerList(node) {
+		if peer.Endpoint != nil && len(getDefaultRoutes(peer.AllowedIPs)) > 0 {
+			return peer.Endpoint
+		}
+	}
+	return nil
+}
+
+// getInternetGatewayPeer - returns the config of the peer acting as internet gateway
+func getInternetGatewayPeer(gateway *net.UDPAddr) *wgtypes.PeerConfig {
+	for _, peer := range config.GetHostPeerList() {
+		if peer.Endpoint != nil && peer.Endpoint.String() == gateway.String() {
+			peer := peer
+			return &peer
+		}
+	}
+	return nil
+}
+
+// getDefaultRoutes - returns the default routes (0.0.0.0/0, ::/0) contained in a list of allowed ips
+func getDefaultRoutes(allowedIPs []net.IPNet) []net.IPNet {
+	routes := []net.IPNet{}
+	for _, allowedIP := range allowedIPs {
+		if ones, _ := allowedIP.Mask.Size(); ones == 0 {
+			routes = append(routes, allowedIP)
+		}
+	}
+	return routes
+}
+
+// GetGatewayBypassAddrs - returns the addresses that must remain reachable via the physical uplink
+// when routing through an internet gateway i.e. peer endpoints and the netmaker api/broker
+func GetGatewayBypassAddrs() []net.IP {
+	resolveServerHosts()
+	return getGatewayBypassAddrs()
+}
+
+// resolveServerHosts - resolves the api/broker hosts of all servers, must not be called with wgMutex held
+// as dns may be slow or routed through the interface being configured
+func resolveServerHosts() {
+	for _, server := range config.Servers {
+		for _, host := range []string{server.API, server.Broker} {
+			resolveHost(host)
+		}
+	}
+}
+
+// getGatewayBypassAddrs - returns the bypass addresses using the last resolution of the api/broker hosts
+func getGatewayBypassAddrs() []net.IP {
+	addrs := []net.IP{}
+	seen := make(map[string]struct{})
+	add := func(ip net.IP) {
+		if ip == nil || ip.IsLoopback() {
+			return
+		}
+		if _, ok := seen[ip.String()]; !ok {
+			seen[ip.String()] = struct{}{}
+			addrs = append(addrs, ip)
+		}
+	}
+	for _, peer := range config.GetHostPeerList() {
+		if peer.Endpoint != nil {
+			add(peer.Endpoint.IP)
+		}
+	}
+	for _, server := range config.Servers {
+		for _, host := range []string{server.API, server.Broker} {
+			for _, ip := range getResolvedHost(host) {
+				add(ip)
+			}
+		}
+	}
+	return addrs
+}
+
+// resolveHost - resolves an api/broker address (with or without scheme and port) to ip addresses,
+// falls back to the last known addresses if resolution fails e.g. when dns is blocked by the kill switch
+func resolveHost(address string) []net.IP {
+	host := hostOf(address)
+	if host == "" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		logger.Log(0, "failed to resolve", host, err.Error())
+		resolvedHostsMutex.RLock()
+		defer resolvedHostsMutex.RUnlock()
+		return resolvedHosts[host]
+	}
+	resolvedHostsMutex.Lock()
+	resolvedHosts[host] = ips
+	resolvedHostsMutex.Unlock()
+	return ips
+}
+
+// getResolvedHost - returns the ip addresses of an api/broker address from its last resolution
+func getResolvedHost(address string) []net.IP {
+	host := hostOf(address)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	resolvedHostsMutex.RLock()
+	defer resolvedHostsMutex.RUnlock()
+	return resolvedHosts[host]
+}
+
+// hostOf - returns the host of an address with or without scheme and port
+func hostOf(address string) string {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		return h
+	}
+	return address
+}
+
+func isServerConnected(nodes config.NodeMap, server string) bool {
+	for _, node := range nodes {
+		if node.Server == server && node.Connected {
+			return true
+		}
+	}
+	return false
+}
+
+func setInternetGatewayCfg(gateway *net.UDPAddr) {
+	if gateway == nil {
+		config.Netclient().InternetGateway = net.UDPAddr{}
+		return
+	}
+	config.Netclient().InternetGateway = *gateway
+}
@@ -0,0 +1,194 @@
+package wireguard
+
+import (
+	"net"
+	"os"
+
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gatewayBypassPriority - rules sending peer endpoints and the netmaker server to the main table
+	gatewayBypassPriority = 29000
+	// gatewaySuppressPriority - rule using the main table for everything but its default route
+	gatewaySuppressPriority = 29001
+	// gatewayMarkPriority - rule sending all unmarked traffic to the gateway table
+	gatewayMarkPriority = 29002
+)
+
+// all gateway rules only match traffic without the gateway mark, wireguard's own marked traffic uses the main table
+// either way; the mark tells the rules of netclient apart from rules of other software at the same priorities
+
+// NCIface.setInternetGateway - installs the default route(s) in the gateway table and the policy
+// routing rules directing all traffic not generated by wireguard itself through the tunnel
+func (n *NCIface) setInternetGateway() error {
+	l, err := netlink.LinkByName(n.Name)
+	if err != nil {
+		return err
+	}
+	if err := n.resetInternetGateway(); err != nil {
+		logger.Log(0, "failed to clean up previous gateway config", err.Error())
+	}
+	peer := getInternetGatewayPeer(n.InternetGateway)
+	if peer == nil {
+		return nil
+	}
+	if _, err := ncutils.RunCmd("sysctl -w net.ipv4.conf.all.src_valid_mark=1", false); err != nil {
+		logger.Log(1, "failed to set src_valid_mark", err.Error())
+	}
+	families := make(map[int]struct{})
+	for _, defaultRoute := range getDefaultRoutes(peer.AllowedIPs) {
+		defaultRoute := defaultRoute
+		family := netlink.FAMILY_V4
+		if defaultRoute.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		families[family] = struct{}{}
+		if err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Dst:       &defaultRoute,
+			Table:     GatewayRouteTable,
+		}); err != nil {
+			return err
+		}
+	}
+	for _, ip := range getGatewayBypassAddrs() {
+		rule := newBypassRule(ip)
+		if _, ok := families[rule.Family]; !ok {
+			continue
+		}
+		if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	for family := range families {
+		suppress := newGatewayRule(family, gatewaySuppressPriority, unix.RT_TABLE_MAIN)
+		suppress.SuppressPrefixlen = 0
+		if err := netlink.RuleAdd(suppress); err != nil && !os.IsExist(err) {
+			return err
+		}
+		mark := newGatewayRule(family, gatewayMarkPriority, GatewayRouteTable)
+		if err := netlink.RuleAdd(mark); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// NCIface.refreshGatewayBypass - adds the bypass rules of new peer endpoints and server addresses
+// and removes the rules of addresses no longer in use
+func (n *NCIface) refreshGatewayBypass() error {
+	peer := getInternetGatewayPeer(n.InternetGateway)
+	if peer == nil {
+		return nil
+	}
+	families := make(map[int]struct{})
+	for _, defaultRoute := range getDefaultRoutes(peer.AllowedIPs) {
+		if defaultRoute.IP.To4() == nil {
+			families[netlink.FAMILY_V6] = struct{}{}
+		} else {
+			families[netlink.FAMILY_V4] = struct{}{}
+		}
+	}
+	desired := make(map[string]*netlink.Rule)
+	for _, ip := range getGatewayBypassAddrs() {
+		rule := newBypassRule(ip)
+		if _, ok := families[rule.Family]; ok {
+			desired[rule.Dst.String()] = rule
+		}
+	}
+	var lastErr error
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for i := range rules {
+			if rules[i].Priority != gatewayBypassPriority || !isGatewayRule(&rules[i]) || rules[i].Dst == nil {
+				continue
+			}
+			if _, ok := desired[rules[i].Dst.String()]; ok {
+				delete(desired, rules[i].Dst.String())
+				continue
+			}
+			rules[i].Family = family
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	for _, rule := range desired {
+		if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// NCIface.resetInternetGateway - removes the policy routing rules and gateway table routes
+func (n *NCIface) resetInternetGateway() error {
+	var lastErr error
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for i := range rules {
+			if rules[i].Priority < gatewayBypassPriority || rules[i].Priority > gatewayMarkPriority ||
+				!isGatewayRule(&rules[i]) {
+				continue
+			}
+			rules[i].Family = family
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				lastErr = err
+			}
+		}
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{
+			Table: GatewayRouteTable,
+		}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for i := range routes {
+			if err := netlink.RouteDel(&routes[i]); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// newGatewayRule - returns a rule of netclient's gateway routing, only matching traffic without the gateway mark
+func newGatewayRule(family, priority, table int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Priority = priority
+	rule.Table = table
+	rule.Mark = GatewayFwMark
+	rule.Invert = true
+	return rule
+}
+
+// newBypassRule - returns the rule sending traffic to an address to the main table
+func newBypassRule(ip net.IP) *netlink.Rule {
+	family := netlink.FAMILY_V4
+	bits := 32
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+		bits = 128
+	}
+	rule := newGatewayRule(family, gatewayBypassPriority, unix.RT_TABLE_MAIN)
+	rule.Dst = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	return rule
+}
+
+// isGatewayRule - checks if a rule was installed by netclient's gateway routing
+func isGatewayRule(rule *netlink.Rule) bool {
+	return rule.Mark == GatewayFwMark && rule.Invert
+}
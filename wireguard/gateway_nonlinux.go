@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package wireguard
+
+import "github.com/gravitl/netmaker/logger"
+
+// NCIface.setInternetGateway - full tunnel routing is currently only supported on linux
+func (n *NCIface) setInternetGateway() error {
+	logger.Log(0, "routing through an internet gateway is not supported on this OS")
+	return nil
+}
+
+// NCIface.resetInternetGateway - no-op on non linux OSes
+func (n *NCIface) resetInternetGateway() error {
+	return nil
+}
+
+// NCIface.refreshGatewayBypass - no-op on non linux OSes
+func (n *NCIface) refreshGatewayBypass() error {
+	return nil
+}
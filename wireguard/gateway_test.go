@@ -0,0 +1,50 @@
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestGatewayBypassAddrs(t *testing.T) {
+	is := is.New(t)
+	host, servers := *config.Netclient(), config.Servers
+	defer func() {
+		config.UpdateNetclient(host)
+		config.Servers = servers
+		resolvedHosts = make(map[string][]net.IP)
+	}()
+	config.UpdateNetclient(config.Config{})
+	config.UpdateHostPeers("server", []wgtypes.PeerConfig{
+		{PublicKey: wgtypes.Key{1}, Endpoint: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51821}},
+		{PublicKey: wgtypes.Key{2}, Endpoint: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51822}},
+		{PublicKey: wgtypes.Key{3}, Endpoint: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51821}},
+		{PublicKey: wgtypes.Key{4}},
+	})
+	server := config.Server{}
+	server.API = "api.example.invalid"
+	server.Broker = "wss://broker.example.invalid:443"
+	config.Servers = map[string]config.Server{"server": server}
+	resolvedHosts = map[string][]net.IP{
+		"api.example.invalid":    {net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8::1")},
+		"broker.example.invalid": {net.ParseIP("198.51.100.1")},
+	}
+	t.Run("endpoints and last resolution of the servers", func(t *testing.T) {
+		addrs := []string{}
+		for _, ip := range getGatewayBypassAddrs() {
+			addrs = append(addrs, ip.String())
+		}
+		is.Equal(addrs, []string{"203.0.113.1", "198.51.100.1", "2001:db8::1"})
+	})
+	t.Run("last resolution kept when resolving fails", func(t *testing.T) {
+		is.Equal(resolveHost("https://api.example.invalid"), resolvedHosts["api.example.invalid"])
+		is.Equal(getResolvedHost("wss://broker.example.invalid:443"), []net.IP{net.ParseIP("198.51.100.1")})
+	})
+	t.Run("literal addresses", func(t *testing.T) {
+		is.Equal(getResolvedHost("198.51.100.7:8883"), []net.IP{net.ParseIP("198.51.100.7")})
+		is.Equal(hostOf("https://[2001:db8::7]:443"), "2001:db8::7")
+	})
+}
@@ -0,0 +1,202 @@
+package wireguard
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var networkIfaces = make(map[string]*NCIface) // interfaces by network when running an interface per network
+var networkIfaceMutex = sync.Mutex{}          // used to mutex access to networkIfaces
+
+// GetNetworkInterface - returns the interface of a network when running an interface per network, nil if it is down
+func GetNetworkInterface(network string) *NCIface {
+	networkIfaceMutex.Lock()
+	defer networkIfaceMutex.Unlock()
+	return networkIfaces[network]
+}
+
+// GetInterfaceNames - returns the names of the netclient wireguard interfaces
+func GetInterfaceNames() []string {
+	if !config.PerNetworkIfaces() {
+		return []string{ncutils.GetInterfaceName()}
+	}
+	networkIfaceMutex.Lock()
+	defer networkIfaceMutex.Unlock()
+	names := []string{}
+	for _, nc := range networkIfaces {
+		names = append(names, nc.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetupNetworkInterface - creates and configures the interface of a connected network,
+// closes the interface of a disconnected network; the interfaces of other networks are left untouched
+func SetupNetworkInterface(node *config.Node) error {
+	if !node.Connected {
+		closeNetworkInterface(node.Network)
+		return nil
+	}
+	if node.Interface == "" || node.ListenPort == 0 {
+		return fmt.Errorf("no interface assigned to network %s", node.Network)
+	}
+	current := GetNetworkInterface(node.Network)
+	if current != nil && current.Name != node.Interface {
+		closeNetworkInterface(node.Network)
+		current = nil
+	}
+	nc := NewNetworkNCIface(config.Netclient(), node)
+	if current == nil {
+		logger.Log(1, "creating interface", nc.Name, "for network", node.Network)
+		if err := nc.Create(); err != nil {
+			closeNetworkInterface(node.Network)
+			return err
+		}
+	}
+	return nc.Configure()
+}
+
+// SyncNetworkInterfaces - brings the interfaces in line with the node config: interfaces are created for connected
+// networks without one and closed for disconnected or removed networks, running interfaces are left untouched
+func SyncNetworkInterfaces() error {
+	if config.AssignNetworkInterfaces() {
+		if err := config.WriteNodeConfig(); err != nil {
+			logger.Log(0, "failed to save network interfaces", err.Error())
+		}
+	}
+	nodes := config.GetNodes()
+	networkIfaceMutex.Lock()
+	stale := []string{}
+	for network := range networkIfaces {
+		if _, ok := nodes[network]; !ok {
+			stale = append(stale, network)
+		}
+	}
+	networkIfaceMutex.Unlock()
+	for _, network := range stale {
+		closeNetworkInterface(network)
+	}
+	var lastErr error
+	for _, node := range nodes {
+		node := node
+		running := GetNetworkInterface(node.Network) != nil
+		if running == node.Connected {
+			continue
+		}
+		if err := SetupNetworkInterface(&node); err != nil {
+			logger.Log(0, "failed to set up interface for network", node.Network, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// UpdateInternetGateways - re-evaluates the internet gateway of each netclient interface
+func UpdateInternetGateways() error {
+	if !config.PerNetworkIfaces() {
+		return GetInterface().UpdateInternetGateway()
+	}
+	var lastErr error
+	for _, nc := range getNetworkInterfaces() {
+		if err := nc.UpdateInternetGateway(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ApplyPrivateKey - sets the private key on all netclient interfaces
+func ApplyPrivateKey(key wgtypes.Key) error {
+	var lastErr error
+	for _, name := range GetInterfaceNames() {
+		if err := apply(name, &wgtypes.Config{PrivateKey: &key}); err != nil {
+			logger.Log(0, "failed to set private key on", name, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CloseInterfaces - closes all netclient interfaces
+func CloseInterfaces() {
+	for _, nc := range getNetworkInterfaces() {
+		closeNetworkInterface(nc.Network)
+	}
+	if !config.PerNetworkIfaces() {
+		GetInterface().Close()
+	}
+}
+
+// == private ==
+
+// setNetworkPeers - sets the peers of each network on the network's interface and removes the peers
+// no longer part of the network
+func setNetworkPeers() error {
+	var lastErr error
+	for _, nc := range getNetworkInterfaces() {
+		node := config.GetNode(nc.Network)
+		peers := setPresharedKeys(config.GetInterfacePeerList(&node))
+		devicePeers, err := GetDevicePeers(nc.Name)
+		if err != nil {
+			logger.Log(0, "failed to get peers of", nc.Name, err.Error())
+		}
+		peers = append(peers, getRemovedPeers(devicePeers, peers)...)
+		if err := apply(nc.Name, &wgtypes.Config{
+			ReplacePeers: false,
+			Peers:        peers,
+		}); err != nil {
+			logger.Log(0, "failed to set peers on", nc.Name, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// getRemovedPeers - returns the configs removing the device peers not in the desired peers
+func getRemovedPeers(devicePeers []wgtypes.Peer, peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	desired := make(map[wgtypes.Key]struct{}, len(peers))
+	for i := range peers {
+		desired[peers[i].PublicKey] = struct{}{}
+	}
+	removed := []wgtypes.PeerConfig{}
+	for i := range devicePeers {
+		if _, ok := desired[devicePeers[i].PublicKey]; !ok {
+			removed = append(removed, wgtypes.PeerConfig{
+				PublicKey: devicePeers[i].PublicKey,
+				Remove:    true,
+			})
+		}
+	}
+	return removed
+}
+
+func getNetworkInterfaces() []*NCIface {
+	networkIfaceMutex.Lock()
+	defer networkIfaceMutex.Unlock()
+	ifaces := []*NCIface{}
+	for _, nc := range networkIfaces {
+		ifaces = append(ifaces, nc)
+	}
+	return ifaces
+}
+
+func closeNetworkInterface(network string) {
+	networkIfaceMutex.Lock()
+	nc, ok := networkIfaces[network]
+	delete(networkIfaces, network)
+	networkIfaceMutex.Unlock()
+	if !ok {
+		return
+	}
+	logger.Log(1, "closing interface", nc.Name, "for network", network)
+	if nc.Iface == nil && !ncutils.IsLinux() {
+		return
+	}
+	nc.Close()
+}
@@ -0,0 +1,19 @@
+package wireguard
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestGetRemovedPeers(t *testing.T) {
+	is := is.New(t)
+	kept, deleted := wgtypes.Key{1}, wgtypes.Key{2}
+	devicePeers := []wgtypes.Peer{{PublicKey: kept}, {PublicKey: deleted}}
+	is.Equal(getRemovedPeers(devicePeers, []wgtypes.PeerConfig{{PublicKey: kept}}),
+		[]wgtypes.PeerConfig{{PublicKey: deleted, Remove: true}})
+	is.Equal(getRemovedPeers(devicePeers, []wgtypes.PeerConfig{{PublicKey: kept}, {PublicKey: deleted}}),
+		[]wgtypes.PeerConfig{})
+	is.Equal(getRemovedPeers(nil, nil), []wgtypes.PeerConfig{})
+}
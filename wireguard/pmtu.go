@@ -0,0 +1,480 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MinMTU - smallest mtu probed and applied, the minimum mtu of ipv6
+	MinMTU = 1280
+	// pmtuFile - state file holding the probed path mtu of each peer and the mtu applied to each interface
+	pmtuFile = "pmtu.yml"
+	// pmtuProbeTimeout - how long to wait for the reply to a probe
+	pmtuProbeTimeout = time.Second
+	// pmtuProbeAttempts - probes sent per size before the size is considered not to pass
+	pmtuProbeAttempts = 2
+	// pmtuMaxConcurrent - peers probed at the same time
+	pmtuMaxConcurrent = 8
+	icmpv4Overhead    = 28 // ipv4 header + icmp echo header
+	icmpv6Overhead    = 48 // ipv6 header + icmpv6 echo header
+	wgv4Overhead      = 60 // ipv4 header + udp header + wireguard data header and tag
+	wgv6Overhead      = 80 // ipv6 header + udp header + wireguard data header and tag
+)
+
+// PeerPathMTU - largest packet passing through the tunnel to a peer
+type PeerPathMTU struct {
+	Interface string `yaml:"interface"`
+	Address   string `yaml:"address"`
+	// MTU - 0 if the peer did not answer any probe
+	MTU     int       `yaml:"mtu"`
+	Updated time.Time `yaml:"updated"`
+}
+
+// pathMTUState - contents of the path mtu state file
+type pathMTUState struct {
+	Peers      map[string]PeerPathMTU `yaml:"peers"`      // by peer public key
+	Interfaces map[string]int         `yaml:"interfaces"` // mtu applied by discovery, by interface name
+}
+
+// pmtuTarget - peer to be probed
+type pmtuTarget struct {
+	key   wgtypes.Key
+	iface string
+	addr  net.IP
+	// endpoint - public address of the peer, nil if unknown or reached through the local proxy
+	endpoint net.IP
+}
+
+var pmtuState *pathMTUState
+var pmtuStateModTime time.Time    // modification time of the state file when it was last read or written
+var pmtuMutex = sync.Mutex{}      // used to mutex access to pmtuState
+var pmtuProbeMutex = sync.Mutex{} // allows a single probe round at a time
+
+// ProbePathMTU - probes the path mtu to each peer through the tunnel with DF-flagged icmp echoes and lowers the
+// interface mtu to the smallest path mtu of its peers if auto apply is on; reset raises the interfaces to the
+// configured mtu before probing so a larger path mtu can be found e.g. after the default interface changed.
+// The DF flag of the inner packet is not copied to the encrypted packet, which is fragmented instead, so the path
+// to the endpoint of the peer is probed outside the tunnel as well
+func ProbePathMTU(reset bool) error {
+	host := config.Netclient()
+	ifaces := getProbeInterfaces()
+	if len(ifaces) == 0 {
+		return nil
+	}
+	// the state is only locked to publish the results, new interfaces read it while the peers are probed
+	pmtuProbeMutex.Lock()
+	defer pmtuProbeMutex.Unlock()
+	targets := []pmtuTarget{}
+	for _, nc := range ifaces {
+		if reset && host.MTUDiscovery.AutoApply && nc.MTU != host.MTU {
+			setInterfaceMTU(nc, host.MTU)
+		}
+		targets = append(targets, getProbeTargets(nc)...)
+	}
+	results := make(map[string]PeerPathMTU)
+	resultMutex := sync.Mutex{}
+	limit := make(chan struct{}, pmtuMaxConcurrent)
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		target := target
+		maxMTU := host.MTU
+		for _, nc := range ifaces {
+			if nc.Name == target.iface && nc.MTU < maxMTU {
+				maxMTU = nc.MTU
+			}
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+			mtu, err := probePeer(target.addr, maxMTU)
+			if err != nil {
+				logger.Log(1, "failed to probe path mtu of peer", target.key.String(), err.Error())
+			}
+			if mtu > 0 && target.endpoint != nil {
+				mtu = limitToEndpointMTU(target, mtu)
+			}
+			resultMutex.Lock()
+			results[target.key.String()] = PeerPathMTU{
+				Interface: target.iface,
+				Address:   target.addr.String(),
+				MTU:       mtu,
+				Updated:   time.Now(),
+			}
+			resultMutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	for _, nc := range ifaces {
+		recommended := getRecommendedMTU(nc.Name, results, host.MTU)
+		if recommended == 0 {
+			continue
+		}
+		if !host.MTUDiscovery.AutoApply {
+			if recommended < nc.MTU {
+				logger.Log(0, "path mtu to the peers on", nc.Name, "is", strconv.Itoa(recommended),
+					"- consider lowering the mtu from", strconv.Itoa(nc.MTU))
+			}
+			continue
+		}
+		if recommended != nc.MTU {
+			logger.Log(0, "setting mtu of", nc.Name, "to", strconv.Itoa(recommended), "from", strconv.Itoa(nc.MTU))
+			setInterfaceMTU(nc, recommended)
+		}
+	}
+	pmtuMutex.Lock()
+	defer pmtuMutex.Unlock()
+	if err := loadPathMTUState(); err != nil {
+		logger.Log(0, "failed to read path mtu state", err.Error())
+	}
+	pmtuState.Peers = results
+	return savePathMTUState()
+}
+
+// GetPathMTUs - returns the last probed path mtu of each peer by public key
+func GetPathMTUs() map[string]PeerPathMTU {
+	pmtuMutex.Lock()
+	defer pmtuMutex.Unlock()
+	if err := loadPathMTUState(); err != nil {
+		logger.Log(1, "failed to read path mtu state", err.Error())
+	}
+	peers := make(map[string]PeerPathMTU, len(pmtuState.Peers))
+	for key, peer := range pmtuState.Peers {
+		peers[key] = peer
+	}
+	return peers
+}
+
+// == private ==
+
+// getInterfaceMTU - returns the mtu for a new interface, the mtu applied by discovery if lower than the configured mtu
+func getInterfaceMTU(name string, host *config.Config) int {
+	if !host.MTUDiscovery.Enabled || !host.MTUDiscovery.AutoApply {
+		return host.MTU
+	}
+	pmtuMutex.Lock()
+	defer pmtuMutex.Unlock()
+	if err := loadPathMTUState(); err != nil {
+		logger.Log(1, "failed to read path mtu state", err.Error())
+		return host.MTU
+	}
+	if mtu := pmtuState.Interfaces[name]; mtu >= MinMTU && mtu < host.MTU {
+		return mtu
+	}
+	return host.MTU
+}
+
+// getProbeInterfaces - returns the running netclient interfaces
+func getProbeInterfaces() []*NCIface {
+	if config.PerNetworkIfaces() {
+		return getNetworkInterfaces()
+	}
+	for _, node := range config.GetNodes() {
+		if node.Connected {
+			return []*NCIface{GetInterface()}
+		}
+	}
+	return nil
+}
+
+// getProbeTargets - returns the tunnel address of each peer of an interface, ipv4 preferred
+func getProbeTargets(nc *NCIface) []pmtuTarget {
+	nodes := []config.Node{}
+	if nc.Network != "" {
+		nodes = append(nodes, config.GetNode(nc.Network))
+	} else {
+		for _, node := range config.GetNodes() {
+			nodes = append(nodes, node)
+		}
+	}
+	targets := []pmtuTarget{}
+	seen := make(map[wgtypes.Key]struct{})
+	for _, node := range nodes {
+		node := node
+		if !node.Connected {
+			continue
+		}
+		for _, peer := range config.GetNetworkPeerList(&node) {
+			if _, ok := seen[peer.PublicKey]; ok {
+				continue
+			}
+			if addr := getPeerTunnelAddr(&node, peer.AllowedIPs); addr != nil {
+				seen[peer.PublicKey] = struct{}{}
+				target := pmtuTarget{key: peer.PublicKey, iface: nc.Name, addr: addr}
+				if peer.Endpoint != nil && !peer.Endpoint.IP.IsLoopback() && !peer.Endpoint.IP.IsUnspecified() {
+					target.endpoint = peer.Endpoint.IP
+				}
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// getPeerTunnelAddr - returns the host address of a peer within the network range of the node
+func getPeerTunnelAddr(node *config.Node, allowedIPs []net.IPNet) net.IP {
+	var addr6 net.IP
+	for _, allowedIP := range allowedIPs {
+		ones, bits := allowedIP.Mask.Size()
+		if ones != bits {
+			continue
+		}
+		if allowedIP.IP.To4() != nil && node.NetworkRange.IP != nil && node.NetworkRange.Contains(allowedIP.IP) {
+			return allowedIP.IP
+		}
+		if allowedIP.IP.To4() == nil && node.NetworkRange6.IP != nil && node.NetworkRange6.Contains(allowedIP.IP) {
+			addr6 = allowedIP.IP
+		}
+	}
+	return addr6
+}
+
+// getRecommendedMTU - returns the smallest path mtu of the peers of an interface, 0 if none is known
+func getRecommendedMTU(iface string, results map[string]PeerPathMTU, maxMTU int) int {
+	recommended := 0
+	for _, result := range results {
+		if result.Interface != iface || result.MTU == 0 {
+			continue
+		}
+		if recommended == 0 || result.MTU < recommended {
+			recommended = result.MTU
+		}
+	}
+	if recommended > maxMTU {
+		recommended = maxMTU
+	}
+	return recommended
+}
+
+// setInterfaceMTU - sets the mtu of an interface and records it as applied by discovery
+func setInterfaceMTU(nc *NCIface, mtu int) {
+	wgMutex.Lock()
+	nc.MTU = mtu
+	err := nc.SetMTU()
+	wgMutex.Unlock()
+	if err != nil {
+		logger.Log(0, "failed to set mtu of", nc.Name, err.Error())
+		return
+	}
+	pmtuMutex.Lock()
+	defer pmtuMutex.Unlock()
+	if err := loadPathMTUState(); err != nil {
+		logger.Log(1, "failed to read path mtu state", err.Error())
+	}
+	pmtuState.Interfaces[nc.Name] = mtu
+}
+
+// limitToEndpointMTU - lowers the path mtu through the tunnel to the largest inner packet whose encrypted packet
+// passes to the endpoint of the peer unfragmented; keeps the mtu if the endpoint does not answer echoes
+func limitToEndpointMTU(target pmtuTarget, mtu int) int {
+	overhead := wgv4Overhead
+	if target.endpoint.To4() == nil {
+		overhead = wgv6Overhead
+	}
+	outer, err := probePeer(target.endpoint, mtu+overhead)
+	if err != nil {
+		logger.Log(1, "failed to probe path mtu to endpoint of peer", target.key.String(), err.Error())
+	}
+	if outer == 0 || outer-overhead >= mtu {
+		return mtu
+	}
+	logger.Log(1, "path mtu to endpoint", target.endpoint.String(), "of peer", target.key.String(), "is", strconv.Itoa(outer))
+	if outer-overhead < MinMTU {
+		return MinMTU
+	}
+	return outer - overhead
+}
+
+// probePeer - searches the largest packet size passing to the peer between MinMTU and maxMTU, 0 if the peer does not answer
+func probePeer(addr net.IP, maxMTU int) (int, error) {
+	conn, err := openProbeConn(addr.To4() == nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	id := os.Getpid() & 0xffff
+	seq := 0
+	passes := func(size int) (bool, error) {
+		for i := 0; i < pmtuProbeAttempts; i++ {
+			seq++
+			ok, err := sendProbe(conn, addr, id, seq, size)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	return searchMTU(maxMTU, passes)
+}
+
+// searchMTU - searches the largest size between MinMTU and maxMTU passes reports as passing, 0 if MinMTU does not pass;
+// the sizes in between are bisected assuming all sizes up to the path mtu pass
+func searchMTU(maxMTU int, passes func(size int) (bool, error)) (int, error) {
+	if ok, err := passes(maxMTU); err != nil || ok {
+		if ok {
+			return maxMTU, nil
+		}
+		return 0, err
+	}
+	if maxMTU <= MinMTU {
+		return 0, nil
+	}
+	if ok, err := passes(MinMTU); err != nil || !ok {
+		return 0, err
+	}
+	low, high := MinMTU, maxMTU
+	for high-low > 1 {
+		size := (low + high) / 2
+		ok, err := passes(size)
+		if err != nil {
+			return low, err
+		}
+		if ok {
+			low = size
+		} else {
+			high = size
+		}
+	}
+	return low, nil
+}
+
+// openProbeConn - opens a raw icmp socket not allowing fragmentation
+func openProbeConn(ipv6 bool) (*net.IPConn, error) {
+	network, address := "ip4:icmp", "0.0.0.0"
+	if ipv6 {
+		network, address = "ip6:ipv6-icmp", "::"
+	}
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.IPConn)
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = setDontFragment(fd, ipv6)
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if sockErr != nil {
+		conn.Close()
+		return nil, sockErr
+	}
+	return conn, nil
+}
+
+// sendProbe - sends an icmp echo of the given ip packet size and waits for the matching reply
+func sendProbe(conn *net.IPConn, addr net.IP, id, seq, size int) (bool, error) {
+	var request, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	overhead, proto := icmpv4Overhead, 1
+	if addr.To4() == nil {
+		request, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		overhead, proto = icmpv6Overhead, 58
+	}
+	msg := icmp.Message{
+		Type: request,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: make([]byte, size-overhead)},
+	}
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(pmtuProbeTimeout)); err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(data, &net.IPAddr{IP: addr}); err != nil {
+		// packets exceeding the interface mtu are rejected locally
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil
+		}
+		return false, err
+	}
+	buf := make([]byte, size+overhead)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		if from.(*net.IPAddr).IP.Equal(addr) {
+			received, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || received.Type != reply {
+				continue
+			}
+			if echo, ok := received.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+				return true, nil
+			}
+		}
+	}
+}
+
+// loadPathMTUState - reads the state file unless the state in memory is current, the file may be written by
+// another process i.e. the daemon
+func loadPathMTUState() error {
+	info, statErr := os.Stat(config.GetNetclientPath() + pmtuFile)
+	if pmtuState != nil && (statErr != nil || !info.ModTime().After(pmtuStateModTime)) {
+		return nil
+	}
+	pmtuState = &pathMTUState{
+		Peers:      make(map[string]PeerPathMTU),
+		Interfaces: make(map[string]int),
+	}
+	if statErr != nil {
+		if os.IsNotExist(statErr) {
+			return nil
+		}
+		return statErr
+	}
+	data, err := os.ReadFile(config.GetNetclientPath() + pmtuFile)
+	if err != nil {
+		return err
+	}
+	pmtuStateModTime = info.ModTime()
+	if err := yaml.Unmarshal(data, pmtuState); err != nil {
+		return err
+	}
+	if pmtuState.Peers == nil {
+		pmtuState.Peers = make(map[string]PeerPathMTU)
+	}
+	if pmtuState.Interfaces == nil {
+		pmtuState.Interfaces = make(map[string]int)
+	}
+	return nil
+}
+
+func savePathMTUState() error {
+	data, err := yaml.Marshal(pmtuState)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(config.GetNetclientPath()+pmtuFile, data, 0644); err != nil {
+		return err
+	}
+	if info, err := os.Stat(config.GetNetclientPath() + pmtuFile); err == nil {
+		pmtuStateModTime = info.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package wireguard
+
+import "golang.org/x/sys/unix"
+
+// setDontFragment - sets DF on the probes
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, 1)
+}
@@ -0,0 +1,11 @@
+package wireguard
+
+import "golang.org/x/sys/unix"
+
+// setDontFragment - sets DF on the probes and ignores the cached path mtu so sizes above it can be probed
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+}
@@ -0,0 +1,120 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+)
+
+func TestSearchMTU(t *testing.T) {
+	upTo := func(pmtu int, probed *[]int) func(int) (bool, error) {
+		return func(size int) (bool, error) {
+			*probed = append(*probed, size)
+			return size <= pmtu, nil
+		}
+	}
+	tests := []struct {
+		name   string
+		maxMTU int
+		pmtu   int
+		want   int
+	}{
+		{"max passes", 1420, 1500, 1420},
+		{"path mtu in between", 1420, 1372, 1372},
+		{"min passes", 1420, MinMTU, MinMTU},
+		{"nothing passes", 1420, 0, 0},
+		{"max at min", MinMTU, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			probed := []int{}
+			mtu, err := searchMTU(tt.maxMTU, upTo(tt.pmtu, &probed))
+			is.NoErr(err)
+			is.Equal(mtu, tt.want)
+			is.True(len(probed) <= 2+10) // max, min and a bisection of the sizes in between
+		})
+	}
+	t.Run("error while bisecting", func(t *testing.T) {
+		is := is.New(t)
+		probeErr := errors.New("probe failed")
+		mtu, err := searchMTU(1420, func(size int) (bool, error) {
+			if size == 1420 || size == MinMTU {
+				return size == MinMTU, nil
+			}
+			return false, probeErr
+		})
+		is.Equal(err, probeErr)
+		is.Equal(mtu, MinMTU) // the largest size known to pass
+	})
+	t.Run("error on the first probe", func(t *testing.T) {
+		is := is.New(t)
+		probeErr := errors.New("probe failed")
+		mtu, err := searchMTU(1420, func(int) (bool, error) { return false, probeErr })
+		is.Equal(err, probeErr)
+		is.Equal(mtu, 0)
+	})
+}
+
+func TestGetRecommendedMTU(t *testing.T) {
+	results := map[string]PeerPathMTU{
+		"a": {Interface: "netmaker", MTU: 1400},
+		"b": {Interface: "netmaker", MTU: 1380},
+		"c": {Interface: "netmaker", MTU: 0},
+		"d": {Interface: "nm-other", MTU: 1300},
+	}
+	tests := []struct {
+		name   string
+		iface  string
+		maxMTU int
+		want   int
+	}{
+		{"smallest of the interface", "netmaker", 1420, 1380},
+		{"limited to the max", "netmaker", 1350, 1350},
+		{"other interface", "nm-other", 1420, 1300},
+		{"no results", "nm-none", 1420, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(getRecommendedMTU(tt.iface, results, tt.maxMTU), tt.want)
+		})
+	}
+}
+
+func TestGetPeerTunnelAddr(t *testing.T) {
+	_, range4, _ := net.ParseCIDR("10.10.0.0/16")
+	_, range6, _ := net.ParseCIDR("fd00::/64")
+	node := &config.Node{}
+	node.NetworkRange = *range4
+	node.NetworkRange6 = *range6
+	allowed := func(cidrs ...string) []net.IPNet {
+		nets := []net.IPNet{}
+		for _, cidr := range cidrs {
+			ip, ipnet, _ := net.ParseCIDR(cidr)
+			ipnet.IP = ip
+			nets = append(nets, *ipnet)
+		}
+		return nets
+	}
+	tests := []struct {
+		name    string
+		allowed []net.IPNet
+		want    net.IP
+	}{
+		{"ipv4 preferred", allowed("fd00::5/128", "10.10.0.5/32"), net.ParseIP("10.10.0.5")},
+		{"ipv6 only", allowed("fd00::5/128"), net.ParseIP("fd00::5")},
+		{"egress ranges skipped", allowed("192.168.0.0/24", "10.10.0.0/16"), nil},
+		{"host outside the network", allowed("192.168.0.5/32"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			addr := getPeerTunnelAddr(node, tt.allowed)
+			is.True(addr.Equal(tt.want))
+		})
+	}
+}
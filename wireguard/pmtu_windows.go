@@ -0,0 +1,16 @@
+package wireguard
+
+import "golang.org/x/sys/windows"
+
+const (
+	ipDontFragment = 14 // IP_DONTFRAGMENT
+	ipv6DontFrag   = 14 // IPV6_DONTFRAG
+)
+
+// setDontFragment - sets DF on the probes
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, ipv6DontFrag, 1)
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, ipDontFragment, 1)
+}
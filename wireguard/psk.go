@@ -0,0 +1,244 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// pskFile - secrets file holding the preshared key of each peer
+	pskFile = "psk.yml"
+	// pskSourceExchanged - random preshared key generated by one peer of the pair and acknowledged by the other
+	pskSourceExchanged = "exchanged"
+)
+
+// kinds of preshared key messages
+const (
+	// PresharedKeyOffer - a new key generated by the peer with the lower public key
+	PresharedKeyOffer = "offer"
+	// PresharedKeyAck - the offered key was stored and is in use by the peer
+	PresharedKeyAck = "ack"
+	// PresharedKeyStale - the offered epoch is not newer than the key in use, the offering peer lost its state
+	PresharedKeyStale = "stale"
+)
+
+// PresharedKeyMsg - preshared key message exchanged by two peers, sealed for the peer and relayed by the server;
+// the epoch orders the keys of a peer pair so replayed or late offers are not taken into use
+type PresharedKeyMsg struct {
+	Kind  string      `json:"kind"`
+	Epoch uint64      `json:"epoch"`
+	Key   wgtypes.Key `json:"key,omitempty"`
+}
+
+// presharedKey - preshared key of a peer as stored in the secrets file
+type presharedKey struct {
+	Key     wgtypes.Key `yaml:"key"`
+	Epoch   uint64      `yaml:"epoch"`
+	Source  string      `yaml:"source"`
+	Created time.Time   `yaml:"created"`
+	// Pending - key offered to the peer, only put into use once the peer acknowledges it
+	Pending      *wgtypes.Key `yaml:"pending,omitempty"`
+	PendingEpoch uint64       `yaml:"pendingepoch,omitempty"`
+}
+
+var presharedKeys map[string]presharedKey // preshared keys indexed by peer public key
+var pskMutex = sync.Mutex{}               // used to mutex access to presharedKeys
+
+// UpdatePresharedKeys - generates a new key for each peer the host offers keys to, i.e. with a greater public key,
+// that has no key yet or whose key is older than the rotation interval, and forgets the keys of removed peers;
+// returns the offers to send, pending offers are repeated until acknowledged, and whether the peers need to be
+// re-applied
+func UpdatePresharedKeys() (map[wgtypes.Key]PresharedKeyMsg, bool, error) {
+	offers := make(map[wgtypes.Key]PresharedKeyMsg)
+	if !config.Netclient().PresharedKeys.Enabled {
+		return offers, false, nil
+	}
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	if err := loadPresharedKeys(); err != nil {
+		return offers, false, err
+	}
+	publicKey := config.Netclient().PrivateKey.PublicKey()
+	interval := time.Duration(config.Netclient().PresharedKeys.Interval) * time.Hour * 24
+	changed, save := false, false
+	peers := make(map[string]struct{})
+	for _, peer := range config.GetHostPeerList() {
+		pub := peer.PublicKey.String()
+		peers[pub] = struct{}{}
+		if bytes.Compare(publicKey[:], peer.PublicKey[:]) >= 0 {
+			continue
+		}
+		current := presharedKeys[pub]
+		next, err := pendingPresharedKey(current, interval, time.Now())
+		if err != nil {
+			return offers, false, err
+		}
+		if next != current {
+			current = next
+			presharedKeys[pub] = current
+			save = true
+		}
+		if current.Pending != nil {
+			offers[peer.PublicKey] = PresharedKeyMsg{
+				Kind:  PresharedKeyOffer,
+				Epoch: current.PendingEpoch,
+				Key:   *current.Pending,
+			}
+		}
+	}
+	for pub, current := range presharedKeys {
+		if _, ok := peers[pub]; !ok {
+			delete(presharedKeys, pub)
+			changed = changed || current.Source == pskSourceExchanged
+			save = true
+		}
+	}
+	if save {
+		return offers, changed, savePresharedKeys()
+	}
+	return offers, changed, nil
+}
+
+// HandlePresharedKeyMsg - stores a key offered by a peer and returns the acknowledgement, or puts the key
+// acknowledged by a peer into use; returns true if the key of the peer changed and the peers need to be re-applied
+func HandlePresharedKeyMsg(peerKey wgtypes.Key, msg PresharedKeyMsg) (*PresharedKeyMsg, bool, error) {
+	if !config.Netclient().PresharedKeys.Enabled {
+		return nil, false, nil
+	}
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	if err := loadPresharedKeys(); err != nil {
+		return nil, false, err
+	}
+	pub := peerKey.String()
+	current := presharedKeys[pub]
+	publicKey := config.Netclient().PrivateKey.PublicKey()
+	next, reply, changed, err := nextPresharedKey(current, bytes.Compare(publicKey[:], peerKey[:]) < 0, msg, time.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	if next == current {
+		return reply, changed, nil
+	}
+	if msg.Kind == PresharedKeyStale {
+		logger.Log(1, "peer", pub, "holds a preshared key of epoch", strconv.FormatUint(next.Epoch, 10), "- offering a newer one")
+	}
+	presharedKeys[pub] = next
+	return reply, changed, savePresharedKeys()
+}
+
+// setPresharedKeys - sets the preshared key on each peer, a key sent by the server takes precedence over an exchanged
+// one; only keys acknowledged by both peers are used and the secrets file is only read
+func setPresharedKeys(peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	if !config.Netclient().PresharedKeys.Enabled {
+		return peers
+	}
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	if err := loadPresharedKeys(); err != nil {
+		logger.Log(0, "failed to read preshared keys", err.Error())
+		return peers
+	}
+	for i := range peers {
+		if peers[i].PresharedKey != nil && *peers[i].PresharedKey != (wgtypes.Key{}) {
+			continue
+		}
+		if current, ok := presharedKeys[peers[i].PublicKey.String()]; ok && current.Source == pskSourceExchanged {
+			key := current.Key
+			peers[i].PresharedKey = &key
+		}
+	}
+	return peers
+}
+
+// ResetPresharedKeys - drops the cached keys, the next read uses the secrets file again
+func ResetPresharedKeys() {
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	presharedKeys = nil
+}
+
+// == private ==
+
+// pendingPresharedKey - returns the state of the key of a peer the host offers keys to with a new pending key if the
+// peer has no exchanged key or its key is older than the interval, 0 never rotates; a pending key is kept until
+// the peer acknowledges it
+func pendingPresharedKey(current presharedKey, interval time.Duration, now time.Time) (presharedKey, error) {
+	expired := current.Source != pskSourceExchanged || (interval > 0 && now.Sub(current.Created) >= interval)
+	if current.Pending != nil || !expired {
+		return current, nil
+	}
+	var key wgtypes.Key
+	if _, err := rand.Read(key[:]); err != nil {
+		return current, err
+	}
+	current.Pending = &key
+	current.PendingEpoch = current.Epoch + 1
+	return current, nil
+}
+
+// nextPresharedKey - returns the state of the key of a peer after a message of the peer, the reply to send and
+// whether the key in use changed; offering is set if the host offers the keys of the pair
+func nextPresharedKey(current presharedKey, offering bool, msg PresharedKeyMsg, now time.Time) (presharedKey, *PresharedKeyMsg, bool, error) {
+	switch msg.Kind {
+	case PresharedKeyOffer:
+		if offering {
+			return current, nil, false, errors.New("preshared key offered by peer with greater key")
+		}
+		if msg.Epoch == current.Epoch && msg.Key == current.Key {
+			// the acknowledgement was lost
+			return current, &PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: msg.Epoch}, false, nil
+		}
+		if msg.Epoch <= current.Epoch {
+			return current, &PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: current.Epoch}, false, nil
+		}
+		next := presharedKey{Key: msg.Key, Epoch: msg.Epoch, Source: pskSourceExchanged, Created: now}
+		return next, &PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: msg.Epoch}, true, nil
+	case PresharedKeyAck:
+		if !offering || current.Pending == nil || msg.Epoch != current.PendingEpoch {
+			return current, nil, false, nil
+		}
+		next := presharedKey{Key: *current.Pending, Epoch: current.PendingEpoch, Source: pskSourceExchanged, Created: now}
+		return next, nil, true, nil
+	case PresharedKeyStale:
+		if !offering || current.Pending == nil || msg.Epoch < current.PendingEpoch {
+			return current, nil, false, nil
+		}
+		// the key in use, if any, is not the one of the peer, the next update offers a key after its epoch
+		return presharedKey{Epoch: msg.Epoch}, nil, current.Source == pskSourceExchanged, nil
+	}
+	return current, nil, false, errors.New("unknown preshared key message " + msg.Kind)
+}
+
+func loadPresharedKeys() error {
+	if presharedKeys != nil {
+		return nil
+	}
+	presharedKeys = make(map[string]presharedKey)
+	data, err := os.ReadFile(config.GetNetclientPath() + pskFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return yaml.Unmarshal(data, &presharedKeys)
+}
+
+func savePresharedKeys() error {
+	data, err := yaml.Marshal(presharedKeys)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.GetNetclientPath()+pskFile, data, 0600)
+}
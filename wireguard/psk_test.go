@@ -0,0 +1,102 @@
+package wireguard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPendingPresharedKey(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	t.Run("no key", func(t *testing.T) {
+		next, err := pendingPresharedKey(presharedKey{}, 0, now)
+		is.NoErr(err)
+		is.True(next.Pending != nil)
+		is.Equal(next.PendingEpoch, uint64(1))
+	})
+	t.Run("pending key repeated", func(t *testing.T) {
+		pending := presharedKey{Pending: &wgtypes.Key{1}, PendingEpoch: 1}
+		next, err := pendingPresharedKey(pending, 0, now)
+		is.NoErr(err)
+		is.Equal(next, pending)
+	})
+	exchanged := presharedKey{Key: wgtypes.Key{1}, Epoch: 3, Source: pskSourceExchanged, Created: now.Add(-time.Hour * 48)}
+	t.Run("no rotation", func(t *testing.T) {
+		next, err := pendingPresharedKey(exchanged, 0, now)
+		is.NoErr(err)
+		is.Equal(next, exchanged)
+	})
+	t.Run("not expired", func(t *testing.T) {
+		next, err := pendingPresharedKey(exchanged, time.Hour*72, now)
+		is.NoErr(err)
+		is.Equal(next, exchanged)
+	})
+	t.Run("expired", func(t *testing.T) {
+		next, err := pendingPresharedKey(exchanged, time.Hour*24, now)
+		is.NoErr(err)
+		is.True(next.Pending != nil)
+		is.Equal(next.PendingEpoch, uint64(4))
+		is.Equal(next.Key, exchanged.Key) // in use until the peer acknowledges the new key
+	})
+}
+
+func TestNextPresharedKey(t *testing.T) {
+	now := time.Now()
+	oldKey, newKey := wgtypes.Key{1}, wgtypes.Key{2}
+	inUse := presharedKey{Key: oldKey, Epoch: 3, Source: pskSourceExchanged, Created: now.Add(-time.Hour)}
+	pending := inUse
+	pending.Pending = &newKey
+	pending.PendingEpoch = 4
+	tests := []struct {
+		name     string
+		current  presharedKey
+		offering bool
+		msg      PresharedKeyMsg
+		next     presharedKey
+		reply    *PresharedKeyMsg
+		changed  bool
+		err      bool
+	}{
+		{"offer taken into use", inUse, false, PresharedKeyMsg{Kind: PresharedKeyOffer, Epoch: 4, Key: newKey},
+			presharedKey{Key: newKey, Epoch: 4, Source: pskSourceExchanged, Created: now},
+			&PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 4}, true, false},
+		{"offer of the key in use", inUse, false, PresharedKeyMsg{Kind: PresharedKeyOffer, Epoch: 3, Key: oldKey},
+			inUse, &PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 3}, false, false},
+		{"replayed offer", inUse, false, PresharedKeyMsg{Kind: PresharedKeyOffer, Epoch: 2, Key: newKey},
+			inUse, &PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: 3}, false, false},
+		{"offer of the same epoch", inUse, false, PresharedKeyMsg{Kind: PresharedKeyOffer, Epoch: 3, Key: newKey},
+			inUse, &PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: 3}, false, false},
+		{"offer by the peer with the greater key", inUse, true, PresharedKeyMsg{Kind: PresharedKeyOffer, Epoch: 4, Key: newKey},
+			inUse, nil, false, true},
+		{"ack", pending, true, PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 4},
+			presharedKey{Key: newKey, Epoch: 4, Source: pskSourceExchanged, Created: now}, nil, true, false},
+		{"ack of another epoch", pending, true, PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 3}, pending, nil, false, false},
+		{"ack without offer", inUse, true, PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 4}, inUse, nil, false, false},
+		{"ack to the peer with the lower key", pending, false, PresharedKeyMsg{Kind: PresharedKeyAck, Epoch: 4},
+			pending, nil, false, false},
+		{"stale", pending, true, PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: 7}, presharedKey{Epoch: 7}, nil, true, false},
+		{"stale of an older epoch", pending, true, PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: 3}, pending, nil, false, false},
+		{"stale without exchanged key", presharedKey{Pending: &newKey, PendingEpoch: 1}, true,
+			PresharedKeyMsg{Kind: PresharedKeyStale, Epoch: 5}, presharedKey{Epoch: 5}, nil, false, false},
+		{"unknown", inUse, true, PresharedKeyMsg{Kind: "rekey"}, inUse, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			next, reply, changed, err := nextPresharedKey(tt.current, tt.offering, tt.msg, now)
+			is.Equal(err != nil, tt.err)
+			is.Equal(next, tt.next)
+			is.Equal(reply, tt.reply)
+			is.Equal(changed, tt.changed)
+		})
+	}
+	t.Run("offer after stale", func(t *testing.T) {
+		is := is.New(t)
+		next, err := pendingPresharedKey(presharedKey{Epoch: 7}, 0, now)
+		is.NoErr(err)
+		is.Equal(next.PendingEpoch, uint64(8))
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lan"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy/peer"
 	"github.com/gravitl/netmaker/logger"
@@ -14,11 +15,15 @@ import (
 
 // NCIface - represents a Netclient network interface
 type NCIface struct {
-	Iface     netIface
-	Name      string
-	Addresses []ifaceAddress
-	MTU       int
-	Config    wgtypes.Config
+	Iface           netIface
+	Name            string
+	Network         string // network served by the interface, empty if the interface is shared by all networks
+	Addresses       []ifaceAddress
+	MTU             int
+	RouteTable      int
+	RouteMetric     int
+	InternetGateway *net.UDPAddr
+	Config          wgtypes.Config
 }
 
 var netmaker NCIface
@@ -27,34 +32,33 @@ var wgMutex = sync.Mutex{} // used to mutex functions of the interface
 // NewNCIFace - creates a new Netclient interface in memory
 func NewNCIface(host *config.Config, nodes config.NodeMap) *NCIface {
 	firewallMark := 0
-	peers := config.GetHostPeerList()
+	peers := setPresharedKeys(config.GetHostPeerList())
+	gateway := getInternetGateway(nodes)
+	if gateway != nil {
+		firewallMark = GatewayFwMark
+	}
+	setInternetGatewayCfg(gateway)
 	addrs := []ifaceAddress{}
 	for _, node := range nodes {
-		if node.Address.IP != nil {
-			addrs = append(addrs, ifaceAddress{
-				IP:      node.Address.IP,
-				Network: node.NetworkRange,
-			})
-		}
-		if node.Address6.IP != nil {
-			addrs = append(addrs, ifaceAddress{
-				IP:      node.Address6.IP,
-				Network: node.NetworkRange6,
-			})
-		}
-
+		node := node
+		addrs = append(addrs, getNodeAddrs(&node)...)
 	}
 	if config.Netclient().ProxyEnabled && len(peers) > 0 {
 		peers = peer.SetPeersEndpointToProxy(peers)
+	} else {
+		peers = lan.SetEndpoints(peers)
 	}
 	iface := netmaker.Iface // store current iface cfg before it gets overwritten
 	netmaker = NCIface{
-		Name:      ncutils.GetInterfaceName(),
-		MTU:       host.MTU,
-		Iface:     iface,
-		Addresses: addrs,
+		Name:            ncutils.GetInterfaceName(),
+		MTU:             getInterfaceMTU(ncutils.GetInterfaceName(), host),
+		RouteTable:      host.RouteTable,
+		RouteMetric:     host.RouteMetric,
+		InternetGateway: gateway,
+		Iface:           iface,
+		Addresses:       addrs,
 		Config: wgtypes.Config{
-			PrivateKey:   &host.PrivateKey,
+			PrivateKey:   getInterfaceKey(host),
 			FirewallMark: &firewallMark,
 			ListenPort:   &host.ListenPort,
 			ReplacePeers: true,
@@ -64,6 +68,68 @@ func NewNCIface(host *config.Config, nodes config.NodeMap) *NCIface {
 	return &netmaker
 }
 
+// NewNetworkNCIface - creates a new in memory Netclient interface serving a single network
+func NewNetworkNCIface(host *config.Config, node *config.Node) *NCIface {
+	firewallMark := 0
+	gateway := getNetworkInternetGateway(node)
+	if gateway != nil {
+		firewallMark = GatewayFwMark
+		setInternetGatewayCfg(gateway)
+	}
+	listenPort := node.ListenPort
+	nc := &NCIface{
+		Name:            node.Interface,
+		Network:         node.Network,
+		MTU:             getInterfaceMTU(node.Interface, host),
+		RouteTable:      host.RouteTable,
+		RouteMetric:     host.RouteMetric,
+		InternetGateway: gateway,
+		Addresses:       getNodeAddrs(node),
+		Config: wgtypes.Config{
+			PrivateKey:   getInterfaceKey(host),
+			FirewallMark: &firewallMark,
+			ListenPort:   &listenPort,
+			ReplacePeers: true,
+			Peers:        setPresharedKeys(config.GetInterfacePeerList(node)),
+		},
+	}
+	networkIfaceMutex.Lock()
+	defer networkIfaceMutex.Unlock()
+	if current, ok := networkIfaces[node.Network]; ok {
+		nc.Iface = current.Iface // keep the running device
+	}
+	networkIfaces[node.Network] = nc
+	return nc
+}
+
+// getInterfaceKey - returns the key the interfaces use, the pending key of a key rotation is in use
+// from its announcement until it is confirmed or rolled back
+func getInterfaceKey(host *config.Config) *wgtypes.Key {
+	key := host.PrivateKey
+	if host.KeyRotation.PendingKey != (wgtypes.Key{}) {
+		key = host.KeyRotation.PendingKey
+	}
+	return &key
+}
+
+// getNodeAddrs - returns the interface addresses of a node
+func getNodeAddrs(node *config.Node) []ifaceAddress {
+	addrs := []ifaceAddress{}
+	if node.Address.IP != nil {
+		addrs = append(addrs, ifaceAddress{
+			IP:      node.Address.IP,
+			Network: node.NetworkRange,
+		})
+	}
+	if node.Address6.IP != nil {
+		addrs = append(addrs, ifaceAddress{
+			IP:      node.Address6.IP,
+			Network: node.NetworkRange6,
+		})
+	}
+	return addrs
+}
+
 // ifaceAddress - interface parsed address
 type ifaceAddress struct {
 	IP       net.IP
@@ -80,6 +146,9 @@ type ifaceAddress struct {
 
 // Configure applies configuration to netmaker wireguard interface
 func (n *NCIface) Configure() error {
+	if n.InternetGateway != nil {
+		resolveServerHosts()
+	}
 	wgMutex.Lock()
 	defer wgMutex.Unlock()
 	logger.Log(0, "adding addresses to netmaker interface")
@@ -90,7 +159,10 @@ func (n *NCIface) Configure() error {
 	if err := n.SetMTU(); err != nil {
 		return err
 	}
-	return apply(&n.Config)
+	if err := apply(n.Name, &n.Config); err != nil {
+		return err
+	}
+	return n.applyInternetGateway()
 }
 
 func (nc *NCIface) getPeerRoutes() {
@@ -101,6 +173,10 @@ func (nc *NCIface) getPeerRoutes() {
 	routeMap := make(map[string]struct{})
 	for _, peer := range nc.Config.Peers {
 		for _, allowedIP := range peer.AllowedIPs {
+			// default routes are handled by the internet gateway routing table
+			if ones, _ := allowedIP.Mask.Size(); ones == 0 {
+				continue
+			}
 			addRoute := true
 			for _, address := range nc.Addresses {
 				normCIDR, err := logic.NormalizeCIDR(address.Network.String())
@@ -137,7 +213,7 @@ func (n *NCIface) UpdatePeer(p wgtypes.PeerConfig) {
 	peers = append(peers, p)
 	n.Config.ReplacePeers = false
 	n.Config.Peers = peers
-	apply(&n.Config)
+	apply(n.Name, &n.Config)
 }
 
 // == private ==
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lan"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy/peer"
 	"github.com/gravitl/netmaker/logger"
@@ -15,17 +16,35 @@ import (
 	"gopkg.in/ini.v1"
 )
 
-// SetPeers - sets peers on netmaker WireGuard interface
+// SetPeers - sets peers on netmaker WireGuard interface(s)
 func SetPeers() error {
-	peers := config.GetHostPeerList()
+	if config.PerNetworkIfaces() {
+		return setNetworkPeers()
+	}
+	peers := setPresharedKeys(config.GetHostPeerList())
 	if config.Netclient().ProxyEnabled && len(peers) > 0 {
 		peers = peer.SetPeersEndpointToProxy(peers)
+	} else {
+		peers = lan.SetEndpoints(peers)
 	}
 	config := wgtypes.Config{
 		ReplacePeers: false,
 		Peers:        peers,
 	}
-	return apply(&config)
+	return apply(ncutils.GetInterfaceName(), &config)
+}
+
+// GetPeerConfigs - returns the peers of a network, or of all networks if node is nil, as applied to the
+// wireguard interface including their preshared keys but without proxy endpoints; with an interface per network
+// a peer shared by several networks is only returned for the network whose interface it is configured on
+func GetPeerConfigs(node *config.Node) []wgtypes.PeerConfig {
+	if node == nil {
+		return setPresharedKeys(config.GetHostPeerList())
+	}
+	if config.PerNetworkIfaces() {
+		return setPresharedKeys(config.GetInterfacePeerList(node))
+	}
+	return setPresharedKeys(config.GetNetworkPeerList(node))
 }
 
 // GetDevicePeers - gets the current device's peers
@@ -180,7 +199,7 @@ func getPeers(n *config.Node) ([]wgtypes.Peer, error) {
 		return nil, err
 	}
 	defer wg.Close()
-	dev, err := wg.Device(ncutils.GetInterfaceName())
+	dev, err := wg.Device(n.InterfaceName())
 	if err != nil {
 		return nil, err
 	}
@@ -195,7 +214,7 @@ func RemovePeer(n *config.Node, p *wgtypes.PeerConfig) error {
 	config := wgtypes.Config{
 		Peers: []wgtypes.PeerConfig{*p},
 	}
-	return apply(&config)
+	return apply(n.InterfaceName(), &config)
 }
 
 // UpdatePeer replaces a wireguard peer
@@ -205,15 +224,15 @@ func UpdatePeer(n *config.Node, p *wgtypes.PeerConfig) error {
 	config := wgtypes.Config{
 		Peers: []wgtypes.PeerConfig{*p},
 	}
-	return apply(&config)
+	return apply(n.InterfaceName(), &config)
 }
 
-func apply(c *wgtypes.Config) error {
+func apply(iface string, c *wgtypes.Config) error {
 	wg, err := wgctrl.New()
 	if err != nil {
 		return err
 	}
 	defer wg.Close()
 
-	return wg.ConfigureDevice(ncutils.GetInterfaceName(), *c)
+	return wg.ConfigureDevice(iface, *c)
 }
@@ -4,47 +4,95 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// NCIface.Create - creates a linux WG interface based on a node's host config
+// NCIface.Create - creates a linux WG interface based on a node's host config using the configured wireguard backend
 func (nc *NCIface) Create() error {
-	if isKernelWireGuardPresent() {
-		newLink := nc.getKernelLink()
-		if newLink == nil {
-			return fmt.Errorf("failed to create kernel interface")
+	switch config.Netclient().WireGuard.Backend {
+	case config.WgBackendKernel:
+		if !isKernelWireGuardPresent() {
+			return fmt.Errorf("kernel WireGuard not detected")
 		}
-		nc.Iface = newLink
-		l, err := netlink.LinkByName(nc.Name)
-		if err != nil {
-			switch err.(type) {
-			case netlink.LinkNotFoundError:
-				break
-			default:
-				return err
-			}
-		}
-		if l != nil {
-			err = netlink.LinkDel(newLink)
-			if err != nil {
-				return err
-			}
+		return nc.createKernelWG()
+	case config.WgBackendUserspace:
+		return nc.createLinuxUserSpaceWG()
+	default:
+		if ncutils.IsKernel() && isKernelWireGuardPresent() {
+			return nc.createKernelWG()
 		}
-		if err = netlink.LinkAdd(newLink); err != nil && !os.IsExist(err) {
+		logger.Log(0, "kernel WireGuard not available, using embedded userspace WireGuard")
+		return nc.createLinuxUserSpaceWG()
+	}
+}
+
+// NCIface.createKernelWG - (re)creates the interface as a kernel wireguard link
+func (nc *NCIface) createKernelWG() error {
+	newLink := nc.getKernelLink()
+	if newLink == nil {
+		return fmt.Errorf("failed to create kernel interface")
+	}
+	nc.Iface = newLink
+	l, err := netlink.LinkByName(nc.Name)
+	if err != nil {
+		switch err.(type) {
+		case netlink.LinkNotFoundError:
+			break
+		default:
 			return err
 		}
-		if err = netlink.LinkSetUp(newLink); err != nil {
+	}
+	if l != nil {
+		err = netlink.LinkDel(newLink)
+		if err != nil {
 			return err
 		}
-		return nil
-	} else if isTunModuleLoaded() {
-		if err := nc.createUserSpaceWG(); err != nil {
+	}
+	if err = netlink.LinkAdd(newLink); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err = netlink.LinkSetUp(newLink); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NCIface.createLinuxUserSpaceWG - runs wireguard-go in process on a tun device,
+// the device is configured through its UAPI socket so the wgctrl apply path works unchanged
+func (nc *NCIface) createLinuxUserSpaceWG() error {
+	if !isTunModuleLoaded() {
+		if err := createTunDevice(); err != nil {
+			return fmt.Errorf("tun device not available - %w", err)
+		}
+	}
+	// remove interface left behind by a previous run or a different backend
+	if l, err := netlink.LinkByName(nc.Name); err == nil {
+		if err := netlink.LinkDel(l); err != nil {
 			return err
 		}
 	}
-	return fmt.Errorf("WireGuard not detected")
+	if err := nc.createUserSpaceWG(); err != nil {
+		return err
+	}
+	l, err := netlink.LinkByName(nc.Name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(l)
+}
+
+// createTunDevice - creates the tun device node, needed in containers without /dev/net/tun
+func createTunDevice() error {
+	if err := os.MkdirAll(filepath.Dir(tunModulePath), 0755); err != nil {
+		return err
+	}
+	return unix.Mknod(tunModulePath, unix.S_IFCHR|0666, int(unix.Mkdev(10, 200)))
 }
 
 // NCIface.SetMTU - sets the mtu for the interface
@@ -68,6 +116,16 @@ func (l *netLink) Type() string {
 
 // NCIface.Close closes netmaker interface
 func (n *NCIface) Close() {
+	if err := n.releaseInternetGateway(); err != nil {
+		logger.Log(0, "failed to remove internet gateway routing", err.Error())
+	}
+	n.resetRouteRules()
+	if userspace, ok := n.Iface.(*userspaceDevice); ok {
+		if err := userspace.Close(); err != nil {
+			logger.Log(0, "failed to close userspace wireguard", err.Error())
+		}
+		return
+	}
 	link := n.getKernelLink()
 	link.Close()
 }
@@ -77,55 +135,182 @@ func (l *netLink) Close() error {
 	return netlink.LinkDel(l)
 }
 
-// netLink.ApplyAddrs - applies the assigned node addresses to given interface (netLink)
+// NCIface.ApplyAddrs - reconciles the assigned node addresses and peer routes on the interface,
+// only adding/removing the entries that differ from the desired state
 func (nc *NCIface) ApplyAddrs() error {
-	l := nc.getKernelLink()
+	l, err := netlink.LinkByName(nc.Name)
+	if err != nil {
+		return err
+	}
+	if err := nc.reconcileAddrs(l); err != nil {
+		return err
+	}
+	return nc.reconcileRoutes(l)
+}
 
-	currentAddrs, err := netlink.AddrList(l, 0)
+// NCIface.reconcileAddrs - adds missing interface addresses and removes stale ones
+func (nc *NCIface) reconcileAddrs(l netlink.Link) error {
+	desired := make(map[string]*net.IPNet)
+	for _, addr := range nc.Addresses {
+		if addr.AddRoute || addr.IP == nil {
+			continue
+		}
+		ipnet := &net.IPNet{IP: addr.IP, Mask: addr.Network.Mask}
+		desired[ipnet.String()] = ipnet
+	}
+	currentAddrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
 	if err != nil {
 		return err
 	}
-	routes, err := netlink.RouteList(l, 0)
+	for i := range currentAddrs {
+		key := currentAddrs[i].IPNet.String()
+		if _, ok := desired[key]; ok {
+			delete(desired, key)
+			continue
+		}
+		if currentAddrs[i].IP.IsLinkLocalUnicast() {
+			continue
+		}
+		logger.Log(3, "removing address", key, "from netmaker interface")
+		if err := netlink.AddrDel(l, &currentAddrs[i]); err != nil {
+			logger.Log(0, "error removing addr", err.Error())
+			return err
+		}
+	}
+	for key, ipnet := range desired {
+		logger.Log(3, "adding address", key, "to netmaker interface")
+		if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: ipnet}); err != nil {
+			logger.Log(0, "error adding addr", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// NCIface.reconcileRoutes - adds missing peer routes and routes with a changed metric,
+// then removes the routes with the old metric and routes that no longer belong to a peer; kernel generated routes are left alone
+func (nc *NCIface) reconcileRoutes(l netlink.Link) error {
+	table := nc.getRouteTable()
+	desired := make(map[string]*net.IPNet)
+	for i := range nc.Addresses {
+		if nc.Addresses[i].AddRoute {
+			desired[nc.Addresses[i].Network.String()] = &nc.Addresses[i].Network
+		}
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: l.Attrs().Index,
+		Table:     table,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
 	if err != nil {
 		return err
 	}
+	stale, missing := diffRoutes(routes, desired, nc.RouteMetric)
+	// routes are added before the stale ones are removed, the new route of a destination whose metric changed
+	// carries the traffic before the old one is gone
+	for key, dst := range missing {
+		logger.Log(3, "adding route", key, "to netmaker interface")
+		if err := netlink.RouteAdd(&netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Dst:       dst,
+			Table:     table,
+			Priority:  nc.RouteMetric,
+		}); err != nil && !os.IsExist(err) {
+			logger.Log(0, "error adding route", err.Error())
+			return err
+		}
+	}
+	for i := range stale {
+		logger.Log(3, "removing route", stale[i].Dst.String(), "from netmaker interface")
+		if err := netlink.RouteDel(&stale[i]); err != nil {
+			logger.Log(0, "error removing route", err.Error())
+			return err
+		}
+	}
+	return nc.reconcileRouteRules()
+}
 
+// diffRoutes - returns the routes to remove and the destinations to add to reach the desired routes,
+// the priority is part of a route's key in the kernel so a route with a changed metric is removed and added again
+func diffRoutes(routes []netlink.Route, desired map[string]*net.IPNet, metric int) ([]netlink.Route, map[string]*net.IPNet) {
+	stale := []netlink.Route{}
+	missing := make(map[string]*net.IPNet, len(desired))
+	for key, dst := range desired {
+		missing[key] = dst
+	}
 	for i := range routes {
-		err = netlink.RouteDel(&routes[i])
-		if err != nil {
-			return err
+		if routes[i].Protocol == unix.RTPROT_KERNEL || routes[i].Dst == nil {
+			continue
+		}
+		key := routes[i].Dst.String()
+		if _, ok := missing[key]; ok && (metric == 0 || routes[i].Priority == metric) {
+			delete(missing, key)
+			continue
 		}
+		stale = append(stale, routes[i])
 	}
+	return stale, missing
+}
 
-	if len(currentAddrs) > 0 {
-		for i := range currentAddrs {
-			err = netlink.AddrDel(l, &currentAddrs[i])
-			if err != nil {
-				return err
-			}
+// NCIface.reconcileRouteRules - routes installed in a custom table are only used with a rule looking the table up,
+// adds the rule for each address family of the desired routes
+func (nc *NCIface) reconcileRouteRules() error {
+	table := nc.getRouteTable()
+	if table == unix.RT_TABLE_MAIN {
+		return nil
+	}
+	families := make(map[int]struct{})
+	for i := range nc.Addresses {
+		if !nc.Addresses[i].AddRoute {
+			continue
+		}
+		if nc.Addresses[i].Network.IP.To4() != nil {
+			families[netlink.FAMILY_V4] = struct{}{}
+		} else {
+			families[netlink.FAMILY_V6] = struct{}{}
 		}
 	}
-	for _, addr := range nc.Addresses {
-		if !addr.AddRoute && addr.IP != nil {
-			logger.Log(3, "adding address", addr.IP.String(), "to netmaker interface")
-			if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: &net.IPNet{IP: addr.IP, Mask: addr.Network.Mask}}); err != nil {
-				logger.Log(0, "error adding addr", err.Error())
-				return err
-			}
+	for family := range families {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Priority = RouteTablePriority
+		rule.Table = table
+		if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			logger.Log(0, "error adding rule for route table", err.Error())
+			return err
 		}
-		if addr.AddRoute {
-			logger.Log(3, "adding route", addr.IP.String(), "to netmaker interface")
-			if err := netlink.RouteAdd(&netlink.Route{
-				LinkIndex: l.Attrs().Index,
-				Dst:       &addr.Network,
-			}); err != nil {
-				logger.Log(0, "error adding addr", err.Error())
-				return err
+	}
+	return nil
+}
+
+// NCIface.resetRouteRules - removes the rules looking up the custom route table of the interface
+func (nc *NCIface) resetRouteRules() {
+	table := nc.getRouteTable()
+	if table == unix.RT_TABLE_MAIN {
+		return
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			continue
+		}
+		for i := range rules {
+			if rules[i].Priority != RouteTablePriority || rules[i].Table != table {
+				continue
+			}
+			rules[i].Family = family
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				logger.Log(0, "error removing rule for route table", err.Error())
 			}
 		}
+	}
+}
 
+// NCIface.getRouteTable - returns the routing table peer routes are installed in, defaults to main
+func (nc *NCIface) getRouteTable() int {
+	if nc.RouteTable <= 0 {
+		return unix.RT_TABLE_MAIN
 	}
-	return nil
+	return nc.RouteTable
 }
 
 // == private ==
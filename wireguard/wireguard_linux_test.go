@@ -0,0 +1,98 @@
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	_, peer, _ := net.ParseCIDR("10.10.0.0/24")
+	_, gone, _ := net.ParseCIDR("10.20.0.0/24")
+	_, local, _ := net.ParseCIDR("100.64.0.0/16")
+	desired := func() map[string]*net.IPNet {
+		return map[string]*net.IPNet{peer.String(): peer}
+	}
+	t.Run("unchanged route", func(t *testing.T) {
+		is := is.New(t)
+		stale, missing := diffRoutes([]netlink.Route{{Dst: peer, Priority: 10}}, desired(), 10)
+		is.Equal(len(stale), 0)
+		is.Equal(len(missing), 0)
+	})
+	t.Run("no metric configured", func(t *testing.T) {
+		is := is.New(t)
+		stale, missing := diffRoutes([]netlink.Route{{Dst: peer, Priority: 10}}, desired(), 0)
+		is.Equal(len(stale), 0)
+		is.Equal(len(missing), 0)
+	})
+	t.Run("changed metric", func(t *testing.T) {
+		is := is.New(t)
+		stale, missing := diffRoutes([]netlink.Route{{Dst: peer, Priority: 10}}, desired(), 20)
+		is.Equal(len(stale), 1)
+		is.Equal(stale[0].Priority, 10) // the old route is removed, not replaced in place
+		is.Equal(missing[peer.String()], peer)
+	})
+	t.Run("missing and removed routes", func(t *testing.T) {
+		is := is.New(t)
+		stale, missing := diffRoutes([]netlink.Route{{Dst: gone}}, desired(), 0)
+		is.Equal(len(stale), 1)
+		is.Equal(stale[0].Dst, gone)
+		is.Equal(missing[peer.String()], peer)
+	})
+	t.Run("kernel routes are left alone", func(t *testing.T) {
+		is := is.New(t)
+		stale, _ := diffRoutes([]netlink.Route{{Dst: local, Protocol: unix.RTPROT_KERNEL}, {}}, desired(), 0)
+		is.Equal(len(stale), 0)
+	})
+}
+
+func TestGatewayRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority int
+		table    int
+	}{
+		{"bypass", gatewayBypassPriority, unix.RT_TABLE_MAIN},
+		{"suppress", gatewaySuppressPriority, unix.RT_TABLE_MAIN},
+		{"mark", gatewayMarkPriority, GatewayRouteTable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			rule := newGatewayRule(netlink.FAMILY_V4, tt.priority, tt.table)
+			is.Equal(rule.Priority, tt.priority)
+			is.Equal(rule.Table, tt.table)
+			is.Equal(rule.Mark, GatewayFwMark)
+			is.True(rule.Invert) // wireguard's own marked traffic is never matched
+			is.True(isGatewayRule(rule))
+		})
+	}
+	t.Run("order", func(t *testing.T) {
+		is := is.New(t)
+		is.True(RouteTablePriority < gatewayBypassPriority)
+		is.Equal(gatewayBypassPriority, 29000)
+		is.Equal(gatewaySuppressPriority, 29001)
+		is.Equal(gatewayMarkPriority, 29002)
+	})
+	t.Run("bypass rules", func(t *testing.T) {
+		is := is.New(t)
+		rule := newBypassRule(net.ParseIP("203.0.113.1"))
+		is.Equal(rule.Family, netlink.FAMILY_V4)
+		is.Equal(rule.Priority, gatewayBypassPriority)
+		is.Equal(rule.Table, unix.RT_TABLE_MAIN)
+		is.Equal(rule.Dst.String(), "203.0.113.1/32")
+		rule = newBypassRule(net.ParseIP("2001:db8::1"))
+		is.Equal(rule.Family, netlink.FAMILY_V6)
+		is.Equal(rule.Dst.String(), "2001:db8::1/128")
+	})
+	t.Run("rules of other software", func(t *testing.T) {
+		is := is.New(t)
+		rule := netlink.NewRule()
+		rule.Priority = gatewayMarkPriority
+		rule.Table = GatewayRouteTable
+		is.True(!isGatewayRule(rule))
+	})
+}
@@ -4,15 +4,31 @@
 package wireguard
 
 import (
+	"errors"
 	"net"
+	"time"
 
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
+// userspaceDevice - in process wireguard-go device serving the UAPI socket used by wgctrl
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+// userspaceDevice.Close - stops serving the UAPI socket and closes the wireguard-go device and its tun
+func (u *userspaceDevice) Close() error {
+	err := u.uapi.Close()
+	u.device.Close()
+	return err
+}
+
 // == private ==
 
 func (nc *NCIface) createUserSpaceWG() error {
@@ -23,26 +39,47 @@ func (nc *NCIface) createUserSpaceWG() error {
 	if err != nil {
 		return err
 	}
-	nc.Iface = tunIface
 	tunDevice := device.NewDevice(tunIface, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "[netclient] "))
 	err = tunDevice.Up()
 	if err != nil {
+		tunDevice.Close()
 		return err
 	}
 	uapi, err := getUAPIByInterface(nc.Name)
 	if err != nil {
+		tunDevice.Close()
 		return err
 	}
-	go func() {
-		for {
-			uapiConn, uapiErr := uapi.Accept()
-			if uapiErr != nil {
-				continue
+	nc.Iface = &userspaceDevice{
+		device: tunDevice,
+		uapi:   uapi,
+	}
+	go serveUAPI(uapi, tunDevice)
+	return nil
+}
+
+// serveUAPI - hands the connections to the UAPI socket to the device, backing off on errors until the listener
+// is closed with the device
+func serveUAPI(uapi net.Listener, tunDevice *device.Device) {
+	var backoff time.Duration
+	for {
+		uapiConn, err := uapi.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
 			}
-			go tunDevice.IpcHandle(uapiConn)
+			logger.Log(1, "failed to accept uapi connection, retrying in", backoff.String(), err.Error())
+			time.Sleep(backoff)
+			continue
 		}
-	}()
-	return nil
+		backoff = 0
+		go tunDevice.IpcHandle(uapiConn)
+	}
 }
 
 func getUAPIByInterface(iface string) (net.Listener, error) {
@@ -21,7 +21,7 @@ func (nc *NCIface) Create() error {
 		return err
 	}
 	logger.Log(3, "creating Windows tunnel")
-	adapter, err := driver.CreateAdapter(ncutils.GetInterfaceName(), "WireGuard", &windowsGUID)
+	adapter, err := driver.CreateAdapter(nc.Name, "WireGuard", &windowsGUID)
 	if err != nil {
 		return err
 	}